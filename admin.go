@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// RuntimeSettings are the generation defaults adjustable through the admin
+// API without editing the config file.
+type RuntimeSettings struct {
+	Provider       string  `json:"provider"`
+	Model          string  `json:"model"`
+	ModelVersion   string  `json:"model_version"`
+	PromptTemplate string  `json:"prompt_template"`
+	SystemPrompt   string  `json:"system_prompt"`
+	Temperature    float64 `json:"temperature"`
+	TopP           float64 `json:"top_p"`
+	MaxTokens      int     `json:"max_tokens"`
+}
+
+func runtimeSettings(config *Config) RuntimeSettings {
+	return RuntimeSettings{
+		Provider:       config.Provider,
+		Model:          config.Replicate.Model,
+		ModelVersion:   config.Replicate.Version,
+		PromptTemplate: config.Generation.PromptTemplate,
+		SystemPrompt:   config.Generation.SystemPrompt,
+		Temperature:    config.Generation.Temperature,
+		TopP:           config.Generation.TopP,
+		MaxTokens:      config.Generation.MaxTokens,
+	}
+}
+
+func (s RuntimeSettings) apply(config *Config) {
+	config.Provider = s.Provider
+	config.Replicate.Model = s.Model
+	config.Replicate.Version = s.ModelVersion
+	config.Generation.PromptTemplate = s.PromptTemplate
+	config.Generation.SystemPrompt = s.SystemPrompt
+	config.Generation.Temperature = s.Temperature
+	config.Generation.TopP = s.TopP
+	config.Generation.MaxTokens = s.MaxTokens
+}
+
+// etag identifies a version of the settings for optimistic concurrency.
+func (s RuntimeSettings) etag() string {
+	data, _ := json.Marshal(s)
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+func handleGetAdminConfig(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	settings := runtimeSettings(currentConfig())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", settings.etag())
+	err := json.NewEncoder(w).Encode(settings)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error encoding admin config", "error", err)
+	}
+}
+
+// handlePutAdminConfig updates the runtime settings. The request must carry
+// the ETag of the settings it was based on in If-Match; fields missing from
+// the body keep their current values.
+func handlePutAdminConfig(w http.ResponseWriter, r *http.Request, providers *providerSet, logger *slog.Logger) {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		http.Error(w, "If-Match header is required", http.StatusPreconditionRequired)
+		return
+	}
+
+	old := currentConfig()
+	settings := runtimeSettings(old)
+	if ifMatch != settings.etag() {
+		http.Error(w, "Config was modified by someone else, reload it and try again", http.StatusPreconditionFailed)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&settings)
+	if err != nil {
+		http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	updated := *old
+	settings.apply(&updated)
+	err = updated.validate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	reloadMu.Lock()
+	swapped := activeConfig.CompareAndSwap(old, &updated)
+	reloadMu.Unlock()
+	if !swapped {
+		http.Error(w, "Config was modified by someone else, reload it and try again", http.StatusPreconditionFailed)
+		return
+	}
+	providers.reset()
+
+	actor := r.Header.Get("X-Actor")
+	if actor == "" {
+		actor = "unknown"
+	}
+	for _, change := range configDiff(old, &updated) {
+		logger.InfoContext(r.Context(), "AUDIT config change", "actor", actor, "remote_addr", r.RemoteAddr, "change", change)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", settings.etag())
+	err = json.NewEncoder(w).Encode(settings)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error encoding admin config", "error", err)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+const (
+	defaultAnthropicBaseURL   = "https://api.anthropic.com/v1"
+	defaultAnthropicModel     = "claude-3-5-haiku-latest"
+	defaultAnthropicMaxTokens = 1024
+	anthropicVersion          = "2023-06-01"
+)
+
+type AnthropicMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type AnthropicRequest struct {
+	Model         string             `json:"model"`
+	System        string             `json:"system,omitempty"`
+	Messages      []AnthropicMessage `json:"messages"`
+	MaxTokens     int                `json:"max_tokens"`
+	Temperature   *float64           `json:"temperature,omitempty"`
+	TopP          *float64           `json:"top_p,omitempty"`
+	Stream        bool               `json:"stream,omitempty"`
+	StopSequences []string           `json:"stop_sequences,omitempty"`
+	// Extra are merged into the request, such as top_k
+	Extra map[string]any `json:"-"`
+}
+
+func (r AnthropicRequest) MarshalJSON() ([]byte, error) {
+	type plain AnthropicRequest
+	return withExtra(plain(r), r.Extra)
+}
+
+type AnthropicResponse struct {
+	ID      string `json:"id"`
+	Model   string `json:"model"`
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	StopReason string `json:"stop_reason"`
+	Usage      struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+}
+
+type AnthropicErrorResponse struct {
+	Type  string `json:"type"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// AnthropicStreamEvent covers the fields used from the streaming events
+// (message_start, content_block_delta, message_delta, error).
+type AnthropicStreamEvent struct {
+	Type    string            `json:"type"`
+	Message AnthropicResponse `json:"message"`
+	Delta   struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"delta"`
+	Usage struct {
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type anthropicProvider struct {
+	client  *http.Client
+	logger  *slog.Logger
+	baseURL string
+	apiKey  string
+	model   string
+}
+
+func init() {
+	registerProvider("anthropic", func(logger *slog.Logger) (Provider, error) {
+		apiKey, err := lookupSecret("ANTHROPIC_API_KEY")
+		if err != nil {
+			return nil, err
+		}
+		if apiKey == "" {
+			return nil, errors.New("ANTHROPIC_API_KEY is not set")
+		}
+		client, err := newProviderClient("anthropic", logger)
+		if err != nil {
+			return nil, err
+		}
+
+		return &anthropicProvider{
+			client:  client,
+			logger:  logger,
+			baseURL: strings.TrimSuffix(getEnv("ANTHROPIC_BASE_URL", defaultAnthropicBaseURL), "/"),
+			apiKey:  apiKey,
+			model:   getEnv("ANTHROPIC_MODEL", defaultAnthropicModel),
+		}, nil
+	})
+}
+
+func (p *anthropicProvider) Name() string {
+	return "anthropic"
+}
+
+func (p *anthropicProvider) Generate(ctx context.Context, request Request) (Response, error) {
+	resp, err := p.call(ctx, p.newRequest(request, false))
+	if err != nil {
+		return Response{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		p.logger.ErrorContext(ctx, "Error reading Anthropic response", "error", err)
+		return Response{}, err
+	}
+	p.logger.DebugContext(ctx, "Anthropic response", "body", string(body))
+
+	var message AnthropicResponse
+	err = json.Unmarshal(body, &message)
+	if err != nil {
+		p.logger.ErrorContext(ctx, "Error unmarshaling Anthropic response", "error", err)
+		return Response{}, err
+	}
+
+	var text strings.Builder
+	for _, block := range message.Content {
+		if block.Type == "text" {
+			text.WriteString(block.Text)
+		}
+	}
+
+	return Response{
+		ID:       message.ID,
+		Text:     strings.TrimSpace(text.String()),
+		Provider: p.Name(),
+		Model:    message.Model,
+		Usage:    Usage{InputTokens: message.Usage.InputTokens, OutputTokens: message.Usage.OutputTokens},
+	}, nil
+}
+
+func (p *anthropicProvider) GenerateStream(ctx context.Context, request Request, onToken func(token string) error) (Response, error) {
+	resp, err := p.call(ctx, p.newRequest(request, true))
+	if err != nil {
+		return Response{}, err
+	}
+	defer resp.Body.Close()
+
+	response := Response{Provider: p.Name(), Model: request.modelOr(p.model)}
+	var text strings.Builder
+	err = readSSE(resp.Body, func(event, data string) error {
+		var streamEvent AnthropicStreamEvent
+		err := json.Unmarshal([]byte(data), &streamEvent)
+		if err != nil {
+			return err
+		}
+
+		switch streamEvent.Type {
+		case "message_start":
+			response.ID = streamEvent.Message.ID
+			response.Model = streamEvent.Message.Model
+			response.Usage.InputTokens = streamEvent.Message.Usage.InputTokens
+		case "message_delta":
+			response.Usage.OutputTokens = streamEvent.Usage.OutputTokens
+		case "content_block_delta":
+			if streamEvent.Delta.Type != "text_delta" {
+				return nil
+			}
+			text.WriteString(streamEvent.Delta.Text)
+			return onToken(streamEvent.Delta.Text)
+		case "message_stop":
+			return errStreamDone
+		case "error":
+			return fmt.Errorf("Anthropic stream error: %s", streamEvent.Error.Message)
+		}
+		return nil
+	})
+	if err != nil && err != errStreamDone {
+		return Response{}, err
+	}
+	if err == nil {
+		return Response{}, io.ErrUnexpectedEOF
+	}
+	response.Text = strings.TrimSpace(text.String())
+
+	return response, nil
+}
+
+func (p *anthropicProvider) newRequest(request Request, stream bool) AnthropicRequest {
+	var messages []AnthropicMessage
+	for _, turn := range request.History {
+		messages = append(messages,
+			AnthropicMessage{Role: "user", Content: turn.User},
+			AnthropicMessage{Role: "assistant", Content: turn.Assistant},
+		)
+	}
+	messages = append(messages, AnthropicMessage{Role: "user", Content: request.Prompt})
+
+	maxTokens := request.MaxTokens
+	if maxTokens <= 0 {
+		maxTokens = defaultAnthropicMaxTokens
+	}
+
+	return AnthropicRequest{
+		Model:         request.modelOr(p.model),
+		System:        request.System,
+		Messages:      messages,
+		MaxTokens:     maxTokens,
+		Temperature:   request.Temperature,
+		TopP:          request.TopP,
+		Stream:        stream,
+		StopSequences: request.StopSequences,
+		Extra:         request.Extra,
+	}
+}
+
+// call sends a Messages API request and returns the successful response.
+// The caller closes the body.
+func (p *anthropicProvider) call(ctx context.Context, messagesRequest AnthropicRequest) (*http.Response, error) {
+	jsonBody, err := json.Marshal(messagesRequest)
+	if err != nil {
+		p.logger.ErrorContext(ctx, "Error marshaling Anthropic request", "error", err)
+		return nil, err
+	}
+	p.logger.DebugContext(ctx, "Calling Anthropic", "body", string(jsonBody))
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.baseURL+"/messages", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		p.logger.ErrorContext(ctx, "Error creating request", "error", err)
+		return nil, err
+	}
+	req.Header.Add("x-api-key", p.apiKey)
+	req.Header.Add("anthropic-version", anthropicVersion)
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		p.logger.ErrorContext(ctx, "Error calling Anthropic", "error", err)
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		var errorResponse AnthropicErrorResponse
+		err = json.Unmarshal(body, &errorResponse)
+		if err != nil || errorResponse.Error.Message == "" {
+			return nil, newStatusError(resp.StatusCode, "Anthropic returned status %d", resp.StatusCode)
+		}
+		return nil, newStatusError(resp.StatusCode, "Anthropic returned status %d: %s", resp.StatusCode, errorResponse.Error.Message)
+	}
+
+	return resp, nil
+}
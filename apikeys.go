@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiKeyPrefix starts every generated key so leaked keys are easy to spot.
+const apiKeyPrefix = "ais_"
+
+// AuthConfig controls client authentication on the generation endpoints.
+type AuthConfig struct {
+	// Required makes the generation endpoints reject requests without a
+	// valid API key or JWT
+	Required bool       `yaml:"required"`
+	KeysFile string     `yaml:"keys_file"`
+	JWT      JWTConfig  `yaml:"jwt"`
+	HMAC     HMACConfig `yaml:"hmac"`
+}
+
+// APIKey is a client API key. Only the SHA-256 of the key is stored; the key
+// itself is shown once, when it is created.
+type APIKey struct {
+	ID        string     `json:"id"`
+	Label     string     `json:"label"`
+	Hint      string     `json:"hint"`
+	Hash      string     `json:"hash,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	// RateLimit overrides the configured rate_limit for this key
+	RateLimit *RateLimitConfig `json:"rate_limit,omitempty"`
+	// JobWeight is the key's share of the job workers against other keys
+	// with jobs of the same priority; 0 means 1
+	JobWeight int `json:"job_weight,omitempty"`
+}
+
+// apiKeyStore keeps the API keys in a JSON file, rewritten on every change.
+type apiKeyStore struct {
+	mu     sync.Mutex
+	path   string
+	keys   []*APIKey
+	byHash map[string]*APIKey
+}
+
+var apiKeys = &apiKeyStore{byHash: make(map[string]*APIKey)}
+
+// load reads the keys file at path. A missing file means no keys yet.
+func (s *apiKeyStore) load(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []*APIKey
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		err = json.Unmarshal(data, &keys)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+
+	s.path = path
+	s.keys = keys
+	s.byHash = make(map[string]*APIKey)
+	for _, key := range keys {
+		s.byHash[key.Hash] = key
+	}
+	return nil
+}
+
+// save writes the keys to a temporary file and renames it over the keys
+// file, so a crash never leaves it half written. Callers hold s.mu.
+func (s *apiKeyStore) save() error {
+	data, err := json.MarshalIndent(s.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// create adds a key with label and returns it along with the plain key.
+func (s *apiKeyStore) create(label string) (APIKey, string, error) {
+	secret := make([]byte, 24)
+	rand.Read(secret)
+	plain := apiKeyPrefix + hex.EncodeToString(secret)
+	key := &APIKey{
+		ID:        strings.ReplaceAll(newUUID(), "-", "")[:12],
+		Label:     label,
+		Hint:      plain[:len(apiKeyPrefix)+4] + "...",
+		Hash:      hashAPIKey(plain),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append(s.keys, key)
+	s.byHash[key.Hash] = key
+	err := s.save()
+	if err != nil {
+		s.keys = s.keys[:len(s.keys)-1]
+		delete(s.byHash, key.Hash)
+		return APIKey{}, "", err
+	}
+	return key.public(), plain, nil
+}
+
+// list returns every key, revoked ones included, oldest first.
+func (s *apiKeyStore) list() []APIKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]APIKey, len(s.keys))
+	for i, key := range s.keys {
+		keys[i] = key.public()
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys
+}
+
+// update applies change to the key with id and saves the store. It returns
+// false if there is no such key.
+func (s *apiKeyStore) update(id string, change func(key *APIKey)) (APIKey, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range s.keys {
+		if key.ID != id {
+			continue
+		}
+		old := *key
+		change(key)
+		err := s.save()
+		if err != nil {
+			*key = old
+			return APIKey{}, true, err
+		}
+		return key.public(), true, nil
+	}
+	return APIKey{}, false, nil
+}
+
+// lookup returns the active key matching plain.
+func (s *apiKeyStore) lookup(plain string) (APIKey, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.byHash[hashAPIKey(plain)]
+	if !ok || key.RevokedAt != nil {
+		return APIKey{}, false
+	}
+	return key.public(), true
+}
+
+// rateLimit returns the rate limit set on the key with id, if any.
+func (s *apiKeyStore) rateLimit(id string) (RateLimitConfig, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range s.keys {
+		if key.ID == id && key.RateLimit != nil {
+			return *key.RateLimit, true
+		}
+	}
+	return RateLimitConfig{}, false
+}
+
+// jobWeight returns the job weight set on the key with id, 0 if none.
+func (s *apiKeyStore) jobWeight(id string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range s.keys {
+		if key.ID == id {
+			return key.JobWeight
+		}
+	}
+	return 0
+}
+
+// public returns a copy of the key without its hash.
+func (k *APIKey) public() APIKey {
+	key := *k
+	key.Hash = ""
+	return key
+}
+
+func hashAPIKey(plain string) string {
+	sum := sha256.Sum256([]byte(plain))
+	return hex.EncodeToString(sum[:])
+}
+
+// Caller identifies the client a request was authenticated as: an API key
+// ID or a JWT subject.
+type Caller struct {
+	ID     string
+	Label  string
+	Source string
+}
+
+type callerKey struct{}
+
+// callerFrom returns the authenticated caller of the request ctx belongs to.
+func callerFrom(ctx context.Context) (Caller, bool) {
+	caller, ok := ctx.Value(callerKey{}).(Caller)
+	return caller, ok
+}
+
+// requireCaller authenticates the request with the API key in X-API-Key,
+// or with an Authorization bearer token holding either an API key, as sent
+// by OpenAI clients, or a JWT, or with an HMAC signature. Without
+// auth.required, requests without credentials are let through anonymously.
+// The generation IP rules are checked first.
+func requireCaller(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !checkIP(w, r, "generation", currentConfig().IPAccess.Generation) {
+			return
+		}
+		var caller Caller
+		var err error
+		if isSigned(r) {
+			caller, err = verifySignedRequest(r, currentConfig().Auth.HMAC, time.Now())
+		} else {
+			credential := r.Header.Get("X-API-Key")
+			if credential == "" {
+				credential = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			}
+			if credential == "" && !currentConfig().Auth.Required {
+				next(w, r)
+				return
+			}
+			caller, err = authenticate(r.Context(), credential)
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			http.Error(w, "Invalid or missing credentials", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), callerKey{}, caller)
+		addLogFields(ctx, "caller", caller.ID)
+		if !allowCaller(w, caller) {
+			return
+		}
+		next(w, r.WithContext(ctx))
+	}
+}
+
+func authenticate(ctx context.Context, credential string) (Caller, error) {
+	if looksLikeJWT(credential) {
+		return verifyJWT(ctx, credential)
+	}
+
+	key, ok := apiKeys.lookup(credential)
+	if !ok {
+		return Caller{}, errors.New("unknown API key")
+	}
+	return Caller{ID: key.ID, Label: key.Label, Source: "api_key"}, nil
+}
+
+type apiKeyRequest struct {
+	Label string `json:"label"`
+}
+
+// CreatedAPIKey is returned once when a key is created.
+type CreatedAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+func handleCreateAPIKey(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	var request apiKeyRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	key, plain, err := apiKeys.create(request.Label)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error saving API keys", "error", err)
+		http.Error(w, "Error saving API key", http.StatusInternalServerError)
+		return
+	}
+	logger.InfoContext(r.Context(), "AUDIT API key created", "key", key.ID, "label", key.Label)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(CreatedAPIKey{APIKey: key, Key: plain})
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error encoding API key", "error", err)
+	}
+}
+
+func handleListAPIKeys(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(apiKeys.list())
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error encoding API keys", "error", err)
+	}
+}
+
+// apiKeyUpdate changes the fields present in the body. A null rate_limit
+// returns the key to the configured default; a job_weight of 0 to the
+// default weight of 1.
+type apiKeyUpdate struct {
+	Label     *string         `json:"label"`
+	RateLimit json.RawMessage `json:"rate_limit"`
+	JobWeight *int            `json:"job_weight"`
+}
+
+func handleUpdateAPIKey(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	var request apiKeyUpdate
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var rateLimit *RateLimitConfig
+	if request.RateLimit != nil {
+		err = json.Unmarshal(request.RateLimit, &rateLimit)
+		if err != nil {
+			http.Error(w, "Invalid rate_limit: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if rateLimit != nil && (rateLimit.RequestsPerMinute < 0 || rateLimit.Burst < 1) {
+			http.Error(w, "rate_limit.requests_per_minute must not be negative and rate_limit.burst must be at least 1", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	if request.JobWeight != nil && *request.JobWeight < 0 {
+		http.Error(w, "job_weight must not be negative", http.StatusUnprocessableEntity)
+		return
+	}
+
+	key, found, err := apiKeys.update(r.PathValue("id"), func(key *APIKey) {
+		if request.Label != nil {
+			key.Label = *request.Label
+		}
+		if request.RateLimit != nil {
+			key.RateLimit = rateLimit
+		}
+		if request.JobWeight != nil {
+			key.JobWeight = *request.JobWeight
+		}
+	})
+	if !found {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error saving API keys", "error", err)
+		http.Error(w, "Error saving API key", http.StatusInternalServerError)
+		return
+	}
+	logger.InfoContext(r.Context(), "AUDIT API key updated", "key", key.ID, "label", key.Label, "rate_limit", key.RateLimit, "job_weight", key.JobWeight)
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(key)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error encoding API key", "error", err)
+	}
+}
+
+func handleRevokeAPIKey(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	key, found, err := apiKeys.update(r.PathValue("id"), func(key *APIKey) {
+		if key.RevokedAt == nil {
+			now := time.Now().UTC()
+			key.RevokedAt = &now
+		}
+	})
+	if !found {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error saving API keys", "error", err)
+		http.Error(w, "Error revoking API key", http.StatusInternalServerError)
+		return
+	}
+	logger.InfoContext(r.Context(), "AUDIT API key revoked", "key", key.ID, "label", key.Label)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAzureOpenAIAPIVersion = "2024-06-01"
+	azureCognitiveServicesScope  = "https://cognitiveservices.azure.com/.default"
+)
+
+type AzureADTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	ExpiresIn        int    `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+type azureOpenAIProvider struct {
+	client     *http.Client
+	logger     *slog.Logger
+	endpoint   string
+	deployment string
+	apiVersion string
+	apiKey     string
+	adToken    *cachedToken
+}
+
+func init() {
+	registerProvider("azure-openai", func(logger *slog.Logger) (Provider, error) {
+		endpoint := os.Getenv("AZURE_OPENAI_ENDPOINT")
+		deployment := os.Getenv("AZURE_OPENAI_DEPLOYMENT")
+		if endpoint == "" || deployment == "" {
+			return nil, errors.New("AZURE_OPENAI_ENDPOINT and AZURE_OPENAI_DEPLOYMENT must be set")
+		}
+		client, err := newProviderClient("azure-openai", logger)
+		if err != nil {
+			return nil, err
+		}
+
+		p := &azureOpenAIProvider{
+			client:     client,
+			logger:     logger,
+			endpoint:   strings.TrimSuffix(endpoint, "/"),
+			deployment: deployment,
+			apiVersion: getEnv("AZURE_OPENAI_API_VERSION", defaultAzureOpenAIAPIVersion),
+		}
+		p.apiKey, err = lookupSecret("AZURE_OPENAI_API_KEY")
+		if err != nil {
+			return nil, err
+		}
+
+		// Without an API key, authenticate as an Azure AD application
+		if p.apiKey == "" {
+			tenantID := os.Getenv("AZURE_TENANT_ID")
+			clientID := os.Getenv("AZURE_CLIENT_ID")
+			clientSecret, err := lookupSecret("AZURE_CLIENT_SECRET")
+			if err != nil {
+				return nil, err
+			}
+			if tenantID == "" || clientID == "" || clientSecret == "" {
+				return nil, errors.New("set AZURE_OPENAI_API_KEY or AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET")
+			}
+			p.adToken = newCachedToken(func(ctx context.Context) (string, time.Time, error) {
+				return fetchAzureADToken(ctx, client, tenantID, clientID, clientSecret)
+			})
+		}
+
+		return p, nil
+	})
+}
+
+func (p *azureOpenAIProvider) Name() string {
+	return "azure-openai"
+}
+
+func (p *azureOpenAIProvider) Generate(ctx context.Context, request Request) (Response, error) {
+	header := http.Header{}
+	if p.apiKey != "" {
+		header.Set("api-key", p.apiKey)
+	} else {
+		token, err := p.adToken.get(ctx)
+		if err != nil {
+			p.logger.ErrorContext(ctx, "Error getting Azure AD token", "error", err)
+			return Response{}, err
+		}
+		header.Set("Authorization", "Bearer "+token)
+	}
+
+	// The deployment selects the model, so none is sent in the body
+	chatURL := fmt.Sprintf("%s/openai/deployments/%s/chat/completions?api-version=%s",
+		p.endpoint, url.PathEscape(p.deployment), url.QueryEscape(p.apiVersion))
+	chatResponse, err := callChatCompletions(ctx, p.client, chatURL, header, newOpenAIChatRequest(request), p.logger)
+	if err != nil {
+		return Response{}, err
+	}
+
+	response := newOpenAIResponse(chatResponse, p.Name())
+	if response.Model == "" {
+		response.Model = p.deployment
+	}
+
+	return response, nil
+}
+
+// fetchAzureADToken requests a Cognitive Services token with the client
+// credentials flow.
+func fetchAzureADToken(ctx context.Context, client *http.Client, tenantID, clientID, clientSecret string) (string, time.Time, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", clientID)
+	form.Set("client_secret", clientSecret)
+	form.Set("scope", azureCognitiveServicesScope)
+
+	tokenURL := "https://login.microsoftonline.com/" + url.PathEscape(tenantID) + "/oauth2/v2.0/token"
+	req, err := http.NewRequestWithContext(ctx, "POST", tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	var tokenResponse AzureADTokenResponse
+	err = json.Unmarshal(body, &tokenResponse)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if resp.StatusCode != http.StatusOK || tokenResponse.AccessToken == "" {
+		return "", time.Time{}, newStatusError(resp.StatusCode, "Azure AD returned status %d: %s", resp.StatusCode, tokenResponse.ErrorDescription)
+	}
+
+	return tokenResponse.AccessToken, time.Now().Add(time.Duration(tokenResponse.ExpiresIn) * time.Second), nil
+}
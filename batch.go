@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// BatchConfig bounds POST /api/v1/batch: at most MaxItems prompts per
+// request, generated Concurrency at a time.
+type BatchConfig struct {
+	MaxItems    int `yaml:"max_items"`
+	Concurrency int `yaml:"concurrency"`
+}
+
+// BatchRequest is the body of POST /api/v1/batch: either Prompts, or a
+// Template with a {name} placeholder per key of each Variables entry.
+// Model, Provider, Preset, Transliterate, Link, Tone and Persona apply to
+// every item.
+// Recipients, when set, has the phone number of every item; they are all
+// validated before anything is generated.
+type BatchRequest struct {
+	Prompts    []string            `json:"prompts"`
+	Template   string              `json:"template"`
+	Variables  []map[string]string `json:"variables"`
+	Recipients []string            `json:"recipients"`
+	Model      string              `json:"model"`
+	Provider   string              `json:"provider"`
+	Preset     string              `json:"preset"`
+	// Transliterate writes Russian output in Latin letters
+	Transliterate bool `json:"transliterate"`
+	// Link is put in every text, shortened
+	Link    string `json:"link"`
+	Tone    string `json:"tone"`
+	Persona string `json:"persona"`
+}
+
+// BatchResult is the outcome of one batch item, in request order.
+type BatchResult struct {
+	Index int `json:"index"`
+	// To is the recipient of the item in E.164 format
+	To     string `json:"to,omitempty"`
+	Status string `json:"status"`
+	SmsResponse
+	Error string `json:"error,omitempty"`
+}
+
+// BatchResponse holds the results of all items of a batch.
+type BatchResponse struct {
+	Results   []BatchResult `json:"results"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+}
+
+// inputs returns the job input of every item of the batch.
+func (b BatchRequest) inputs() ([]JobInput, error) {
+	prompts := b.Prompts
+	if b.Template != "" {
+		if len(b.Prompts) > 0 {
+			return nil, fmt.Errorf("send either prompts or template with variables")
+		}
+		prompts = make([]string, len(b.Variables))
+		for i, variables := range b.Variables {
+			prompts[i] = renderTemplate(b.Template, variables)
+		}
+	}
+
+	inputs := make([]JobInput, len(prompts))
+	for i, prompt := range prompts {
+		inputs[i] = JobInput{Prompt: prompt, Model: b.Model, Provider: b.Provider, Preset: b.Preset, Transliterate: b.Transliterate, Link: b.Link, Tone: b.Tone, Persona: b.Persona}
+	}
+	return inputs, nil
+}
+
+// renderTemplate replaces the {name} placeholders of template with the
+// variables. Placeholders without a variable are left as they are.
+func renderTemplate(template string, variables map[string]string) string {
+	// Sorted so the replacement does not depend on map order
+	names := make([]string, 0, len(variables))
+	for name := range variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		pairs = append(pairs, "{"+name+"}", variables[name])
+	}
+	return strings.NewReplacer(pairs...).Replace(template)
+}
+
+// runBatch generates the text of every input, batch.concurrency at a time,
+// and returns the results in input order. A failed item doesn't stop the
+// others.
+func runBatch(ctx context.Context, providers *providerSet, inputs []JobInput, logger *slog.Logger) BatchResponse {
+	results := make([]BatchResult, len(inputs))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range min(currentConfig().Batch.Concurrency, len(inputs)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = runBatchItem(ctx, providers, i, inputs[i], logger)
+			}
+		}()
+	}
+	for i := range inputs {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	response := BatchResponse{Results: results}
+	for _, result := range results {
+		if result.Status == jobSucceeded {
+			response.Succeeded++
+		} else {
+			response.Failed++
+		}
+	}
+	return response
+}
+
+func runBatchItem(ctx context.Context, providers *providerSet, index int, input JobInput, logger *slog.Logger) BatchResult {
+	result := BatchResult{Index: index, Status: jobFailed}
+	provider, request, postProcess, err := prepareJob(providers, input)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	response, err := generateSms(ctx, provider, request, postProcess, logger)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error generating batch item", "index", index, "error", err)
+		result.Error = generationErrorMessage(err)
+		return result
+	}
+
+	result.Status = jobSucceeded
+	result.SmsResponse = newSmsResponse(response)
+	return result
+}
+
+// handleBatch generates the text for every prompt of a batch and answers
+// with a result per item; failed items don't fail the request.
+func handleBatch(w http.ResponseWriter, r *http.Request, providers *providerSet, logger *slog.Logger) {
+	requestCounter.Inc()
+	var batch BatchRequest
+	err := json.NewDecoder(r.Body).Decode(&batch)
+	if err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	inputs, err := batch.inputs()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	maxItems := currentConfig().Batch.MaxItems
+	if len(inputs) == 0 || len(inputs) > maxItems {
+		http.Error(w, fmt.Sprintf("a batch must have 1 to %d items", maxItems), http.StatusBadRequest)
+		return
+	}
+
+	var recipients []string
+	if batch.Recipients != nil {
+		if len(batch.Recipients) != len(inputs) {
+			http.Error(w, "recipients must have a phone number per item", http.StatusBadRequest)
+			return
+		}
+		recipients, err = normalizeRecipients(batch.Recipients, func(i int) string {
+			return fmt.Sprintf("item %d", i)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	addLogFields(r.Context(), "batch_items", len(inputs))
+	response := runBatch(r.Context(), providers, inputs, logger)
+	for i, to := range recipients {
+		response.Results[i].To = to
+	}
+	logger.InfoContext(r.Context(), "Generated batch", "succeeded", response.Succeeded, "failed", response.Failed)
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error encoding batch response", "error", err)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// csvResultColumns are appended to the uploaded columns in the result.
+var csvResultColumns = []string{"sms_text", "status", "error"}
+
+// readVariablesCSV reads a CSV whose header row names the template
+// variables, one recipient per row. The delimiter is a comma, or a
+// semicolon as written by spreadsheets in many locales.
+func readVariablesCSV(r io.Reader) (header []string, rows [][]string, delimiter rune, err error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	// Spreadsheets often start UTF-8 files with a byte order mark
+	data = bytes.TrimPrefix(data, []byte("\ufeff"))
+	firstLine, _, _ := bufio.NewReader(bytes.NewReader(data)).ReadLine()
+	delimiter = ','
+	if bytes.Count(firstLine, []byte(";")) > bytes.Count(firstLine, []byte(",")) {
+		delimiter = ';'
+	}
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comma = delimiter
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if len(records) == 0 {
+		return nil, nil, 0, errors.New("the file is empty")
+	}
+	header = records[0]
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+	return header, records[1:], delimiter, nil
+}
+
+// handleBatchCSV generates an SMS per row of an uploaded CSV. The multipart
+// form has the file, the template with {column} placeholders and optional
+// model, provider, preset, transliterate, link, tone and persona. With phone_column, that
+// column has the recipient of each row; every number is validated before
+// anything is generated and written back in E.164 format. The response is
+// the uploaded CSV with the generated text, status and error of each row
+// appended.
+func handleBatchCSV(w http.ResponseWriter, r *http.Request, providers *providerSet, logger *slog.Logger) {
+	requestCounter.Inc()
+	file, fileHeader, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "file is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	template := r.FormValue("template")
+	if template == "" {
+		http.Error(w, "template is required", http.StatusBadRequest)
+		return
+	}
+	header, rows, delimiter, err := readVariablesCSV(file)
+	if err != nil {
+		http.Error(w, "Invalid CSV: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	maxItems := currentConfig().Batch.MaxItems
+	if len(rows) == 0 || len(rows) > maxItems {
+		http.Error(w, fmt.Sprintf("the file must have 1 to %d rows", maxItems), http.StatusBadRequest)
+		return
+	}
+
+	if name := r.FormValue("phone_column"); name != "" {
+		phoneColumn := slices.Index(header, name)
+		if phoneColumn < 0 {
+			http.Error(w, fmt.Sprintf("there is no %s column", name), http.StatusBadRequest)
+			return
+		}
+		numbers := make([]string, len(rows))
+		for i, row := range rows {
+			numbers[i] = row[phoneColumn]
+		}
+		recipients, err := normalizeRecipients(numbers, func(i int) string {
+			return fmt.Sprintf("line %d", i+2)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for i, row := range rows {
+			row[phoneColumn] = recipients[i]
+		}
+	}
+
+	batch := BatchRequest{
+		Template:  template,
+		Variables: make([]map[string]string, len(rows)),
+		Model:     r.FormValue("model"),
+		Provider:  r.FormValue("provider"),
+		Preset:    r.FormValue("preset"),
+		Link:      r.FormValue("link"),
+		Tone:      r.FormValue("tone"),
+		Persona:   r.FormValue("persona"),
+	}
+	batch.Transliterate, _ = strconv.ParseBool(r.FormValue("transliterate"))
+	for i, row := range rows {
+		variables := make(map[string]string, len(header))
+		for j, name := range header {
+			variables[name] = row[j]
+		}
+		batch.Variables[i] = variables
+	}
+	inputs, err := batch.inputs()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	addLogFields(r.Context(), "batch_items", len(inputs))
+	response := runBatch(r.Context(), providers, inputs, logger)
+	logger.InfoContext(r.Context(), "Generated CSV batch", "succeeded", response.Succeeded, "failed", response.Failed)
+
+	name := strings.TrimSuffix(path.Base(fileHeader.Filename), path.Ext(fileHeader.Filename))
+	if name == "" || name == "." || name == "/" {
+		name = "recipients"
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-sms.csv"`, strings.ReplaceAll(name, `"`, "")))
+	writer := csv.NewWriter(w)
+	writer.Comma = delimiter
+	writer.Write(slices.Concat(header, csvResultColumns))
+	for i, row := range rows {
+		result := response.Results[i]
+		writer.Write(slices.Concat(row, []string{result.Text, result.Status, result.Error}))
+	}
+	writer.Flush()
+	err = writer.Error()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error writing CSV batch response", "error", err)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const defaultBedrockModelID = "anthropic.claude-3-haiku-20240307-v1:0"
+
+type BedrockContentBlock struct {
+	Text string `json:"text"`
+}
+
+type BedrockMessage struct {
+	Role    string                `json:"role"`
+	Content []BedrockContentBlock `json:"content"`
+}
+
+type BedrockInferenceConfig struct {
+	MaxTokens     int      `json:"maxTokens,omitempty"`
+	Temperature   *float64 `json:"temperature,omitempty"`
+	TopP          *float64 `json:"topP,omitempty"`
+	StopSequences []string `json:"stopSequences,omitempty"`
+}
+
+// BedrockConverseRequest is the body of the Converse API, which works the
+// same for Claude, Titan, Mistral and the other Bedrock text models.
+type BedrockConverseRequest struct {
+	Messages        []BedrockMessage       `json:"messages"`
+	System          []BedrockContentBlock  `json:"system,omitempty"`
+	InferenceConfig BedrockInferenceConfig `json:"inferenceConfig"`
+	// AdditionalModelRequestFields are the model-specific parameters
+	AdditionalModelRequestFields map[string]any `json:"additionalModelRequestFields,omitempty"`
+}
+
+type BedrockConverseResponse struct {
+	Output struct {
+		Message BedrockMessage `json:"message"`
+	} `json:"output"`
+	StopReason string `json:"stopReason"`
+	Usage      struct {
+		InputTokens  int `json:"inputTokens"`
+		OutputTokens int `json:"outputTokens"`
+	} `json:"usage"`
+}
+
+type BedrockErrorResponse struct {
+	Message string `json:"message"`
+}
+
+type bedrockProvider struct {
+	client   *http.Client
+	logger   *slog.Logger
+	creds    awsCredentials
+	region   string
+	endpoint string
+	modelID  string
+}
+
+func init() {
+	registerProvider("bedrock", func(logger *slog.Logger) (Provider, error) {
+		creds, err := awsCredentialsFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		client, err := newProviderClient("bedrock", logger)
+		if err != nil {
+			return nil, err
+		}
+
+		// BEDROCK_ENDPOINT points at a VPC interface endpoint when traffic
+		// has to stay inside the VPC
+		region := awsRegionFromEnv()
+		return &bedrockProvider{
+			client:   client,
+			logger:   logger,
+			creds:    creds,
+			region:   region,
+			endpoint: strings.TrimSuffix(getEnv("BEDROCK_ENDPOINT", "https://bedrock-runtime."+region+".amazonaws.com"), "/"),
+			modelID:  getEnv("BEDROCK_MODEL_ID", defaultBedrockModelID),
+		}, nil
+	})
+}
+
+func (p *bedrockProvider) Name() string {
+	return "bedrock"
+}
+
+func (p *bedrockProvider) Generate(ctx context.Context, request Request) (Response, error) {
+	converseRequest := BedrockConverseRequest{
+		InferenceConfig: BedrockInferenceConfig{
+			MaxTokens:     request.MaxTokens,
+			Temperature:   request.Temperature,
+			TopP:          request.TopP,
+			StopSequences: request.StopSequences,
+		},
+		AdditionalModelRequestFields: request.Extra,
+	}
+	if request.System != "" {
+		converseRequest.System = []BedrockContentBlock{{Text: request.System}}
+	}
+	for _, message := range newOpenAIChatRequest(Request{Prompt: request.Prompt, History: request.History}).Messages {
+		converseRequest.Messages = append(converseRequest.Messages, BedrockMessage{
+			Role:    message.Role,
+			Content: []BedrockContentBlock{{Text: message.Content}},
+		})
+	}
+
+	jsonBody, err := json.Marshal(converseRequest)
+	if err != nil {
+		p.logger.ErrorContext(ctx, "Error marshaling Bedrock request", "error", err)
+		return Response{}, err
+	}
+	modelID := request.modelOr(p.modelID)
+	p.logger.DebugContext(ctx, "Calling Bedrock", "model", modelID, "body", string(jsonBody))
+
+	// Model IDs contain ":" which has to be escaped in the path
+	escapedPath := "/model/" + awsURIEncode(modelID, true) + "/converse"
+	path, err := url.PathUnescape(escapedPath)
+	if err != nil {
+		return Response{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", p.endpoint+escapedPath, bytes.NewReader(jsonBody))
+	if err != nil {
+		p.logger.ErrorContext(ctx, "Error creating request", "error", err)
+		return Response{}, err
+	}
+	req.URL.Path = path
+	req.URL.RawPath = escapedPath
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	signAWSRequest(req, jsonBody, p.creds, p.region, "bedrock", time.Now())
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		p.logger.ErrorContext(ctx, "Error calling Bedrock", "error", err)
+		return Response{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		p.logger.ErrorContext(ctx, "Error reading Bedrock response", "error", err)
+		return Response{}, err
+	}
+	p.logger.DebugContext(ctx, "Bedrock response", "body", string(body))
+
+	if resp.StatusCode != http.StatusOK {
+		var errorResponse BedrockErrorResponse
+		if json.Unmarshal(body, &errorResponse) == nil && errorResponse.Message != "" {
+			return Response{}, newStatusError(resp.StatusCode, "Bedrock returned status %d: %s", resp.StatusCode, errorResponse.Message)
+		}
+		return Response{}, newStatusError(resp.StatusCode, "Bedrock returned status %d", resp.StatusCode)
+	}
+
+	var converseResponse BedrockConverseResponse
+	err = json.Unmarshal(body, &converseResponse)
+	if err != nil {
+		p.logger.ErrorContext(ctx, "Error unmarshaling Bedrock response", "error", err)
+		return Response{}, err
+	}
+
+	var text strings.Builder
+	for _, block := range converseResponse.Output.Message.Content {
+		text.WriteString(block.Text)
+	}
+
+	return Response{
+		ID:       resp.Header.Get("X-Amzn-Requestid"),
+		Text:     strings.TrimSpace(text.String()),
+		Provider: p.Name(),
+		Model:    modelID,
+		Usage:    Usage{InputTokens: converseResponse.Usage.InputTokens, OutputTokens: converseResponse.Usage.OutputTokens},
+	}, nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Circuit breaker states, as exposed by the state gauge.
+const (
+	breakerClosed = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+var (
+	breakerStateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ai_sms_circuit_breaker_state",
+		Help: "Circuit breaker state per provider: 0 closed, 1 half-open, 2 open",
+	}, []string{"provider"})
+	breakerRejectedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ai_sms_circuit_breaker_rejected_total",
+		Help: "The total number of requests rejected by an open circuit breaker",
+	}, []string{"provider"})
+)
+
+// CircuitBreakerConfig controls when a provider is taken out of service.
+// The breaker opens once at least MinRequests calls were made in the
+// current window and the share of failures reaches FailureRate. After
+// OpenTimeout up to HalfOpenRequests probe calls decide whether it closes
+// again.
+type CircuitBreakerConfig struct {
+	Enabled          bool          `yaml:"enabled"`
+	FailureRate      float64       `yaml:"failure_rate"`
+	MinRequests      int           `yaml:"min_requests"`
+	Window           time.Duration `yaml:"window"`
+	OpenTimeout      time.Duration `yaml:"open_timeout"`
+	HalfOpenRequests int           `yaml:"half_open_requests"`
+}
+
+// circuitOpenError is returned instead of calling a provider whose breaker
+// is open.
+type circuitOpenError struct {
+	Provider string
+	Wait     time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("provider %s is unavailable (circuit open)", e.Provider)
+}
+
+func (e *circuitOpenError) StatusCode() int {
+	return http.StatusServiceUnavailable
+}
+
+func (e *circuitOpenError) Code() string {
+	return "circuit_open"
+}
+
+func (e *circuitOpenError) RetryAfter() time.Duration {
+	return e.Wait
+}
+
+// breakers holds a circuit breaker per provider name. They outlive the
+// provider instances, which are recreated on config reloads.
+var breakers = &breakerSet{items: make(map[string]*circuitBreaker)}
+
+type breakerSet struct {
+	mu    sync.Mutex
+	items map[string]*circuitBreaker
+}
+
+func (s *breakerSet) get(provider string) *circuitBreaker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	breaker, ok := s.items[provider]
+	if !ok {
+		breaker = &circuitBreaker{provider: provider}
+		s.items[provider] = breaker
+		breakerStateGauge.WithLabelValues(provider).Set(breakerClosed)
+	}
+	return breaker
+}
+
+type circuitBreaker struct {
+	provider string
+
+	mu          sync.Mutex
+	state       int
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probes      int
+}
+
+// allow reports whether a call may go ahead. Every allowed call must be
+// followed by done.
+func (b *circuitBreaker) allow(config CircuitBreakerConfig) error {
+	if !config.Enabled {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.state == breakerOpen {
+		if wait := config.OpenTimeout - now.Sub(b.openedAt); wait > 0 {
+			breakerRejectedCounter.WithLabelValues(b.provider).Inc()
+			return &circuitOpenError{Provider: b.provider, Wait: wait}
+		}
+		b.setState(breakerHalfOpen)
+		b.probes = 0
+	}
+	if b.state == breakerHalfOpen {
+		if b.probes >= config.HalfOpenRequests {
+			breakerRejectedCounter.WithLabelValues(b.provider).Inc()
+			return &circuitOpenError{Provider: b.provider, Wait: config.OpenTimeout}
+		}
+		b.probes++
+		return nil
+	}
+
+	if now.Sub(b.windowStart) > config.Window {
+		b.windowStart = now
+		b.requests = 0
+		b.failures = 0
+	}
+	return nil
+}
+
+// done records the outcome of an allowed call. Calls abandoned by the
+// client say nothing about the provider and are not counted.
+func (b *circuitBreaker) done(ctx context.Context, config CircuitBreakerConfig, err error) {
+	if !config.Enabled {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err != nil && ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		if b.state == breakerHalfOpen {
+			b.probes--
+		}
+		return
+	}
+
+	if b.state == breakerHalfOpen {
+		if err != nil {
+			b.open()
+			return
+		}
+		b.setState(breakerClosed)
+		b.windowStart = time.Now()
+		b.requests = 0
+		b.failures = 0
+		return
+	}
+	if b.state == breakerOpen {
+		return
+	}
+
+	b.requests++
+	if err != nil {
+		b.failures++
+	}
+	if b.requests >= config.MinRequests && float64(b.failures)/float64(b.requests) >= config.FailureRate {
+		b.open()
+	}
+}
+
+func (b *circuitBreaker) open() {
+	b.setState(breakerOpen)
+	b.openedAt = time.Now()
+}
+
+func (b *circuitBreaker) setState(state int) {
+	b.state = state
+	breakerStateGauge.WithLabelValues(b.provider).Set(float64(state))
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	lengthRegenerationsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ai_sms_length_regenerations_total",
+		Help: "The total number of texts sent back to the model for being over the length budget, by preset",
+	}, []string{"preset"})
+	overBudgetCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ai_sms_over_budget_total",
+		Help: "The total number of texts returned over the length budget after all regenerations, by preset",
+	}, []string{"preset"})
+)
+
+// shortenPrompt asks the model to shorten its previous answer.
+const shortenPrompt = "This SMS is too long. Rewrite it in at most %d characters, keeping its meaning. Reply with the SMS text only."
+
+// LengthBudgetConfig bounds the generated text to MaxChars characters and
+// MaxSegments SMS segments; 0 leaves either unbounded. A text over budget
+// is sent back to the model to be shortened, up to Attempts times, and the
+// shortest candidate wins.
+type LengthBudgetConfig struct {
+	MaxChars    int `yaml:"max_chars"`
+	MaxSegments int `yaml:"max_segments"`
+	Attempts    int `yaml:"attempts"`
+}
+
+// limit returns how many characters text may have: for a segment budget,
+// that depends on the encoding text needs.
+func (b LengthBudgetConfig) limit(text string) int {
+	limit := b.MaxChars
+	if b.MaxSegments > 0 {
+		encoding, _ := smsLength(text)
+		capacity := smsCapacity(encoding, b.MaxSegments)
+		if limit == 0 || capacity < limit {
+			limit = capacity
+		}
+	}
+	return limit
+}
+
+// fits reports whether text is within the budget.
+func (b LengthBudgetConfig) fits(text string) bool {
+	if b.MaxChars > 0 && len([]rune(text)) > b.MaxChars {
+		return false
+	}
+	return b.MaxSegments == 0 || smsSegments(text) <= b.MaxSegments
+}
+
+// shorter reports whether text a is better than b: fewer segments, or as
+// many but fewer characters.
+func shorter(a, b string) bool {
+	segmentsA, segmentsB := smsSegments(a), smsSegments(b)
+	if segmentsA != segmentsB {
+		return segmentsA < segmentsB
+	}
+	return len([]rune(a)) < len([]rune(b))
+}
+
+// generateSms gets the text of request and post-processes it. A text over
+// the length budget of postProcess is regenerated with an instruction to
+// shorten it; if no candidate fits, the shortest is returned, cut to
+// max_length if that is set. The footer is appended last. Links are
+// shortened before the length is checked. The model writes placeholders
+// for the variables, which are only filled into the final text. The prompt
+// and the text are moderated, and profanity is masked, or regenerated
+// first in strict mode. Several candidates are generated and ranked when
+// the request asks for them. A text for a language is written in it or
+// translated into it, as configured. The text is proofread last.
+func generateSms(ctx context.Context, provider Provider, request Request, postProcess PostProcessConfig, logger *slog.Logger) (Response, error) {
+	if postProcess.Candidates > 1 {
+		return generateCandidates(ctx, provider, request, postProcess, logger)
+	}
+	flagged, err := moderate(ctx, moderationPrompt, request.Prompt, logger)
+	if err != nil {
+		return Response{}, err
+	}
+	// Short links found or made, to their long links
+	links := map[string]string{}
+	if postProcess.Link != "" {
+		postProcess.Link = shortenLink(ctx, postProcess.Link, links, logger)
+		request.Prompt += fmt.Sprintf(includeLinkPrompt, postProcess.Link)
+	}
+	language := currentConfig().Language
+	if postProcess.Language != "" && language.Mode == languageInstruct {
+		request.System = withLanguagePrompt(request.System, postProcess.Language)
+	}
+	variables := postProcess.Variables
+	names := slices.Sorted(maps.Keys(variables))
+	if len(variables) > 0 {
+		request.Prompt += fmt.Sprintf(keepPlaceholdersPrompt, braced(names))
+	}
+	prepare := func(text string) string {
+		text = postProcess.clean(text)
+		if postProcess.ShortenLinks {
+			text = shortenLinks(ctx, text, links, logger)
+		}
+		if postProcess.Link != "" && !strings.Contains(text, postProcess.Link) {
+			text += " " + postProcess.Link
+		}
+		return text
+	}
+	// placeholdersOK reports whether text can take the variables
+	placeholdersOK := func(text string) bool {
+		return len(variables) == 0 || checkPlaceholders(text, variables) == nil
+	}
+	// localize translates response in translate mode, the first time, and
+	// whenever verification finds it in another language; texts found to
+	// be in the language are left alone
+	translated := false
+	localize := func(response Response) (Response, error) {
+		if postProcess.Language == "" {
+			return response, nil
+		}
+		detected := detectLanguage(response.Text)
+		if detected == postProcess.Language || (language.Mode != languageTranslate || translated) && (!language.Verify || detected == "") {
+			return response, nil
+		}
+		translation, err := translate(ctx, provider, postProcess, response.Text, logger)
+		if err != nil {
+			return Response{}, err
+		}
+		translated = true
+		response.Text = prepare(translation.Text)
+		return response, nil
+	}
+	// final is the SMS text will make
+	final := func(text string) string {
+		return postProcess.withFooter(substitute(text, variables))
+	}
+
+	response, err := getAISmsContent(ctx, provider, request, logger)
+	if err != nil {
+		return Response{}, err
+	}
+	budget := postProcess.Budget
+	best := response
+	best.Text = prepare(response.Text)
+	best, err = localize(best)
+	if err != nil {
+		return Response{}, err
+	}
+
+	if !placeholdersOK(best.Text) {
+		logger.WarnContext(ctx, "Text has the wrong placeholders, regenerating", "error", checkPlaceholders(best.Text, variables))
+		retry := request
+		retry.History = append(request.History[:len(request.History):len(request.History)], Turn{User: request.Prompt, Assistant: best.Text})
+		retry.Prompt = fmt.Sprintf(fixPlaceholdersPrompt, braced(names))
+		best, err = getAISmsContent(ctx, provider, retry, logger)
+		if err != nil {
+			return Response{}, err
+		}
+		best.Text = prepare(best.Text)
+		best, err = localize(best)
+		if err != nil {
+			return Response{}, err
+		}
+		err = checkPlaceholders(best.Text, variables)
+		if err != nil {
+			return Response{}, err
+		}
+	}
+
+	if profanity != nil && profanity.strict {
+		for attempt := 0; attempt < profanity.attempts; attempt++ {
+			language, found := profanity.find(best.Text)
+			if !found {
+				break
+			}
+			profanityCounter.WithLabelValues(language, "regenerate").Inc()
+			retry := request
+			retry.History = append(request.History[:len(request.History):len(request.History)], Turn{User: request.Prompt, Assistant: best.Text})
+			retry.Prompt = profanityPrompt
+			candidate, err := getAISmsContent(ctx, provider, retry, logger)
+			if err != nil {
+				logger.WarnContext(ctx, "Error regenerating text with profanity, masking it", "attempt", attempt+1, "error", err)
+				break
+			}
+			candidate.Text = prepare(candidate.Text)
+			candidate, err = localize(candidate)
+			if err != nil {
+				logger.WarnContext(ctx, "Error translating regenerated text, masking profanity", "attempt", attempt+1, "error", err)
+				break
+			}
+			if placeholdersOK(candidate.Text) {
+				best = candidate
+			}
+		}
+	}
+
+	// The footer and variables are part of the SMS, so the model gets what
+	// they leave
+	extra := len([]rune(final(best.Text))) - len([]rune(best.Text))
+	for attempt := 0; attempt < budget.Attempts && !budget.fits(final(best.Text)); attempt++ {
+		lengthRegenerationsCounter.WithLabelValues(request.Preset).Inc()
+		retry := request
+		retry.History = append(request.History[:len(request.History):len(request.History)], Turn{User: request.Prompt, Assistant: best.Text})
+		retry.Prompt = fmt.Sprintf(shortenPrompt, max(budget.limit(final(best.Text))-extra, 1))
+		candidate, err := getAISmsContent(ctx, provider, retry, logger)
+		if err != nil {
+			logger.WarnContext(ctx, "Error shortening text, keeping the shortest", "attempt", attempt+1, "error", err)
+			break
+		}
+		candidate.Text = prepare(candidate.Text)
+		candidate, err = localize(candidate)
+		if err != nil {
+			logger.WarnContext(ctx, "Error translating shortened text, keeping the shortest", "attempt", attempt+1, "error", err)
+			break
+		}
+		if placeholdersOK(candidate.Text) && shorter(final(candidate.Text), final(best.Text)) {
+			best = candidate
+		}
+	}
+	best.Text = proofreadText(ctx, best.Text, postProcess, logger)
+	if text := final(best.Text); !budget.fits(text) {
+		overBudgetCounter.WithLabelValues(request.Preset).Inc()
+		logger.WarnContext(ctx, "Text is over the length budget", "chars", len([]rune(text)), "segments", smsSegments(text))
+	}
+	if postProcess.Language != "" && language.Verify && !inLanguage(best.Text, postProcess.Language) {
+		languageCounter.WithLabelValues(postProcess.Language, "mismatch").Inc()
+		return Response{}, &languageError{Language: postProcess.Language, Detected: detectLanguage(best.Text)}
+	}
+	// The variables are left out, not to send them anywhere
+	outputFlagged, err := moderate(ctx, moderationOutput, best.Text, logger)
+	if err != nil {
+		return Response{}, err
+	}
+	for _, category := range outputFlagged {
+		if !slices.Contains(flagged, category) {
+			flagged = append(flagged, category)
+		}
+	}
+	best.Flagged = flagged
+	best.Text = postProcess.withFooter(postProcess.cut(substitute(profanity.mask(best.Text), variables)))
+	recordLinks(best.GenerationID, best.Text, links)
+	return best, nil
+}
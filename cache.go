@@ -0,0 +1,165 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	cacheRequestCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ai_sms_cache_requests_total",
+		Help: "The total number of generation cache lookups by result (hit, miss or error)",
+	}, []string{"result"})
+	cacheEntriesGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ai_sms_cache_entries",
+		Help: "The number of generation results held in the in-memory cache",
+	})
+)
+
+// CacheConfig enables caching of generation results, keyed by provider,
+// prompt, model and sampling parameters. Cached results are returned
+// without calling the provider until TTL passes. Backend is "memory" or
+// "redis".
+type CacheConfig struct {
+	Enabled bool          `yaml:"enabled"`
+	Backend string        `yaml:"backend"`
+	TTL     time.Duration `yaml:"ttl"`
+	// MaxEntries bounds the in-memory cache; the least recently used
+	// results are evicted first
+	MaxEntries int         `yaml:"max_entries"`
+	Redis      RedisConfig `yaml:"redis"`
+}
+
+// ResponseCache stores generation results by key.
+type ResponseCache interface {
+	Name() string
+	Get(ctx context.Context, key string) (Response, bool, error)
+	Set(ctx context.Context, key string, response Response, ttl time.Duration) error
+}
+
+// responseCache holds generation results; nil when caching is disabled.
+// It is set up once at startup, while the TTL and size limit are read on
+// every use.
+var responseCache ResponseCache
+
+func newResponseCache(config CacheConfig, logger *slog.Logger) (ResponseCache, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+	logger.Info("Caching generation results", "backend", config.Backend, "ttl", config.TTL)
+	if config.Backend == "redis" {
+		return newRedisCache(config.Redis, logger)
+	}
+	return newMemoryCache(), nil
+}
+
+// generateCached is generateShared answered from responseCache when an
+// identical generation finished within the cache TTL. Cache failures are
+// logged and treated as misses.
+func generateCached(ctx context.Context, provider Provider, request Request) (Response, error) {
+	config := currentConfig().Cache
+	if responseCache == nil || !config.Enabled {
+		return generateShared(ctx, provider, request)
+	}
+	key, err := dedupKey(provider, request)
+	if err != nil {
+		return generateShared(ctx, provider, request)
+	}
+
+	response, ok, err := responseCache.Get(ctx, key)
+	switch {
+	case errors.Is(err, errCacheUnavailable):
+		cacheRequestCounter.WithLabelValues("error").Inc()
+	case err != nil:
+		cacheRequestCounter.WithLabelValues("error").Inc()
+		slog.WarnContext(ctx, "Error reading generation cache", "backend", responseCache.Name(), "error", err)
+	case ok:
+		cacheRequestCounter.WithLabelValues("hit").Inc()
+		addLogFields(ctx, "cache", "hit")
+		return response, nil
+	default:
+		cacheRequestCounter.WithLabelValues("miss").Inc()
+	}
+
+	response, err = generateShared(ctx, provider, request)
+	if err != nil {
+		return Response{}, err
+	}
+	err = responseCache.Set(ctx, key, response, config.TTL)
+	if err != nil && !errors.Is(err, errCacheUnavailable) {
+		slog.WarnContext(ctx, "Error writing generation cache", "backend", responseCache.Name(), "error", err)
+	}
+	return response, nil
+}
+
+// memoryCache is an LRU cache of generation results with per-entry expiry.
+type memoryCache struct {
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type memoryCacheEntry struct {
+	key      string
+	response Response
+	expires  time.Time
+}
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *memoryCache) Name() string {
+	return "memory"
+}
+
+func (c *memoryCache) Get(_ context.Context, key string) (Response, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return Response{}, false, nil
+	}
+	entry := element.Value.(*memoryCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(element)
+		return Response{}, false, nil
+	}
+	c.order.MoveToFront(element)
+	return entry.response, true, nil
+}
+
+func (c *memoryCache) Set(_ context.Context, key string, response Response, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &memoryCacheEntry{key: key, response: response, expires: time.Now().Add(ttl)}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+	} else {
+		c.entries[key] = c.order.PushFront(entry)
+	}
+
+	maxEntries := currentConfig().Cache.MaxEntries
+	for c.order.Len() > maxEntries {
+		c.remove(c.order.Back())
+	}
+	cacheEntriesGauge.Set(float64(c.order.Len()))
+	return nil
+}
+
+// remove drops element from the cache. Callers hold c.mu.
+func (c *memoryCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*memoryCacheEntry).key)
+	cacheEntriesGauge.Set(float64(c.order.Len()))
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var jobCallbacksCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ai_sms_job_callbacks_total",
+	Help: "The total number of job callback attempts by result (delivered, retried or failed)",
+}, []string{"result"})
+
+// JobCallbackConfig POSTs finished jobs to the callback_url they were
+// submitted with. The callbacks are signed like inbound HMAC requests,
+// with the secret named Secret, and retried per Retry while the receiver
+// is unreachable or answers 5xx or 429. With AllowedHosts, callback URLs
+// must be on one of the hosts, or of their subdomains for entries with a
+// leading dot; without it, any host is taken but callbacks are never sent
+// to loopback, private or link-local addresses.
+type JobCallbackConfig struct {
+	Secret       string         `yaml:"secret"`
+	AllowedHosts []string       `yaml:"allowed_hosts"`
+	Retry        JobRetryConfig `yaml:"retry"`
+}
+
+// JobCallback is the callback of a job and how its delivery went.
+type JobCallback struct {
+	URL         string     `json:"url"`
+	Attempts    int        `json:"attempts,omitempty"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// errCallbacksDisabled is returned for a callback URL while the callback
+// secret is not set.
+var errCallbacksDisabled = errors.New("job callbacks are not configured")
+
+// errCallbackHost is returned for a callback URL the service won't call.
+var errCallbackHost = errors.New("callback_url host is not allowed")
+
+// newJobCallback checks a callback URL from a submission.
+func newJobCallback(callbackURL string) (*JobCallback, error) {
+	u, err := url.Parse(callbackURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("callback_url must be an absolute http or https URL")
+	}
+	err = checkCallbackHost(u.Hostname(), currentConfig().Jobs.Callback.AllowedHosts)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := lookupSecret(currentConfig().Jobs.Callback.Secret)
+	if err != nil || secret == "" {
+		return nil, errCallbacksDisabled
+	}
+	return &JobCallback{URL: callbackURL}, nil
+}
+
+// checkCallbackHost checks that callbacks may go to host: one of allowed,
+// when it isn't empty, or else any host but a loopback, private or
+// link-local address. Host names are checked again once resolved, when
+// the callback is sent.
+func checkCallbackHost(host string, allowed []string) error {
+	if len(allowed) > 0 {
+		if !callbackHostListed(host, allowed) {
+			return errCallbackHost
+		}
+		return nil
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errCallbackHost
+	}
+	if ip, err := netip.ParseAddr(host); err == nil && internalAddr(ip) {
+		return errCallbackHost
+	}
+	return nil
+}
+
+// callbackHostListed reports whether host is one of allowed: the same
+// name, or a subdomain of an entry with a leading dot.
+func callbackHostListed(host string, allowed []string) bool {
+	host = strings.ToLower(host)
+	for _, entry := range allowed {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if host == entry || strings.HasPrefix(entry, ".") && strings.HasSuffix(host, entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// internalAddr reports whether ip is an address callbacks may not reach
+// unless allowed: loopback, private, link-local (such as cloud metadata
+// endpoints), multicast or unspecified.
+func internalAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified()
+}
+
+// newCallbackClient returns the client to send a callback to callbackURL
+// with. Without allowed hosts, its dialer refuses internal addresses, so a
+// host name resolving to one, or rebinding to one, is refused too; through
+// a proxy, resolving is up to the proxy. Redirects are not followed.
+func newCallbackClient(callbackURL *url.URL, logger *slog.Logger) (*http.Client, error) {
+	client, err := newProviderClient("", logger)
+	if err != nil {
+		return nil, err
+	}
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	if len(currentConfig().Jobs.Callback.AllowedHosts) > 0 {
+		return client, nil
+	}
+	proxy, err := proxyFor("")
+	if err != nil {
+		return nil, err
+	}
+	if proxy != nil {
+		proxyURL, err := proxy(&http.Request{URL: callbackURL})
+		if err != nil || proxyURL != nil {
+			return client, err
+		}
+	}
+
+	transport := newTransport(nil)
+	transport.TLSClientConfig, err = outboundTLSConfig(currentConfig().OutboundTLS)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{
+		Timeout:   currentConfig().Timeouts.Dial,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil || internalAddr(addrPort.Addr()) {
+				return fmt.Errorf("%w: %s", errCallbackHost, address)
+			}
+			return nil
+		},
+	}
+	transport.DialContext = dialer.DialContext
+	client.Transport = &requestIDTransport{next: tracingTransport(transport, "")}
+	return client, nil
+}
+
+// notify delivers the callback of the finished job in the background.
+func (q *jobQueue) notify(job Job) {
+	q.callbacks.Add(1)
+	go func() {
+		defer q.callbacks.Done()
+		q.deliver(job)
+	}()
+}
+
+// deliver POSTs job to its callback URL until the receiver takes it,
+// refuses it with a 4xx or the attempts run out, and saves the outcome in
+// the job. A delivery interrupted by shutdown is not resumed.
+func (q *jobQueue) deliver(job Job) {
+	callback := *job.Callback
+	payload := job
+	payload.Callback = nil
+	body, err := json.Marshal(payload)
+	if err != nil {
+		q.logger.Error("Error encoding job callback", "job", job.ID, "error", err)
+		return
+	}
+
+	policy := currentConfig().Jobs.Callback.Retry
+	backoff := policy.InitialBackoff
+	for {
+		callback.Attempts++
+		retry, err := q.postCallback(callback.URL, body)
+		if err == nil {
+			delivered := time.Now().UTC()
+			callback.DeliveredAt = &delivered
+			callback.Error = ""
+			jobCallbacksCounter.WithLabelValues("delivered").Inc()
+			break
+		}
+		callback.Error = err.Error()
+		if !retry || callback.Attempts >= policy.MaxAttempts || q.ctx.Err() != nil {
+			jobCallbacksCounter.WithLabelValues(jobFailed).Inc()
+			q.logger.Error("Error delivering job callback", "job", job.ID, "attempts", callback.Attempts, "error", err)
+			break
+		}
+
+		jobCallbacksCounter.WithLabelValues("retried").Inc()
+		wait := backoff/2 + rand.N(backoff/2+1)
+		q.logger.Warn("Retrying job callback", "job", job.ID, "attempt", callback.Attempts, "wait", wait, "error", err)
+		select {
+		case <-q.ctx.Done():
+		case <-time.After(wait):
+		}
+		backoff = min(time.Duration(float64(backoff)*policy.Multiplier), policy.MaxBackoff)
+	}
+
+	// The job may have changed since, e.g. requeued from the dead letters
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	current, found, err := q.store.Get(context.WithoutCancel(q.ctx), job.ID)
+	if err != nil || !found || current.FinishedAt == nil || !current.FinishedAt.Equal(*job.FinishedAt) {
+		return
+	}
+	current.Callback = &callback
+	q.save(current)
+}
+
+// postCallback sends one signed callback. retry reports whether a failure
+// may be temporary.
+func (q *jobQueue) postCallback(callbackURL string, body []byte) (retry bool, err error) {
+	secret, err := lookupSecret(currentConfig().Jobs.Callback.Secret)
+	if err != nil {
+		return true, err
+	}
+	if secret == "" {
+		return false, errCallbacksDisabled
+	}
+	req, err := http.NewRequestWithContext(q.ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	// The allowed hosts may have changed since the job was submitted
+	err = checkCallbackHost(req.URL.Hostname(), currentConfig().Jobs.Callback.AllowedHosts)
+	if err != nil {
+		return false, err
+	}
+	client, err := newCallbackClient(req.URL, q.logger)
+	if err != nil {
+		return true, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(signatureTimestampHeader, timestamp)
+	req.Header.Set(signatureHeader, "sha256="+hex.EncodeToString(signRequest(secret, req.Method, req.URL.RequestURI(), timestamp, body)))
+
+	resp, err := client.Do(req)
+	if errors.Is(err, errCallbackHost) {
+		return false, err
+	}
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("callback answered %s", resp.Status)
+	}
+	return false, nil
+}
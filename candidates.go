@@ -0,0 +1,215 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// CandidatesConfig sets how the candidates of requests with
+// num_candidates are generated and ranked. Max bounds num_candidates.
+// Candidate i is generated with Temperatures[i], cycling, when set. The
+// score of a candidate is the average of its scores, weighted by Weights.
+type CandidatesConfig struct {
+	Max          int              `yaml:"max"`
+	Temperatures []float64        `yaml:"temperatures"`
+	Weights      CandidateWeights `yaml:"weights"`
+	// BannedWords make a candidate score 0 on banned, as does profanity
+	BannedWords []string `yaml:"banned_words"`
+}
+
+// CandidateWeights weigh the scores of candidates.
+type CandidateWeights struct {
+	Length      float64 `yaml:"length"`
+	Readability float64 `yaml:"readability"`
+	Banned      float64 `yaml:"banned"`
+}
+
+// Candidate is one of the texts generated for a request, with its scores
+// from 0 to 1.
+type Candidate struct {
+	Text         string          `json:"text"`
+	GenerationID string          `json:"generation_id,omitempty"`
+	Temperature  *float64        `json:"temperature,omitempty"`
+	Score        float64         `json:"score"`
+	Scores       CandidateScores `json:"scores"`
+	SegmentInfo
+}
+
+// CandidateScores are the scores a candidate is ranked by: how well it
+// fits the length limits, how easy it is to read, and whether it is free
+// of banned words.
+type CandidateScores struct {
+	Length      float64 `json:"length"`
+	Readability float64 `json:"readability"`
+	Banned      float64 `json:"banned"`
+}
+
+// checkCandidates validates the num_candidates of a request.
+func checkCandidates(n int) error {
+	limit := currentConfig().Candidates.Max
+	if n < 0 || n > limit {
+		return fmt.Errorf("num_candidates must be between 1 and %d", limit)
+	}
+	return nil
+}
+
+// generateCandidates generates postProcess.Candidates texts for request at
+// once and returns the best scoring one, with the ranked list of all of
+// them if postProcess.AllCandidates is set. Candidates that fail are left
+// out, unless they all do.
+func generateCandidates(ctx context.Context, provider Provider, request Request, postProcess PostProcessConfig, logger *slog.Logger) (Response, error) {
+	config := currentConfig().Candidates
+	n := postProcess.Candidates
+	postProcess.Candidates = 0
+	responses := make([]Response, n)
+	errs := make([]error, n)
+	temperatures := make([]*float64, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		candidate := request
+		// Candidates must neither be cached nor shared as one
+		candidate.Candidate = i + 1
+		if len(config.Temperatures) > 0 {
+			temperature := config.Temperatures[i%len(config.Temperatures)]
+			candidate.Temperature = &temperature
+		}
+		temperatures[i] = candidate.Temperature
+		if request.Seed != nil {
+			// The same seed would give the same text every time
+			seed := *request.Seed + int64(i)
+			candidate.Seed = &seed
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i], errs[i] = generateSms(ctx, provider, candidate, postProcess, logger)
+		}()
+	}
+	wg.Wait()
+
+	// The candidates that were generated, best first; ties go to the
+	// earlier candidate
+	var ranked []int
+	candidates := make([]Candidate, n)
+	for i, response := range responses {
+		if errs[i] != nil {
+			logger.WarnContext(ctx, "Error generating candidate", "candidate", i+1, "error", errs[i])
+			continue
+		}
+		candidates[i] = Candidate{
+			Text:         response.Text,
+			GenerationID: response.GenerationID,
+			Temperature:  temperatures[i],
+			Scores:       scoreCandidate(response.Text, postProcess),
+			SegmentInfo:  segmentInfo(response.Text),
+		}
+		candidates[i].Score = config.Weights.score(candidates[i].Scores)
+		ranked = append(ranked, i)
+	}
+	if len(ranked) == 0 {
+		return Response{}, errs[0]
+	}
+	slices.SortStableFunc(ranked, func(a, b int) int {
+		return cmp.Compare(candidates[b].Score, candidates[a].Score)
+	})
+
+	response := responses[ranked[0]]
+	if postProcess.AllCandidates {
+		for _, i := range ranked {
+			response.Candidates = append(response.Candidates, candidates[i])
+		}
+	}
+	return response, nil
+}
+
+// score returns the weighted average of scores.
+func (w CandidateWeights) score(scores CandidateScores) float64 {
+	total := w.Length + w.Readability + w.Banned
+	if total == 0 {
+		return 0
+	}
+	score := (w.Length*scores.Length + w.Readability*scores.Readability + w.Banned*scores.Banned) / total
+	return math.Round(score*1000) / 1000
+}
+
+// scoreCandidate scores a generated text.
+func scoreCandidate(text string, postProcess PostProcessConfig) CandidateScores {
+	return CandidateScores{
+		Length:      lengthScore(text, postProcess),
+		Readability: readabilityScore(text),
+		Banned:      bannedScore(text),
+	}
+}
+
+// lengthScore is 1 for a text within the length limits of postProcess,
+// and the share of it that fits otherwise.
+func lengthScore(text string, postProcess PostProcessConfig) float64 {
+	limit := postProcess.Budget.limit(text)
+	if postProcess.MaxLength > 0 && (limit == 0 || postProcess.MaxLength < limit) {
+		limit = postProcess.MaxLength
+	}
+	length := len([]rune(text))
+	if limit == 0 || length <= limit {
+		return 1
+	}
+	return math.Round(float64(limit)/float64(length)*1000) / 1000
+}
+
+var (
+	sentenceEndPattern = regexp.MustCompile(`[.!?…]+`)
+	scoredWordPattern  = regexp.MustCompile(`[\p{L}\p{N}]+`)
+	vowelGroupPattern  = regexp.MustCompile(`(?i)[aeiouyаеёиоуыэюя]+`)
+)
+
+// readabilityScore is the Flesch reading ease of text over 100, clamped to
+// 0..1, with Oborneva's coefficients for Russian. Syllables are counted as
+// groups of vowels.
+func readabilityScore(text string) float64 {
+	words := scoredWordPattern.FindAllString(text, -1)
+	if len(words) == 0 {
+		return 0
+	}
+	sentences := 0
+	for _, sentence := range sentenceEndPattern.Split(text, -1) {
+		if scoredWordPattern.MatchString(sentence) {
+			sentences++
+		}
+	}
+	syllables := 0
+	cyrillic := 0
+	for _, word := range words {
+		syllables += max(len(vowelGroupPattern.FindAllString(word, -1)), 1)
+		if strings.IndexFunc(word, func(r rune) bool { return unicode.Is(unicode.Cyrillic, r) }) >= 0 {
+			cyrillic++
+		}
+	}
+	wordsPerSentence := float64(len(words)) / float64(max(sentences, 1))
+	syllablesPerWord := float64(syllables) / float64(len(words))
+	ease := 206.835 - 1.015*wordsPerSentence - 84.6*syllablesPerWord
+	if cyrillic*2 > len(words) {
+		ease = 206.835 - 1.3*wordsPerSentence - 60.1*syllablesPerWord
+	}
+	return math.Round(min(max(ease/100, 0), 1)*1000) / 1000
+}
+
+// bannedScore is 0 for a text with banned words or profanity, 1 otherwise.
+func bannedScore(text string) float64 {
+	if _, found := profanity.find(text); found {
+		return 0
+	}
+	banned := currentConfig().Candidates.BannedWords
+	for _, word := range scoredWordPattern.FindAllString(text, -1) {
+		if slices.ContainsFunc(banned, func(b string) bool { return strings.EqualFold(b, word) }) {
+			return 0
+		}
+	}
+	return 1
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// maxChatTurns bounds how much history is replayed into the prompt.
+const maxChatTurns = 10
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+// ChatMessage is sent by the client: the first one is the SMS prompt, the
+// following ones are refinement instructions ("make it shorter").
+type ChatMessage struct {
+	Prompt string `json:"prompt"`
+}
+
+// ChatReply is sent back for every client message. A message blocked by
+// moderation is answered with type "blocked", the stage and categories.
+type ChatReply struct {
+	Type       string   `json:"type"`
+	Text       string   `json:"text,omitempty"`
+	Error      string   `json:"error,omitempty"`
+	Stage      string   `json:"stage,omitempty"`
+	Categories []string `json:"categories,omitempty"`
+}
+
+// chatModerationReply is the reply to a message whose prompt or text failed
+// moderation.
+func chatModerationReply(ctx context.Context, err error, logger *slog.Logger) ChatReply {
+	var blocked *moderationError
+	if errors.As(err, &blocked) {
+		return ChatReply{Type: "blocked", Error: blocked.Error(), Stage: blocked.Stage, Categories: blocked.Categories}
+	}
+	logger.ErrorContext(ctx, "Error moderating chat message", "error", err)
+	return ChatReply{Type: "error", Error: "Error getting AI SMS content"}
+}
+
+// handleChat serves a chat over WebSocket. The default provider is resolved
+// per connection, so a reloaded config applies to new chats.
+func handleChat(w http.ResponseWriter, r *http.Request, providers *providerSet, logger *slog.Logger) {
+	provider, err := providers.get("")
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error setting up chat provider", "error", err)
+		http.Error(w, "Error setting up AI provider", http.StatusInternalServerError)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error upgrading chat connection", "error", err)
+		return
+	}
+	defer conn.Close()
+	if limit := currentConfig().Limits.MaxBodyBytes; limit > 0 {
+		conn.SetReadLimit(limit)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger.InfoContext(r.Context(), "Chat connection opened", "remote_addr", r.RemoteAddr)
+	var history []Turn
+	for {
+		var msg ChatMessage
+		err := conn.ReadJSON(&msg)
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				logger.ErrorContext(r.Context(), "Error reading chat message", "error", err)
+			}
+			return
+		}
+		if strings.TrimSpace(msg.Prompt) == "" {
+			conn.WriteJSON(ChatReply{Type: "error", Error: "prompt is required"})
+			continue
+		}
+		requestCounter.Inc()
+		logger.InfoContext(r.Context(), "Received chat message", "turn", len(history)+1, "prompt", msg.Prompt)
+
+		prompt, err := screenPrompt(msg.Prompt)
+		if err != nil {
+			err = conn.WriteJSON(ChatReply{Type: "error", Error: err.Error()})
+			if err != nil {
+				return
+			}
+			continue
+		}
+		request := newGenerateRequest(prompt, "")
+		request.History = history
+		err = checkPromptSize(request)
+		if err != nil {
+			err = conn.WriteJSON(ChatReply{Type: "error", Error: err.Error()})
+			if err != nil {
+				return
+			}
+			continue
+		}
+		_, err = moderate(ctx, moderationPrompt, prompt, logger)
+		if err != nil {
+			err = conn.WriteJSON(chatModerationReply(r.Context(), err, logger))
+			if err != nil {
+				return
+			}
+			continue
+		}
+		start := time.Now()
+		response, err := generate(ctx, provider, request)
+		recordGeneration(r.Context(), provider, request, response, start, err)
+		if err != nil {
+			logger.ErrorContext(r.Context(), "Error getting AI SMS content", "error", err)
+			err = conn.WriteJSON(ChatReply{Type: "error", Error: "Error getting AI SMS content"})
+			if err != nil {
+				return
+			}
+			continue
+		}
+		response = filterProfanity(ctx, provider, request, response, logger)
+		// A blocked draft is not kept in the history
+		_, err = moderate(ctx, moderationOutput, response.Text, logger)
+		if err != nil {
+			err = conn.WriteJSON(chatModerationReply(r.Context(), err, logger))
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		text := response.Text
+		history = append(history, Turn{User: prompt, Assistant: text})
+		if len(history) > maxChatTurns {
+			history = history[len(history)-maxChatTurns:]
+		}
+
+		err = conn.WriteJSON(ChatReply{Type: "draft", Text: text})
+		if err != nil {
+			logger.ErrorContext(r.Context(), "Error writing chat reply", "error", err)
+			return
+		}
+	}
+}
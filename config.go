@@ -0,0 +1,732 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nyaruka/phonenumbers"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultConfigFile = "config.yaml"
+
+// Config holds the settings loaded from the YAML config file. Values not
+// present in the file keep their defaults; a few environment variables
+// override the file (see applyEnv).
+type Config struct {
+	Server     ServerConfig     `yaml:"server"`
+	Logging    LoggingConfig    `yaml:"logging"`
+	Provider   string           `yaml:"provider"`
+	Fallback   []string         `yaml:"fallback"`
+	Replicate  ReplicateConfig  `yaml:"replicate"`
+	Generation GenerationConfig `yaml:"generation"`
+	Polling    PollingConfig    `yaml:"polling"`
+	Proxy      string           `yaml:"proxy"`
+	NoProxy    []string         `yaml:"no_proxy"`
+	Secrets    SecretsConfig    `yaml:"secrets"`
+	TokenPool  TokenPoolConfig  `yaml:"token_pool"`
+	Retry      RetryConfig      `yaml:"retry"`
+	Hedge      HedgeConfig      `yaml:"hedge"`
+	Timeouts   TimeoutsConfig   `yaml:"timeouts"`
+	Health     HealthConfig     `yaml:"health"`
+	Limits     LimitsConfig     `yaml:"limits"`
+	Dedup      bool             `yaml:"dedup"`
+	Cache      CacheConfig      `yaml:"cache"`
+	History    HistoryConfig    `yaml:"history"`
+	Tracing    TracingConfig    `yaml:"tracing"`
+	Auth       AuthConfig       `yaml:"auth"`
+	RateLimit  RateLimitConfig  `yaml:"rate_limit"`
+	IPAccess   IPAccessConfig   `yaml:"ip_access"`
+
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker"`
+	OutboundTLS    OutboundTLSConfig    `yaml:"outbound_tls"`
+	Idempotency    IdempotencyConfig    `yaml:"idempotency"`
+	Jobs           JobsConfig           `yaml:"jobs"`
+	Batch          BatchConfig          `yaml:"batch"`
+	Schedules      []ScheduleConfig     `yaml:"schedules"`
+	Twilio         TwilioConfig         `yaml:"twilio"`
+	SMPP           SMPPConfig           `yaml:"smpp"`
+	Phone          PhoneConfig          `yaml:"phone"`
+	Shortener      ShortenerConfig      `yaml:"shortener"`
+	Moderation     ModerationConfig     `yaml:"moderation"`
+	PII            PIIConfig            `yaml:"pii"`
+	Profanity      ProfanityConfig      `yaml:"profanity"`
+	Injection      InjectionConfig      `yaml:"injection"`
+	Candidates     CandidatesConfig     `yaml:"candidates"`
+	Language       LanguageConfig       `yaml:"language"`
+	Proofread      ProofreadConfig      `yaml:"proofread"`
+
+	Models  map[string]ModelConfig  `yaml:"models"`
+	Presets map[string]PresetConfig `yaml:"presets"`
+	// Tones and Personas are system prompt snippets clients pick by name
+	Tones           map[string]string `yaml:"tones"`
+	Personas        map[string]string `yaml:"personas"`
+	ProviderProxies map[string]string `yaml:"provider_proxies"`
+	// Transliteration overrides entries of the built-in Russian to Latin
+	// table, by lowercase letter
+	Transliteration map[string]string `yaml:"transliteration"`
+}
+
+type ServerConfig struct {
+	Addr        string `yaml:"addr"`
+	MetricsAddr string `yaml:"metrics_addr"`
+	// MetricsListener is "separate" to serve /metrics and pprof on
+	// MetricsAddr, or "main" to serve them on Addr instead
+	MetricsListener string `yaml:"metrics_listener"`
+	LogFile         string `yaml:"log_file"`
+	StaticDir       string `yaml:"static_dir"`
+	// DrainTimeout is how long in-flight requests may finish on shutdown
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+	TLS          TLSConfig     `yaml:"tls"`
+}
+
+// ReplicateConfig selects the default Replicate model. Without a version the
+// latest version of the model is used.
+type ReplicateConfig struct {
+	Model   string `yaml:"model"`
+	Version string `yaml:"version"`
+}
+
+type GenerationConfig struct {
+	PromptTemplate   string  `yaml:"prompt_template"`
+	SystemPrompt     string  `yaml:"system_prompt"`
+	Temperature      float64 `yaml:"temperature"`
+	TopP             float64 `yaml:"top_p"`
+	TopK             int     `yaml:"top_k"`
+	MaxTokens        int     `yaml:"max_tokens"`
+	PresencePenalty  float64 `yaml:"presence_penalty"`
+	FrequencyPenalty float64 `yaml:"frequency_penalty"`
+}
+
+// HealthConfig controls the readiness checks behind /readyz.
+type HealthConfig struct {
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+}
+
+type PollingConfig struct {
+	Interval    time.Duration `yaml:"interval"`
+	MaxInterval time.Duration `yaml:"max_interval"`
+	Backoff     float64       `yaml:"backoff"`
+	MaxWait     time.Duration `yaml:"max_wait"`
+}
+
+// TokenPoolConfig controls how requests are spread across several API tokens
+// for the same provider.
+type TokenPoolConfig struct {
+	Strategy string        `yaml:"strategy"`
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+// SecretsConfig selects where provider credentials come from. With the env
+// backend they are read from environment variables only.
+type SecretsConfig struct {
+	Backend         string        `yaml:"backend"`
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	Vault           VaultConfig   `yaml:"vault"`
+	AWS             AWSConfig     `yaml:"aws"`
+}
+
+type VaultConfig struct {
+	Addr      string `yaml:"addr"`
+	Namespace string `yaml:"namespace"`
+	Mount     string `yaml:"mount"`
+	Path      string `yaml:"path"`
+}
+
+type AWSConfig struct {
+	Region   string `yaml:"region"`
+	SecretID string `yaml:"secret_id"`
+}
+
+var activeConfig atomic.Pointer[Config]
+
+func init() {
+	activeConfig.Store(defaultConfig())
+}
+
+// currentConfig returns the configuration in effect.
+func currentConfig() *Config {
+	return activeConfig.Load()
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Addr:            ":8080",
+			MetricsAddr:     "127.0.0.1:8082",
+			MetricsListener: "separate",
+			LogFile:         "ai_sms_service.log",
+			StaticDir:       "static",
+			DrainTimeout:    30 * time.Second,
+			TLS: TLSConfig{
+				ClientAuth: "require",
+				ACME: ACMEConfig{
+					CacheDir: "acme-cache",
+					HTTPAddr: ":80",
+				},
+			},
+		},
+		Logging: LoggingConfig{
+			Level:  "info",
+			Format: "json",
+			Output: "both",
+			Rotation: RotationConfig{
+				MaxSizeMB:  100,
+				MaxAgeDays: 30,
+				MaxBackups: 10,
+				Compress:   true,
+			},
+			Redact: RedactConfig{
+				Phones: true,
+			},
+		},
+		Provider: defaultProvider,
+		Replicate: ReplicateConfig{
+			Model: "mistralai/mixtral-8x7b-instruct-v0.1",
+		},
+		Generation: GenerationConfig{
+			PromptTemplate: "<s>[INST] {prompt} [/INST] ",
+			Temperature:    0.6,
+			TopP:           0.9,
+			TopK:           50,
+			MaxTokens:      1024,
+		},
+		Polling: PollingConfig{
+			Interval:    1 * time.Second,
+			MaxInterval: 5 * time.Second,
+			Backoff:     1.5,
+			MaxWait:     60 * time.Second,
+		},
+		ProviderProxies: map[string]string{
+			"ollama": directProxy,
+		},
+		Retry: RetryConfig{
+			MaxAttempts:       3,
+			InitialBackoff:    500 * time.Millisecond,
+			MaxBackoff:        10 * time.Second,
+			Multiplier:        2,
+			RetryableStatuses: []int{429, 500, 502, 503, 504},
+		},
+		Timeouts: TimeoutsConfig{
+			Dial:           10 * time.Second,
+			TLSHandshake:   10 * time.Second,
+			ResponseHeader: 90 * time.Second,
+			Request:        2 * time.Minute,
+			Handler:        3 * time.Minute,
+			ReadHeader:     10 * time.Second,
+			Idle:           2 * time.Minute,
+		},
+		Dedup: true,
+		RateLimit: RateLimitConfig{
+			RequestsPerMinute: 60,
+			Burst:             20,
+		},
+		Auth: AuthConfig{
+			KeysFile: "api_keys.json",
+			HMAC: HMACConfig{
+				Tolerance: 5 * time.Minute,
+			},
+		},
+		Tracing: TracingConfig{
+			ServiceName: "ai-sms-service",
+			SampleRatio: 1,
+			Propagate:   []string{"ollama"},
+		},
+		Limits: LimitsConfig{
+			MaxConcurrentGenerations: 20,
+			MaxQueued:                100,
+			QueueTimeout:             10 * time.Second,
+			MaxBodyBytes:             1 << 20,
+			MaxPromptChars:           4000,
+			MaxPromptTokens:          1000,
+		},
+		Idempotency: IdempotencyConfig{
+			Enabled: true,
+			TTL:     24 * time.Hour,
+			MaxKeys: 100000,
+		},
+		Jobs: JobsConfig{
+			Backend:         "memory",
+			Path:            "jobs.db",
+			Workers:         4,
+			MaxQueued:       1000,
+			Priorities:      []string{"otp", "transactional", "marketing"},
+			DefaultPriority: "transactional",
+			Timeout:         3 * time.Minute,
+			Retry: JobRetryConfig{
+				MaxAttempts:    3,
+				InitialBackoff: 5 * time.Second,
+				MaxBackoff:     5 * time.Minute,
+				Multiplier:     2,
+			},
+			ResultTTL: 24 * time.Hour,
+			DeadTTL:   7 * 24 * time.Hour,
+			Callback: JobCallbackConfig{
+				Secret: "JOB_CALLBACK_SECRET",
+				Retry: JobRetryConfig{
+					MaxAttempts:    5,
+					InitialBackoff: 10 * time.Second,
+					MaxBackoff:     10 * time.Minute,
+					Multiplier:     2,
+				},
+			},
+		},
+		Batch: BatchConfig{
+			MaxItems:    100,
+			Concurrency: 4,
+		},
+		Twilio: TwilioConfig{
+			BaseURL: defaultTwilioBaseURL,
+		},
+		Shortener: ShortenerConfig{
+			TokenSecret: "SHORTENER_TOKEN",
+		},
+		Moderation: ModerationConfig{
+			Prompt:      true,
+			Output:      true,
+			TokenSecret: "OPENAI_API_KEY",
+		},
+		PII: PIIConfig{
+			Detect: []string{"email", "card", "phone"},
+		},
+		Profanity: ProfanityConfig{
+			Attempts: 2,
+		},
+		Language: LanguageConfig{
+			Mode:   languageInstruct,
+			Verify: true,
+		},
+		Proofread: ProofreadConfig{
+			Language:     "auto",
+			APIKeySecret: "LANGUAGETOOL_API_KEY",
+		},
+		Candidates: CandidatesConfig{
+			Max: 5,
+			Weights: CandidateWeights{
+				Length:      1,
+				Readability: 1,
+				Banned:      2,
+			},
+		},
+		SMPP: SMPPConfig{
+			EnquireLink:      30 * time.Second,
+			Timeout:          10 * time.Second,
+			DeliveryReceipts: true,
+		},
+		Cache: CacheConfig{
+			Backend:    "memory",
+			TTL:        10 * time.Minute,
+			MaxEntries: 10000,
+			Redis: RedisConfig{
+				Addr:      "localhost:6379",
+				KeyPrefix: "ai-sms:cache:",
+				Timeout:   200 * time.Millisecond,
+			},
+		},
+		History: HistoryConfig{
+			Backend: "sqlite",
+			Path:    "history.db",
+			Postgres: PostgresConfig{
+				MaxOpenConns:    10,
+				MaxIdleConns:    5,
+				ConnMaxLifetime: 30 * time.Minute,
+			},
+		},
+		Health: HealthConfig{
+			CacheTTL: 30 * time.Second,
+		},
+		Hedge: HedgeConfig{
+			Delay: 3 * time.Second,
+		},
+		CircuitBreaker: CircuitBreakerConfig{
+			Enabled:          true,
+			FailureRate:      0.5,
+			MinRequests:      10,
+			Window:           time.Minute,
+			OpenTimeout:      30 * time.Second,
+			HalfOpenRequests: 1,
+		},
+		TokenPool: TokenPoolConfig{
+			Strategy: "round_robin",
+			Cooldown: time.Minute,
+		},
+		Secrets: SecretsConfig{
+			Backend:         "env",
+			RefreshInterval: 5 * time.Minute,
+			Vault: VaultConfig{
+				Mount: "secret",
+			},
+		},
+		Tones: maps.Clone(defaultTones),
+	}
+}
+
+// loadConfig reads the config file at path on top of the defaults. A missing
+// file is only an error when required is set.
+func loadConfig(path string, required bool) (*Config, error) {
+	config := defaultConfig()
+
+	file, err := os.Open(path)
+	switch {
+	case err == nil:
+		defer file.Close()
+		decoder := yaml.NewDecoder(file)
+		decoder.KnownFields(true)
+		err = decoder.Decode(config)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("config %s: %v", path, err)
+		}
+	case errors.Is(err, os.ErrNotExist) && !required:
+	default:
+		return nil, err
+	}
+
+	err = config.applyEnv()
+	if err != nil {
+		return nil, err
+	}
+	err = config.validate()
+	if err != nil {
+		return nil, fmt.Errorf("config %s: %v", path, err)
+	}
+
+	return config, nil
+}
+
+// applyEnv lets the environment variables supported before the config file
+// existed, and a few operational knobs, keep overriding it.
+func (c *Config) applyEnv() error {
+	if value := os.Getenv("AI_PROVIDER"); value != "" {
+		c.Provider = value
+	}
+	if value := os.Getenv("LOG_OUTPUT"); value != "" {
+		c.Logging.Output = value
+	}
+	if value := os.Getenv("SYSTEM_PROMPT"); value != "" {
+		c.Generation.SystemPrompt = value
+	}
+
+	durations := map[string]*time.Duration{
+		"POLL_INTERVAL":     &c.Polling.Interval,
+		"POLL_MAX_INTERVAL": &c.Polling.MaxInterval,
+		"POLL_MAX_WAIT":     &c.Polling.MaxWait,
+	}
+	for name, target := range durations {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", name, err)
+		}
+		*target = d
+	}
+	if value := os.Getenv("MAX_CONCURRENT_GENERATIONS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid MAX_CONCURRENT_GENERATIONS: %v", err)
+		}
+		c.Limits.MaxConcurrentGenerations = n
+	}
+	if value := os.Getenv("POLL_BACKOFF"); value != "" {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid POLL_BACKOFF: %v", err)
+		}
+		c.Polling.Backoff = f
+	}
+
+	return nil
+}
+
+func (c *Config) validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Server.Addr != "", "server.addr is required")
+	check(c.Server.MetricsListener == "separate" || c.Server.MetricsListener == "main", "server.metrics_listener must be separate or main")
+	check(c.Server.MetricsListener == "main" || c.Server.MetricsAddr != "", "server.metrics_addr is required")
+	check(c.Server.StaticDir != "", "server.static_dir is required")
+	check(c.Server.DrainTimeout > 0, "server.drain_timeout must be positive")
+	check((c.Server.TLS.CertFile == "") == (c.Server.TLS.KeyFile == ""), "server.tls.cert_file and server.tls.key_file must be set together")
+	check(c.Server.TLS.CertFile == "" || len(c.Server.TLS.ACME.Domains) == 0, "server.tls.cert_file and server.tls.acme are mutually exclusive")
+	check(len(c.Server.TLS.ACME.Domains) == 0 || c.Server.TLS.ACME.CacheDir != "", "server.tls.acme.cache_dir is required")
+	check(c.Server.TLS.ClientCAFile == "" || c.Server.TLS.enabled(), "server.tls.client_ca_file needs server.tls.cert_file or server.tls.acme")
+	check(c.Server.TLS.ClientAuth == "require" || c.Server.TLS.ClientAuth == "optional", "server.tls.client_auth must be require or optional")
+	check((c.OutboundTLS.CertFile == "") == (c.OutboundTLS.KeyFile == ""), "outbound_tls.cert_file and outbound_tls.key_file must be set together")
+	for _, pattern := range c.Logging.Redact.Patterns {
+		_, err := regexp.Compile(pattern)
+		check(err == nil, "logging.redact.patterns: %q is not a valid regular expression", pattern)
+	}
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.Logging.Level)) == nil, "logging.level must be debug, info, warn or error")
+	check(c.Logging.Format == "json" || c.Logging.Format == "text", "logging.format must be json or text")
+	check(c.Logging.Output == "both" || c.Logging.Output == "file" || c.Logging.Output == "stdout", "logging.output must be both, file or stdout")
+	if c.Logging.Output != "stdout" {
+		check(c.Server.LogFile != "", "server.log_file is required unless logging.output is stdout")
+	}
+	check(c.Logging.Rotation.MaxSizeMB > 0, "logging.rotation.max_size_mb must be positive")
+	check(c.Logging.Rotation.MaxAgeDays >= 0, "logging.rotation.max_age_days must not be negative")
+	check(c.Logging.Rotation.MaxBackups >= 0, "logging.rotation.max_backups must not be negative")
+	check(providerFactories[c.Provider] != nil, "provider %q is unknown (available: %s)", c.Provider, strings.Join(providerNames(), ", "))
+	for _, name := range c.Fallback {
+		check(providerFactories[name] != nil, "fallback: provider %q is unknown", name)
+	}
+	check(c.Replicate.Model != "", "replicate.model is required")
+	check(c.Replicate.Version == "" || replicateVersionPattern.MatchString(c.Replicate.Version), "replicate.version must be a 64 character version hash")
+	check(strings.Contains(c.Generation.PromptTemplate, "{prompt}"), "generation.prompt_template must contain {prompt}")
+	check(c.Generation.Temperature >= 0 && c.Generation.Temperature <= 2, "generation.temperature must be between 0 and 2")
+	check(c.Generation.TopP > 0 && c.Generation.TopP <= 1, "generation.top_p must be in (0, 1]")
+	check(c.Generation.TopK >= 0, "generation.top_k must not be negative")
+	check(c.Generation.MaxTokens > 0, "generation.max_tokens must be positive")
+	check(c.Polling.Interval > 0, "polling.interval must be positive")
+	check(c.Polling.MaxInterval >= c.Polling.Interval, "polling.max_interval must not be less than polling.interval")
+	check(c.Polling.Backoff >= 1, "polling.backoff must be at least 1")
+	check(c.Polling.MaxWait > 0, "polling.max_wait must be positive")
+	switch c.Secrets.Backend {
+	case "env":
+	case "vault":
+		check(c.Secrets.Vault.Addr != "", "secrets.vault.addr is required")
+		check(c.Secrets.Vault.Path != "", "secrets.vault.path is required")
+	case "aws":
+		check(c.Secrets.AWS.SecretID != "", "secrets.aws.secret_id is required")
+	default:
+		check(false, "secrets.backend must be env, vault or aws")
+	}
+	check(c.Secrets.RefreshInterval > 0, "secrets.refresh_interval must be positive")
+	check(c.TokenPool.Strategy == "round_robin" || c.TokenPool.Strategy == "least_errors", "token_pool.strategy must be round_robin or least_errors")
+	check(c.TokenPool.Cooldown > 0, "token_pool.cooldown must be positive")
+	check(c.Retry.MaxAttempts >= 1, "retry.max_attempts must be at least 1")
+	check(c.Retry.InitialBackoff > 0, "retry.initial_backoff must be positive")
+	check(c.Retry.MaxBackoff >= c.Retry.InitialBackoff, "retry.max_backoff must not be less than retry.initial_backoff")
+	check(c.Retry.Multiplier >= 1, "retry.multiplier must be at least 1")
+	check(c.CircuitBreaker.FailureRate > 0 && c.CircuitBreaker.FailureRate <= 1, "circuit_breaker.failure_rate must be in (0, 1]")
+	check(c.CircuitBreaker.MinRequests >= 1, "circuit_breaker.min_requests must be at least 1")
+	check(c.CircuitBreaker.Window > 0, "circuit_breaker.window must be positive")
+	check(c.CircuitBreaker.OpenTimeout > 0, "circuit_breaker.open_timeout must be positive")
+	check(c.CircuitBreaker.HalfOpenRequests >= 1, "circuit_breaker.half_open_requests must be at least 1")
+	check(c.Limits.MaxConcurrentGenerations >= 1, "limits.max_concurrent_generations must be at least 1")
+	check(c.Limits.MaxQueued >= 0, "limits.max_queued must not be negative")
+	check(c.Limits.QueueTimeout >= 0, "limits.queue_timeout must not be negative")
+	check(c.History.Backend == "sqlite" || c.History.Backend == "postgres", "history.backend must be sqlite or postgres")
+	check(c.History.Backend != "sqlite" || c.History.Path != "", "history.path is required")
+	check(c.History.RetentionDays >= 0, "history.retention_days must not be negative")
+	check(c.History.Postgres.MaxOpenConns >= 1, "history.postgres.max_open_conns must be at least 1")
+	check(c.Idempotency.TTL > 0, "idempotency.ttl must be positive")
+	check(c.Idempotency.MaxKeys >= 1, "idempotency.max_keys must be at least 1")
+	check(c.Jobs.Backend == "memory" || c.Jobs.Backend == "bolt", "jobs.backend must be memory or bolt")
+	check(c.Jobs.Backend != "bolt" || c.Jobs.Path != "", "jobs.path is required")
+	check(c.Jobs.Workers >= 1, "jobs.workers must be at least 1")
+	check(c.Jobs.MaxQueued >= 1, "jobs.max_queued must be at least 1")
+	check(len(c.Jobs.Priorities) > 0, "jobs.priorities must not be empty")
+	for i, priority := range c.Jobs.Priorities {
+		check(priority != "" && !slices.Contains(c.Jobs.Priorities[:i], priority), "jobs.priorities must be unique and not empty")
+	}
+	check(slices.Contains(c.Jobs.Priorities, c.Jobs.DefaultPriority), "jobs.default_priority must be one of jobs.priorities")
+	check(c.Jobs.Timeout > 0, "jobs.timeout must be positive")
+	check(c.Jobs.Retry.MaxAttempts >= 1, "jobs.retry.max_attempts must be at least 1")
+	check(c.Jobs.Retry.InitialBackoff > 0, "jobs.retry.initial_backoff must be positive")
+	check(c.Jobs.Retry.MaxBackoff >= c.Jobs.Retry.InitialBackoff, "jobs.retry.max_backoff must not be less than jobs.retry.initial_backoff")
+	check(c.Jobs.Retry.Multiplier >= 1, "jobs.retry.multiplier must be at least 1")
+	check(c.Jobs.ResultTTL > 0, "jobs.result_ttl must be positive")
+	check(c.Jobs.DeadTTL > 0, "jobs.dead_ttl must be positive")
+	check(c.Jobs.Callback.Secret != "", "jobs.callback.secret is required")
+	for _, host := range c.Jobs.Callback.AllowedHosts {
+		check(strings.Trim(host, ". ") != "" && !strings.ContainsAny(host, "/:"), "jobs.callback.allowed_hosts must be host names, %q is not", host)
+	}
+	check(c.Jobs.Callback.Retry.MaxAttempts >= 1, "jobs.callback.retry.max_attempts must be at least 1")
+	check(c.Jobs.Callback.Retry.InitialBackoff > 0, "jobs.callback.retry.initial_backoff must be positive")
+	check(c.Jobs.Callback.Retry.MaxBackoff >= c.Jobs.Callback.Retry.InitialBackoff, "jobs.callback.retry.max_backoff must not be less than jobs.callback.retry.initial_backoff")
+	check(c.Jobs.Callback.Retry.Multiplier >= 1, "jobs.callback.retry.multiplier must be at least 1")
+	for i, schedule := range c.Schedules {
+		check(schedule.Name != "", "schedules need a name")
+		for _, other := range c.Schedules[:i] {
+			check(other.Name != schedule.Name, "schedule %s is defined twice", schedule.Name)
+		}
+		_, err := parseCron(schedule.Cron)
+		check(err == nil, "schedule %s: invalid cron: %v", schedule.Name, err)
+		check(strings.TrimSpace(schedule.Prompt) != "", "schedule %s: prompt is required", schedule.Name)
+		gateway := schedule.SMSGateway
+		check(gateway == nil || gateway.URL != "" && len(gateway.To) > 0, "schedule %s: sms_gateway needs url and to", schedule.Name)
+	}
+	if c.Twilio.AccountSID != "" {
+		check(c.Twilio.From != "" || c.Twilio.MessagingServiceSID != "", "twilio.from or twilio.messaging_service_sid is required")
+		_, err := url.Parse(c.Twilio.BaseURL)
+		check(err == nil, "invalid twilio.base_url: %v", err)
+		if c.Twilio.StatusCallbackURL != "" {
+			callback, err := url.Parse(c.Twilio.StatusCallbackURL)
+			check(err == nil && callback.IsAbs(), "twilio.status_callback_url must be an absolute URL")
+		}
+	}
+	check(slices.Contains([]string{"", "bitly", "http"}, c.Shortener.Backend), "shortener.backend must be bitly or http, not %q", c.Shortener.Backend)
+	check(c.Shortener.Backend != "http" || c.Shortener.URL != "", "shortener.url is required for the http backend")
+	if c.Shortener.URL != "" {
+		_, err := url.Parse(c.Shortener.URL)
+		check(err == nil, "invalid shortener.url: %v", err)
+	}
+	check(slices.Contains([]string{"", "rules", "openai"}, c.Moderation.Backend), "moderation.backend must be rules or openai, not %q", c.Moderation.Backend)
+	check(c.Moderation.Backend != "rules" || len(c.Moderation.Rules) > 0, "moderation.rules are required for the rules backend")
+	for _, rule := range c.Moderation.Rules {
+		check(rule.Category != "", "moderation rules need a category")
+		check(len(rule.Keywords) > 0 || len(rule.Patterns) > 0, "moderation rule %q needs keywords or patterns", rule.Category)
+	}
+	if _, err := newRulesModerator(c.Moderation.Rules); err != nil {
+		check(false, "%v", err)
+	}
+	if c.Moderation.URL != "" {
+		_, err := url.Parse(c.Moderation.URL)
+		check(err == nil, "invalid moderation.url: %v", err)
+	}
+	for _, kind := range c.PII.Detect {
+		check(slices.Contains(piiKinds, kind), "pii.detect must list email, card or phone, not %q", kind)
+	}
+	for _, pattern := range c.PII.Patterns {
+		placeholder := "{" + pattern.Name + "}"
+		check(placeholderPattern.FindString(placeholder) == placeholder, "pii pattern name %q must be letters, digits and underscores", pattern.Name)
+		_, err := regexp.Compile(pattern.Pattern)
+		check(err == nil, "pii pattern %s: %q is not a valid regular expression", pattern.Name, pattern.Pattern)
+	}
+	check(c.Profanity.Attempts >= 0 && c.Profanity.Attempts <= 5, "profanity.attempts must be between 0 and 5")
+	check(len(c.Profanity.Lists) > 0 || !c.Profanity.Strict, "profanity.strict needs profanity.lists")
+	check(slices.Contains([]string{"", injectionFlag, injectionSanitize, injectionReject}, c.Injection.Action), "injection.action must be flag, sanitize or reject, not %q", c.Injection.Action)
+	for _, pattern := range c.Injection.Patterns {
+		_, err := regexp.Compile(pattern)
+		check(err == nil, "injection.patterns: %q is not a valid regular expression", pattern)
+	}
+	check(c.Candidates.Max >= 1, "candidates.max must be at least 1")
+	for _, temperature := range c.Candidates.Temperatures {
+		check(temperature >= 0 && temperature <= 2, "candidates.temperatures must be between 0 and 2")
+	}
+	weights := c.Candidates.Weights
+	check(weights.Length >= 0 && weights.Readability >= 0 && weights.Banned >= 0, "candidates.weights must not be negative")
+	check(c.Language.Mode == languageInstruct || c.Language.Mode == languageTranslate, "language.mode must be instruct or translate, not %q", c.Language.Mode)
+	check(c.Language.Translator == "" || providerFactories[c.Language.Translator] != nil, "language.translator: provider %q is unknown", c.Language.Translator)
+	check(slices.Contains([]string{"", "model", "languagetool"}, c.Proofread.Backend), "proofread.backend must be model or languagetool, not %q", c.Proofread.Backend)
+	check(c.Proofread.Provider == "" || providerFactories[c.Proofread.Provider] != nil, "proofread.provider %q is unknown", c.Proofread.Provider)
+	if c.Proofread.URL != "" {
+		_, err := url.Parse(c.Proofread.URL)
+		check(err == nil, "proofread.url is not a valid URL: %v", err)
+	}
+	check(c.Phone.DefaultRegion == "" || phonenumbers.GetSupportedRegions()[strings.ToUpper(c.Phone.DefaultRegion)], "unknown phone.default_region %q", c.Phone.DefaultRegion)
+	if c.SMPP.Addr != "" {
+		check(c.Twilio.AccountSID == "", "only one of twilio and smpp can be configured")
+		_, _, err := net.SplitHostPort(c.SMPP.Addr)
+		check(err == nil, "invalid smpp.addr: %v", err)
+		check(c.SMPP.SystemID != "", "smpp.system_id is required")
+		check(c.SMPP.SourceAddr != "", "smpp.source_addr is required")
+		check(c.SMPP.EnquireLink > 0, "smpp.enquire_link must be positive")
+		check(c.SMPP.Timeout > 0, "smpp.timeout must be positive")
+	}
+	for letter, latin := range c.Transliteration {
+		check(utf8.RuneCountInString(letter) == 1 && strings.ToLower(letter) == letter, "transliteration keys must be single lowercase letters, not %q", letter)
+		encoding, _ := smsLength(latin)
+		check(encoding == encodingGSM7, "transliteration of %q must be GSM-7 text", letter)
+	}
+	check(c.Batch.MaxItems >= 1, "batch.max_items must be at least 1")
+	check(c.Batch.Concurrency >= 1, "batch.concurrency must be at least 1")
+	check(c.Cache.TTL > 0, "cache.ttl must be positive")
+	check(c.Cache.MaxEntries >= 1, "cache.max_entries must be at least 1")
+	check(c.Cache.Backend == "memory" || c.Cache.Backend == "redis", "cache.backend must be memory or redis")
+	if c.Cache.Backend == "redis" {
+		check(c.Cache.Redis.Addr != "", "cache.redis.addr is required")
+		check(c.Cache.Redis.Timeout > 0, "cache.redis.timeout must be positive")
+	}
+	check(c.Limits.MaxBodyBytes >= 0, "limits.max_body_bytes must not be negative")
+	check(c.Limits.MaxPromptChars >= 0, "limits.max_prompt_chars must not be negative")
+	check(c.Limits.MaxPromptTokens >= 0, "limits.max_prompt_tokens must not be negative")
+	check(c.Health.CacheTTL >= 0, "health.cache_ttl must not be negative")
+	check(c.Timeouts.Dial > 0, "timeouts.dial must be positive")
+	check(c.Timeouts.TLSHandshake > 0, "timeouts.tls_handshake must be positive")
+	check(c.Timeouts.ResponseHeader > 0, "timeouts.response_header must be positive")
+	check(c.Timeouts.Request > 0, "timeouts.request must be positive")
+	check(c.Timeouts.Handler > 0, "timeouts.handler must be positive")
+	check(c.Timeouts.Handler > c.Polling.MaxWait, "timeouts.handler must be longer than polling.max_wait")
+	check(c.Timeouts.ReadHeader > 0, "timeouts.read_header must be positive")
+	check(c.Timeouts.Idle > 0, "timeouts.idle must be positive")
+	if c.Hedge.Provider != "" {
+		check(providerFactories[c.Hedge.Provider] != nil, "hedge.provider %q is unknown", c.Hedge.Provider)
+	}
+	check(c.Hedge.Delay > 0, "hedge.delay must be positive")
+	check(c.Auth.KeysFile != "", "auth.keys_file is required")
+	check(c.Auth.HMAC.Tolerance > 0, "auth.hmac.tolerance must be positive")
+	for client, secret := range c.Auth.HMAC.Clients {
+		check(secret != "", "auth.hmac.clients.%s must name the secret holding its key", client)
+	}
+	for _, list := range []struct {
+		name    string
+		entries IPList
+	}{
+		{"ip_access.trusted_proxies", c.IPAccess.TrustedProxies},
+		{"ip_access.generation.allow", c.IPAccess.Generation.Allow},
+		{"ip_access.generation.deny", c.IPAccess.Generation.Deny},
+		{"ip_access.admin.allow", c.IPAccess.Admin.Allow},
+		{"ip_access.admin.deny", c.IPAccess.Admin.Deny},
+	} {
+		for _, entry := range list.entries {
+			_, err := parseIPEntry(entry)
+			check(err == nil, "%s: %q is not an IP address or CIDR range", list.name, entry)
+		}
+	}
+	check(c.RateLimit.RequestsPerMinute >= 0, "rate_limit.requests_per_minute must not be negative")
+	check(c.RateLimit.Burst >= 1, "rate_limit.burst must be at least 1")
+	if c.Auth.JWT.Issuer != "" {
+		check(c.Auth.JWT.Audience != "", "auth.jwt.audience is required with auth.jwt.issuer")
+	}
+	if c.Auth.JWT.JWKSURL != "" {
+		check(c.Auth.JWT.Issuer != "", "auth.jwt.issuer is required with auth.jwt.jwks_url")
+	}
+	check(c.Tracing.ServiceName != "", "tracing.service_name is required")
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio must be between 0 and 1")
+	for _, name := range c.Tracing.Propagate {
+		check(providerFactories[name] != nil, "tracing.propagate: provider %q is unknown", name)
+	}
+	validateModels(c.Models, check)
+	validatePresets(c.Presets, check)
+	for name, snippet := range c.Tones {
+		check(strings.TrimSpace(snippet) != "", "tones.%s is empty", name)
+	}
+	for name, snippet := range c.Personas {
+		check(strings.TrimSpace(snippet) != "", "personas.%s is empty", name)
+	}
+	for name, preset := range c.Presets {
+		_, ok := c.Tones[preset.Tone]
+		check(preset.Tone == "" || ok, "preset %s: tone %q is unknown", name, preset.Tone)
+		_, ok = c.Personas[preset.Persona]
+		check(preset.Persona == "" || ok, "preset %s: persona %q is unknown", name, preset.Persona)
+	}
+	if c.Proxy != "" {
+		_, err := url.Parse(c.Proxy)
+		check(err == nil, "proxy is not a valid URL: %v", err)
+	}
+	for name, proxy := range c.ProviderProxies {
+		check(providerFactories[name] != nil, "provider_proxies: provider %q is unknown", name)
+		if proxy != directProxy {
+			_, err := url.Parse(proxy)
+			check(err == nil && proxy != "", "provider_proxies.%s must be %q or a proxy URL", name, directProxy)
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+
+	return nil
+}
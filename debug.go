@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/netip"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// registerRuntimeMetrics replaces the default Go collector with one that
+// also exports the runtime/metrics GC, memory and scheduler series.
+func registerRuntimeMetrics() {
+	prometheus.Unregister(collectors.NewGoCollector())
+	prometheus.MustRegister(collectors.NewGoCollector(
+		collectors.WithGoCollectorRuntimeMetrics(collectors.GoRuntimeMetricsRule{Matcher: regexp.MustCompile(`^/(gc|memory|sched)/.*`)}),
+	))
+}
+
+// metricsHandler serves the Prometheus metrics. When METRICS_TOKEN or
+// METRICS_USERNAME and METRICS_PASSWORD are set, scrapers must present the
+// token as a bearer token or the credentials with basic auth. Without
+// either, metrics are only served on loopback listeners.
+func metricsHandler() http.Handler {
+	next := promhttp.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := os.Getenv("METRICS_TOKEN")
+		username, password := os.Getenv("METRICS_USERNAME"), os.Getenv("METRICS_PASSWORD")
+		if token == "" && username == "" {
+			if !loopbackListener(r) {
+				http.Error(w, "Metrics need METRICS_TOKEN or METRICS_USERNAME and METRICS_PASSWORD off loopback", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && token != "" {
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if givenUser, givenPassword, ok := r.BasicAuth(); ok && username != "" {
+			userOK := subtle.ConstantTimeCompare([]byte(givenUser), []byte(username)) == 1
+			passwordOK := subtle.ConstantTimeCompare([]byte(givenPassword), []byte(password)) == 1
+			if userOK && passwordOK {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		if username != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// loopbackListener reports whether r came in on a loopback address, which
+// only the host itself can reach.
+func loopbackListener(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.Unmap().IsLoopback()
+}
+
+// registerPprof adds the net/http/pprof handlers to mux behind the admin
+// token. Importing net/http/pprof also registers them on
+// http.DefaultServeMux, which is why no server uses it.
+func registerPprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", requireAdmin(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", requireAdmin(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", requireAdmin(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", requireAdmin(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", requireAdmin(pprof.Trace))
+}
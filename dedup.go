@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var dedupHitCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "ai_sms_dedup_hits_total",
+	Help: "The total number of requests served by joining an identical in-flight generation",
+})
+
+// sharedGeneration is a generation identical concurrent requests wait on.
+// waiters counts the requests still waiting; when the last one goes away
+// the generation is cancelled.
+type sharedGeneration struct {
+	done     chan struct{}
+	response Response
+	err      error
+	waiters  int
+	cancel   context.CancelFunc
+}
+
+var (
+	// inFlightGenerations collapses identical concurrent generations, by
+	// dedup key.
+	inFlightGenerations   = map[string]*sharedGeneration{}
+	inFlightGenerationsMu sync.Mutex
+)
+
+// generateShared is generate for callers that can share the result with
+// identical concurrent requests, such as OTP templates sent by many clients
+// at once. The shared call runs detached from the first caller, so it is not
+// cancelled when that caller goes away while others still wait; it is when
+// every caller has gone away.
+func generateShared(ctx context.Context, provider Provider, request Request) (Response, error) {
+	if !currentConfig().Dedup {
+		return generate(ctx, provider, request)
+	}
+
+	key, err := dedupKey(provider, request)
+	if err != nil {
+		return generate(ctx, provider, request)
+	}
+
+	inFlightGenerationsMu.Lock()
+	call, ok := inFlightGenerations[key]
+	if ok {
+		dedupHitCounter.Inc()
+	} else {
+		callCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), currentConfig().Timeouts.Handler)
+		call = &sharedGeneration{done: make(chan struct{}), cancel: cancel}
+		inFlightGenerations[key] = call
+		go func() {
+			defer cancel()
+			call.response, call.err = generate(callCtx, provider, request)
+			inFlightGenerationsMu.Lock()
+			if inFlightGenerations[key] == call {
+				delete(inFlightGenerations, key)
+			}
+			inFlightGenerationsMu.Unlock()
+			close(call.done)
+		}()
+	}
+	call.waiters++
+	inFlightGenerationsMu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.response, call.err
+	case <-ctx.Done():
+		inFlightGenerationsMu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			// Nobody is left to share the result: cancel the upstream
+			// generation, and have new requests start their own
+			call.cancel()
+			if inFlightGenerations[key] == call {
+				delete(inFlightGenerations, key)
+			}
+		}
+		inFlightGenerationsMu.Unlock()
+		return Response{}, ctx.Err()
+	}
+}
+
+// dedupKey identifies a generation by its provider and every request field
+// that affects the output. It is also the generation cache key.
+func dedupKey(provider Provider, request Request) (string, error) {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+
+	return fmt.Sprintf("%T/%s/%s", provider, provider.Name(), hex.EncodeToString(sum[:])), nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var generationErrorCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ai_sms_generation_errors_total",
+	Help: "The total number of failed generations by provider and error class",
+}, []string{"provider", "class"})
+
+// statusError is an error response from an upstream API.
+type statusError struct {
+	StatusCode int
+	Message    string
+}
+
+func newStatusError(status int, format string, args ...interface{}) *statusError {
+	return &statusError{StatusCode: status, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *statusError) Error() string {
+	return e.Message
+}
+
+// errorStatus returns the upstream status code behind err, 200 for nil and 0
+// if the request never got a response.
+func errorStatus(err error) int {
+	if err == nil {
+		return 200
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.StatusCode
+	}
+	return 0
+}
+
+// classifiedError is implemented by errors that name their own class, such
+// as generations blocked by content checks.
+type classifiedError interface {
+	error
+	errorClass() string
+}
+
+// errorClass sorts a generation error into a class for the error counter.
+func errorClass(err error) string {
+	var classified classifiedError
+	var status *statusError
+	var timeout *predictionTimeoutError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var netErr net.Error
+	var unavailable unavailableError
+	switch {
+	case errors.As(err, &classified):
+		return classified.errorClass()
+	case errors.Is(err, context.Canceled):
+		return "cancelled"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &timeout):
+		return "timeout"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &unavailable):
+		return unavailable.Code()
+	case errors.As(err, &status) && status.StatusCode >= 500:
+		return "upstream_5xx"
+	case errors.As(err, &status) && status.StatusCode >= 400:
+		return "upstream_4xx"
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return "unmarshal"
+	case errors.As(err, &netErr):
+		return "network"
+	}
+	return "other"
+}
+
+// generationErrorMessage is what clients are told about a failed
+// generation outside an HTTP status: why to come back later, or a generic
+// message. The details, which may name upstream hosts, are only logged.
+func generationErrorMessage(err error) string {
+	if unavailable, ok := asUnavailable(err); ok {
+		return unavailable.Error()
+	}
+	var placeholders *placeholderError
+	if errors.As(err, &placeholders) {
+		return placeholders.Error()
+	}
+	var wrongLanguage *languageError
+	if errors.As(err, &wrongLanguage) {
+		return wrongLanguage.Error()
+	}
+	var blocked *moderationError
+	if errors.As(err, &blocked) {
+		return blocked.Error()
+	}
+	return "Error getting AI SMS content"
+}
+
+// isTransientError reports whether a generation failed for a reason that
+// may go away on its own, so retrying later can succeed.
+func isTransientError(err error) bool {
+	if _, ok := asUnavailable(err); ok {
+		return true
+	}
+	if errorStatus(err) == 429 {
+		return true
+	}
+	switch errorClass(err) {
+	case "timeout", "upstream_5xx", "network":
+		return true
+	}
+	return false
+}
+
+// countGenerationError records a failed generation.
+func countGenerationError(provider string, err error) {
+	generationErrorCounter.WithLabelValues(provider, errorClass(err)).Inc()
+}
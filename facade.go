@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type OpenAIChunkChoice struct {
+	Index        int           `json:"index"`
+	Delta        OpenAIMessage `json:"delta"`
+	FinishReason *string       `json:"finish_reason"`
+}
+
+type OpenAIChatChunk struct {
+	ID      string              `json:"id"`
+	Object  string              `json:"object"`
+	Created int64               `json:"created"`
+	Model   string              `json:"model"`
+	Choices []OpenAIChunkChoice `json:"choices"`
+}
+
+// handleChatCompletions serves the OpenAI chat-completions wire format on top
+// of the provider layer. The model may be a configured model name,
+// "provider" or "provider/model" to pick a backend; any other value uses the
+// default provider.
+func handleChatCompletions(w http.ResponseWriter, r *http.Request, providers *providerSet, logger *slog.Logger) {
+	var chatRequest struct {
+		OpenAIChatRequest
+		Stream bool `json:"stream"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&chatRequest)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeOpenAIError(w, http.StatusRequestEntityTooLarge, "invalid_request_error", fmt.Sprintf("Request body is over the limit of %d bytes", tooLarge.Limit))
+		return
+	}
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "Invalid JSON body: "+err.Error())
+		return
+	}
+	requestCounter.Inc()
+
+	request, err := newRequestFromMessages(chatRequest.Messages)
+	if err == nil {
+		err = screenMessages(&request)
+	}
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	err = checkPromptSize(request)
+	if err != nil {
+		writeOpenAIError(w, http.StatusUnprocessableEntity, "invalid_request_error", err.Error())
+		return
+	}
+	providerName, model := "", chatRequest.Model
+	if name, rest, _ := strings.Cut(chatRequest.Model, "/"); providerFactories[name] != nil {
+		providerName, model = name, rest
+	} else if _, ok := currentConfig().Models[model]; !ok {
+		model = ""
+	}
+	request.Model = model
+	provider, err := selectProvider(providers, providerName, &request)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	// Explicit sampling parameters win over the named model defaults
+	if chatRequest.Temperature != nil {
+		request.Temperature = chatRequest.Temperature
+	}
+	if chatRequest.TopP != nil {
+		request.TopP = chatRequest.TopP
+	}
+	if chatRequest.MaxTokens > 0 {
+		request.MaxTokens = chatRequest.MaxTokens
+	}
+	request.Seed = chatRequest.Seed
+	err = applySampling(Sampling{StopSequences: chatRequest.Stop}, &request)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	addLogFields(r.Context(), "prompt_hash", promptHash(request.Prompt), "provider", provider.Name())
+	logger.InfoContext(r.Context(), "Received chat completions request", "prompt", request.Prompt)
+	_, err = moderate(r.Context(), moderationPrompt, request.Prompt, logger)
+	if err != nil {
+		writeModerationError(w, r, err, logger)
+		return
+	}
+
+	id := "chatcmpl-" + strings.ReplaceAll(newUUID(), "-", "")
+	created := time.Now().Unix()
+
+	start := time.Now()
+	if !chatRequest.Stream {
+		response, err := generateCached(r.Context(), provider, request)
+		recordGeneration(r.Context(), provider, request, response, start, err)
+		if err != nil {
+			logger.ErrorContext(r.Context(), "Error getting AI SMS content", "error", err)
+			writeGenerateError(w, err)
+			return
+		}
+		addLogFields(r.Context(), "provider", response.Provider, "model", response.Model)
+		response = filterProfanity(r.Context(), provider, request, response, logger)
+		_, err = moderate(r.Context(), moderationOutput, response.Text, logger)
+		if err != nil {
+			writeModerationError(w, r, err, logger)
+			return
+		}
+
+		chatResponse := OpenAIChatResponse{
+			ID:      id,
+			Object:  "chat.completion",
+			Created: created,
+			Model:   response.Model,
+			Choices: []OpenAIChatChoice{{
+				Message:      OpenAIMessage{Role: "assistant", Content: response.Text},
+				FinishReason: "stop",
+			}},
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(chatResponse)
+		if err != nil {
+			logger.ErrorContext(r.Context(), "Error encoding chat completions response", "error", err)
+		}
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeOpenAIError(w, http.StatusInternalServerError, "api_error", "Streaming is not supported")
+		return
+	}
+	started := false
+	writeChunk := func(delta OpenAIMessage, finishReason *string) error {
+		if !started {
+			started = true
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("Connection", "keep-alive")
+		}
+		chunk := OpenAIChatChunk{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   chatRequest.Model,
+			Choices: []OpenAIChunkChoice{{Delta: delta, FinishReason: finishReason}},
+		}
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+		if err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	// Providers without streaming support answer in a single chunk
+	onToken := func(token string) error {
+		return writeChunk(OpenAIMessage{Content: token}, nil)
+	}
+	var response Response
+	if streamer, ok := provider.(StreamingProvider); ok {
+		response, err = generateStream(r.Context(), streamer, request, onToken)
+	} else {
+		response, err = generate(r.Context(), provider, request)
+		if err == nil {
+			response = filterProfanity(r.Context(), provider, request, response, logger)
+			err = onToken(response.Text)
+		}
+	}
+	recordGeneration(r.Context(), provider, request, response, start, err)
+	if err != nil {
+		if r.Context().Err() != nil {
+			return
+		}
+		logger.ErrorContext(r.Context(), "Error streaming AI SMS content", "error", err)
+		if !started {
+			writeGenerateError(w, err)
+		}
+		return
+	}
+
+	// The text was streamed already, so a blocked one, or one with
+	// profanity, can only be marked as filtered, the way OpenAI does
+	stop := "stop"
+	_, err = moderate(r.Context(), moderationOutput, response.Text, logger)
+	if err != nil {
+		logger.WarnContext(r.Context(), "Streamed text failed moderation", "error", err)
+		stop = "content_filter"
+	}
+	if language, found := profanity.find(response.Text); found {
+		logger.WarnContext(r.Context(), "Streamed text has profanity", "language", language)
+		stop = "content_filter"
+	}
+	writeChunk(OpenAIMessage{}, &stop)
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	flusher.Flush()
+}
+
+// screenMessages screens the user messages of request, the earlier ones
+// too, for prompt injections, as screenPrompt does client prompts.
+func screenMessages(request *Request) error {
+	var err error
+	for i := range request.History {
+		request.History[i].User, err = screenPrompt(request.History[i].User)
+		if err != nil {
+			return err
+		}
+	}
+	request.Prompt, err = screenPrompt(request.Prompt)
+	return err
+}
+
+// newRequestFromMessages turns a chat transcript into a provider request:
+// system messages become the system prompt, earlier user/assistant pairs the
+// history and the final user message the prompt.
+func newRequestFromMessages(messages []OpenAIMessage) (Request, error) {
+	var request Request
+	var system []string
+	var pending []string
+	for _, message := range messages {
+		switch message.Role {
+		case "system", "developer":
+			system = append(system, message.Content)
+		case "user":
+			pending = append(pending, message.Content)
+		case "assistant":
+			request.History = append(request.History, Turn{User: strings.Join(pending, "\n"), Assistant: message.Content})
+			pending = nil
+		default:
+			return Request{}, fmt.Errorf("unsupported message role %q", message.Role)
+		}
+	}
+	if len(pending) == 0 {
+		return Request{}, errors.New("the last message must be from the user")
+	}
+	request.System = strings.Join(system, "\n")
+	request.Prompt = strings.Join(pending, "\n")
+
+	return request, nil
+}
+
+// writeGenerateError reports a failed generation, telling clients when to
+// come back if the service is temporarily unavailable.
+func writeGenerateError(w http.ResponseWriter, err error) {
+	if unavailable, ok := asUnavailable(err); ok {
+		var errorResponse OpenAIErrorResponse
+		errorResponse.Error.Type = "api_error"
+		if unavailable.StatusCode() == http.StatusTooManyRequests {
+			errorResponse.Error.Type = "rate_limit_error"
+		}
+		errorResponse.Error.Code = unavailable.Code()
+		errorResponse.Error.Message = unavailable.Error()
+
+		writeRetryAfter(w, unavailable.RetryAfter())
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(unavailable.StatusCode())
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+	writeOpenAIError(w, http.StatusBadGateway, "api_error", "Error getting AI SMS content")
+}
+
+// writeModerationError answers a generation blocked by moderation with
+// the blocked response, or one whose moderation failed like a failed
+// generation.
+func writeModerationError(w http.ResponseWriter, r *http.Request, err error, logger *slog.Logger) {
+	var blocked *moderationError
+	if errors.As(err, &blocked) {
+		writeBlocked(w, blocked)
+		return
+	}
+	logger.ErrorContext(r.Context(), "Error moderating text", "error", err)
+	writeGenerateError(w, err)
+}
+
+func writeOpenAIError(w http.ResponseWriter, status int, errorType, message string) {
+	var errorResponse OpenAIErrorResponse
+	errorResponse.Error.Type = errorType
+	errorResponse.Error.Message = message
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse)
+}
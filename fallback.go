@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var fallbackCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ai_sms_provider_fallbacks_total",
+	Help: "The total number of requests handed to the next provider of the fallback chain",
+}, []string{"from", "to"})
+
+// fallbackChain tries the providers of the configured fallback list in
+// order until one succeeds. A model requested for the first provider is not
+// passed on, since model names are provider-specific.
+type fallbackChain struct {
+	providers *providerSet
+	names     []string
+}
+
+func (c *fallbackChain) Name() string {
+	return strings.Join(c.names, ",")
+}
+
+func (c *fallbackChain) Generate(ctx context.Context, request Request) (Response, error) {
+	return c.run(ctx, request, func(provider Provider, request Request) (Response, bool, error) {
+		response, err := generate(ctx, provider, request)
+		return response, false, err
+	})
+}
+
+// GenerateStream falls back only while no token has been sent to the
+// client yet. Providers without streaming support answer in one chunk.
+func (c *fallbackChain) GenerateStream(ctx context.Context, request Request, onToken func(token string) error) (Response, error) {
+	return c.run(ctx, request, func(provider Provider, request Request) (Response, bool, error) {
+		streamer, ok := provider.(StreamingProvider)
+		if !ok {
+			response, err := generate(ctx, provider, request)
+			if err != nil {
+				return response, false, err
+			}
+			return response, true, onToken(response.Text)
+		}
+
+		sent := false
+		response, err := generateStream(ctx, streamer, request, func(token string) error {
+			sent = true
+			return onToken(token)
+		})
+		return response, sent, err
+	})
+}
+
+// run calls attempt for every provider in turn. attempt reports whether
+// output already reached the client, which rules out falling back.
+func (c *fallbackChain) run(ctx context.Context, request Request, attempt func(Provider, Request) (Response, bool, error)) (Response, error) {
+	var errs []error
+	previous := ""
+	for i, name := range c.names {
+		provider, err := c.providers.get(name)
+		if err != nil {
+			c.providers.logger.WarnContext(ctx, "Skipping provider in fallback chain", "provider", name, "error", err)
+			errs = append(errs, err)
+			continue
+		}
+		if previous != "" {
+			fallbackCounter.WithLabelValues(previous, name).Inc()
+		}
+		if i > 0 {
+			request.Model = ""
+			request.Version = ""
+		}
+
+		response, sent, err := attempt(provider, request)
+		if err == nil || sent || ctx.Err() != nil {
+			return response, err
+		}
+		c.providers.logger.WarnContext(ctx, "Provider failed, trying the next one in the fallback chain", "provider", name, "error", err)
+		errs = append(errs, err)
+		previous = name
+	}
+
+	return Response{}, errors.Join(errs...)
+}
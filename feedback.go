@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// maxFeedbackCommentChars bounds the free-text comment of a rating.
+const maxFeedbackCommentChars = 2000
+
+var feedbackCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ai_sms_feedback_total",
+	Help: "The total number of ratings given to generated texts, by preset, model and rating (up or down)",
+}, []string{"preset", "model", "rating"})
+
+// Feedback is a client's rating of a generated text.
+type Feedback struct {
+	// Rating is "up" or "down"
+	Rating    string    `json:"rating"`
+	Comment   string    `json:"comment,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// FeedbackStats is the feedback on the generations of one preset and
+// model. Generations counts them all, rated or not.
+type FeedbackStats struct {
+	Preset      string `json:"preset"`
+	Model       string `json:"model"`
+	Generations int64  `json:"generations"`
+	Up          int64  `json:"up"`
+	Down        int64  `json:"down"`
+}
+
+// handleFeedback rates a recorded generation. Callers can only rate their
+// own generations, anonymous ones anonymous generations; a new rating
+// replaces the previous one.
+func handleFeedback(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	if history == nil {
+		http.Error(w, "Generation history is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	var feedback Feedback
+	err := json.NewDecoder(r.Body).Decode(&feedback)
+	if err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	feedback.Rating = strings.ToLower(feedback.Rating)
+	if feedback.Rating != "up" && feedback.Rating != "down" {
+		http.Error(w, "rating must be up or down", http.StatusBadRequest)
+		return
+	}
+	feedback.Comment = strings.TrimSpace(feedback.Comment)
+	if utf8.RuneCountInString(feedback.Comment) > maxFeedbackCommentChars {
+		http.Error(w, "comment is too long", http.StatusBadRequest)
+		return
+	}
+	feedback.CreatedAt = time.Now().UTC()
+
+	id := r.PathValue("id")
+	generation, found, err := history.store.Get(r.Context(), id)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error reading generation", "error", err)
+		http.Error(w, "Error reading generation", http.StatusInternalServerError)
+		return
+	}
+	if caller, _ := callerFrom(r.Context()); found && generation.Caller != caller.ID {
+		found = false
+	}
+	if found {
+		found, err = history.store.SetFeedback(r.Context(), id, feedback)
+		if err != nil {
+			logger.ErrorContext(r.Context(), "Error saving feedback", "error", err)
+			http.Error(w, "Error saving feedback", http.StatusInternalServerError)
+			return
+		}
+	}
+	if !found {
+		// A generation still in the write queue is not found either
+		http.Error(w, "Generation not found", http.StatusNotFound)
+		return
+	}
+	feedbackCounter.WithLabelValues(generation.Preset, generation.Model, feedback.Rating).Inc()
+	logger.InfoContext(r.Context(), "Generation rated", "generation", id, "rating", feedback.Rating)
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(feedback)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error encoding feedback", "error", err)
+	}
+}
+
+// handleFeedbackStats aggregates the feedback per preset and model over
+// the generations matching the history filters.
+func handleFeedbackStats(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	if history == nil {
+		http.Error(w, "Generation history is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	filter, err := parseGenerationFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stats, err := history.store.FeedbackStats(r.Context(), filter)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error aggregating feedback", "error", err)
+		http.Error(w, "Error aggregating feedback", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string]any{"stats": stats})
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error encoding feedback stats", "error", err)
+	}
+}
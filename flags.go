@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"os"
+)
+
+// cliFlags holds the command-line overrides for the config file.
+type cliFlags struct {
+	configFile  string
+	addr        string
+	metricsAddr string
+	logFile     string
+	staticDir   string
+}
+
+func parseFlags() *cliFlags {
+	f := &cliFlags{}
+	flag.StringVar(&f.configFile, "config", "", "path to the config file (default $CONFIG_FILE or "+defaultConfigFile+")")
+	flag.StringVar(&f.addr, "addr", "", "web server listen address, overrides server.addr")
+	flag.StringVar(&f.metricsAddr, "metrics-addr", "", "metrics server listen address, overrides server.metrics_addr")
+	flag.StringVar(&f.logFile, "log-file", "", "log file path, overrides server.log_file")
+	flag.StringVar(&f.staticDir, "static-dir", "", "directory with index.html and other static assets, overrides server.static_dir")
+	flag.Parse()
+
+	if f.configFile == "" {
+		f.configFile = os.Getenv("CONFIG_FILE")
+	}
+
+	return f
+}
+
+// configPath returns the config file to load and whether it must exist.
+func (f *cliFlags) configPath() (string, bool) {
+	if f.configFile != "" {
+		return f.configFile, true
+	}
+
+	return defaultConfigFile, false
+}
+
+// apply overrides the config with the flags that were set.
+func (f *cliFlags) apply(config *Config) {
+	if f.addr != "" {
+		config.Server.Addr = f.addr
+	}
+	if f.metricsAddr != "" {
+		config.Server.MetricsAddr = f.metricsAddr
+	}
+	if f.logFile != "" {
+		config.Server.LogFile = f.logFile
+	}
+	if f.staticDir != "" {
+		config.Server.StaticDir = f.staticDir
+	}
+}
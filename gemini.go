@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultGeminiBaseURL = "https://generativelanguage.googleapis.com/v1beta"
+	defaultGeminiModel   = "gemini-1.5-flash"
+	googleCloudScope     = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+type GeminiPart struct {
+	Text string `json:"text"`
+}
+
+type GeminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []GeminiPart `json:"parts"`
+}
+
+type GeminiGenerationConfig struct {
+	Temperature     *float64 `json:"temperature,omitempty"`
+	TopP            *float64 `json:"topP,omitempty"`
+	MaxOutputTokens int      `json:"maxOutputTokens,omitempty"`
+	Seed            *int64   `json:"seed,omitempty"`
+	StopSequences   []string `json:"stopSequences,omitempty"`
+	// Extra are merged into the generation config, such as topK
+	Extra map[string]any `json:"-"`
+}
+
+func (c GeminiGenerationConfig) MarshalJSON() ([]byte, error) {
+	type plain GeminiGenerationConfig
+	return withExtra(plain(c), c.Extra)
+}
+
+type GeminiSafetySetting struct {
+	Category  string `json:"category"`
+	Threshold string `json:"threshold"`
+}
+
+type GeminiRequest struct {
+	Contents          []GeminiContent        `json:"contents"`
+	SystemInstruction *GeminiContent         `json:"systemInstruction,omitempty"`
+	GenerationConfig  GeminiGenerationConfig `json:"generationConfig"`
+	SafetySettings    []GeminiSafetySetting  `json:"safetySettings,omitempty"`
+}
+
+type GeminiResponse struct {
+	Candidates []struct {
+		Content      GeminiContent `json:"content"`
+		FinishReason string        `json:"finishReason"`
+	} `json:"candidates"`
+	PromptFeedback struct {
+		BlockReason string `json:"blockReason"`
+	} `json:"promptFeedback"`
+	UsageMetadata struct {
+		PromptTokenCount     int `json:"promptTokenCount"`
+		CandidatesTokenCount int `json:"candidatesTokenCount"`
+	} `json:"usageMetadata"`
+	ModelVersion string `json:"modelVersion"`
+}
+
+type GeminiErrorResponse struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+	} `json:"error"`
+}
+
+// geminiProvider talks to either the Generative Language API (API key) or
+// Vertex AI (service account), which share the same request format.
+type geminiProvider struct {
+	client         *http.Client
+	logger         *slog.Logger
+	baseURL        string
+	apiKey         string
+	accessToken    *cachedToken
+	model          string
+	safetySettings []GeminiSafetySetting
+}
+
+func init() {
+	registerProvider("gemini", func(logger *slog.Logger) (Provider, error) {
+		client, err := newProviderClient("gemini", logger)
+		if err != nil {
+			return nil, err
+		}
+
+		p := &geminiProvider{
+			client: client,
+			logger: logger,
+			model:  getEnv("GEMINI_MODEL", defaultGeminiModel),
+		}
+
+		if value := os.Getenv("GEMINI_SAFETY_SETTINGS"); value != "" {
+			err = json.Unmarshal([]byte(value), &p.safetySettings)
+			if err != nil {
+				return nil, fmt.Errorf("invalid GEMINI_SAFETY_SETTINGS: %v", err)
+			}
+		}
+
+		if project := os.Getenv("VERTEX_PROJECT"); project != "" {
+			location := getEnv("VERTEX_LOCATION", "us-central1")
+			credentialsFile := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+			if credentialsFile == "" {
+				return nil, errors.New("GOOGLE_APPLICATION_CREDENTIALS must be set for Vertex AI")
+			}
+			account, err := loadGoogleServiceAccount(credentialsFile)
+			if err != nil {
+				return nil, err
+			}
+			p.baseURL = fmt.Sprintf("https://%s-aiplatform.googleapis.com/v1/projects/%s/locations/%s/publishers/google",
+				location, url.PathEscape(project), location)
+			p.accessToken = newCachedToken(func(ctx context.Context) (string, time.Time, error) {
+				return fetchGoogleAccessToken(ctx, client, account)
+			})
+			return p, nil
+		}
+
+		p.apiKey, err = lookupSecret("GEMINI_API_KEY")
+		if err != nil {
+			return nil, err
+		}
+		if p.apiKey == "" {
+			return nil, errors.New("set GEMINI_API_KEY, or VERTEX_PROJECT and GOOGLE_APPLICATION_CREDENTIALS")
+		}
+		p.baseURL = strings.TrimSuffix(getEnv("GEMINI_BASE_URL", defaultGeminiBaseURL), "/")
+
+		return p, nil
+	})
+}
+
+func (p *geminiProvider) Name() string {
+	return "gemini"
+}
+
+func (p *geminiProvider) Generate(ctx context.Context, request Request) (Response, error) {
+	resp, err := p.call(ctx, request, "generateContent", nil)
+	if err != nil {
+		return Response{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		p.logger.ErrorContext(ctx, "Error reading Gemini response", "error", err)
+		return Response{}, err
+	}
+	p.logger.DebugContext(ctx, "Gemini response", "body", string(body))
+
+	var geminiResponse GeminiResponse
+	err = json.Unmarshal(body, &geminiResponse)
+	if err != nil {
+		p.logger.ErrorContext(ctx, "Error unmarshaling Gemini response", "error", err)
+		return Response{}, err
+	}
+	text, err := geminiText(&geminiResponse)
+	if err != nil {
+		return Response{}, err
+	}
+
+	return Response{
+		Text:     strings.TrimSpace(text),
+		Provider: p.Name(),
+		Model:    request.modelOr(p.model),
+		Usage:    geminiResponse.usage(),
+	}, nil
+}
+
+func (p *geminiProvider) GenerateStream(ctx context.Context, request Request, onToken func(token string) error) (Response, error) {
+	resp, err := p.call(ctx, request, "streamGenerateContent", url.Values{"alt": {"sse"}})
+	if err != nil {
+		return Response{}, err
+	}
+	defer resp.Body.Close()
+
+	var text strings.Builder
+	var usage Usage
+	err = readSSE(resp.Body, func(event, data string) error {
+		var chunk GeminiResponse
+		err := json.Unmarshal([]byte(data), &chunk)
+		if err != nil {
+			return err
+		}
+		// Every chunk carries the running totals
+		if chunk.UsageMetadata.CandidatesTokenCount > 0 {
+			usage = chunk.usage()
+		}
+		token, err := geminiText(&chunk)
+		if err != nil {
+			return err
+		}
+		if token == "" {
+			return nil
+		}
+		text.WriteString(token)
+		return onToken(token)
+	})
+	if err != nil {
+		return Response{}, err
+	}
+
+	return Response{
+		Text:     strings.TrimSpace(text.String()),
+		Provider: p.Name(),
+		Model:    request.modelOr(p.model),
+		Usage:    usage,
+	}, nil
+}
+
+// call sends request to the given model method and returns the successful
+// response. The caller closes the body.
+func (p *geminiProvider) call(ctx context.Context, request Request, method string, query url.Values) (*http.Response, error) {
+	geminiRequest := GeminiRequest{
+		GenerationConfig: GeminiGenerationConfig{
+			Temperature:     request.Temperature,
+			TopP:            request.TopP,
+			MaxOutputTokens: request.MaxTokens,
+			Seed:            request.Seed,
+			StopSequences:   request.StopSequences,
+			Extra:           request.Extra,
+		},
+		SafetySettings: p.safetySettings,
+	}
+	if request.System != "" {
+		geminiRequest.SystemInstruction = &GeminiContent{Parts: []GeminiPart{{Text: request.System}}}
+	}
+	for _, turn := range request.History {
+		geminiRequest.Contents = append(geminiRequest.Contents,
+			GeminiContent{Role: "user", Parts: []GeminiPart{{Text: turn.User}}},
+			GeminiContent{Role: "model", Parts: []GeminiPart{{Text: turn.Assistant}}},
+		)
+	}
+	geminiRequest.Contents = append(geminiRequest.Contents, GeminiContent{Role: "user", Parts: []GeminiPart{{Text: request.Prompt}}})
+
+	jsonBody, err := json.Marshal(geminiRequest)
+	if err != nil {
+		p.logger.ErrorContext(ctx, "Error marshaling Gemini request", "error", err)
+		return nil, err
+	}
+	p.logger.DebugContext(ctx, "Calling Gemini", "body", string(jsonBody))
+
+	callURL := p.baseURL + "/models/" + url.PathEscape(request.modelOr(p.model)) + ":" + method
+	if len(query) > 0 {
+		callURL += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", callURL, bytes.NewBuffer(jsonBody))
+	if err != nil {
+		p.logger.ErrorContext(ctx, "Error creating request", "error", err)
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	if p.accessToken != nil {
+		token, err := p.accessToken.get(ctx)
+		if err != nil {
+			p.logger.ErrorContext(ctx, "Error getting Google access token", "error", err)
+			return nil, err
+		}
+		req.Header.Add("Authorization", "Bearer "+token)
+	} else {
+		req.Header.Add("x-goog-api-key", p.apiKey)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		p.logger.ErrorContext(ctx, "Error calling Gemini", "error", err)
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		var errorResponse GeminiErrorResponse
+		if json.Unmarshal(body, &errorResponse) == nil && errorResponse.Error.Message != "" {
+			return nil, newStatusError(resp.StatusCode, "Gemini returned status %d: %s", resp.StatusCode, errorResponse.Error.Message)
+		}
+		return nil, newStatusError(resp.StatusCode, "Gemini returned status %d", resp.StatusCode)
+	}
+
+	return resp, nil
+}
+
+func (r *GeminiResponse) usage() Usage {
+	return Usage{InputTokens: r.UsageMetadata.PromptTokenCount, OutputTokens: r.UsageMetadata.CandidatesTokenCount}
+}
+
+// geminiText extracts the text of the first candidate, reporting prompts and
+// answers blocked by the safety settings as errors.
+func geminiText(response *GeminiResponse) (string, error) {
+	if response.PromptFeedback.BlockReason != "" {
+		return "", fmt.Errorf("Gemini blocked the prompt: %s", response.PromptFeedback.BlockReason)
+	}
+	if len(response.Candidates) == 0 {
+		return "", nil
+	}
+	candidate := response.Candidates[0]
+	if candidate.FinishReason == "SAFETY" {
+		return "", errors.New("Gemini blocked the answer for safety reasons")
+	}
+
+	var text strings.Builder
+	for _, part := range candidate.Content.Parts {
+		text.WriteString(part.Text)
+	}
+
+	return text.String(), nil
+}
+
+type googleServiceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+func loadGoogleServiceAccount(path string) (*googleServiceAccount, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var account googleServiceAccount
+	err = json.Unmarshal(data, &account)
+	if err != nil {
+		return nil, fmt.Errorf("invalid service account file %s: %v", path, err)
+	}
+	if account.TokenURI == "" {
+		account.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	return &account, nil
+}
+
+// fetchGoogleAccessToken exchanges a self-signed JWT for an access token
+// (OAuth 2.0 JWT bearer flow for service accounts).
+func fetchGoogleAccessToken(ctx context.Context, client *http.Client, account *googleServiceAccount) (string, time.Time, error) {
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return "", time.Time{}, errors.New("invalid service account private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", time.Time{}, errors.New("service account private key is not RSA")
+	}
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   account.ClientEmail,
+		"scope": googleCloudScope,
+		"aud":   account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	assertion := unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", assertion)
+	req, err := http.NewRequestWithContext(ctx, "POST", account.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	var tokenResponse struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tokenResponse)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if resp.StatusCode != http.StatusOK || tokenResponse.AccessToken == "" {
+		return "", time.Time{}, newStatusError(resp.StatusCode, "Google token endpoint returned status %d", resp.StatusCode)
+	}
+
+	return tokenResponse.AccessToken, now.Add(time.Duration(tokenResponse.ExpiresIn) * time.Second), nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// Limits of the metadata of a generation request.
+const (
+	maxMetadataKeys        = 16
+	maxMetadataKeyLength   = 64
+	maxMetadataValueLength = 512
+)
+
+// GenerateParams are the sampling parameters of a generation request. Set
+// ones win over the preset and named model.
+type GenerateParams struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	MaxTokens   int      `json:"max_tokens,omitempty"`
+	Seed        *int64   `json:"seed,omitempty"`
+	Sampling
+}
+
+// GenerateRequest is the body of POST /api/v1/generate, and what the form
+// values of /getAiSmsContent are read into. Metadata is the client's own,
+// logged and returned with the response.
+type GenerateRequest struct {
+	Prompt        string            `json:"prompt"`
+	Preset        string            `json:"preset,omitempty"`
+	Model         string            `json:"model,omitempty"`
+	Provider      string            `json:"provider,omitempty"`
+	Params        GenerateParams    `json:"params"`
+	Variables     map[string]string `json:"variables,omitempty"`
+	Link          string            `json:"link,omitempty"`
+	Tone          string            `json:"tone,omitempty"`
+	Persona       string            `json:"persona,omitempty"`
+	Language      string            `json:"language,omitempty"`
+	Transliterate bool              `json:"transliterate,omitempty"`
+	NumCandidates int               `json:"num_candidates,omitempty"`
+	AllCandidates bool              `json:"all_candidates,omitempty"`
+	// Hedge races a second provider when the first one is slow
+	Hedge    bool              `json:"hedge,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// GenerateResponse is the response of POST /api/v1/generate.
+type GenerateResponse struct {
+	SmsResponse
+	RequestID string            `json:"request_id,omitempty"`
+	Usage     GenerateUsage     `json:"usage"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// GenerateUsage are the tokens the generation took.
+type GenerateUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// APIErrorResponse is the body of the error responses of /api/v1/generate.
+type APIErrorResponse struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// writeAPIError answers with a JSON error.
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	var response APIErrorResponse
+	response.Error.Code = code
+	response.Error.Message = message
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// generateRequestForm reads the form values of /getAiSmsContent.
+func generateRequestForm(r *http.Request) (GenerateRequest, error) {
+	generate := GenerateRequest{
+		Prompt:   r.FormValue("prompt"),
+		Preset:   r.FormValue("preset"),
+		Model:    r.FormValue("model"),
+		Provider: r.FormValue("provider"),
+		Link:     r.FormValue("link"),
+		Tone:     r.FormValue("tone"),
+		Persona:  r.FormValue("persona"),
+		Language: r.FormValue("language"),
+	}
+	var err error
+	generate.Params.Seed, err = parseSeed(r.FormValue("seed"))
+	if err != nil {
+		return generate, err
+	}
+	generate.Params.Sampling, err = samplingForm(r)
+	if err != nil {
+		return generate, err
+	}
+	if value := r.FormValue("variables"); value != "" {
+		err = json.Unmarshal([]byte(value), &generate.Variables)
+		if err != nil {
+			return generate, errors.New("variables must be a JSON object of strings")
+		}
+	}
+	if value := r.FormValue("num_candidates"); value != "" {
+		generate.NumCandidates, err = strconv.Atoi(value)
+		if err != nil {
+			return generate, fmt.Errorf("num_candidates must be between 1 and %d", currentConfig().Candidates.Max)
+		}
+	}
+	generate.Transliterate, _ = strconv.ParseBool(r.FormValue("transliterate"))
+	generate.AllCandidates, _ = strconv.ParseBool(r.FormValue("all_candidates"))
+	generate.Hedge, _ = strconv.ParseBool(r.FormValue("hedge"))
+	return generate, nil
+}
+
+// prepare builds the generation request the way jobs are, with the
+// parameters on top.
+func (g GenerateRequest) prepare(providers *providerSet) (Provider, Request, PostProcessConfig, error) {
+	err := g.check()
+	if err != nil {
+		return nil, Request{}, PostProcessConfig{}, err
+	}
+	provider, request, postProcess, err := prepareJob(providers, JobInput{
+		Prompt:        g.Prompt,
+		Model:         g.Model,
+		Provider:      g.Provider,
+		Preset:        g.Preset,
+		Transliterate: g.Transliterate,
+		Link:          g.Link,
+		Variables:     g.Variables,
+		Tone:          g.Tone,
+		Persona:       g.Persona,
+		NumCandidates: g.NumCandidates,
+		AllCandidates: g.AllCandidates,
+		Seed:          g.Params.Seed,
+		Sampling:      g.Params.Sampling,
+		Language:      g.Language,
+	})
+	if err != nil {
+		return nil, Request{}, PostProcessConfig{}, err
+	}
+	if g.Params.Temperature != nil {
+		request.Temperature = g.Params.Temperature
+	}
+	if g.Params.TopP != nil {
+		request.TopP = g.Params.TopP
+	}
+	if g.Params.MaxTokens > 0 {
+		request.MaxTokens = g.Params.MaxTokens
+	}
+	if g.Hedge {
+		provider, err = newHedgedProvider(providers, provider)
+		if err != nil {
+			return nil, Request{}, PostProcessConfig{}, err
+		}
+	}
+	return provider, request, postProcess, nil
+}
+
+// check reports the first problem with the parameters and metadata.
+func (g GenerateRequest) check() error {
+	params := g.Params
+	if params.Temperature != nil && (*params.Temperature < 0 || *params.Temperature > 2) {
+		return errors.New("params.temperature must be between 0 and 2")
+	}
+	if params.TopP != nil && (*params.TopP <= 0 || *params.TopP > 1) {
+		return errors.New("params.top_p must be in (0, 1]")
+	}
+	if params.MaxTokens < 0 {
+		return errors.New("params.max_tokens must not be negative")
+	}
+	if len(g.Metadata) > maxMetadataKeys {
+		return fmt.Errorf("metadata must have at most %d keys", maxMetadataKeys)
+	}
+	for key, value := range g.Metadata {
+		if len(key) > maxMetadataKeyLength || len(value) > maxMetadataValueLength {
+			return fmt.Errorf("metadata keys must be at most %d bytes and values %d", maxMetadataKeyLength, maxMetadataValueLength)
+		}
+	}
+	return nil
+}
+
+// writeGenerationError answers a failed generation of /getAiSmsContent
+// or, with jsonErrors, of /api/v1/generate.
+func writeGenerationError(w http.ResponseWriter, r *http.Request, err error, jsonErrors bool, logger *slog.Logger) {
+	writeError := func(status int, code, message string) {
+		if jsonErrors {
+			writeAPIError(w, status, code, message)
+		} else {
+			http.Error(w, message, status)
+		}
+	}
+	var timeoutErr *predictionTimeoutError
+	if errors.As(err, &timeoutErr) {
+		logger.ErrorContext(r.Context(), "Error getting AI SMS content", "error", err)
+		location := "/predictions/" + timeoutErr.ID
+		w.Header().Set("Location", location)
+		w.Header().Set("Retry-After", strconv.Itoa(int(currentConfig().Polling.MaxInterval.Seconds())))
+		writeError(http.StatusGatewayTimeout, "timeout", "AI SMS content is still being generated, check "+location)
+		return
+	}
+	if unavailable, ok := asUnavailable(err); ok {
+		writeUnavailable(w, unavailable)
+		return
+	}
+	var blocked *moderationError
+	if errors.As(err, &blocked) {
+		writeBlocked(w, blocked)
+		return
+	}
+	var placeholders *placeholderError
+	if errors.As(err, &placeholders) {
+		logger.ErrorContext(r.Context(), "Error getting AI SMS content", "error", err)
+		writeError(http.StatusBadGateway, "placeholders", placeholders.Error())
+		return
+	}
+	var wrongLanguage *languageError
+	if errors.As(err, &wrongLanguage) {
+		logger.ErrorContext(r.Context(), "Error getting AI SMS content", "error", err)
+		writeError(http.StatusBadGateway, "language", wrongLanguage.Error())
+		return
+	}
+	logger.ErrorContext(r.Context(), "Error getting AI SMS content", "error", err)
+	writeError(http.StatusInternalServerError, "internal", "Error getting AI SMS content")
+}
+
+// handleGenerate generates a text for the JSON body of POST
+// /api/v1/generate.
+func handleGenerate(w http.ResponseWriter, r *http.Request, providers *providerSet, logger *slog.Logger) {
+	requestCounter.Inc()
+	var generate GenerateRequest
+	err := json.NewDecoder(r.Body).Decode(&generate)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "invalid_request", fmt.Sprintf("Request body is over the limit of %d bytes", tooLarge.Limit))
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request", "Invalid JSON body: "+err.Error())
+		return
+	}
+	logger.InfoContext(r.Context(), "Received request for AI SMS content", "prompt", generate.Prompt, "metadata", generate.Metadata)
+
+	provider, request, postProcess, err := generate.prepare(providers)
+	var promptTooLarge *promptTooLargeError
+	if errors.As(err, &promptTooLarge) {
+		writeAPIError(w, http.StatusUnprocessableEntity, "prompt_too_large", err.Error())
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	response, err := generateSms(r.Context(), provider, request, postProcess, logger)
+	if err != nil {
+		writeGenerationError(w, r, err, true, logger)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(GenerateResponse{
+		SmsResponse: newSmsResponse(response),
+		RequestID:   requestID(r.Context()),
+		Usage: GenerateUsage{
+			InputTokens:  response.Usage.InputTokens,
+			OutputTokens: response.Usage.OutputTokens,
+		},
+		Metadata: generate.Metadata,
+	})
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error encoding AI SMS response", "error", err)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultGigaChatBaseURL  = "https://gigachat.devices.sberbank.ru/api/v1"
+	defaultGigaChatOAuthURL = "https://ngw.devices.sberbank.ru:9443/api/v2/oauth"
+	defaultGigaChatScope    = "GIGACHAT_API_PERS"
+	defaultGigaChatModel    = "GigaChat"
+)
+
+type gigaChatProvider struct {
+	client      *http.Client
+	logger      *slog.Logger
+	baseURL     string
+	accessToken *cachedToken
+	model       string
+}
+
+func init() {
+	registerProvider("gigachat", func(logger *slog.Logger) (Provider, error) {
+		authKey, err := lookupSecret("GIGACHAT_AUTH_KEY")
+		if err != nil {
+			return nil, err
+		}
+		if authKey == "" {
+			return nil, errors.New("GIGACHAT_AUTH_KEY is not set")
+		}
+		client, err := newProviderClient("gigachat", logger)
+		if err != nil {
+			return nil, err
+		}
+
+		// Sber certificates are issued by the Russian Trusted Root CA, which
+		// is usually not in the system pool
+		if caFile := os.Getenv("GIGACHAT_CA_FILE"); caFile != "" {
+			client, err = withExtraRootCA(client, caFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		oauthURL := getEnv("GIGACHAT_OAUTH_URL", defaultGigaChatOAuthURL)
+		scope := getEnv("GIGACHAT_SCOPE", defaultGigaChatScope)
+		return &gigaChatProvider{
+			client:  client,
+			logger:  logger,
+			baseURL: strings.TrimSuffix(getEnv("GIGACHAT_BASE_URL", defaultGigaChatBaseURL), "/"),
+			accessToken: newCachedToken(func(ctx context.Context) (string, time.Time, error) {
+				return fetchGigaChatToken(ctx, client, oauthURL, authKey, scope)
+			}),
+			model: getEnv("GIGACHAT_MODEL", defaultGigaChatModel),
+		}, nil
+	})
+}
+
+func (p *gigaChatProvider) Name() string {
+	return "gigachat"
+}
+
+func (p *gigaChatProvider) Generate(ctx context.Context, request Request) (Response, error) {
+	token, err := p.accessToken.get(ctx)
+	if err != nil {
+		p.logger.ErrorContext(ctx, "Error getting GigaChat access token", "error", err)
+		return Response{}, err
+	}
+
+	chatRequest := newOpenAIChatRequest(request)
+	chatRequest.Model = request.modelOr(p.model)
+	chatRequest.Seed = nil
+	chatRequest.RepetitionPenalty = request.RepetitionPenalty
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+token)
+	chatResponse, err := callChatCompletions(ctx, p.client, p.baseURL+"/chat/completions", header, chatRequest, p.logger)
+	if err != nil {
+		return Response{}, err
+	}
+
+	return newOpenAIResponse(chatResponse, p.Name()), nil
+}
+
+func fetchGigaChatToken(ctx context.Context, client *http.Client, oauthURL, authKey, scope string) (string, time.Time, error) {
+	form := url.Values{}
+	form.Set("scope", scope)
+	req, err := http.NewRequestWithContext(ctx, "POST", oauthURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Authorization", "Basic "+authKey)
+	req.Header.Add("RqUID", newUUID())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	var tokenResponse struct {
+		AccessToken string `json:"access_token"`
+		ExpiresAt   int64  `json:"expires_at"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tokenResponse)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if resp.StatusCode != http.StatusOK || tokenResponse.AccessToken == "" {
+		return "", time.Time{}, newStatusError(resp.StatusCode, "GigaChat OAuth returned status %d", resp.StatusCode)
+	}
+
+	return tokenResponse.AccessToken, time.UnixMilli(tokenResponse.ExpiresAt), nil
+}
+
+// withExtraRootCA returns a copy of client that also trusts the CA
+// certificates in caFile.
+func withExtraRootCA(client *http.Client, caFile string) (*http.Client, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	transport, err := innerTransport(client)
+	if err != nil {
+		return nil, err
+	}
+	transport = transport.Clone()
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.RootCAs = pool
+
+	copied := *client
+	copied.Transport = transport
+	if retry, ok := client.Transport.(*retryTransport); ok {
+		copied.Transport = &retryTransport{next: transport, provider: retry.provider}
+	}
+	return &copied, nil
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// readinessCheckTimeout bounds a single dependency check.
+const readinessCheckTimeout = 5 * time.Second
+
+// HealthChecker is implemented by providers that can verify their
+// credentials and that their API is reachable.
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+// shuttingDown is set once the server starts draining, so load balancers
+// stop routing new requests here.
+var shuttingDown atomic.Bool
+
+// readiness holds the dependency checks behind /readyz. Results are cached
+// so probes don't hammer the upstream APIs.
+var readiness = &readinessChecks{items: make(map[string]*readinessCheck)}
+
+type readinessChecks struct {
+	mu    sync.Mutex
+	items map[string]*readinessCheck
+}
+
+type readinessCheck struct {
+	mu      sync.Mutex
+	check   func(ctx context.Context) error
+	err     error
+	checked time.Time
+}
+
+// registerReadinessCheck adds a dependency that must be healthy for the
+// instance to be ready.
+func registerReadinessCheck(name string, check func(ctx context.Context) error) {
+	readiness.mu.Lock()
+	defer readiness.mu.Unlock()
+
+	readiness.items[name] = &readinessCheck{check: check}
+}
+
+func (c *readinessCheck) run(ctx context.Context, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.checked.IsZero() && time.Since(c.checked) < ttl {
+		return c.err
+	}
+	// The result is shared, so a probe giving up must not poison it
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), readinessCheckTimeout)
+	defer cancel()
+	c.err = c.check(ctx)
+	c.checked = time.Now()
+
+	return c.err
+}
+
+// runAll runs every check and returns the result per check name.
+func (s *readinessChecks) runAll(ctx context.Context) map[string]error {
+	s.mu.Lock()
+	names := make([]string, 0, len(s.items))
+	for name := range s.items {
+		names = append(names, name)
+	}
+	s.mu.Unlock()
+	sort.Strings(names)
+
+	ttl := currentConfig().Health.CacheTTL
+	results := make(map[string]error, len(names))
+	for _, name := range names {
+		s.mu.Lock()
+		check := s.items[name]
+		s.mu.Unlock()
+		results[name] = check.run(ctx, ttl)
+	}
+
+	return results
+}
+
+// checkProviderHealth checks the default provider. With a fallback chain
+// one healthy provider is enough.
+func checkProviderHealth(ctx context.Context, providers *providerSet) error {
+	names := currentConfig().Fallback
+	if len(names) == 0 {
+		names = []string{currentConfig().Provider}
+	}
+
+	var errs []error
+	for _, name := range names {
+		provider, err := providers.get(name)
+		if err == nil {
+			if checker, ok := provider.(HealthChecker); ok {
+				err = checker.CheckHealth(ctx)
+			}
+		}
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", name, err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// HealthStatus is the body of /readyz.
+type HealthStatus struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(HealthStatus{Status: "ok"})
+}
+
+func handleReadyz(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	status := HealthStatus{Status: "ok", Checks: make(map[string]string)}
+	code := http.StatusOK
+	if shuttingDown.Load() {
+		status.Status = "shutting down"
+		code = http.StatusServiceUnavailable
+	} else {
+		for name, err := range readiness.runAll(r.Context()) {
+			status.Checks[name] = "ok"
+			if err != nil {
+				logger.WarnContext(r.Context(), "Readiness check failed", "check", name, "error", err)
+				status.Checks[name] = err.Error()
+				status.Status = "unavailable"
+				code = http.StatusServiceUnavailable
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var hedgeCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ai_sms_hedged_requests_total",
+	Help: "The total number of hedged requests by outcome: primary, hedge, not_needed or failed",
+}, []string{"outcome"})
+
+// HedgeConfig controls hedged requests: when the primary provider has not
+// answered after Delay, the same request is also sent to Provider and the
+// first answer wins.
+type HedgeConfig struct {
+	Provider string        `yaml:"provider"`
+	Delay    time.Duration `yaml:"delay"`
+}
+
+// hedgedProvider races a primary provider against a hedge provider started
+// after a delay. The losing call is cancelled.
+type hedgedProvider struct {
+	primary Provider
+	hedge   Provider
+	delay   time.Duration
+}
+
+// newHedgedProvider wraps primary with the configured hedge provider. It
+// returns primary unchanged when hedging is not configured.
+func newHedgedProvider(providers *providerSet, primary Provider) (Provider, error) {
+	config := currentConfig().Hedge
+	if config.Provider == "" {
+		return primary, nil
+	}
+	hedge, err := providers.get(config.Provider)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hedgedProvider{primary: primary, hedge: hedge, delay: config.Delay}, nil
+}
+
+func (p *hedgedProvider) Name() string {
+	return p.primary.Name()
+}
+
+type hedgeResult struct {
+	response Response
+	err      error
+	hedge    bool
+}
+
+func (p *hedgedProvider) Generate(ctx context.Context, request Request) (Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan hedgeResult, 2)
+	go func() {
+		response, err := generate(ctx, p.primary, request)
+		results <- hedgeResult{response: response, err: err}
+	}()
+
+	timer := time.NewTimer(p.delay)
+	defer timer.Stop()
+
+	pending := 1
+	hedged := false
+	startHedge := func() {
+		if hedged {
+			return
+		}
+		hedged = true
+		pending++
+		// The requested model belongs to the primary provider
+		hedgeRequest := request
+		if p.hedge.Name() != p.primary.Name() {
+			hedgeRequest.Model = ""
+			hedgeRequest.Version = ""
+		}
+		go func() {
+			response, err := generate(ctx, p.hedge, hedgeRequest)
+			results <- hedgeResult{response: response, err: err, hedge: true}
+		}()
+	}
+
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+			startHedge()
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				switch {
+				case !hedged:
+					hedgeCounter.WithLabelValues("not_needed").Inc()
+				case result.hedge:
+					hedgeCounter.WithLabelValues("hedge").Inc()
+				default:
+					hedgeCounter.WithLabelValues("primary").Inc()
+				}
+				return result.response, nil
+			}
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			// Don't wait out the delay once the primary has failed
+			if !hedged && ctx.Err() == nil {
+				startHedge()
+				continue
+			}
+			if pending == 0 {
+				hedgeCounter.WithLabelValues("failed").Inc()
+				return Response{}, firstErr
+			}
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// historyQueueSize bounds the generations waiting to be written.
+const historyQueueSize = 1000
+
+var historyDroppedCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "ai_sms_history_dropped_total",
+	Help: "The total number of generations not recorded in the history because the write queue was full",
+})
+
+// HistoryConfig records every generation in a Store: an SQLite database at
+// Path, or PostgreSQL for history shared by several replicas.
+type HistoryConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Backend string `yaml:"backend"`
+	Path    string `yaml:"path"`
+	// RetentionDays purges older generations; 0 keeps them forever
+	RetentionDays int `yaml:"retention_days"`
+	// Postgres connects to the database in HISTORY_DATABASE_URL
+	Postgres PostgresConfig `yaml:"postgres"`
+}
+
+// Generation is one recorded generation request and its outcome.
+type Generation struct {
+	ID           string           `json:"id"`
+	CreatedAt    time.Time        `json:"created_at"`
+	RequestID    string           `json:"request_id,omitempty"`
+	Caller       string           `json:"caller,omitempty"`
+	Provider     string           `json:"provider"`
+	Model        string           `json:"model,omitempty"`
+	Preset       string           `json:"preset,omitempty"`
+	PredictionID string           `json:"prediction_id,omitempty"`
+	Prompt       string           `json:"prompt"`
+	Params       GenerationParams `json:"params"`
+	Output       string           `json:"output,omitempty"`
+	// Status is "success" or "error"
+	Status       string `json:"status"`
+	Error        string `json:"error,omitempty"`
+	LatencyMS    int64  `json:"latency_ms"`
+	InputTokens  int    `json:"input_tokens,omitempty"`
+	OutputTokens int    `json:"output_tokens,omitempty"`
+	// Feedback is the latest rating given to the generated text
+	Feedback *Feedback `json:"feedback,omitempty"`
+	// Message is the SMS the text was sent in, if any
+	Message *SentMessage `json:"message,omitempty"`
+}
+
+// GenerationParams are the request settings a generation ran with.
+type GenerationParams struct {
+	System       string   `json:"system,omitempty"`
+	Version      string   `json:"version,omitempty"`
+	Temperature  *float64 `json:"temperature,omitempty"`
+	TopP         *float64 `json:"top_p,omitempty"`
+	MaxTokens    int      `json:"max_tokens,omitempty"`
+	Seed         *int64   `json:"seed,omitempty"`
+	HistoryTurns int      `json:"history_turns,omitempty"`
+	Sampling
+}
+
+// history records generations; nil when the history is disabled.
+var history *historyRecorder
+
+// historyRecorder writes generations to the store from a single goroutine,
+// so recording never holds up a response. Later writes about a generation
+// go through the same queue, so they land after its insert.
+type historyRecorder struct {
+	store  Store
+	queue  chan historyWrite
+	done   chan struct{}
+	logger *slog.Logger
+}
+
+// openHistory opens the configured store and starts the writer.
+func openHistory(config HistoryConfig, logger *slog.Logger) (*historyRecorder, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+
+	store, err := openStore(config, logger)
+	if err != nil {
+		return nil, err
+	}
+	registerReadinessCheck("history", store.Ping)
+	go enforceRetention(context.Background(), store, logger)
+
+	h := &historyRecorder{
+		store:  store,
+		queue:  make(chan historyWrite, historyQueueSize),
+		done:   make(chan struct{}),
+		logger: logger,
+	}
+	go h.run()
+	return h, nil
+}
+
+// historyWrite is a queued write about the generation with the given ID.
+type historyWrite struct {
+	generation string
+	write      func(ctx context.Context, store Store) error
+}
+
+// record queues generation for writing, dropping it if the queue is full.
+func (h *historyRecorder) record(generation Generation) {
+	h.enqueue(historyWrite{generation: generation.ID, write: func(ctx context.Context, store Store) error {
+		return store.Insert(ctx, generation)
+	}})
+}
+
+// recordMessage queues recording the SMS the generation id was sent in.
+func (h *historyRecorder) recordMessage(id string, message SentMessage) {
+	h.enqueue(historyWrite{generation: id, write: func(ctx context.Context, store Store) error {
+		_, err := store.SetMessage(ctx, id, message)
+		return err
+	}})
+}
+
+// recordMessageStatus queues recording the delivery status of an SMS.
+func (h *historyRecorder) recordMessageStatus(message SentMessage) {
+	h.enqueue(historyWrite{write: func(ctx context.Context, store Store) error {
+		found, err := store.SetMessageStatus(ctx, message)
+		if err == nil && !found {
+			h.logger.Debug("No SMS to record the delivery status of", "gateway", message.Gateway, "message_id", message.ID)
+		}
+		return err
+	}})
+}
+
+// recordLinks queues recording the short links of the generation id.
+func (h *historyRecorder) recordLinks(id string, links []Link) {
+	h.enqueue(historyWrite{generation: id, write: func(ctx context.Context, store Store) error {
+		return store.InsertLinks(ctx, links)
+	}})
+}
+
+func (h *historyRecorder) enqueue(write historyWrite) {
+	select {
+	case h.queue <- write:
+	default:
+		historyDroppedCounter.Inc()
+	}
+}
+
+func (h *historyRecorder) run() {
+	defer close(h.done)
+	for write := range h.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := write.write(ctx, h.store)
+		cancel()
+		if err != nil {
+			h.logger.Error("Error recording generation", "store", h.store.Name(), "generation", write.generation, "error", err)
+		}
+	}
+}
+
+// close writes the queued generations and closes the store.
+func (h *historyRecorder) close() error {
+	close(h.queue)
+	<-h.done
+	return h.store.Close()
+}
+
+// recordGeneration adds a finished generation to the history and returns
+// its ID. Cancelled requests are not recorded.
+func recordGeneration(ctx context.Context, provider Provider, request Request, response Response, start time.Time, err error) string {
+	if history == nil || errors.Is(err, context.Canceled) {
+		return ""
+	}
+
+	generation := Generation{
+		ID:           newUUID(),
+		CreatedAt:    start.UTC(),
+		RequestID:    requestID(ctx),
+		Provider:     provider.Name(),
+		Model:        request.Model,
+		Preset:       request.Preset,
+		PredictionID: response.ID,
+		Prompt:       request.Prompt,
+		Params: GenerationParams{
+			System:       request.System,
+			Version:      request.Version,
+			Temperature:  request.Temperature,
+			TopP:         request.TopP,
+			MaxTokens:    request.MaxTokens,
+			Seed:         request.Seed,
+			HistoryTurns: len(request.History),
+			Sampling:     request.Sampling,
+		},
+		Output:       response.Text,
+		Status:       "success",
+		LatencyMS:    time.Since(start).Milliseconds(),
+		InputTokens:  response.Usage.InputTokens,
+		OutputTokens: response.Usage.OutputTokens,
+	}
+	if caller, ok := callerFrom(ctx); ok {
+		generation.Caller = caller.ID
+	}
+	if response.Provider != "" {
+		generation.Provider = response.Provider
+	}
+	if response.Model != "" {
+		generation.Model = response.Model
+	}
+	if slices.Contains(seedlessProviders, generation.Provider) {
+		// The seed was not sent, so it would not reproduce the text
+		generation.Params.Seed = nil
+	}
+	if err != nil {
+		generation.Status = "error"
+		generation.Error = err.Error()
+	}
+	history.record(generation)
+	return generation.ID
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultHistoryPageSize = 50
+	maxHistoryPageSize     = 500
+)
+
+// GenerationList is a page of the generation history. NextOffset is set
+// when more generations match.
+type GenerationList struct {
+	Generations []Generation `json:"generations"`
+	NextOffset  int          `json:"next_offset,omitempty"`
+}
+
+// parseGenerationFilter reads the history filter from the query string:
+// from and to (RFC 3339 times, or dates where to includes the whole day),
+// caller, model, status, q, limit and offset.
+func parseGenerationFilter(query url.Values) (GenerationFilter, error) {
+	filter := GenerationFilter{
+		Caller: query.Get("caller"),
+		Model:  query.Get("model"),
+		Status: query.Get("status"),
+		Query:  query.Get("q"),
+		Limit:  defaultHistoryPageSize,
+	}
+
+	var err error
+	if value := query.Get("from"); value != "" {
+		filter.From, err = parseHistoryTime(value, false)
+		if err != nil {
+			return GenerationFilter{}, fmt.Errorf("invalid from: %v", err)
+		}
+	}
+	if value := query.Get("to"); value != "" {
+		filter.To, err = parseHistoryTime(value, true)
+		if err != nil {
+			return GenerationFilter{}, fmt.Errorf("invalid to: %v", err)
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		filter.Limit, err = strconv.Atoi(value)
+		if err != nil || filter.Limit < 1 || filter.Limit > maxHistoryPageSize {
+			return GenerationFilter{}, fmt.Errorf("limit must be between 1 and %d", maxHistoryPageSize)
+		}
+	}
+	if value := query.Get("offset"); value != "" {
+		filter.Offset, err = strconv.Atoi(value)
+		if err != nil || filter.Offset < 0 {
+			return GenerationFilter{}, fmt.Errorf("offset must be a non-negative integer")
+		}
+	}
+	return filter, nil
+}
+
+// parseHistoryTime parses an RFC 3339 time or a date. A date used as the
+// end of a range means the end of that day.
+func parseHistoryTime(value string, end bool) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC 3339 time nor a date", value)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func handleListGenerations(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	if history == nil {
+		http.Error(w, "Generation history is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	filter, err := parseGenerationFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// One extra row tells whether there is a next page
+	filter.Limit++
+	generations, err := history.store.List(r.Context(), filter)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error listing generations", "error", err)
+		http.Error(w, "Error listing generations", http.StatusInternalServerError)
+		return
+	}
+	filter.Limit--
+	list := GenerationList{Generations: generations}
+	if len(generations) > filter.Limit {
+		list.Generations = generations[:filter.Limit]
+		list.NextOffset = filter.Offset + filter.Limit
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(list)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error encoding generations", "error", err)
+	}
+}
+
+func handleGetGeneration(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	if history == nil {
+		http.Error(w, "Generation history is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	generation, found, err := history.store.Get(r.Context(), r.PathValue("id"))
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error reading generation", "error", err)
+		http.Error(w, "Error reading generation", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Generation not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(generation)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error encoding generation", "error", err)
+	}
+}
+
+// generationExportPath streams the history; it is exempt from the handler
+// timeout because exports can take longer than any one request.
+const generationExportPath = "/api/v1/generations/export"
+
+// exportPageSize is how many generations an export reads from the store at
+// a time.
+const exportPageSize = 500
+
+var generationCSVHeader = []string{
+	"id", "created_at", "request_id", "caller", "provider", "model", "preset", "prediction_id",
+	"prompt", "params", "output", "status", "error", "latency_ms", "input_tokens", "output_tokens",
+	"feedback_rating", "feedback_comment", "message_gateway", "message_id", "message_status",
+}
+
+// handleExportGenerations streams every generation matching the list
+// filters as JSON lines or CSV, newest first. limit and offset are ignored.
+func handleExportGenerations(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	if history == nil {
+		http.Error(w, "Generation history is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	filter, err := parseGenerationFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "jsonl"
+	}
+	if format != "jsonl" && format != "csv" {
+		http.Error(w, "format must be jsonl or csv", http.StatusBadRequest)
+		return
+	}
+	// Generations recorded during the export would shift the pages
+	if filter.To.IsZero() {
+		filter.To = time.Now()
+	}
+	filter.Limit = exportPageSize
+	filter.Offset = 0
+
+	var writeGeneration func(Generation) error
+	var flush func() error
+	switch format {
+	case "jsonl":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(w)
+		writeGeneration = func(generation Generation) error {
+			return encoder.Encode(generation)
+		}
+		flush = func() error { return nil }
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		writer := csv.NewWriter(w)
+		writeGeneration = func(generation Generation) error {
+			return writer.Write(generationCSVRecord(generation))
+		}
+		flush = func() error {
+			writer.Flush()
+			return writer.Error()
+		}
+		writer.Write(generationCSVHeader)
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="generations.%s"`, format))
+
+	controller := http.NewResponseController(w)
+	exported := 0
+	for {
+		generations, err := history.store.List(r.Context(), filter)
+		if err != nil {
+			// The status is already sent; a truncated export is all the
+			// client gets
+			logger.ErrorContext(r.Context(), "Error exporting generations", "exported", exported, "error", err)
+			return
+		}
+		for _, generation := range generations {
+			err = writeGeneration(generation)
+			if err != nil {
+				logger.WarnContext(r.Context(), "Error writing generation export", "exported", exported, "error", err)
+				return
+			}
+			exported++
+		}
+		err = flush()
+		if err == nil {
+			err = controller.Flush()
+		}
+		if err != nil {
+			logger.WarnContext(r.Context(), "Error writing generation export", "exported", exported, "error", err)
+			return
+		}
+		if len(generations) < filter.Limit {
+			break
+		}
+		filter.Offset += filter.Limit
+	}
+	logger.InfoContext(r.Context(), "Exported generations", "format", format, "exported", exported)
+}
+
+// generationCSVRecord flattens generation into a row under
+// generationCSVHeader; the parameters stay a JSON object.
+func generationCSVRecord(generation Generation) []string {
+	params, _ := json.Marshal(generation.Params)
+	var feedback Feedback
+	if generation.Feedback != nil {
+		feedback = *generation.Feedback
+	}
+	var message SentMessage
+	if generation.Message != nil {
+		message = *generation.Message
+	}
+	return []string{
+		generation.ID,
+		generation.CreatedAt.Format(time.RFC3339Nano),
+		generation.RequestID,
+		generation.Caller,
+		generation.Provider,
+		generation.Model,
+		generation.Preset,
+		generation.PredictionID,
+		generation.Prompt,
+		string(params),
+		generation.Output,
+		generation.Status,
+		generation.Error,
+		strconv.FormatInt(generation.LatencyMS, 10),
+		strconv.Itoa(generation.InputTokens),
+		strconv.Itoa(generation.OutputTokens),
+		feedback.Rating,
+		feedback.Comment,
+		message.Gateway,
+		message.ID,
+		message.Status,
+	}
+}
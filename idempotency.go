@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// maxIdempotencyKeyLength bounds the Idempotency-Key header.
+	maxIdempotencyKeyLength = 255
+	// maxIdempotentResponseBytes bounds the responses kept for replay;
+	// larger ones are not kept.
+	maxIdempotentResponseBytes = 1 << 20
+)
+
+var idempotentReplayCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "ai_sms_idempotent_replays_total",
+	Help: "The total number of requests answered with the stored response of an earlier request with the same Idempotency-Key",
+})
+
+// IdempotencyConfig keeps the successful responses to requests carrying an
+// Idempotency-Key header, so a client retrying after a timeout gets the
+// original result instead of a new, paid-for generation. Keys are kept in
+// memory per replica for TTL, at most MaxKeys of them.
+type IdempotencyConfig struct {
+	Enabled bool          `yaml:"enabled"`
+	TTL     time.Duration `yaml:"ttl"`
+	MaxKeys int           `yaml:"max_keys"`
+}
+
+// idempotencyKeys holds the responses by caller and key.
+var idempotencyKeys = newIdempotencyStore()
+
+// idempotencyStore is an LRU of idempotent requests, in flight or done.
+type idempotencyStore struct {
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type idempotencyEntry struct {
+	key string
+	// fingerprint is the hash of the request the key was first used with
+	fingerprint string
+	// done is closed when the first request finishes; stored is then set
+	// if its response was kept
+	done    chan struct{}
+	stored  bool
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func newIdempotencyStore() *idempotencyStore {
+	return &idempotencyStore{order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// begin returns the live entry for key, or starts a new one that the
+// caller must finish. ok is false when key was used with another request.
+func (s *idempotencyStore) begin(key, fingerprint string) (entry *idempotencyEntry, started, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if element, found := s.entries[key]; found {
+		entry := element.Value.(*idempotencyEntry)
+		expired := entry.stored && time.Now().After(entry.expires)
+		if !expired {
+			if entry.fingerprint != fingerprint {
+				return nil, false, false
+			}
+			s.order.MoveToFront(element)
+			return entry, false, true
+		}
+		s.remove(element)
+	}
+
+	entry = &idempotencyEntry{key: key, fingerprint: fingerprint, done: make(chan struct{})}
+	s.entries[key] = s.order.PushFront(entry)
+	maxKeys := currentConfig().Idempotency.MaxKeys
+	for s.order.Len() > maxKeys {
+		s.remove(s.order.Back())
+	}
+	return entry, true, true
+}
+
+// finish keeps the response of a started entry, or forgets the key when
+// keep is false so a retry generates again.
+func (s *idempotencyStore) finish(entry *idempotencyEntry, keep bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	element, found := s.entries[entry.key]
+	if found && element.Value == entry && !keep {
+		s.remove(element)
+	}
+	if keep {
+		entry.stored = true
+		entry.expires = time.Now().Add(currentConfig().Idempotency.TTL)
+	}
+	close(entry.done)
+}
+
+// remove drops element from the store. Callers hold s.mu.
+func (s *idempotencyStore) remove(element *list.Element) {
+	s.order.Remove(element)
+	delete(s.entries, element.Value.(*idempotencyEntry).key)
+}
+
+// withIdempotency answers a request carrying an Idempotency-Key header
+// with the response to the first request with that key from the same
+// caller. A retry arriving while the first request still runs waits for
+// it. Only successful, non-streaming responses are kept; reusing a key for
+// a different request is rejected with 422.
+func withIdempotency(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		idempotencyKey := r.Header.Get("Idempotency-Key")
+		if idempotencyKey == "" || !currentConfig().Idempotency.Enabled {
+			next(w, r)
+			return
+		}
+		if len(idempotencyKey) > maxIdempotencyKeyLength {
+			http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Error reading request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash := sha256.New()
+		hash.Write([]byte(r.URL.RawQuery + "\x00"))
+		hash.Write(body)
+		fingerprint := hex.EncodeToString(hash.Sum(nil))
+
+		caller, _ := callerFrom(r.Context())
+		key := strings.Join([]string{caller.ID, r.Method, r.URL.Path, idempotencyKey}, "\x00")
+		for {
+			entry, started, ok := idempotencyKeys.begin(key, fingerprint)
+			if !ok {
+				http.Error(w, "Idempotency-Key was already used with a different request", http.StatusUnprocessableEntity)
+				return
+			}
+			if started {
+				recorder := &idempotencyRecorder{ResponseWriter: w, status: http.StatusOK}
+				keep := false
+				defer func() { idempotencyKeys.finish(entry, keep) }()
+				next(recorder, r)
+				keep = recorder.keep()
+				if keep {
+					entry.status = recorder.status
+					entry.header = recorder.Header().Clone()
+					entry.header.Del("X-Request-Id")
+					entry.body = recorder.body.Bytes()
+				}
+				return
+			}
+
+			select {
+			case <-entry.done:
+			case <-r.Context().Done():
+				return
+			}
+			if entry.stored {
+				idempotentReplayCounter.Inc()
+				addLogFields(r.Context(), "idempotent_replay", true)
+				for name, values := range entry.header {
+					w.Header()[name] = values
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(entry.status)
+				w.Write(entry.body)
+				return
+			}
+			// The first request failed; this one generates in its place
+		}
+	}
+}
+
+// idempotencyRecorder copies the response for replay while writing it.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	// streamed is set once the response was flushed or outgrew
+	// maxIdempotentResponseBytes
+	streamed bool
+	body     bytes.Buffer
+}
+
+func (r *idempotencyRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *idempotencyRecorder) Write(data []byte) (int, error) {
+	r.wroteHeader = true
+	if r.body.Len()+len(data) <= maxIdempotentResponseBytes {
+		r.body.Write(data)
+	} else {
+		r.streamed = true
+	}
+	return r.ResponseWriter.Write(data)
+}
+
+// Flush marks the response as streamed, which is not kept for replay.
+func (r *idempotencyRecorder) Flush() {
+	r.streamed = true
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *idempotencyRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// keep reports whether the response can be replayed: successful, complete
+// and not streamed.
+func (r *idempotencyRecorder) keep() bool {
+	return r.status >= 200 && r.status < 300 && !r.streamed
+}
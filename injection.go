@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var injectionsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ai_sms_prompt_injections_total",
+	Help: "The total number of client prompts that looked like prompt injections by signal and action (flag, sanitize or reject)",
+}, []string{"signal", "action"})
+
+// Actions on prompts that look like injections.
+const (
+	injectionFlag     = "flag"
+	injectionSanitize = "sanitize"
+	injectionReject   = "reject"
+)
+
+// injectionSignal is one sign of a prompt injection.
+type injectionSignal struct {
+	name    string
+	pattern *regexp.Regexp
+}
+
+// injectionSignals are the built-in signs of prompt injections, in
+// English and Russian.
+var injectionSignals = []injectionSignal{
+	{"ignore_instructions", regexp.MustCompile(`(?i)\b(?:ignore|disregard|forget|override)\b.{0,30}\b(?:previous|prior|above|earlier|all|your|system)\b.{0,20}\b(?:instructions?|prompts?|rules|directions)\b`)},
+	{"ignore_instructions", regexp.MustCompile(`(?i)(?:игнорируй|забудь|не обращай внимания на|отмени).{0,30}(?:предыдущ|прошл|вс[еёи]|системн).{0,20}(?:инструкци|указани|правил|промпт)\p{L}*`)},
+	{"role_change", regexp.MustCompile(`(?i)\byou are now\b|\bpretend (?:to be|you are)\b|\bfrom now on,? you\b|ты теперь|притворись|с этого момента ты`)},
+	{"system_prompt", regexp.MustCompile(`(?i)\bsystem prompt\b|\breveal your (?:instructions|prompt)\b|\bdeveloper mode\b|\bjailbreak|системн(?:ый|ого|ые) (?:промпт|инструкци)\p{L}*`)},
+	// Chat template markers of Llama, Mistral and ChatML, and role lines
+	{"template_tokens", regexp.MustCompile(`(?im)</?s>|\[/?INST\]|<\|[a-z_]+\|>|<</?SYS>>|^\s*#{2,}\s*(?:instruction|system|response)\b|^\s*(?:system|assistant)\s*:`)},
+}
+
+// InjectionConfig screens client prompts for prompt injections:
+// instructions to ignore the previous ones or take another role, requests
+// for the system prompt, chat template tokens and matches of Patterns.
+// Action is "flag" to log and count them, "sanitize" to remove what was
+// found or "reject" to refuse the prompt; empty turns screening off.
+type InjectionConfig struct {
+	Action   string   `yaml:"action"`
+	Patterns []string `yaml:"patterns"`
+}
+
+// injectionGuard screens prompts; nil when screening is off. It is set up
+// at startup.
+var injectionGuard *promptGuard
+
+type promptGuard struct {
+	action  string
+	signals []injectionSignal
+}
+
+// newPromptGuard returns the configured guard, or nil.
+func newPromptGuard(config InjectionConfig) (*promptGuard, error) {
+	if config.Action == "" {
+		return nil, nil
+	}
+	g := &promptGuard{action: config.Action, signals: injectionSignals}
+	for _, pattern := range config.Patterns {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("injection pattern %q: %v", pattern, err)
+		}
+		g.signals = append(g.signals, injectionSignal{name: "pattern", pattern: compiled})
+	}
+	return g, nil
+}
+
+// injectionError is a client prompt rejected as a prompt injection.
+type injectionError struct {
+	Signals []string
+}
+
+func (e *injectionError) Error() string {
+	return "prompt looks like a prompt injection (" + strings.Join(e.Signals, ", ") + ")"
+}
+
+func (e *injectionError) errorClass() string {
+	return "injection"
+}
+
+// screenPrompt checks a client prompt for prompt injections and returns
+// it, sanitized if so configured, or an injectionError if it is to be
+// rejected.
+func screenPrompt(prompt string) (string, error) {
+	if injectionGuard == nil {
+		return prompt, nil
+	}
+	var found []string
+	sanitized := prompt
+	for _, signal := range injectionGuard.signals {
+		if !signal.pattern.MatchString(sanitized) {
+			continue
+		}
+		if !slices.Contains(found, signal.name) {
+			found = append(found, signal.name)
+		}
+		if injectionGuard.action == injectionSanitize {
+			sanitized = signal.pattern.ReplaceAllString(sanitized, "")
+		}
+	}
+	if len(found) == 0 {
+		return prompt, nil
+	}
+	action := injectionGuard.action
+	if action == injectionSanitize && strings.TrimSpace(sanitized) == "" {
+		// Nothing but the injection
+		action = injectionReject
+	}
+	for _, signal := range found {
+		injectionsCounter.WithLabelValues(signal, action).Inc()
+	}
+	// Jobs are prepared without a logger of their own
+	slog.Warn("Prompt looks like a prompt injection", "signals", found, "action", action, "prompt_hash", promptHash(prompt))
+	switch action {
+	case injectionReject:
+		return "", &injectionError{Signals: found}
+	case injectionSanitize:
+		return strings.TrimSpace(sanitized), nil
+	}
+	return prompt, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var ipRejectedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ai_sms_requests_ip_rejected_total",
+	Help: "The total number of requests rejected by the IP allow and deny lists",
+}, []string{"scope"})
+
+// IPAccessConfig restricts who may call the service by client address.
+// Admin covers the admin endpoints and the metrics listener. X-Forwarded-For
+// is only believed when the peer is one of TrustedProxies.
+type IPAccessConfig struct {
+	TrustedProxies IPList     `yaml:"trusted_proxies"`
+	Generation     IPRuleList `yaml:"generation"`
+	Admin          IPRuleList `yaml:"admin"`
+}
+
+// IPRuleList denies addresses matching Deny; with a non-empty Allow only
+// matching addresses get through.
+type IPRuleList struct {
+	Allow IPList `yaml:"allow"`
+	Deny  IPList `yaml:"deny"`
+}
+
+// IPList holds IP addresses and CIDR ranges.
+type IPList []string
+
+// contains reports whether addr is in the list. Invalid entries are caught
+// by config validation and never match.
+func (l IPList) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, entry := range l {
+		prefix, err := parseIPEntry(entry)
+		if err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseIPEntry(entry string) (netip.Prefix, error) {
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// allows reports whether the list lets the address in. Unparseable client
+// addresses are only let through when no allow list is set.
+func (l IPRuleList) allows(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return len(l.Allow) == 0
+	}
+	if l.Deny.contains(addr) {
+		return false
+	}
+	return len(l.Allow) == 0 || l.Allow.contains(addr)
+}
+
+// checkIP writes a 403 response and returns false if the client of r is not
+// allowed by rules.
+func checkIP(w http.ResponseWriter, r *http.Request, scope string, rules IPRuleList) bool {
+	if rules.allows(clientIP(r)) {
+		return true
+	}
+	ipRejectedCounter.WithLabelValues(scope).Inc()
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return false
+}
+
+// withAdminIPAccess applies the admin IP rules to every request of next.
+func withAdminIPAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !checkIP(w, r, "admin", currentConfig().IPAccess.Admin) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the address of the client that sent r. Behind trusted
+// proxies it is the last X-Forwarded-For hop not added by one of them.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	trusted := currentConfig().IPAccess.TrustedProxies
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !trusted.contains(addr) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		addr, err := netip.ParseAddr(hop)
+		if err != nil {
+			return host
+		}
+		host = hop
+		if !trusted.contains(addr) {
+			break
+		}
+	}
+	return host
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultJobPageSize = 50
+	maxJobPageSize     = 500
+)
+
+// jobStates are the states GET /admin/jobs filters on.
+var jobStates = []string{jobQueued, jobRunning, jobSucceeded, jobFailed, jobDead, jobCancelled}
+
+// JobList is a page of jobs. NextOffset is set when there are more.
+type JobList struct {
+	Jobs       []Job `json:"jobs"`
+	NextOffset int   `json:"next_offset,omitempty"`
+}
+
+// errJobFinished is returned when cancelling a job that already finished.
+var errJobFinished = errors.New("job already finished")
+
+// cancelJob cancels the job with id: a queued or dead job right away, a
+// running one as soon as its worker notices. It returns the job and
+// whether it exists.
+func (q *jobQueue) cancelJob(ctx context.Context, id string) (Job, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, found, err := q.store.Get(ctx, id)
+	if err != nil {
+		return Job{}, false, err
+	}
+	if !found {
+		return Job{}, false, nil
+	}
+	if cancel, ok := q.running[id]; ok {
+		cancel(errJobCancelled)
+		job.State = jobRunning
+		return job, true, nil
+	}
+	switch job.State {
+	case jobQueued:
+		if q.queued.remove(job.ID, job.Caller, priorityRank(job.Priority)) {
+			jobsQueuedGauge.Dec()
+		}
+	case jobDead:
+		jobsDeadGauge.Dec()
+	default:
+		return job, true, errJobFinished
+	}
+
+	finished := time.Now().UTC()
+	job.State = jobCancelled
+	job.FinishedAt = &finished
+	job.Error = errJobCancelled.Error()
+	err = q.store.Put(ctx, job)
+	if err != nil {
+		return Job{}, false, err
+	}
+	jobsCounter.WithLabelValues(jobCancelled).Inc()
+	if job.Callback != nil {
+		q.notify(job)
+	}
+	return job, true, nil
+}
+
+// parseJobListQuery reads the state, caller, limit and offset of GET
+// /admin/jobs.
+func parseJobListQuery(query url.Values) (state, caller string, limit, offset int, err error) {
+	state = query.Get("state")
+	if !slices.Contains(jobStates, state) {
+		return "", "", 0, 0, fmt.Errorf("state must be one of %v", jobStates)
+	}
+	limit = defaultJobPageSize
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxJobPageSize {
+			return "", "", 0, 0, fmt.Errorf("limit must be between 1 and %d", maxJobPageSize)
+		}
+	}
+	if value := query.Get("offset"); value != "" {
+		offset, err = strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			return "", "", 0, 0, fmt.Errorf("offset must be a non-negative integer")
+		}
+	}
+	return state, query.Get("caller"), limit, offset, nil
+}
+
+// handleListJobs lists the jobs in a state, oldest first, optionally of
+// one caller.
+func handleListJobs(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	state, caller, limit, offset, err := parseJobListQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	all, err := jobs.store.List(r.Context(), state)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error listing jobs", "error", err)
+		http.Error(w, "Error listing jobs", http.StatusInternalServerError)
+		return
+	}
+	if caller != "" {
+		all = slices.DeleteFunc(all, func(job Job) bool {
+			return job.Caller != caller
+		})
+	}
+
+	list := JobList{Jobs: append([]Job{}, all[min(offset, len(all)):min(offset+limit, len(all))]...)}
+	if offset+limit < len(all) {
+		list.NextOffset = offset + limit
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(list)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error encoding jobs", "error", err)
+	}
+}
+
+// handleCancelJob cancels a queued, running or dead job. A running job is
+// cancelled asynchronously, so it answers 202 with the job still running.
+func handleCancelJob(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	job, found, err := jobs.cancelJob(r.Context(), r.PathValue("id"))
+	if errors.Is(err, errJobFinished) {
+		http.Error(w, "Job already finished", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error cancelling job", "error", err)
+		http.Error(w, "Error cancelling job", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	logger.InfoContext(r.Context(), "AUDIT job cancelled", "job", job.ID, "state", job.State, "caller", job.Caller)
+
+	status := http.StatusOK
+	if job.State == jobRunning {
+		status = http.StatusAccepted
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err = json.NewEncoder(w).Encode(job)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error encoding job", "error", err)
+	}
+}
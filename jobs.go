@@ -0,0 +1,810 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	jobsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ai_sms_jobs_total",
+		Help: "The total number of finished background jobs by state (succeeded, failed, dead or cancelled)",
+	}, []string{"state"})
+	jobsQueuedGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ai_sms_jobs_queued",
+		Help: "The number of background jobs waiting for a worker",
+	})
+	jobsDeadGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ai_sms_jobs_dead",
+		Help: "The number of background jobs in the dead-letter queue",
+	})
+	jobWorkersGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ai_sms_job_workers",
+		Help: "The number of background job workers",
+	})
+	jobWorkersBusyGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ai_sms_job_workers_busy",
+		Help: "The number of background job workers running a job",
+	})
+	jobQueueLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ai_sms_job_queue_duration_seconds",
+		Help:    "Time background jobs waited in the queue before a worker started them",
+		Buckets: []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600},
+	})
+	jobRetryCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ai_sms_job_retries_total",
+		Help: "The total number of retried background job attempts by error class",
+	}, []string{"class"})
+)
+
+// Job states. A job failing with a transient error on its last attempt is
+// dead rather than failed: it waits in the dead-letter queue to be queued
+// again once the provider recovers.
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobDead      = "dead"
+	jobCancelled = "cancelled"
+)
+
+// errJobQueueFull is returned when jobs.max_queued jobs are already waiting.
+var errJobQueueFull = errors.New("job queue is full")
+
+// errJobCancelled is the error of a job cancelled by an operator.
+var errJobCancelled = errors.New("job was cancelled")
+
+// JobsConfig runs the generations submitted to POST /api/v1/jobs in the
+// background, on Workers goroutines. Backend is "memory", or "bolt" to keep
+// the jobs in a BoltDB file at Path so they survive restarts.
+type JobsConfig struct {
+	Backend   string `yaml:"backend"`
+	Path      string `yaml:"path"`
+	Workers   int    `yaml:"workers"`
+	MaxQueued int    `yaml:"max_queued"`
+	// Priorities names the job priorities, highest first
+	Priorities      []string `yaml:"priorities"`
+	DefaultPriority string   `yaml:"default_priority"`
+	// Timeout bounds each attempt at a job
+	Timeout time.Duration  `yaml:"timeout"`
+	Retry   JobRetryConfig `yaml:"retry"`
+	// ResultTTL is how long a finished job can be fetched
+	ResultTTL time.Duration `yaml:"result_ttl"`
+	// DeadTTL is how long a dead job stays in the dead-letter queue
+	DeadTTL  time.Duration     `yaml:"dead_ttl"`
+	Callback JobCallbackConfig `yaml:"callback"`
+}
+
+// JobRetryConfig retries jobs failing with a transient error, such as a
+// timeout, an upstream 5xx or 429, or an overloaded service. The worker
+// waits out the backoff, which also slows the queue down while a provider
+// is rate limiting. MaxAttempts counts the first attempt, so 1 disables
+// retries.
+type JobRetryConfig struct {
+	MaxAttempts    int           `yaml:"max_attempts"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+	Multiplier     float64       `yaml:"multiplier"`
+}
+
+// JobInput is what a job generates: the parameters of /getAiSmsContent.
+type JobInput struct {
+	Prompt   string `json:"prompt"`
+	Model    string `json:"model,omitempty"`
+	Provider string `json:"provider,omitempty"`
+	Preset   string `json:"preset,omitempty"`
+	// Transliterate writes Russian output in Latin letters
+	Transliterate bool `json:"transliterate,omitempty"`
+	// Link is put in the text, shortened
+	Link string `json:"link,omitempty"`
+	// Variables fill the {name} placeholders of the prompt in the generated
+	// text, without being shown to the model
+	Variables map[string]string `json:"variables,omitempty"`
+	// Tone and Persona pick system prompt snippets from the config
+	Tone    string `json:"tone,omitempty"`
+	Persona string `json:"persona,omitempty"`
+	// NumCandidates texts are generated and the best one returned, or all
+	// of them, ranked, with AllCandidates
+	NumCandidates int  `json:"num_candidates,omitempty"`
+	AllCandidates bool `json:"all_candidates,omitempty"`
+	// Seed makes the generation repeatable where the provider supports it
+	Seed *int64 `json:"seed,omitempty"`
+	// Sampling sets the stop sequences and other sampling parameters
+	Sampling
+	// Language is the ISO 639-1 code of the language of the text
+	Language string `json:"language,omitempty"`
+}
+
+// Job is a generation run in the background.
+type Job struct {
+	ID         string       `json:"id"`
+	State      string       `json:"state"`
+	Input      JobInput     `json:"input"`
+	Priority   string       `json:"priority"`
+	Caller     string       `json:"caller,omitempty"`
+	RequestID  string       `json:"request_id,omitempty"`
+	CreatedAt  time.Time    `json:"created_at"`
+	Attempts   int          `json:"attempts,omitempty"`
+	StartedAt  *time.Time   `json:"started_at,omitempty"`
+	FinishedAt *time.Time   `json:"finished_at,omitempty"`
+	Result     *SmsResponse `json:"result,omitempty"`
+	Error      string       `json:"error,omitempty"`
+	Callback   *JobCallback `json:"callback,omitempty"`
+}
+
+// jobs runs the background jobs; it is set up at startup.
+var jobs *jobQueue
+
+// jobQueue hands the queued jobs to the workers in the order of the
+// scheduler. Jobs are saved
+// in the store at every step, so with a persistent store the queued and
+// running ones are queued again after a restart: each job runs at least
+// once, and a worker skips a job that is no longer queued.
+type jobQueue struct {
+	store JobStore
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queued *jobScheduler
+	closed bool
+	// running cancels the running jobs by ID
+	running map[string]context.CancelCauseFunc
+
+	// ctx is cancelled on shutdown, interrupting the running jobs
+	ctx       context.Context
+	cancel    context.CancelFunc
+	workers   sync.WaitGroup
+	callbacks sync.WaitGroup
+	providers *providerSet
+	logger    *slog.Logger
+}
+
+// startJobQueue opens the job store, queues the jobs left pending by the
+// last run and starts the workers.
+func startJobQueue(config JobsConfig, providers *providerSet, logger *slog.Logger) (*jobQueue, error) {
+	store, err := openJobStore(config)
+	if err != nil {
+		return nil, err
+	}
+	q := &jobQueue{
+		store:     store,
+		queued:    newJobScheduler(len(config.Priorities), jobWeight),
+		running:   make(map[string]context.CancelCauseFunc),
+		providers: providers,
+		logger:    logger,
+	}
+	q.cond = sync.NewCond(&q.mu)
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+
+	pending, err := store.Pending(q.ctx)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("reading pending jobs: %v", err)
+	}
+	for _, job := range pending {
+		if job.State == jobRunning {
+			job.State = jobQueued
+			job.StartedAt = nil
+			err = store.Put(q.ctx, job)
+			if err != nil {
+				store.Close()
+				return nil, err
+			}
+		}
+		q.queued.push(job.ID, job.Caller, priorityRank(job.Priority))
+	}
+	jobsQueuedGauge.Set(float64(q.queued.len()))
+	err = q.countDead()
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("reading dead jobs: %v", err)
+	}
+	logger.Info("Started job workers", "store", store.Name(), "workers", config.Workers, "recovered", len(pending))
+
+	for range config.Workers {
+		q.workers.Add(1)
+		go q.work()
+	}
+	jobWorkersGauge.Set(float64(config.Workers))
+	go q.prune()
+	return q, nil
+}
+
+// submit saves and queues job. When a job with the same ID exists it is
+// returned instead, with false.
+func (q *jobQueue) submit(ctx context.Context, job Job) (Job, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	existing, found, err := q.store.Get(ctx, job.ID)
+	if err != nil {
+		return Job{}, false, err
+	}
+	if found {
+		return existing, false, nil
+	}
+	if q.queued.len() >= currentConfig().Jobs.MaxQueued {
+		return Job{}, false, errJobQueueFull
+	}
+	err = q.store.Put(ctx, job)
+	if err != nil {
+		return Job{}, false, err
+	}
+	q.queued.push(job.ID, job.Caller, priorityRank(job.Priority))
+	jobsQueuedGauge.Inc()
+	q.cond.Signal()
+	return job, true, nil
+}
+
+func (q *jobQueue) get(ctx context.Context, id string) (Job, bool, error) {
+	return q.store.Get(ctx, id)
+}
+
+// next waits for a queued job ID; false once the queue is closed.
+func (q *jobQueue) next() (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.queued.len() == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return "", false
+	}
+	id, _ := q.queued.pop()
+	jobsQueuedGauge.Dec()
+	return id, true
+}
+
+func (q *jobQueue) work() {
+	defer q.workers.Done()
+	for {
+		id, ok := q.next()
+		if !ok {
+			return
+		}
+		job, ctx, ok := q.start(id)
+		if !ok {
+			continue
+		}
+
+		jobWorkersBusyGauge.Inc()
+		result, err := q.attempt(ctx, &job)
+		jobWorkersBusyGauge.Dec()
+		if q.ctx.Err() != nil {
+			// Interrupted by shutdown; run it again after the restart
+			job.State = jobQueued
+			job.StartedAt = nil
+			q.save(job)
+			return
+		}
+		q.finish(ctx, job, result, err)
+	}
+}
+
+// start marks the queued job with id running and returns it with the
+// context to run it in; false when the job is no longer queued.
+func (q *jobQueue) start(id string) (Job, context.Context, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, found, err := q.store.Get(q.ctx, id)
+	if err != nil {
+		// The job stays pending in the store and runs after a restart
+		q.logger.Error("Error reading job", "job", id, "error", err)
+		return Job{}, nil, false
+	}
+	if !found || job.State != jobQueued {
+		return Job{}, nil, false
+	}
+
+	now := time.Now().UTC()
+	if job.Attempts == 0 {
+		jobQueueLatency.Observe(now.Sub(job.CreatedAt).Seconds())
+	}
+	job.State = jobRunning
+	job.StartedAt = &now
+	ctx, cancel := context.WithCancelCause(q.ctx)
+	q.running[id] = cancel
+	return job, ctx, true
+}
+
+// finish saves the outcome of the job run in ctx: its result, its error,
+// or that it was cancelled meanwhile.
+func (q *jobQueue) finish(ctx context.Context, job Job, result SmsResponse, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.running[job.ID](nil)
+	delete(q.running, job.ID)
+
+	finished := time.Now().UTC()
+	job.FinishedAt = &finished
+	switch {
+	case errors.Is(context.Cause(ctx), errJobCancelled):
+		job.State = jobCancelled
+		job.Result = nil
+		job.Error = errJobCancelled.Error()
+	case err != nil:
+		job.State = jobFailed
+		if isTransientError(err) {
+			job.State = jobDead
+			jobsDeadGauge.Inc()
+		}
+		job.Error = generationErrorMessage(err)
+	default:
+		job.State = jobSucceeded
+		job.Result = &result
+	}
+	q.save(job)
+	jobsCounter.WithLabelValues(job.State).Inc()
+	if job.Callback != nil {
+		q.notify(job)
+	}
+}
+
+// attempt runs job until it succeeds, fails for good or runs out of
+// attempts, backing off between attempts. The attempts are counted in the
+// store, so a job recovered after a restart doesn't start over.
+func (q *jobQueue) attempt(ctx context.Context, job *Job) (SmsResponse, error) {
+	policy := currentConfig().Jobs.Retry
+	backoff := policy.InitialBackoff
+	for {
+		job.Attempts++
+		q.save(*job)
+		result, err := q.run(ctx, *job)
+		if err == nil || ctx.Err() != nil || job.Attempts >= policy.MaxAttempts || !isTransientError(err) {
+			return result, err
+		}
+
+		class := errorClass(err)
+		jobRetryCounter.WithLabelValues(class).Inc()
+		job.Error = generationErrorMessage(err)
+		q.save(*job)
+		wait := backoff/2 + rand.N(backoff/2+1)
+		q.logger.Warn("Retrying job", "job", job.ID, "attempt", job.Attempts, "class", class, "wait", wait)
+		select {
+		case <-ctx.Done():
+			return SmsResponse{}, ctx.Err()
+		case <-time.After(wait):
+		}
+		job.Error = ""
+		backoff = min(time.Duration(float64(backoff)*policy.Multiplier), policy.MaxBackoff)
+	}
+}
+
+// save writes job to the store, logging failures.
+func (q *jobQueue) save(job Job) {
+	// Saving must not fail because of the shutdown it is part of
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(q.ctx), 10*time.Second)
+	defer cancel()
+	err := q.store.Put(ctx, job)
+	if err != nil {
+		q.logger.Error("Error saving job", "job", job.ID, "state", job.State, "error", err)
+	}
+}
+
+// prune deletes the jobs finished more than jobs.result_ttl ago, every
+// minute until the queue is closed.
+func (q *jobQueue) prune() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		config := currentConfig().Jobs
+		now := time.Now()
+		deleted, err := q.store.DeleteFinished(q.ctx, now.Add(-config.ResultTTL), now.Add(-config.DeadTTL))
+		if err == nil && deleted > 0 {
+			err = q.countDead()
+		}
+		if err != nil && q.ctx.Err() == nil {
+			q.logger.Error("Error deleting finished jobs", "error", err)
+		}
+	}
+}
+
+// countDead sets the dead-letter queue gauge from the store.
+func (q *jobQueue) countDead() error {
+	dead, err := q.store.List(q.ctx, jobDead)
+	if err != nil {
+		return err
+	}
+	jobsDeadGauge.Set(float64(len(dead)))
+	return nil
+}
+
+// dead returns the jobs of caller in the dead-letter queue, oldest first.
+// Anonymous callers, with an empty caller, only get anonymous jobs;
+// operators see them all at GET /admin/jobs.
+func (q *jobQueue) dead(ctx context.Context, caller string) ([]Job, error) {
+	dead, err := q.store.List(ctx, jobDead)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(dead, func(job Job) bool {
+		return job.Caller != caller
+	}), nil
+}
+
+// requeue queues the dead jobs of caller again with fresh attempts: those
+// with ids, or all of them when ids is empty. It queues either all the jobs
+// or, when they don't fit in jobs.max_queued, none.
+func (q *jobQueue) requeue(ctx context.Context, caller string, ids []string) ([]Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	dead, err := q.dead(ctx, caller)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) > 0 {
+		dead = slices.DeleteFunc(dead, func(job Job) bool {
+			return !slices.Contains(ids, job.ID)
+		})
+	}
+	if q.queued.len()+len(dead) > currentConfig().Jobs.MaxQueued {
+		return nil, errJobQueueFull
+	}
+
+	requeued := make([]Job, 0, len(dead))
+	for _, job := range dead {
+		job.State = jobQueued
+		job.Attempts = 0
+		job.StartedAt = nil
+		job.FinishedAt = nil
+		job.Error = ""
+		if job.Callback != nil {
+			job.Callback = &JobCallback{URL: job.Callback.URL}
+		}
+		err = q.store.Put(ctx, job)
+		if err != nil {
+			return requeued, err
+		}
+		q.queued.push(job.ID, job.Caller, priorityRank(job.Priority))
+		jobsQueuedGauge.Inc()
+		jobsDeadGauge.Dec()
+		q.cond.Signal()
+		requeued = append(requeued, job)
+	}
+	return requeued, nil
+}
+
+// close stops taking jobs and waits until ctx is done for the running ones
+// to finish. Jobs still running then are interrupted and stay queued;
+// callbacks still being delivered are abandoned.
+func (q *jobQueue) close(ctx context.Context) error {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		q.cancel()
+		<-done
+	}
+	q.cancel()
+	q.callbacks.Wait()
+	return q.store.Close()
+}
+
+// run generates the text of job within jobs.timeout. The context carries
+// the caller and request ID of the submission, so the generation is logged
+// and recorded like a synchronous one.
+func (q *jobQueue) run(ctx context.Context, job Job) (SmsResponse, error) {
+	ctx = withLogFields(ctx)
+	if job.Caller != "" {
+		ctx = context.WithValue(ctx, callerKey{}, Caller{ID: job.Caller})
+	}
+	if job.RequestID != "" {
+		ctx = context.WithValue(ctx, requestIDKey{}, job.RequestID)
+	}
+	addLogFields(ctx, "job", job.ID, "request_id", job.RequestID)
+	ctx, cancel := context.WithTimeout(ctx, currentConfig().Jobs.Timeout)
+	defer cancel()
+
+	provider, request, postProcess, err := prepareJob(q.providers, job.Input)
+	if err != nil {
+		// The job was valid when submitted, but the config changed since
+		q.logger.ErrorContext(ctx, "Invalid job", "error", err)
+		return SmsResponse{}, err
+	}
+	response, err := generateSms(ctx, provider, request, postProcess, q.logger)
+	if err != nil {
+		if context.Cause(ctx) == nil || errors.Is(context.Cause(ctx), context.DeadlineExceeded) {
+			q.logger.ErrorContext(ctx, "Error running job", "error", err)
+		}
+		return SmsResponse{}, err
+	}
+	return newSmsResponse(response), nil
+}
+
+// priorityRank returns the index of priority in jobs.priorities. Jobs of
+// a priority since removed from the config rank lowest.
+func priorityRank(priority string) int {
+	priorities := currentConfig().Jobs.Priorities
+	rank := slices.Index(priorities, priority)
+	if rank < 0 {
+		return len(priorities)
+	}
+	return rank
+}
+
+// jobWeight returns the share of the job workers of caller against the
+// other callers with jobs of the same priority: the job_weight of its API
+// key, or 1.
+func jobWeight(caller string) int {
+	weight := apiKeys.jobWeight(caller)
+	if weight < 1 {
+		return 1
+	}
+	return weight
+}
+
+// prepareJob builds the generation request for input the way
+// /getAiSmsContent does. It runs on submission to reject invalid jobs
+// right away, and again when the job runs.
+func prepareJob(providers *providerSet, input JobInput) (Provider, Request, PostProcessConfig, error) {
+	if strings.TrimSpace(input.Prompt) == "" {
+		return nil, Request{}, PostProcessConfig{}, errors.New("prompt is required")
+	}
+	prompt, err := screenPrompt(input.Prompt)
+	if err != nil {
+		return nil, Request{}, PostProcessConfig{}, err
+	}
+	request := newGenerateRequest(prompt, input.Model)
+	request.Seed = input.Seed
+	err = checkPromptSize(request)
+	if err != nil {
+		return nil, Request{}, PostProcessConfig{}, err
+	}
+	postProcess, err := applyPreset(input.Preset, &request)
+	if err != nil {
+		return nil, Request{}, PostProcessConfig{}, err
+	}
+	err = applyVoice(input.Tone, input.Persona, &request)
+	if err != nil {
+		return nil, Request{}, PostProcessConfig{}, err
+	}
+	err = applySampling(input.Sampling, &request)
+	if err != nil {
+		return nil, Request{}, PostProcessConfig{}, err
+	}
+	postProcess.Transliterate = postProcess.Transliterate || input.Transliterate
+	err = checkLink(input.Link)
+	if err != nil {
+		return nil, Request{}, PostProcessConfig{}, err
+	}
+	postProcess.Link = input.Link
+	postProcess.Variables, err = promptVariables(prompt, input.Variables)
+	if err != nil {
+		return nil, Request{}, PostProcessConfig{}, err
+	}
+	err = checkCandidates(input.NumCandidates)
+	if err != nil {
+		return nil, Request{}, PostProcessConfig{}, err
+	}
+	postProcess.Candidates = input.NumCandidates
+	postProcess.AllCandidates = input.AllCandidates
+	err = applyLanguage(providers, input.Language, &postProcess)
+	if err != nil {
+		return nil, Request{}, PostProcessConfig{}, err
+	}
+	provider, err := selectProvider(providers, input.Provider, &request)
+	if err != nil {
+		return nil, Request{}, PostProcessConfig{}, err
+	}
+	return provider, request, postProcess, nil
+}
+
+// jobSubmission is the body of POST /api/v1/jobs.
+type jobSubmission struct {
+	// ID optionally names the job, so a client resubmitting after a lost
+	// response gets the job it already submitted instead of a second one
+	ID string `json:"id"`
+	// Priority is one of jobs.priorities, jobs.default_priority if empty
+	Priority string `json:"priority"`
+	// CallbackURL optionally receives the job once it finishes
+	CallbackURL string `json:"callback_url"`
+	JobInput
+}
+
+// handleSubmitJob queues a generation and answers 202 with the job, to be
+// polled at its Location.
+func handleSubmitJob(w http.ResponseWriter, r *http.Request, providers *providerSet, logger *slog.Logger) {
+	requestCounter.Inc()
+	var submission jobSubmission
+	err := json.NewDecoder(r.Body).Decode(&submission)
+	if err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if submission.ID == "" {
+		submission.ID = newUUID()
+	}
+	if !requestIDPattern.MatchString(submission.ID) {
+		http.Error(w, "id must be 1 to 128 letters, digits or ._:-", http.StatusBadRequest)
+		return
+	}
+	if submission.ID == jobDead {
+		// GET /api/v1/jobs/dead is the dead-letter queue
+		http.Error(w, "id dead is reserved", http.StatusBadRequest)
+		return
+	}
+	priorities := currentConfig().Jobs.Priorities
+	if submission.Priority == "" {
+		submission.Priority = currentConfig().Jobs.DefaultPriority
+	}
+	if !slices.Contains(priorities, submission.Priority) {
+		http.Error(w, "priority must be one of "+strings.Join(priorities, ", "), http.StatusBadRequest)
+		return
+	}
+	_, _, _, err = prepareJob(providers, submission.JobInput)
+	var tooLarge *promptTooLargeError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var callback *JobCallback
+	if submission.CallbackURL != "" {
+		callback, err = newJobCallback(submission.CallbackURL)
+		if errors.Is(err, errCallbacksDisabled) {
+			http.Error(w, "Job callbacks are not configured", http.StatusNotImplemented)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	job := Job{
+		ID:        submission.ID,
+		State:     jobQueued,
+		Input:     submission.JobInput,
+		Priority:  submission.Priority,
+		Callback:  callback,
+		RequestID: requestID(r.Context()),
+		CreatedAt: time.Now().UTC(),
+	}
+	if caller, ok := callerFrom(r.Context()); ok {
+		job.Caller = caller.ID
+	}
+	job, created, err := jobs.submit(r.Context(), job)
+	if errors.Is(err, errJobQueueFull) {
+		shedCounter.WithLabelValues("job_queue_full").Inc()
+		writeRetryAfter(w, time.Minute)
+		http.Error(w, "Too many queued jobs, try again later", http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error queueing job", "error", err)
+		http.Error(w, "Error queueing job", http.StatusInternalServerError)
+		return
+	}
+	addLogFields(r.Context(), "job", job.ID, "priority", job.Priority)
+	status := http.StatusAccepted
+	if !created {
+		if caller, _ := callerFrom(r.Context()); job.Caller != caller.ID {
+			http.Error(w, "Job ID is already taken", http.StatusConflict)
+			return
+		}
+		status = http.StatusOK
+	} else {
+		logger.InfoContext(r.Context(), "Queued job")
+	}
+
+	location := "/api/v1/jobs/" + job.ID
+	w.Header().Set("Location", location)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err = json.NewEncoder(w).Encode(job)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error encoding job", "error", err)
+	}
+}
+
+// handleGetJob returns the state of a job and, once it succeeded, its
+// result. Callers only see their own jobs, anonymous ones anonymous jobs.
+func handleGetJob(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	job, found, err := jobs.get(r.Context(), r.PathValue("id"))
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error reading job", "error", err)
+		http.Error(w, "Error reading job", http.StatusInternalServerError)
+		return
+	}
+	if caller, _ := callerFrom(r.Context()); found && job.Caller != caller.ID {
+		found = false
+	}
+	if !found {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(job)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error encoding job", "error", err)
+	}
+}
+
+// handleListDeadJobs lists the caller's jobs in the dead-letter queue.
+func handleListDeadJobs(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	caller, _ := callerFrom(r.Context())
+	dead, err := jobs.dead(r.Context(), caller.ID)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error reading dead jobs", "error", err)
+		http.Error(w, "Error reading dead jobs", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(append([]Job{}, dead...))
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error encoding jobs", "error", err)
+	}
+}
+
+// requeueRequest is the body of POST /api/v1/jobs/dead. Without IDs, all
+// the caller's dead jobs are queued again.
+type requeueRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// handleRequeueDeadJobs queues dead jobs again and answers with them.
+func handleRequeueDeadJobs(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	var request requeueRequest
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+	}
+	caller, _ := callerFrom(r.Context())
+	requeued, err := jobs.requeue(r.Context(), caller.ID, request.IDs)
+	if errors.Is(err, errJobQueueFull) {
+		shedCounter.WithLabelValues("job_queue_full").Inc()
+		writeRetryAfter(w, time.Minute)
+		http.Error(w, "Too many queued jobs, try again later", http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error requeueing dead jobs", "error", err, "requeued", len(requeued))
+		http.Error(w, "Error requeueing dead jobs", http.StatusInternalServerError)
+		return
+	}
+	logger.InfoContext(r.Context(), "Requeued dead jobs", "jobs", len(requeued))
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(requeued)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error encoding jobs", "error", err)
+	}
+}
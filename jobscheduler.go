@@ -0,0 +1,108 @@
+package main
+
+import (
+	"maps"
+	"slices"
+)
+
+// jobScheduler orders the queued jobs. Priorities are strict: a job of a
+// higher priority always runs before one of a lower priority. Within a
+// priority the callers take turns in proportion to their job weight, so a
+// caller with a large batch queued delays the others by at most a few
+// jobs. Callers of the scheduler hold the job queue lock.
+type jobScheduler struct {
+	// levels holds the queued jobs per priority, highest first
+	levels []*priorityLevel
+	size   int
+	// weight returns the job weight of a caller, at least 1
+	weight func(caller string) int
+}
+
+// priorityLevel is stride scheduling between callers: each caller has a
+// pass that grows by 1/weight with every job it runs, and the caller with
+// the lowest pass goes next.
+type priorityLevel struct {
+	callers map[string]*callerJobs
+	// pass is the pass of the last caller served. Callers joining start
+	// from it, so a caller can't save up turns while it has nothing queued.
+	pass float64
+}
+
+type callerJobs struct {
+	ids  []string
+	pass float64
+}
+
+func newJobScheduler(priorities int, weight func(caller string) int) *jobScheduler {
+	s := &jobScheduler{weight: weight}
+	for range priorities {
+		s.levels = append(s.levels, &priorityLevel{callers: make(map[string]*callerJobs)})
+	}
+	return s
+}
+
+// push queues the job id of caller at the priority with index rank.
+func (s *jobScheduler) push(id, caller string, rank int) {
+	level := s.levels[min(rank, len(s.levels)-1)]
+	queue, ok := level.callers[caller]
+	if !ok {
+		queue = &callerJobs{pass: level.pass}
+		level.callers[caller] = queue
+	}
+	queue.ids = append(queue.ids, id)
+	s.size++
+}
+
+// pop returns the next job ID to run; false when no job is queued.
+func (s *jobScheduler) pop() (string, bool) {
+	for _, level := range s.levels {
+		if len(level.callers) == 0 {
+			continue
+		}
+		// Ties go to the caller first in name order, so the order is
+		// deterministic
+		var next string
+		var queue *callerJobs
+		for _, caller := range slices.Sorted(maps.Keys(level.callers)) {
+			candidate := level.callers[caller]
+			if queue == nil || candidate.pass < queue.pass {
+				next, queue = caller, candidate
+			}
+		}
+
+		id := queue.ids[0]
+		queue.ids = queue.ids[1:]
+		level.pass = queue.pass
+		queue.pass += 1 / float64(max(s.weight(next), 1))
+		if len(queue.ids) == 0 {
+			delete(level.callers, next)
+		}
+		s.size--
+		return id, true
+	}
+	return "", false
+}
+
+// remove takes the job id of caller at the priority with index rank out
+// of the queue; false if it isn't queued.
+func (s *jobScheduler) remove(id, caller string, rank int) bool {
+	level := s.levels[min(rank, len(s.levels)-1)]
+	queue, ok := level.callers[caller]
+	if !ok {
+		return false
+	}
+	i := slices.Index(queue.ids, id)
+	if i < 0 {
+		return false
+	}
+	queue.ids = slices.Delete(queue.ids, i, i+1)
+	if len(queue.ids) == 0 {
+		delete(level.callers, caller)
+	}
+	s.size--
+	return true
+}
+
+func (s *jobScheduler) len() int {
+	return s.size
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// JobStore persists the background jobs.
+type JobStore interface {
+	Name() string
+	// Put saves job, replacing the job with the same ID
+	Put(ctx context.Context, job Job) error
+	Get(ctx context.Context, id string) (Job, bool, error)
+	// Pending returns the queued and running jobs, oldest first
+	Pending(ctx context.Context) ([]Job, error)
+	// List returns the jobs in state, oldest first
+	List(ctx context.Context, state string) ([]Job, error)
+	// DeleteFinished deletes the jobs that finished before cutoff, and the
+	// dead ones that finished before deadCutoff
+	DeleteFinished(ctx context.Context, cutoff, deadCutoff time.Time) (int, error)
+	Close() error
+}
+
+// openJobStore opens the configured job backend.
+func openJobStore(config JobsConfig) (JobStore, error) {
+	if config.Backend == "bolt" {
+		return openBoltJobStore(config.Path)
+	}
+	return &memoryJobStore{jobs: make(map[string]Job)}, nil
+}
+
+// isPending reports whether job still has to run.
+func (job Job) isPending() bool {
+	return job.State == jobQueued || job.State == jobRunning
+}
+
+// expired reports whether job finished before cutoff, or before
+// deadCutoff for a dead job.
+func (job Job) expired(cutoff, deadCutoff time.Time) bool {
+	if job.State == jobDead {
+		cutoff = deadCutoff
+	}
+	return job.FinishedAt != nil && job.FinishedAt.Before(cutoff)
+}
+
+// memoryJobStore keeps the jobs in memory; they are lost on restart.
+type memoryJobStore struct {
+	mu   sync.Mutex
+	jobs map[string]Job
+}
+
+func (s *memoryJobStore) Name() string {
+	return "memory"
+}
+
+func (s *memoryJobStore) Put(_ context.Context, job Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.ID] = job
+	return nil
+}
+
+func (s *memoryJobStore) Get(_ context.Context, id string) (Job, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	return job, ok, nil
+}
+
+func (s *memoryJobStore) Pending(_ context.Context) ([]Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var pending []Job
+	for _, job := range s.jobs {
+		if job.isPending() {
+			pending = append(pending, job)
+		}
+	}
+	sortJobs(pending)
+	return pending, nil
+}
+
+func (s *memoryJobStore) List(_ context.Context, state string) ([]Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []Job
+	for _, job := range s.jobs {
+		if job.State == state {
+			list = append(list, job)
+		}
+	}
+	sortJobs(list)
+	return list, nil
+}
+
+func (s *memoryJobStore) DeleteFinished(_ context.Context, cutoff, deadCutoff time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deleted := 0
+	for id, job := range s.jobs {
+		if job.expired(cutoff, deadCutoff) {
+			delete(s.jobs, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *memoryJobStore) Close() error {
+	return nil
+}
+
+// jobsBucket holds the jobs of a BoltDB store as JSON by ID.
+var jobsBucket = []byte("jobs")
+
+// boltJobStore keeps the jobs in a BoltDB file, so they survive restarts.
+// The file is locked by one process at a time.
+type boltJobStore struct {
+	db *bolt.DB
+}
+
+func openBoltJobStore(path string) (*boltJobStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening job store %s: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(jobsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltJobStore{db: db}, nil
+}
+
+func (s *boltJobStore) Name() string {
+	return "bolt"
+}
+
+func (s *boltJobStore) Put(_ context.Context, job Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).Put([]byte(job.ID), data)
+	})
+}
+
+func (s *boltJobStore) Get(_ context.Context, id string) (Job, bool, error) {
+	var job Job
+	found := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(jobsBucket).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &job)
+	})
+	return job, found, err
+}
+
+func (s *boltJobStore) Pending(_ context.Context) ([]Job, error) {
+	return s.filter(Job.isPending)
+}
+
+func (s *boltJobStore) List(_ context.Context, state string) ([]Job, error) {
+	return s.filter(func(job Job) bool {
+		return job.State == state
+	})
+}
+
+// filter returns the jobs for which match is true, oldest first.
+func (s *boltJobStore) filter(match func(Job) bool) ([]Job, error) {
+	var list []Job
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(_, data []byte) error {
+			var job Job
+			err := json.Unmarshal(data, &job)
+			if err != nil {
+				return err
+			}
+			if match(job) {
+				list = append(list, job)
+			}
+			return nil
+		})
+	})
+	sortJobs(list)
+	return list, err
+}
+
+func (s *boltJobStore) DeleteFinished(_ context.Context, cutoff, deadCutoff time.Time) (int, error) {
+	var expired [][]byte
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(jobsBucket)
+		err := bucket.ForEach(func(key, data []byte) error {
+			var job Job
+			err := json.Unmarshal(data, &job)
+			if err != nil {
+				return err
+			}
+			if job.expired(cutoff, deadCutoff) {
+				expired = append(expired, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Deleting while iterating would skip keys
+		for _, key := range expired {
+			err = bucket.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(expired), nil
+}
+
+func (s *boltJobStore) Close() error {
+	return s.db.Close()
+}
+
+// sortJobs orders jobs oldest first.
+func sortJobs(jobs []Job) {
+	slices.SortFunc(jobs, func(a, b Job) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var languageCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ai_sms_language_total",
+	Help: "The total number of texts translated into the requested language, or still in another one after that, by language and action (translate or mismatch)",
+}, []string{"language", "action"})
+
+// Language modes: ask the model to write in the language, or translate
+// what it wrote.
+const (
+	languageInstruct  = "instruct"
+	languageTranslate = "translate"
+)
+
+// languageNames are the languages requests can ask for, by ISO 639-1 code.
+var languageNames = map[string]string{
+	"ar": "Arabic",
+	"de": "German",
+	"el": "Greek",
+	"en": "English",
+	"es": "Spanish",
+	"fr": "French",
+	"he": "Hebrew",
+	"hy": "Armenian",
+	"it": "Italian",
+	"ja": "Japanese",
+	"ka": "Georgian",
+	"kk": "Kazakh",
+	"ko": "Korean",
+	"pl": "Polish",
+	"pt": "Portuguese",
+	"ru": "Russian",
+	"tr": "Turkish",
+	"uk": "Ukrainian",
+	"zh": "Chinese",
+}
+
+// languagePrompt asks the model to write in a language.
+const languagePrompt = "Write the SMS in %s, whatever the language of the request."
+
+// translatePrompt is the system prompt of translations.
+const translatePrompt = "You translate SMS messages. Translate the SMS the user sends into %s. Keep placeholders in braces, links, numbers and names as they are. Reply with the translation only."
+
+// LanguageConfig sets how requests with a language get their text in it.
+// Mode "instruct" asks the model to write in the language; "translate"
+// has the text translated after generation by Translator, a provider, with
+// Model, or by the provider that wrote it when Translator is empty. Verify
+// detects the language of the text: in instruct mode a text in another
+// language is translated, and a text still in another one fails.
+type LanguageConfig struct {
+	Mode       string `yaml:"mode"`
+	Translator string `yaml:"translator"`
+	Model      string `yaml:"model"`
+	Verify     bool   `yaml:"verify"`
+}
+
+// languageError is a text not in the requested language even after
+// translation.
+type languageError struct {
+	Language string
+	Detected string
+}
+
+func (e *languageError) Error() string {
+	return fmt.Sprintf("the text is in %s, not %s", languageNames[e.Detected], languageNames[e.Language])
+}
+
+func (e *languageError) errorClass() string {
+	return "language"
+}
+
+// checkLanguage validates the language of a request.
+func checkLanguage(language string) error {
+	if _, ok := languageNames[language]; language != "" && !ok {
+		return fmt.Errorf("language %q is not supported", language)
+	}
+	return nil
+}
+
+// applyLanguage sets up postProcess to get the text in language: the
+// language and, when it may be needed, the provider to translate with.
+func applyLanguage(providers *providerSet, language string, postProcess *PostProcessConfig) error {
+	err := checkLanguage(language)
+	if err != nil || language == "" {
+		return err
+	}
+	postProcess.Language = language
+	config := currentConfig().Language
+	if config.Translator != "" && (config.Mode == languageTranslate || config.Verify) {
+		postProcess.Translator, err = providers.get(config.Translator)
+	}
+	return err
+}
+
+// withLanguagePrompt adds the instruction to write in language to a system
+// prompt.
+func withLanguagePrompt(system, language string) string {
+	return strings.TrimSpace(system + "\n\n" + fmt.Sprintf(languagePrompt, languageNames[language]))
+}
+
+// translate translates text into the language of postProcess, with its
+// translator or else provider.
+func translate(ctx context.Context, provider Provider, postProcess PostProcessConfig, text string, logger *slog.Logger) (Response, error) {
+	config := currentConfig()
+	if postProcess.Translator != nil {
+		provider = postProcess.Translator
+	}
+	temperature := 0.0
+	request := Request{
+		Prompt:      text,
+		System:      fmt.Sprintf(translatePrompt, languageNames[postProcess.Language]),
+		Model:       config.Language.Model,
+		Temperature: &temperature,
+		MaxTokens:   config.Generation.MaxTokens,
+	}
+	languageCounter.WithLabelValues(postProcess.Language, "translate").Inc()
+	return getAISmsContent(ctx, provider, request, logger)
+}
+
+// inLanguage reports whether text is in language, as far as it can be
+// told; texts in no language detectLanguage knows are taken to be.
+func inLanguage(text, language string) bool {
+	detected := detectLanguage(text)
+	return detected == "" || detected == language
+}
+
+// languageIgnored are the parts of a text not written in its language.
+var languageIgnored = regexp.MustCompile(`https?://\S+|\{[^{}]*\}`)
+
+// languageScripts are the languages that are the only one of the
+// detectable languages written in a script.
+var languageScripts = []struct {
+	language string
+	script   *unicode.RangeTable
+}{
+	// Kana before Han, as Japanese mixes both
+	{"ja", unicode.Hiragana},
+	{"ja", unicode.Katakana},
+	{"ko", unicode.Hangul},
+	{"zh", unicode.Han},
+	{"ar", unicode.Arabic},
+	{"he", unicode.Hebrew},
+	{"el", unicode.Greek},
+	{"hy", unicode.Armenian},
+	{"ka", unicode.Georgian},
+}
+
+// languageLetters are letters only some of the languages written in the
+// same script use.
+var languageLetters = []struct {
+	language string
+	letters  string
+}{
+	{"kk", "әғқңөұүһ"},
+	{"uk", "іїєґ"},
+	{"de", "ß"},
+	{"es", "ñ¿¡"},
+	{"tr", "ğşı"},
+	{"pl", "ąęłśźżń"},
+	{"pt", "ãõ"},
+}
+
+// languageWords are common short words of the languages written in Latin
+// letters.
+var languageWords = map[string][]string{
+	"en": {"the", "and", "you", "your", "for", "is", "are", "to", "of", "with", "our", "now", "today"},
+	"de": {"der", "die", "das", "und", "ist", "sie", "ihr", "ihre", "für", "mit", "nicht", "heute", "jetzt"},
+	"fr": {"le", "la", "les", "et", "est", "vous", "votre", "pour", "avec", "des", "une", "aujourd'hui"},
+	"es": {"el", "los", "las", "y", "es", "su", "para", "con", "del", "una", "hoy", "usted"},
+	"it": {"il", "gli", "e", "è", "per", "con", "della", "una", "oggi", "tuo", "vostro"},
+	"pt": {"o", "os", "as", "e", "é", "para", "com", "uma", "hoje", "seu", "você", "não"},
+	"tr": {"ve", "bir", "bu", "için", "ile", "sizin", "bugün", "değil"},
+	"pl": {"i", "jest", "dla", "się", "nie", "twój", "dziś", "na"},
+}
+
+// detectLanguage guesses the language of text from its script, the
+// letters only some languages use and common words. It returns "" when it
+// can't tell.
+func detectLanguage(text string) string {
+	text = languageIgnored.ReplaceAllString(text, " ")
+	var letters, cyrillic, latin int
+	scripts := map[string]int{}
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		switch {
+		case unicode.Is(unicode.Cyrillic, r):
+			cyrillic++
+		case unicode.Is(unicode.Latin, r):
+			latin++
+		default:
+			for _, script := range languageScripts {
+				if unicode.Is(script.script, r) {
+					scripts[script.language]++
+					break
+				}
+			}
+		}
+	}
+	if letters == 0 {
+		return ""
+	}
+	for _, script := range languageScripts {
+		if scripts[script.language]*2 > letters || script.language == "ja" && scripts["ja"] > 0 {
+			return script.language
+		}
+	}
+
+	lower := strings.ToLower(text)
+	if cyrillic*2 > letters {
+		for _, hint := range languageLetters[:2] {
+			if strings.ContainsAny(lower, hint.letters) {
+				return hint.language
+			}
+		}
+		return "ru"
+	}
+	if latin*2 <= letters {
+		return ""
+	}
+	scores := map[string]int{}
+	for _, hint := range languageLetters[2:] {
+		if strings.ContainsAny(lower, hint.letters) {
+			scores[hint.language] += 2
+		}
+	}
+	for _, word := range strings.FieldsFunc(lower, func(r rune) bool { return !unicode.IsLetter(r) && r != '\'' }) {
+		for language, words := range languageWords {
+			for _, w := range words {
+				if w == word {
+					scores[language]++
+				}
+			}
+		}
+	}
+	best, bestScore, tied := "", 0, false
+	for language, score := range scores {
+		switch {
+		case score > bestScore:
+			best, bestScore, tied = language, score, false
+		case score == bestScore:
+			tied = true
+		}
+	}
+	if tied || bestScore < 2 {
+		return ""
+	}
+	return best
+}
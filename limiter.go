@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	activeGenerationsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ai_sms_generations_active",
+		Help: "The number of upstream generation calls holding a concurrency slot",
+	})
+	queuedGenerationsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ai_sms_generations_queued",
+		Help: "The number of generation calls waiting for a concurrency slot",
+	})
+	shedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ai_sms_requests_shed_total",
+		Help: "The total number of requests rejected with 429 because the service was overloaded",
+	}, []string{"reason"})
+)
+
+// LimitsConfig bounds the upstream generation calls running at once. Calls
+// over the limit queue for up to QueueTimeout; with MaxQueued calls already
+// waiting, further calls are rejected right away.
+type LimitsConfig struct {
+	MaxConcurrentGenerations int           `yaml:"max_concurrent_generations"`
+	MaxQueued                int           `yaml:"max_queued"`
+	QueueTimeout             time.Duration `yaml:"queue_timeout"`
+	// MaxBodyBytes, MaxPromptChars and MaxPromptTokens bound what clients
+	// may send; 0 disables a limit
+	MaxBodyBytes    int64 `yaml:"max_body_bytes"`
+	MaxPromptChars  int   `yaml:"max_prompt_chars"`
+	MaxPromptTokens int   `yaml:"max_prompt_tokens"`
+}
+
+// unavailableError is an error telling the client to come back later.
+// Code is a stable machine-readable identifier.
+type unavailableError interface {
+	error
+	StatusCode() int
+	Code() string
+	RetryAfter() time.Duration
+}
+
+// asUnavailable reports whether err asks the client to retry later.
+func asUnavailable(err error) (unavailableError, bool) {
+	var unavailable unavailableError
+	ok := errors.As(err, &unavailable)
+	return unavailable, ok
+}
+
+// writeRetryAfter sets the Retry-After header, rounding up to whole seconds.
+func writeRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+}
+
+// UnavailableResponse is the body returned with an unavailableError.
+type UnavailableResponse struct {
+	Error struct {
+		Code              string `json:"code"`
+		Message           string `json:"message"`
+		RetryAfterSeconds int    `json:"retry_after_seconds"`
+	} `json:"error"`
+}
+
+// writeUnavailable answers with the status, Retry-After header and JSON
+// body for err.
+func writeUnavailable(w http.ResponseWriter, err unavailableError) {
+	var response UnavailableResponse
+	response.Error.Code = err.Code()
+	response.Error.Message = err.Error()
+	response.Error.RetryAfterSeconds = int(err.RetryAfter().Seconds()) + 1
+
+	writeRetryAfter(w, err.RetryAfter())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.StatusCode())
+	json.NewEncoder(w).Encode(response)
+}
+
+// overloadedError is returned when a generation was shed because the
+// concurrency limit and its queue are exhausted.
+type overloadedError struct {
+	Reason string
+	Wait   time.Duration
+}
+
+func (e *overloadedError) Error() string {
+	return "too many concurrent generations, try again later"
+}
+
+func (e *overloadedError) StatusCode() int {
+	return http.StatusTooManyRequests
+}
+
+func (e *overloadedError) Code() string {
+	return "overloaded"
+}
+
+func (e *overloadedError) RetryAfter() time.Duration {
+	return e.Wait
+}
+
+// generations limits the concurrent upstream generation calls.
+var generations = &generationLimiter{wake: make(chan struct{}), average: 5 * time.Second}
+
+// generationLimiter is a semaphore whose size is read from the current
+// config, so it follows reloads. It keeps a moving average of how long
+// generations take to estimate when shed clients should come back.
+type generationLimiter struct {
+	mu      sync.Mutex
+	active  int
+	queued  int
+	average time.Duration
+	wake    chan struct{}
+}
+
+// acquire waits for a free slot and returns the function releasing it.
+func (l *generationLimiter) acquire(ctx context.Context) (func(), error) {
+	limits := currentConfig().Limits
+	timer := time.NewTimer(limits.QueueTimeout)
+	defer timer.Stop()
+
+	queued := false
+	defer func() {
+		if queued {
+			l.mu.Lock()
+			l.queued--
+			l.mu.Unlock()
+			queuedGenerationsGauge.Dec()
+		}
+	}()
+	for {
+		l.mu.Lock()
+		if l.active < limits.MaxConcurrentGenerations {
+			l.active++
+			l.mu.Unlock()
+			activeGenerationsGauge.Inc()
+			start := time.Now()
+			return func() { l.release(start) }, nil
+		}
+		if !queued && l.queued >= limits.MaxQueued {
+			wait := l.estimateWait(limits)
+			l.mu.Unlock()
+			shedCounter.WithLabelValues("queue_full").Inc()
+			return nil, &overloadedError{Reason: "queue_full", Wait: wait}
+		}
+		if !queued {
+			queued = true
+			l.queued++
+			queuedGenerationsGauge.Inc()
+		}
+		wake := l.wake
+		l.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+			l.mu.Lock()
+			wait := l.estimateWait(limits)
+			l.mu.Unlock()
+			shedCounter.WithLabelValues("queue_timeout").Inc()
+			return nil, &overloadedError{Reason: "queue_timeout", Wait: wait}
+		}
+	}
+}
+
+// estimateWait guesses how long until the queue has drained enough for a
+// new call to start. Callers hold l.mu.
+func (l *generationLimiter) estimateWait(limits LimitsConfig) time.Duration {
+	return time.Duration(l.queued+1) * l.average / time.Duration(limits.MaxConcurrentGenerations)
+}
+
+func (l *generationLimiter) release(start time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.active--
+	l.average = (l.average*9 + time.Since(start)) / 10
+	activeGenerationsGauge.Dec()
+	// Wake all waiters; the first to get the lock takes the slot
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const defaultBitlyURL = "https://api-ssl.bitly.com/v4/shorten"
+
+var linksShortenedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ai_sms_links_shortened_total",
+	Help: "The total number of links shortened in generated texts by result (success or failure)",
+}, []string{"result"})
+
+// linkPattern matches the http and https URLs in a text.
+var linkPattern = regexp.MustCompile(`https?://[^\s"'<>«»]+`)
+
+// includeLinkPrompt asks the model to put the link of the request in the
+// text.
+const includeLinkPrompt = "\n\nInclude this link exactly as written: %s"
+
+// ShortenerConfig shortens the links in generated texts, for presets with
+// post_process.shorten_links and for the link of a request. Backend is
+// "bitly" (the Bitly v4 API at URL, links on Domain when set) or "http":
+// an internal endpoint at URL taking {"url": ...} and answering
+// {"short_url": ...}. TokenSecret names the secret sent as the bearer
+// token.
+type ShortenerConfig struct {
+	Backend     string `yaml:"backend"`
+	URL         string `yaml:"url"`
+	TokenSecret string `yaml:"token_secret"`
+	Domain      string `yaml:"domain"`
+}
+
+// LinkShortener shortens URLs.
+type LinkShortener interface {
+	Name() string
+	Shorten(ctx context.Context, long string) (string, error)
+}
+
+// linkShortener shortens links; nil when no backend is configured. It is
+// set up at startup.
+var linkShortener LinkShortener
+
+// newLinkShortener returns the configured shortener, or nil.
+func newLinkShortener(config ShortenerConfig, logger *slog.Logger) (LinkShortener, error) {
+	if config.Backend == "" {
+		return nil, nil
+	}
+	if config.URL == "" {
+		config.URL = defaultBitlyURL
+	}
+	token, err := lookupSecret(config.TokenSecret)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newProviderClient("", logger)
+	if err != nil {
+		return nil, err
+	}
+	return &httpShortener{config: config, token: token, client: client}, nil
+}
+
+// httpShortener shortens links with the Bitly API or an internal endpoint.
+type httpShortener struct {
+	config ShortenerConfig
+	token  string
+	client *http.Client
+}
+
+func (s *httpShortener) Name() string {
+	return s.config.Backend
+}
+
+func (s *httpShortener) Shorten(ctx context.Context, long string) (string, error) {
+	var body any = map[string]string{"url": long}
+	if s.config.Backend == "bitly" {
+		body = struct {
+			LongURL string `json:"long_url"`
+			Domain  string `json:"domain,omitempty"`
+		}{long, s.config.Domain}
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.URL, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("%s answered %s", s.config.Backend, resp.Status)
+	}
+	var shortened struct {
+		Link     string `json:"link"`
+		ShortURL string `json:"short_url"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&shortened)
+	if err != nil {
+		return "", fmt.Errorf("decoding the %s response: %v", s.config.Backend, err)
+	}
+	short := shortened.ShortURL
+	if s.config.Backend == "bitly" {
+		short = shortened.Link
+	}
+	if short == "" {
+		return "", fmt.Errorf("%s answered without a link", s.config.Backend)
+	}
+	return short, nil
+}
+
+// Link maps a short link in a generated text to the link it stands for,
+// for attributing clicks to the generation.
+type Link struct {
+	ShortURL     string    `json:"short_url"`
+	LongURL      string    `json:"long_url"`
+	GenerationID string    `json:"generation_id"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// checkLink validates the link of a request.
+func checkLink(link string) error {
+	if link == "" {
+		return nil
+	}
+	parsed, err := url.Parse(link)
+	if err != nil || parsed.Scheme != "http" && parsed.Scheme != "https" || parsed.Host == "" {
+		return errors.New("link must be an http or https URL")
+	}
+	return nil
+}
+
+// shortenLink returns the short form of long, or long itself when there
+// is no shortener or it fails. Shortened links are added to links.
+func shortenLink(ctx context.Context, long string, links map[string]string, logger *slog.Logger) string {
+	if linkShortener == nil {
+		return long
+	}
+	for short, known := range links {
+		if known == long {
+			return short
+		}
+	}
+	short, err := linkShortener.Shorten(ctx, long)
+	if err != nil {
+		linksShortenedCounter.WithLabelValues("failure").Inc()
+		logger.WarnContext(ctx, "Error shortening link, keeping it", "shortener", linkShortener.Name(), "error", err)
+		return long
+	}
+	linksShortenedCounter.WithLabelValues("success").Inc()
+	links[short] = long
+	return short
+}
+
+// shortenLinks replaces the URLs in text with short links, leaving the
+// ones that are short links already.
+func shortenLinks(ctx context.Context, text string, links map[string]string, logger *slog.Logger) string {
+	return linkPattern.ReplaceAllStringFunc(text, func(match string) string {
+		// Punctuation ending a sentence is not part of the link
+		link := strings.TrimRight(match, ".,;:!?)")
+		if _, ok := links[link]; ok {
+			return match
+		}
+		return shortenLink(ctx, link, links, logger) + match[len(link):]
+	})
+}
+
+// recordLinks queues recording the short links used in the final text of
+// a generation.
+func recordLinks(generationID, text string, links map[string]string) {
+	if history == nil || generationID == "" {
+		return
+	}
+	created := time.Now().UTC()
+	var used []Link
+	for short, long := range links {
+		if strings.Contains(text, short) {
+			used = append(used, Link{ShortURL: short, LongURL: long, GenerationID: generationID, CreatedAt: created})
+		}
+	}
+	if len(used) > 0 {
+		history.recordLinks(generationID, used)
+	}
+}
+
+// handleGetLink tells which link and generation a short link belongs to.
+func handleGetLink(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	if history == nil {
+		http.Error(w, "Generation history is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	short := r.URL.Query().Get("short_url")
+	if short == "" {
+		http.Error(w, "short_url is required", http.StatusBadRequest)
+		return
+	}
+	link, found, err := history.store.GetLink(r.Context(), short)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error reading link", "error", err)
+		http.Error(w, "Error reading link", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Link not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(link)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error encoding link", "error", err)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// LoggingConfig selects the log level, output format and destination.
+type LoggingConfig struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+	// Output is "both" (server.log_file and stdout), "file" or "stdout"
+	Output   string         `yaml:"output"`
+	Rotation RotationConfig `yaml:"rotation"`
+	Redact   RedactConfig   `yaml:"redact"`
+	// FullBodies logs request and response bodies without redaction; for
+	// development only
+	FullBodies bool `yaml:"full_bodies"`
+}
+
+// RedactConfig masks sensitive values in every log record. Credentials in
+// Authorization headers, bearer tokens and key/token/password fields are
+// always masked.
+type RedactConfig struct {
+	Phones bool `yaml:"phones"`
+	// Patterns are regular expressions whose matches are masked
+	Patterns []string `yaml:"patterns"`
+}
+
+// RotationConfig controls when the log file is rotated and how long rotated
+// files are kept. Zero MaxAgeDays or MaxBackups keeps them forever.
+type RotationConfig struct {
+	MaxSizeMB  int  `yaml:"max_size_mb"`
+	MaxAgeDays int  `yaml:"max_age_days"`
+	MaxBackups int  `yaml:"max_backups"`
+	Compress   bool `yaml:"compress"`
+}
+
+// newLogWriter opens the configured log destination. The returned function
+// closes the log file, if any.
+func newLogWriter(config *Config) (io.Writer, func() error, error) {
+	if config.Logging.Output == "stdout" {
+		return os.Stdout, func() error { return nil }, nil
+	}
+
+	// Fail at startup rather than losing every log line later
+	file, err := os.OpenFile(config.Server.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	file.Close()
+
+	rotation := config.Logging.Rotation
+	rotating := &lumberjack.Logger{
+		Filename:   config.Server.LogFile,
+		MaxSize:    rotation.MaxSizeMB,
+		MaxAge:     rotation.MaxAgeDays,
+		MaxBackups: rotation.MaxBackups,
+		Compress:   rotation.Compress,
+		LocalTime:  true,
+	}
+	if config.Logging.Output == "file" {
+		return rotating, rotating.Close, nil
+	}
+
+	return io.MultiWriter(rotating, os.Stdout), rotating.Close, nil
+}
+
+// newLogger returns a logger writing to w. Every record logged with a
+// request context also carries that request's fields (see addLogFields).
+func newLogger(w io.Writer, config LoggingConfig) (*slog.Logger, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(config.Level))
+	if err != nil {
+		return nil, err
+	}
+
+	redactor, err := newRedactor(config.Redact)
+	if err != nil {
+		return nil, err
+	}
+
+	options := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(_ []string, attr slog.Attr) slog.Attr {
+			switch attr.Value.Kind() {
+			case slog.KindDuration:
+				// Durations read better as "1.5s" than as nanoseconds
+				return slog.String(attr.Key, attr.Value.Duration().String())
+			case slog.KindString:
+				if attr.Key == "body" && config.FullBodies {
+					return attr
+				}
+				return redactor.attr(attr.Key, attr.Value.String())
+			case slog.KindAny:
+				if err, ok := attr.Value.Any().(error); ok {
+					return redactor.attr(attr.Key, err.Error())
+				}
+			}
+			return attr
+		},
+	}
+	var handler slog.Handler = slog.NewJSONHandler(w, options)
+	if config.Format == "text" {
+		handler = slog.NewTextHandler(w, options)
+	}
+
+	return slog.New(&contextHandler{handler}), nil
+}
+
+// redactedValue replaces masked values in the logs.
+const redactedValue = "[REDACTED]"
+
+var (
+	// sensitiveKeys are log attributes whose values are never logged
+	sensitiveKeys = map[string]bool{"authorization": true, "api_key": true, "token": true, "password": true, "secret": true}
+	// identifierKeys hold IDs and addresses the phone and custom patterns
+	// could mangle
+	identifierKeys = map[string]bool{"request_id": true, "origin_request_id": true, "prompt_hash": true, "client_ip": true, "addr": true, "route": true, "prediction": true, "caller": true, "key": true}
+	// credentialPattern finds credentials inside logged text such as
+	// request bodies and error messages
+	credentialPattern = regexp.MustCompile(`(?i)("?(?:authorization|x-api-key|api[_-]?key|access[_-]?token|token|password|secret)"?\s*[:=]\s*"?(?:(?:bearer|basic)\s+)?|(?:bearer|basic)\s+)[^\s",}]+`)
+	// phonePattern matches phone numbers of 10 to 15 digits, optionally
+	// with a leading + and separators. Long numeric IDs and Unix
+	// timestamps are masked too, which is the safe side to err on.
+	phonePattern = regexp.MustCompile(`\+?\d(?:[\s().-]{0,2}\d){9,14}`)
+)
+
+type redactor struct {
+	patterns []*regexp.Regexp
+}
+
+func newRedactor(config RedactConfig) (*redactor, error) {
+	r := &redactor{}
+	if config.Phones {
+		r.patterns = append(r.patterns, phonePattern)
+	}
+	for _, pattern := range config.Patterns {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		r.patterns = append(r.patterns, compiled)
+	}
+	return r, nil
+}
+
+// attr returns the attribute key with value masked as needed.
+func (r *redactor) attr(key, value string) slog.Attr {
+	switch {
+	case sensitiveKeys[strings.ToLower(key)]:
+		return slog.String(key, redactedValue)
+	case identifierKeys[key]:
+		return slog.String(key, value)
+	}
+	return slog.String(key, r.redact(value))
+}
+
+func (r *redactor) redact(value string) string {
+	value = credentialPattern.ReplaceAllString(value, "${1}"+redactedValue)
+	for _, pattern := range r.patterns {
+		value = pattern.ReplaceAllString(value, redactedValue)
+	}
+	return value
+}
+
+// fatal logs msg at error level and exits.
+func fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+type logFieldsKey struct{}
+
+// logFields are the attributes collected for a request as it is handled.
+// They are shared by everything logging for the request, including the
+// access log line written when it completes.
+type logFields struct {
+	mu    sync.Mutex
+	attrs []slog.Attr
+}
+
+// withLogFields returns a context collecting log fields.
+func withLogFields(ctx context.Context) context.Context {
+	return context.WithValue(ctx, logFieldsKey{}, &logFields{})
+}
+
+// addLogFields adds key/value pairs to the fields of the request in ctx,
+// replacing earlier values of the same keys. It does nothing outside a
+// request.
+func addLogFields(ctx context.Context, args ...any) {
+	fields, ok := ctx.Value(logFieldsKey{}).(*logFields)
+	if !ok {
+		return
+	}
+
+	record := slog.NewRecord(time.Time{}, 0, "", 0)
+	record.Add(args...)
+	fields.mu.Lock()
+	defer fields.mu.Unlock()
+	record.Attrs(func(attr slog.Attr) bool {
+		for i := range fields.attrs {
+			if fields.attrs[i].Key == attr.Key {
+				fields.attrs[i] = attr
+				return true
+			}
+		}
+		fields.attrs = append(fields.attrs, attr)
+		return true
+	})
+}
+
+// contextHandler adds the request fields found in the context to records.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if fields, ok := ctx.Value(logFieldsKey{}).(*logFields); ok {
+		fields.mu.Lock()
+		record.AddAttrs(fields.attrs...)
+		fields.mu.Unlock()
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{h.Handler.WithGroup(name)}
+}
+
+// promptHash identifies a prompt in the logs without repeating it.
+func promptHash(prompt string) string {
+	sum := sha256.Sum256([]byte(prompt))
+	return hex.EncodeToString(sum[:8])
+}
+
+// withAccessLog sets up the log fields of every request and logs one line
+// per request once it has been served.
+func withAccessLog(logger *slog.Logger, mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		ctx := withLogFields(r.Context())
+		addLogFields(ctx, "client_ip", clientIP(r))
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		logger.InfoContext(ctx, "Request served",
+			"method", r.Method,
+			"route", route,
+			"status", recorder.status,
+			"duration_ms", time.Since(start).Milliseconds(),
+		)
+	})
+}
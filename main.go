@@ -1,232 +1,774 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
-	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-const replicateToken = "Bearer replicate.com"
-
-type Input struct {
-	TopK             int     `json:"top_k"`
-	TopP             float64 `json:"top_p"`
-	Prompt           string  `json:"prompt"`
-	Temperature      float64 `json:"temperature"`
-	MaxNewTokens     int     `json:"max_new_tokens"`
-	PromptTemplate   string  `json:"prompt_template"`
-	PresencePenalty  float64 `json:"presence_penalty"`
-	FrequencyPenalty float64 `json:"frequency_penalty"`
-}
-
-type AIRequest struct {
-	Input Input `json:"input"`
-}
-
-type AIErrorResponse struct {
-	Title  string `json:"title"`
-	Detail string `json:"detail"`
-	Status int    `json:"status"`
-}
-
-type AIResponseUri struct {
-	URLs struct {
-		Cancel string `json:"cancel"`
-		Get    string `json:"get"`
-	} `json:"urls"`
-}
-
 var (
 	requestCounter = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "ai_sms_requests_total",
 		Help: "Total number of AI SMS requests",
 	})
+	cancelledCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ai_sms_requests_cancelled_total",
+		Help: "Total number of AI SMS requests cancelled because the client went away",
+	})
 )
 
 func main() {
+	// Load configuration, command-line flags win over the config file
+	flags := parseFlags()
+	configFile, required := flags.configPath()
+	config, err := loadConfig(configFile, required)
+	if err != nil {
+		slog.Error("Failed to load config", "error", err)
+		os.Exit(1)
+	}
+	flags.apply(config)
+	activeConfig.Store(config)
+
 	// Set up logging
-	logFile, err := os.OpenFile("ai_sms_service.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	logWriter, closeLog, err := newLogWriter(config)
+	if err != nil {
+		slog.Error("Failed to open log file", "error", err)
+		os.Exit(1)
+	}
+	defer closeLog()
+	logger, err := newLogger(logWriter, config.Logging)
 	if err != nil {
-		log.Fatalf("Failed to open log file: %v", err)
+		slog.Error("Failed to set up logging", "error", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+	if config.Logging.FullBodies {
+		logger.Warn("Logging full request and response bodies, do not use this in production")
 	}
-	defer logFile.Close()
-	logger := log.New(io.MultiWriter(logFile, os.Stdout), "", log.LstdFlags|log.Lmicroseconds)
 
-	// Set up Prometheus metrics
-	http.Handle("/metrics", promhttp.Handler())
-	go func() {
-		logger.Println("Starting Prometheus metrics server on :8082")
-		err := http.ListenAndServe(":8082", nil)
-		if err != nil {
-			logger.Fatalf("Failed to start Prometheus metrics server: %v", err)
-		}
-	}()
+	// Set up tracing
+	shutdownTracing, err := setupTracing(context.Background(), config.Tracing, logger)
+	if err != nil {
+		fatal(logger, "Failed to set up tracing", "error", err)
+	}
 
-	// Set up web server
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "index.html")
-	})
-	http.HandleFunc("/getAiSmsContent", func(w http.ResponseWriter, r *http.Request) {
-		requestCounter.Inc()
-		prompt := r.FormValue("prompt")
-		logger.Printf("Received request for AI SMS content with prompt: %s", prompt)
+	// Set up error reporting
+	flushErrors, err := setupErrorReporting(logger)
+	if err != nil {
+		fatal(logger, "Failed to set up error reporting", "error", err)
+	}
 
-		aiResponse, err := getAISmsContent(prompt, logger)
+	// Set up the secrets backend for provider credentials
+	providers := newProviderSet(logger)
+	secretStore, err := newSecretStore(config.Secrets, logger)
+	if err != nil {
+		fatal(logger, "Failed to set up secrets backend", "error", err)
+	}
+	if secretStore != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		values, err := secretStore.Fetch(ctx)
+		cancel()
 		if err != nil {
-			logger.Printf("Error getting AI SMS content: %v", err)
-			http.Error(w, "Error getting AI SMS content", http.StatusInternalServerError)
-			return
+			fatal(logger, "Failed to fetch secrets", "backend", secretStore.Name(), "error", err)
 		}
+		secretValues.set(values)
+		logger.Info("Loaded secrets", "backend", secretStore.Name(), "count", len(values))
+		go refreshSecrets(context.Background(), secretStore, config.Secrets.RefreshInterval, providers.reset, logger)
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		err = json.NewEncoder(w).Encode(aiResponse)
+	// Load the client API keys and set up JWT validation
+	err = apiKeys.load(config.Auth.KeysFile)
+	if err != nil {
+		fatal(logger, "Failed to load API keys", "error", err)
+	}
+
+	err = setupJWTVerifier(context.Background(), config.Auth.JWT, logger)
+	if err != nil {
+		fatal(logger, "Failed to set up JWT authentication", "error", err)
+	}
+
+	// Load and verify the Replicate tokens
+	replicateAPITokens, err := replicateTokens.all()
+	if err != nil {
+		fatal(logger, "Failed to load Replicate token", "error", err)
+	}
+	if len(replicateAPITokens) > 0 {
+		client, err := newProviderClient("replicate", logger)
 		if err != nil {
-			logger.Printf("Error encoding AI SMS response: %v", err)
-			http.Error(w, "Error encoding AI SMS response", http.StatusInternalServerError)
-			return
+			fatal(logger, "Failed to set up HTTP client", "error", err)
 		}
-	})
+		for i, token := range replicateAPITokens {
+			ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+			err = verifyReplicateToken(ctx, client, token)
+			cancel()
+			if err != nil {
+				fatal(logger, "Failed to verify Replicate token", "token", i+1, "error", err)
+			}
+		}
+		logger.Info("Replicate tokens verified", "count", len(replicateAPITokens))
+	} else {
+		logger.Info("REPLICATE_API_TOKEN is not set, Replicate generation is disabled")
+	}
 
-	logger.Println("Starting web server on :8080")
-	err = http.ListenAndServe(":8080", nil)
+	// Open the generation history
+	history, err = openHistory(config.History, logger)
 	if err != nil {
-		logger.Fatalf("Failed to start web server: %v", err)
+		fatal(logger, "Failed to open the generation history", "error", err)
 	}
-}
 
-func getAISmsContent(prompt string, logger *log.Logger) (*AIResponseUri, error) {
-	// Call external AI service
-	aiResponse, err := callAIService(prompt, logger)
+	// Set up the generation cache
+	responseCache, err = newResponseCache(config.Cache, logger)
 	if err != nil {
-		return nil, err
+		fatal(logger, "Failed to set up the generation cache", "error", err)
 	}
 
-	return aiResponse, nil
-}
-
-func callAIService(prompt string, logger *log.Logger) (*AIResponseUri, error) {
-	// Check if corporate proxy is set
-	proxyURL, err := getProxyURL()
+	// Start the background job workers
+	jobs, err = startJobQueue(config.Jobs, providers, logger)
 	if err != nil {
-		logger.Printf("Error getting proxy URL: %v", err)
-		return nil, err
+		fatal(logger, "Failed to start the job workers", "error", err)
 	}
 
-	// Create HTTP client with proxy
-	client := &http.Client{
-		Transport: &http.Transport{
-			Proxy: http.ProxyURL(proxyURL),
-		},
+	// Set up SMS sending
+	smsSender, err = newSmsSender(config, logger)
+	if err != nil {
+		fatal(logger, "Failed to set up SMS sending", "error", err)
+	}
+	if smsSender != nil {
+		logger.Info("Sending SMS", "gateway", smsSender.Name())
 	}
 
-	// Call AI service
-	requestBody := AIRequest{
-		Input: Input{
-			TopK:             50,
-			TopP:             0.9,
-			Prompt:           prompt,
-			Temperature:      0.6,
-			MaxNewTokens:     1024,
-			PromptTemplate:   "<s>[INST] {prompt} [/INST] ",
-			PresencePenalty:  0,
-			FrequencyPenalty: 0,
-		},
+	// Set up link shortening
+	linkShortener, err = newLinkShortener(config.Shortener, logger)
+	if err != nil {
+		fatal(logger, "Failed to set up link shortening", "error", err)
 	}
-	jsonBody, err := json.Marshal(requestBody)
+
+	// Set up moderation
+	moderator, err = newModerator(config.Moderation, logger)
 	if err != nil {
-		logger.Printf("Error marshaling request body: %v", err)
-		return nil, err
+		fatal(logger, "Failed to set up moderation", "error", err)
+	}
+	moderation = config.Moderation
+	if moderator != nil {
+		logger.Info("Moderating texts", "moderator", moderator.Name())
 	}
-	logger.Printf("Calling AI service with request body: %s", string(jsonBody))
 
-	req, err := http.NewRequest("POST", "https://api.replicate.com/v1/models/mistralai/mixtral-8x7b-instruct-v0.1/predictions", bytes.NewBuffer(jsonBody))
+	// Set up personal data scrubbing
+	scrubber, err = newPIIScrubber(config.PII)
 	if err != nil {
-		logger.Printf("Error creating request: %v", err)
-		return nil, err
+		fatal(logger, "Failed to set up personal data scrubbing", "error", err)
 	}
-	req.Header.Add("Authorization", replicateToken)
-	req.Header.Add("Content-Type", "application/json")
 
-	resp, err := client.Do(req)
+	// Load the profanity lists
+	profanity, err = newProfanityFilter(config.Profanity)
 	if err != nil {
-		logger.Printf("Error calling AI service: %v", err)
-		return nil, err
+		fatal(logger, "Failed to load the profanity lists", "error", err)
 	}
-	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	// Set up prompt injection screening
+	injectionGuard, err = newPromptGuard(config.Injection)
 	if err != nil {
-		logger.Printf("Error reading AI service response: %v", err)
-		return nil, err
+		fatal(logger, "Failed to set up prompt injection screening", "error", err)
 	}
-	logger.Printf("AI service response: %s", string(body))
 
-	if resp.StatusCode != 201 {
-		logger.Printf("Error calling AI service: status code %d", resp.StatusCode)
-		var aiErrorResponse AIErrorResponse
-		err = json.Unmarshal(body, &aiErrorResponse)
-		if err != nil {
-			logger.Printf("Error unmarshaling AI service ERROR response: %v", err)
-			return nil, nil
-		}
+	// Set up proofreading
+	proofreader, err = newProofreader(config.Proofread, providers, logger)
+	if err != nil {
+		fatal(logger, "Failed to set up proofreading", "error", err)
+	}
+	if proofreader != nil {
+		logger.Info("Proofreading texts", "proofreader", proofreader.Name())
+	}
 
+	// Start the scheduled generations
+	scheduler, err := startSchedules(config.Schedules, providers, logger)
+	if err != nil {
+		fatal(logger, "Failed to start the schedules", "error", err)
 	}
 
-	var AIResponseUri AIResponseUri
-	err = json.Unmarshal(body, &AIResponseUri)
+	// Set up AI provider
+	provider, err := providers.get("")
 	if err != nil {
-		logger.Printf("Error unmarshaling AI service response URI: %v", err)
-		return nil, err
+		fatal(logger, "Failed to set up AI provider", "error", err)
 	}
+	logger.Info("Using AI provider", "provider", provider.Name())
 
-	logger.Printf("result AI URI: %s", AIResponseUri.URLs.Get)
+	// Reload the config file on SIGHUP
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			logger.Info("Received SIGHUP, reloading config")
+			err := reloadConfig(flags, providers, logger)
+			if err != nil {
+				logger.Error("Failed to reload config", "error", err)
+			}
+		}
+	}()
 
-	// Call AI service again
-	req, err = http.NewRequest("GET", AIResponseUri.URLs.Get, nil)
-	if err != nil {
-		logger.Printf("result Error creating req AI answer: %v", err)
-		return nil, err
+	// Set up Prometheus metrics and profiling, on the metrics port unless
+	// they are served on the main port
+	registerRuntimeMetrics()
+	mux := http.NewServeMux()
+	if config.Server.MetricsListener == "main" {
+		mux.Handle("/metrics", withAdminIPAccess(metricsHandler()))
+		registerPprof(mux)
+	} else {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", metricsHandler())
+		registerPprof(metricsMux)
+		go func() {
+			logger.Info("Starting Prometheus metrics server", "addr", config.Server.MetricsAddr)
+			err := http.ListenAndServe(config.Server.MetricsAddr, withAdminIPAccess(metricsMux))
+			if err != nil {
+				fatal(logger, "Failed to start Prometheus metrics server", "error", err)
+			}
+		}()
 	}
-	req.Header.Add("Authorization", replicateToken)
-	req.Header.Add("Content-Type", "application/json")
 
-	start := time.Now()
-	resp, err = client.Do(req)
-	elapsed := time.Since(start)
+	// Set up web server
+	registerReadinessCheck("provider", func(ctx context.Context) error {
+		return checkProviderHealth(ctx, providers)
+	})
+	mux.HandleFunc("GET /healthz", handleHealthz)
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		handleReadyz(w, r, logger)
+	})
+	mux.Handle("/", http.FileServer(http.Dir(config.Server.StaticDir)))
+	// /getAiSmsContent takes form values; it is kept for the clients from
+	// before /api/v1/generate
+	mux.HandleFunc("/getAiSmsContent", requireCaller(withIdempotency(func(w http.ResponseWriter, r *http.Request) {
+		requestCounter.Inc()
+		logger.InfoContext(r.Context(), "Received request for AI SMS content", "prompt", r.FormValue("prompt"))
+		generate, err := generateRequestForm(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		provider, request, postProcess, err := generate.prepare(providers)
+		var tooLarge *promptTooLargeError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		aiResponse, err := generateSms(r.Context(), provider, request, postProcess, logger)
+		if err != nil {
+			writeGenerationError(w, r, err, false, logger)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(newSmsResponse(aiResponse))
+		if err != nil {
+			logger.ErrorContext(r.Context(), "Error encoding AI SMS response", "error", err)
+			return
+		}
+	})))
+	mux.HandleFunc("POST /api/v1/generate", requireCaller(withIdempotency(func(w http.ResponseWriter, r *http.Request) {
+		handleGenerate(w, r, providers, logger)
+	})))
+
+	mux.HandleFunc("/getAiSmsContent/stream", requireCaller(func(w http.ResponseWriter, r *http.Request) {
+		requestCounter.Inc()
+		prompt := r.FormValue("prompt")
+		logger.InfoContext(r.Context(), "Received streaming request for AI SMS content", "prompt", prompt)
+		prompt, err := screenPrompt(prompt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		request := newGenerateRequest(prompt, r.FormValue("model"))
+		request.Seed, err = parseSeed(r.FormValue("seed"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = checkPromptSize(request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		postProcess, err := applyPreset(r.FormValue("preset"), &request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = applyVoice(r.FormValue("tone"), r.FormValue("persona"), &request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sampling, err := samplingForm(r)
+		if err == nil {
+			err = applySampling(sampling, &request)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		provider, err := selectProvider(providers, r.FormValue("provider"), &request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Streamed text can't be translated, so the model is asked to write
+		// in the language whatever the mode
+		if language := r.FormValue("language"); language != "" {
+			err = checkLanguage(language)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			request.System = withLanguagePrompt(request.System, language)
+		}
+		addLogFields(r.Context(), "prompt_hash", promptHash(request.Prompt), "provider", provider.Name())
+		// Streamed text reaches the client before it could be checked, so
+		// only the prompt is moderated
+		_, err = moderate(r.Context(), moderationPrompt, request.Prompt, logger)
+		var blocked *moderationError
+		if errors.As(err, &blocked) {
+			writeBlocked(w, blocked)
+			return
+		}
+		if err != nil {
+			logger.ErrorContext(r.Context(), "Error moderating prompt", "error", err)
+			http.Error(w, "Error getting AI SMS content", http.StatusInternalServerError)
+			return
+		}
+		streamer, ok := provider.(StreamingProvider)
+		if !ok {
+			http.Error(w, "Streaming is not supported by provider "+provider.Name(), http.StatusBadRequest)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		// Headers are sent with the first token so upstream errors can
+		// still be reported with a proper status code
+		started := false
+		start := func() {
+			if started {
+				return
+			}
+			started = true
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("Connection", "keep-alive")
+		}
+
+		generationStart := time.Now()
+		response, err := generateStream(r.Context(), streamer, request, func(token string) error {
+			start()
+			err := writeSSE(w, "output", token)
+			if err != nil {
+				return err
+			}
+			flusher.Flush()
+			return nil
+		})
+		response.GenerationID = recordGeneration(r.Context(), provider, request, response, generationStart, err)
+		if err != nil && r.Context().Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.ErrorContext(r.Context(), "Error streaming AI SMS content", "error", err)
+			if unavailable, ok := asUnavailable(err); ok && !started {
+				writeUnavailable(w, unavailable)
+				return
+			}
+			if !started {
+				http.Error(w, "Error getting AI SMS content", http.StatusInternalServerError)
+				return
+			}
+			writeSSE(w, "error", "Error getting AI SMS content")
+			flusher.Flush()
+			return
+		}
+
+		addLogFields(r.Context(), "provider", response.Provider, "model", response.Model)
+		start()
+		// The footer is not the model's to leave out
+		if footer := postProcess.footer(); footer != "" {
+			writeSSE(w, "output", footer)
+			response.Text += footer
+		}
+		// The text was streamed already
+		summary := newSmsResponse(response)
+		summary.Text = ""
+		done, _ := json.Marshal(summary)
+		writeSSE(w, "done", string(done))
+		flusher.Flush()
+	}))
+
+	mux.HandleFunc("POST /predictions", requireCaller(withIdempotency(func(w http.ResponseWriter, r *http.Request) {
+		requestCounter.Inc()
+		prompt := r.FormValue("prompt")
+		logger.InfoContext(r.Context(), "Received request to start AI SMS prediction", "prompt", prompt)
+		if !replicateTokens.configured() {
+			http.Error(w, "Replicate is not configured", http.StatusServiceUnavailable)
+			return
+		}
+		prompt, err := screenPrompt(prompt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		request := Request{Prompt: prompt}
+		err = checkPromptSize(request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		provider, err := providers.get("replicate")
+		if err != nil {
+			logger.ErrorContext(r.Context(), "Error setting up Replicate", "error", err)
+			http.Error(w, "Error starting prediction", http.StatusInternalServerError)
+			return
+		}
+		client, err := newProviderClient("replicate", logger)
+		if err != nil {
+			http.Error(w, "Error starting prediction", http.StatusInternalServerError)
+			return
+		}
+		_, err = moderate(r.Context(), moderationPrompt, request.Prompt, logger)
+		if err != nil {
+			writeGenerationError(w, r, err, false, logger)
+			return
+		}
+		// The prediction is started like any generation, with personal data
+		// masked and through the limiter and breaker; the mask is kept to
+		// restore the output
+		request, mask := scrubRequest(request, provider)
+		var prediction *AIPrediction
+		_, err = guardedCall(r.Context(), provider, request, func(ctx context.Context) (Response, error) {
+			prediction, err = createPrediction(ctx, client, replicateTargetFor(request), newInput(request.Prompt), false, logger)
+			if err != nil {
+				return Response{}, err
+			}
+			return Response{ID: prediction.ID, Provider: provider.Name()}, nil
+		})
+		if unavailable, ok := asUnavailable(err); ok {
+			writeUnavailable(w, unavailable)
+			return
+		}
+		if err != nil {
+			logger.ErrorContext(r.Context(), "Error starting prediction", "error", err)
+			http.Error(w, "Error starting prediction", http.StatusBadGateway)
+			return
+		}
+		trackedPredictions.mask(prediction.ID, mask)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/predictions/"+prediction.ID)
+		w.WriteHeader(http.StatusAccepted)
+		err = json.NewEncoder(w).Encode(newPredictionStatus(prediction))
+		if err != nil {
+			logger.ErrorContext(r.Context(), "Error encoding prediction response", "error", err)
+		}
+	})))
+	mux.HandleFunc("GET /predictions/{id}", requireCaller(func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		caller, _ := callerFrom(r.Context())
+		tracked, ok := trackedPredictions.get(id, caller.ID)
+		if !ok {
+			http.Error(w, "Prediction not found", http.StatusNotFound)
+			return
+		}
+		prediction := tracked.prediction
+
+		client, err := newProviderClient("replicate", logger)
+		if err != nil {
+			http.Error(w, "Error getting prediction", http.StatusInternalServerError)
+			return
+		}
+		// Long-poll when the client asks to wait for completion
+		var wait time.Duration
+		if value := r.URL.Query().Get("wait"); value != "" {
+			wait, err = time.ParseDuration(value)
+			if err != nil || wait < 0 {
+				http.Error(w, "Invalid wait duration", http.StatusBadRequest)
+				return
+			}
+			if maxWait := currentConfig().Polling.MaxWait; wait > maxWait {
+				wait = maxWait
+			}
+		}
+
+		var current *AIPrediction
+		if wait > 0 {
+			current, err = pollPrediction(r.Context(), client, prediction, wait, logger)
+			var timeoutErr *predictionTimeoutError
+			if errors.As(err, &timeoutErr) {
+				err = nil
+			}
+		} else {
+			current, err = getPrediction(r.Context(), client, prediction, logger)
+		}
+		if err != nil {
+			logger.ErrorContext(r.Context(), "Error getting prediction", "prediction", id, "error", err)
+			http.Error(w, "Error getting prediction", http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if wait > 0 && !predictionDone(current) {
+			w.WriteHeader(http.StatusAccepted)
+		}
+		status := newPredictionStatus(current)
+		status.Output = tracked.mask.restore(status.Output)
+		err = json.NewEncoder(w).Encode(status)
+		if err != nil {
+			logger.ErrorContext(r.Context(), "Error encoding prediction response", "error", err)
+		}
+	}))
+	mux.HandleFunc("POST /predictions/{id}/cancel", requireCaller(func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		caller, _ := callerFrom(r.Context())
+		tracked, ok := trackedPredictions.get(id, caller.ID)
+		if !ok {
+			http.Error(w, "Prediction not found", http.StatusNotFound)
+			return
+		}
+
+		client, err := newProviderClient("replicate", logger)
+		if err != nil {
+			http.Error(w, "Error cancelling prediction", http.StatusInternalServerError)
+			return
+		}
+		logger.InfoContext(r.Context(), "Received request to cancel prediction", "prediction", id)
+		canceled, err := cancelPrediction(r.Context(), client, tracked.prediction, logger)
+		if err != nil {
+			logger.ErrorContext(r.Context(), "Error cancelling prediction", "prediction", id, "error", err)
+			http.Error(w, "Error cancelling prediction", http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(newPredictionStatus(canceled))
+		if err != nil {
+			logger.ErrorContext(r.Context(), "Error encoding cancel response", "error", err)
+		}
+	}))
+	mux.HandleFunc("/ws", requireCaller(func(w http.ResponseWriter, r *http.Request) {
+		handleChat(w, r, providers, logger)
+	}))
+	mux.HandleFunc("POST /admin/reload", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		logger.InfoContext(r.Context(), "Received admin request to reload config")
+		err := reloadConfig(flags, providers, logger)
+		if err != nil {
+			logger.ErrorContext(r.Context(), "Failed to reload config", "error", err)
+			http.Error(w, "Failed to reload config: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("GET /admin/config", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		handleGetAdminConfig(w, r, logger)
+	}))
+	mux.HandleFunc("PUT /admin/config", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		handlePutAdminConfig(w, r, providers, logger)
+	}))
+	mux.HandleFunc("POST /admin/keys", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		handleCreateAPIKey(w, r, logger)
+	}))
+	mux.HandleFunc("GET /admin/keys", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		handleListAPIKeys(w, r, logger)
+	}))
+	mux.HandleFunc("PATCH /admin/keys/{id}", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		handleUpdateAPIKey(w, r, logger)
+	}))
+	mux.HandleFunc("GET /admin/jobs", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		handleListJobs(w, r, logger)
+	}))
+	mux.HandleFunc("POST /admin/jobs/{id}/cancel", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		handleCancelJob(w, r, logger)
+	}))
+	mux.HandleFunc("DELETE /admin/keys/{id}", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		handleRevokeAPIKey(w, r, logger)
+	}))
+	mux.HandleFunc("GET /api/v1/generations", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		handleListGenerations(w, r, logger)
+	}))
+	mux.HandleFunc("DELETE /api/v1/generations", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		handleEraseSubject(w, r, logger)
+	}))
+	mux.HandleFunc("GET "+generationExportPath, requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		handleExportGenerations(w, r, logger)
+	}))
+	mux.HandleFunc("GET /api/v1/generations/{id}", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		handleGetGeneration(w, r, logger)
+	}))
+	mux.HandleFunc("GET /api/v1/links", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		handleGetLink(w, r, logger)
+	}))
+	mux.HandleFunc("POST /api/v1/generations/{id}/feedback", requireCaller(func(w http.ResponseWriter, r *http.Request) {
+		handleFeedback(w, r, logger)
+	}))
+	mux.HandleFunc("GET /api/v1/stats/feedback", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		handleFeedbackStats(w, r, logger)
+	}))
+	mux.HandleFunc("POST /api/v1/jobs", requireCaller(withIdempotency(func(w http.ResponseWriter, r *http.Request) {
+		handleSubmitJob(w, r, providers, logger)
+	})))
+	mux.HandleFunc("POST /api/v1/sendSms", requireCaller(withIdempotency(func(w http.ResponseWriter, r *http.Request) {
+		handleSendSms(w, r, providers, logger)
+	})))
+	mux.HandleFunc("GET /api/v1/messages/{id}/status", requireCaller(func(w http.ResponseWriter, r *http.Request) {
+		handleMessageStatus(w, r, logger)
+	}))
+	mux.HandleFunc("POST /api/v1/validatePhone", requireCaller(func(w http.ResponseWriter, r *http.Request) {
+		handleValidatePhone(w, r, logger)
+	}))
+	mux.HandleFunc("POST /api/v1/segments", requireCaller(func(w http.ResponseWriter, r *http.Request) {
+		handleSegments(w, r, logger)
+	}))
+	mux.HandleFunc("POST /api/v1/batch", requireCaller(withIdempotency(func(w http.ResponseWriter, r *http.Request) {
+		handleBatch(w, r, providers, logger)
+	})))
+	mux.HandleFunc("POST /api/v1/batch/csv", requireCaller(func(w http.ResponseWriter, r *http.Request) {
+		handleBatchCSV(w, r, providers, logger)
+	}))
+	mux.HandleFunc("GET /api/v1/jobs/{id}", requireCaller(func(w http.ResponseWriter, r *http.Request) {
+		handleGetJob(w, r, logger)
+	}))
+	mux.HandleFunc("GET /api/v1/jobs/dead", requireCaller(func(w http.ResponseWriter, r *http.Request) {
+		handleListDeadJobs(w, r, logger)
+	}))
+	mux.HandleFunc("POST /api/v1/jobs/dead", requireCaller(func(w http.ResponseWriter, r *http.Request) {
+		handleRequeueDeadJobs(w, r, logger)
+	}))
+	mux.HandleFunc("POST /v1/chat/completions", requireCaller(withIdempotency(func(w http.ResponseWriter, r *http.Request) {
+		handleChatCompletions(w, r, providers, logger)
+	})))
+	mux.HandleFunc("/webhooks/replicate", func(w http.ResponseWriter, r *http.Request) {
+		handleReplicateWebhook(w, r, logger)
+	})
+	mux.HandleFunc("POST /webhooks/twilio/status", func(w http.ResponseWriter, r *http.Request) {
+		handleTwilioStatus(w, r, logger)
+	})
+
+	logger.Info("Starting web server", "addr", config.Server.Addr)
+	server := &http.Server{
+		Addr:              config.Server.Addr,
+		Handler:           withTracing(mux, withMetrics(mux, withAccessLog(logger, mux, withRequestID(withPanicReporting(logger, withBodyLimit(withHandlerTimeout(mux))))))),
+		ReadHeaderTimeout: config.Timeouts.ReadHeader,
+		IdleTimeout:       config.Timeouts.Idle,
+	}
+	countConnections(server)
+	err = setupTLS(server, config.Server.TLS, logger)
+	if err != nil {
+		fatal(logger, "Failed to set up TLS", "error", err)
+	}
+	err = serveUntilSignal(server, config.Server.DrainTimeout, logger)
+	if err != nil {
+		fatal(logger, "Failed to start web server", "error", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.Server.DrainTimeout)
+	select {
+	case <-scheduler.Stop().Done():
+	case <-ctx.Done():
+	}
+	err = jobs.close(ctx)
+	cancel()
+	if err != nil {
+		logger.Error("Failed to close the job store", "error", err)
+	}
+	if closer, ok := smsSender.(io.Closer); ok {
+		err = closer.Close()
+		if err != nil {
+			logger.Error("Failed to close the SMS gateway connection", "error", err)
+		}
+	}
+	if history != nil {
+		err = history.close()
+		if err != nil {
+			logger.Error("Failed to close the generation history", "error", err)
+		}
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	err = shutdownTracing(ctx)
+	cancel()
 	if err != nil {
-		logger.Printf("result Error calling AI service: %v (elapsed %s)", err, elapsed)
-		return nil, err
+		logger.Error("Failed to flush traces", "error", err)
 	}
-	defer resp.Body.Close()
+	flushErrors()
+	logger.Info("Shutdown complete")
+}
 
-	body, err = ioutil.ReadAll(resp.Body)
+func getAISmsContent(ctx context.Context, provider Provider, request Request, logger *slog.Logger) (Response, error) {
+	// Call external AI service
+	addLogFields(ctx, "prompt_hash", promptHash(request.Prompt), "provider", provider.Name())
+	start := time.Now()
+	response, err := generateCached(ctx, provider, request)
+	generationID := recordGeneration(ctx, provider, request, response, start, err)
 	if err != nil {
-		logger.Printf("Error reading AI service response: %v (elapsed %s)", err, elapsed)
-		return nil, err
+		return Response{}, err
 	}
-	logger.Printf("result AI service response (elapsed %s): %s", elapsed, string(body))
+	response.GenerationID = generationID
+	addLogFields(ctx, "provider", response.Provider, "model", response.Model)
+	logger.InfoContext(ctx, "Generated AI SMS content", "duration_ms", time.Since(start).Milliseconds())
 
-	return &AIResponseUri, nil
+	return response, nil
 }
 
-func getProxyURL() (*url.URL, error) {
-	proxyHost := os.Getenv("HTTP_PROXY")
-	if proxyHost == "" {
-		proxyHost = os.Getenv("HTTPS_PROXY")
+// newGenerateRequest builds a provider request for a single SMS prompt
+// with the configured generation defaults.
+func newGenerateRequest(prompt, model string) Request {
+	generation := currentConfig().Generation
+	return Request{
+		Prompt:      prompt,
+		System:      generation.SystemPrompt,
+		Model:       model,
+		Temperature: &generation.Temperature,
+		TopP:        &generation.TopP,
+		MaxTokens:   generation.MaxTokens,
 	}
-	if proxyHost == "" {
+}
+
+// parseSeed parses the seed form value of a request, which is optional.
+func parseSeed(value string) (*int64, error) {
+	if value == "" {
 		return nil, nil
 	}
+	seed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, errors.New("seed must be an integer")
+	}
+	return &seed, nil
+}
+
+// newAIClient creates an HTTP client with the global proxy rules, for calls
+// that do not belong to a provider.
+func newAIClient(logger *slog.Logger) (*http.Client, error) {
+	return newProviderClient("", logger)
+}
+
+func getEnv(name, def string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
 
-	return url.Parse(proxyHost)
+	return value
 }
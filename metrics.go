@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	handlerLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ai_sms_http_request_duration_seconds",
+		Help:    "Time taken to serve HTTP requests by route and status code",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1, 2, 5, 10, 20, 30, 60, 120},
+	}, []string{"route", "code"})
+	predictionCreateLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ai_sms_prediction_create_duration_seconds",
+		Help:    "Time taken by Replicate to accept a new prediction",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2, 5, 10},
+	}, []string{"model", "status"})
+	tokenUsageCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ai_sms_tokens_total",
+		Help: "The total number of tokens reported by providers, by direction (input or output)",
+	}, []string{"provider", "model", "direction"})
+	predictTimeCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ai_sms_predict_seconds_total",
+		Help: "The cumulative compute time reported by Replicate per model",
+	}, []string{"model"})
+	inFlightRequestsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ai_sms_http_requests_in_flight",
+		Help: "The number of HTTP requests currently being served",
+	})
+	openConnectionsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ai_sms_http_connections_open",
+		Help: "The number of open client connections",
+	})
+)
+
+// observeUsage adds the consumption reported for a generation to the usage
+// counters.
+func observeUsage(response Response) {
+	usage := response.Usage
+	if usage.InputTokens > 0 {
+		tokenUsageCounter.WithLabelValues(response.Provider, response.Model, "input").Add(float64(usage.InputTokens))
+	}
+	if usage.OutputTokens > 0 {
+		tokenUsageCounter.WithLabelValues(response.Provider, response.Model, "output").Add(float64(usage.OutputTokens))
+	}
+	if usage.PredictTime > 0 {
+		predictTimeCounter.WithLabelValues(response.Model).Add(usage.PredictTime.Seconds())
+	}
+}
+
+// countConnections keeps the open connections gauge up to date for server.
+// Hijacked connections, such as websockets, are no longer tracked by the
+// server and are counted as closed.
+func countConnections(server *http.Server) {
+	server.ConnState = func(_ net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			openConnectionsGauge.Inc()
+		case http.StateHijacked, http.StateClosed:
+			openConnectionsGauge.Dec()
+		}
+	}
+}
+
+// withMetrics records the latency of every request, labelled by the route
+// pattern it matched so paths with IDs don't explode the label set.
+func withMetrics(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+
+		inFlightRequestsGauge.Inc()
+		defer inFlightRequestsGauge.Dec()
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		handlerLatency.WithLabelValues(route, strconv.Itoa(recorder.status)).Observe(time.Since(start).Seconds())
+	})
+}
+
+// statusRecorder captures the response status while keeping streaming and
+// WebSocket upgrades working.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(data)
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection does not support hijacking")
+	}
+	r.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+const (
+	defaultMistralBaseURL = "https://api.mistral.ai/v1"
+	defaultMistralModel   = "open-mixtral-8x7b"
+)
+
+// mistralProvider calls Mistral's own API, which speaks the chat-completions
+// wire format, instead of going through Replicate.
+type mistralProvider struct {
+	client  *http.Client
+	logger  *slog.Logger
+	baseURL string
+	apiKey  string
+	model   string
+}
+
+func init() {
+	registerProvider("mistral", func(logger *slog.Logger) (Provider, error) {
+		apiKey, err := lookupSecret("MISTRAL_API_KEY")
+		if err != nil {
+			return nil, err
+		}
+		if apiKey == "" {
+			return nil, errors.New("MISTRAL_API_KEY is not set")
+		}
+		client, err := newProviderClient("mistral", logger)
+		if err != nil {
+			return nil, err
+		}
+
+		return &mistralProvider{
+			client:  client,
+			logger:  logger,
+			baseURL: strings.TrimSuffix(getEnv("MISTRAL_BASE_URL", defaultMistralBaseURL), "/"),
+			apiKey:  apiKey,
+			model:   getEnv("MISTRAL_MODEL", defaultMistralModel),
+		}, nil
+	})
+}
+
+func (p *mistralProvider) Name() string {
+	return "mistral"
+}
+
+func (p *mistralProvider) Generate(ctx context.Context, request Request) (Response, error) {
+	chatRequest := newOpenAIChatRequest(request)
+	chatRequest.Model = request.modelOr(p.model)
+	chatRequest.Seed, chatRequest.RandomSeed = nil, request.Seed
+	chatRequest.MinTokens = request.MinNewTokens
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+p.apiKey)
+	chatResponse, err := callChatCompletions(ctx, p.client, p.baseURL+"/chat/completions", header, chatRequest, p.logger)
+	if err != nil {
+		return Response{}, err
+	}
+
+	return newOpenAIResponse(chatResponse, p.Name()), nil
+}
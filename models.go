@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// replicateVersionPattern matches a Replicate model version hash.
+var replicateVersionPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ModelConfig is a named model operators can request by name instead of a
+// provider-specific model path. Parameters left unset keep the generation
+// defaults.
+type ModelConfig struct {
+	Provider     string   `yaml:"provider"`
+	Model        string   `yaml:"model"`
+	Version      string   `yaml:"version"`
+	SystemPrompt string   `yaml:"system_prompt"`
+	Temperature  *float64 `yaml:"temperature"`
+	TopP         *float64 `yaml:"top_p"`
+	MaxTokens    int      `yaml:"max_tokens"`
+}
+
+// selectProvider returns the provider for a request. If request.Model names
+// a configured model, the request is rewritten to its model path, version
+// and default parameters, and its provider is used.
+func selectProvider(providers *providerSet, providerName string, request *Request) (Provider, error) {
+	named, ok := currentConfig().Models[request.Model]
+	if ok {
+		if providerName != "" && providerName != named.Provider {
+			return nil, fmt.Errorf("model %q is served by provider %s, not %s", request.Model, named.Provider, providerName)
+		}
+		providerName = named.Provider
+		named.apply(request)
+	}
+
+	return providers.get(providerName)
+}
+
+func (m ModelConfig) apply(request *Request) {
+	request.Model = m.Model
+	request.Version = m.Version
+	if m.SystemPrompt != "" {
+		request.System = m.SystemPrompt
+	}
+	if m.Temperature != nil {
+		request.Temperature = m.Temperature
+	}
+	if m.TopP != nil {
+		request.TopP = m.TopP
+	}
+	if m.MaxTokens > 0 {
+		request.MaxTokens = m.MaxTokens
+	}
+}
+
+// validateModels reports the problems in the named model definitions.
+func validateModels(models map[string]ModelConfig, check func(ok bool, format string, args ...interface{})) {
+	for name, m := range models {
+		check(providerFactories[m.Provider] != nil, "models.%s.provider %q is unknown", name, m.Provider)
+		check(m.Model != "", "models.%s.model is required", name)
+		if m.Version != "" {
+			check(m.Provider == "replicate", "models.%s.version is only supported for replicate", name)
+			check(replicateVersionPattern.MatchString(m.Version), "models.%s.version must be a 64 character version hash", name)
+		}
+		if m.Temperature != nil {
+			check(*m.Temperature >= 0 && *m.Temperature <= 2, "models.%s.temperature must be between 0 and 2", name)
+		}
+		if m.TopP != nil {
+			check(*m.TopP > 0 && *m.TopP <= 1, "models.%s.top_p must be in (0, 1]", name)
+		}
+		check(m.MaxTokens >= 0, "models.%s.max_tokens must not be negative", name)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	defaultModerationURL   = "https://api.openai.com/v1/moderations"
+	defaultModerationModel = "omni-moderation-latest"
+)
+
+var moderationCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ai_sms_moderation_total",
+	Help: "The total number of texts caught by moderation by stage (prompt or output), category and action (flag or block)",
+}, []string{"stage", "category", "action"})
+
+// Moderation stages: the client prompt before generation and the text the
+// model wrote after.
+const (
+	moderationPrompt = "prompt"
+	moderationOutput = "output"
+)
+
+// ModerationConfig checks prompts and generated texts for disallowed
+// content. Backend is "rules", matching Rules locally, or "openai": the
+// OpenAI moderation API at URL with Model, authenticated with the secret
+// TokenSecret names. Prompt and Output pick the stages checked. Categories
+// listed in Flag are only flagged: logged, counted and named in the
+// response; the others block the generation. FailClosed blocks texts the
+// moderator could not check instead of letting them through.
+type ModerationConfig struct {
+	Backend     string           `yaml:"backend"`
+	Prompt      bool             `yaml:"prompt"`
+	Output      bool             `yaml:"output"`
+	Rules       []ModerationRule `yaml:"rules"`
+	URL         string           `yaml:"url"`
+	Model       string           `yaml:"model"`
+	TokenSecret string           `yaml:"token_secret"`
+	Flag        []string         `yaml:"flag"`
+	FailClosed  bool             `yaml:"fail_closed"`
+}
+
+// ModerationRule puts texts with one of Keywords, matched as whole words
+// regardless of case, or matching one of the Patterns regexps in Category.
+type ModerationRule struct {
+	Category string   `yaml:"category"`
+	Keywords []string `yaml:"keywords"`
+	Patterns []string `yaml:"patterns"`
+}
+
+// Moderator returns the categories of disallowed content in a text.
+type Moderator interface {
+	Name() string
+	Moderate(ctx context.Context, text string) ([]string, error)
+}
+
+// moderator checks texts; nil when moderation is off. It is set up at
+// startup, with moderation, the rest of its settings.
+var (
+	moderator  Moderator
+	moderation ModerationConfig
+)
+
+// newModerator returns the configured moderator, or nil.
+func newModerator(config ModerationConfig, logger *slog.Logger) (Moderator, error) {
+	switch config.Backend {
+	case "":
+		return nil, nil
+	case "rules":
+		return newRulesModerator(config.Rules)
+	}
+	if config.URL == "" {
+		config.URL = defaultModerationURL
+	}
+	if config.Model == "" {
+		config.Model = defaultModerationModel
+	}
+	token, err := lookupSecret(config.TokenSecret)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newProviderClient("", logger)
+	if err != nil {
+		return nil, err
+	}
+	return &openAIModerator{config: config, token: token, client: client}, nil
+}
+
+// moderationRule is a ModerationRule compiled into one regexp.
+type moderationRule struct {
+	category string
+	pattern  *regexp.Regexp
+}
+
+// rulesModerator matches texts against keyword and regexp rules.
+type rulesModerator struct {
+	rules []moderationRule
+}
+
+func newRulesModerator(rules []ModerationRule) (*rulesModerator, error) {
+	m := &rulesModerator{}
+	for _, rule := range rules {
+		alternatives := slices.Clone(rule.Patterns)
+		if len(rule.Keywords) > 0 {
+			keywords := make([]string, len(rule.Keywords))
+			for i, keyword := range rule.Keywords {
+				keywords[i] = regexp.QuoteMeta(keyword)
+			}
+			// \b only knows ASCII letters, and keywords may be Cyrillic
+			alternatives = append(alternatives, `(?:^|[^\p{L}\p{N}])(?:`+strings.Join(keywords, "|")+`)(?:$|[^\p{L}\p{N}])`)
+		}
+		pattern, err := regexp.Compile("(?i)" + strings.Join(alternatives, "|"))
+		if err != nil {
+			return nil, fmt.Errorf("moderation rule %q: %v", rule.Category, err)
+		}
+		m.rules = append(m.rules, moderationRule{category: rule.Category, pattern: pattern})
+	}
+	return m, nil
+}
+
+func (m *rulesModerator) Name() string {
+	return "rules"
+}
+
+func (m *rulesModerator) Moderate(ctx context.Context, text string) ([]string, error) {
+	var categories []string
+	for _, rule := range m.rules {
+		if rule.pattern.MatchString(text) && !slices.Contains(categories, rule.category) {
+			categories = append(categories, rule.category)
+		}
+	}
+	return categories, nil
+}
+
+// openAIModerator asks the OpenAI moderation API.
+type openAIModerator struct {
+	config ModerationConfig
+	token  string
+	client *http.Client
+}
+
+func (m *openAIModerator) Name() string {
+	return "openai"
+}
+
+func (m *openAIModerator) Moderate(ctx context.Context, text string) ([]string, error) {
+	data, err := json.Marshal(map[string]string{"model": m.config.Model, "input": scrubText(text)})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.config.URL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+m.token)
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, newStatusError(resp.StatusCode, "moderation API answered %s", resp.Status)
+	}
+	var moderated struct {
+		Results []struct {
+			Categories map[string]bool `json:"categories"`
+		} `json:"results"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&moderated)
+	if err != nil {
+		return nil, fmt.Errorf("decoding the moderation response: %v", err)
+	}
+	var categories []string
+	for _, result := range moderated.Results {
+		for category, flagged := range result.Categories {
+			if flagged && !slices.Contains(categories, category) {
+				categories = append(categories, category)
+			}
+		}
+	}
+	slices.Sort(categories)
+	return categories, nil
+}
+
+// moderationError is a generation blocked by moderation.
+type moderationError struct {
+	Stage      string
+	Categories []string
+}
+
+func (e *moderationError) Error() string {
+	return fmt.Sprintf("the %s was blocked by moderation: %s", e.Stage, strings.Join(e.Categories, ", "))
+}
+
+func (e *moderationError) errorClass() string {
+	return "moderation_block"
+}
+
+// moderate checks text at stage and returns the categories it is flagged
+// for, or a moderationError if one of them blocks it.
+func moderate(ctx context.Context, stage, text string, logger *slog.Logger) ([]string, error) {
+	if moderator == nil || stage == moderationPrompt && !moderation.Prompt || stage == moderationOutput && !moderation.Output {
+		return nil, nil
+	}
+	categories, err := moderator.Moderate(ctx, text)
+	if err != nil {
+		if moderation.FailClosed {
+			return nil, fmt.Errorf("moderating the %s: %w", stage, err)
+		}
+		logger.WarnContext(ctx, "Error moderating text, letting it through", "moderator", moderator.Name(), "stage", stage, "error", err)
+		return nil, nil
+	}
+	var blocked []string
+	for _, category := range categories {
+		action := "block"
+		if slices.Contains(moderation.Flag, category) {
+			action = "flag"
+		} else {
+			blocked = append(blocked, category)
+		}
+		moderationCounter.WithLabelValues(stage, category, action).Inc()
+	}
+	if len(blocked) > 0 {
+		logger.WarnContext(ctx, "Moderation blocked text", "stage", stage, "categories", blocked)
+		return nil, &moderationError{Stage: stage, Categories: blocked}
+	}
+	if len(categories) > 0 {
+		logger.WarnContext(ctx, "Moderation flagged text", "stage", stage, "categories", categories)
+	}
+	return categories, nil
+}
+
+// BlockedResponse is the body of responses to generations blocked by
+// moderation.
+type BlockedResponse struct {
+	Error struct {
+		Code       string   `json:"code"`
+		Message    string   `json:"message"`
+		Stage      string   `json:"stage"`
+		Categories []string `json:"categories"`
+	} `json:"error"`
+}
+
+// writeBlocked answers a blocked generation with 422 and the stage and
+// categories that blocked it.
+func writeBlocked(w http.ResponseWriter, err *moderationError) {
+	var response BlockedResponse
+	response.Error.Code = "blocked"
+	response.Error.Message = err.Error()
+	response.Error.Stage = err.Stage
+	response.Error.Categories = err.Categories
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+// JWTConfig enables bearer JWTs issued by an OpenID Connect provider as an
+// alternative to API keys. Without a JWKS URL the keys are found through
+// the issuer's discovery document.
+type JWTConfig struct {
+	Issuer   string `yaml:"issuer"`
+	JWKSURL  string `yaml:"jwks_url"`
+	Audience string `yaml:"audience"`
+	// Algorithms defaults to RS256
+	Algorithms []string `yaml:"algorithms"`
+}
+
+// jwtVerifier checks bearer JWTs; nil when JWT authentication is disabled.
+// It is set up once at startup, so JWT settings need a restart.
+var jwtVerifier *oidc.IDTokenVerifier
+
+// setupJWTVerifier prepares jwtVerifier from the config. The signing keys
+// are fetched lazily and refreshed when a token names an unknown key.
+func setupJWTVerifier(ctx context.Context, config JWTConfig, logger *slog.Logger) error {
+	if config.Issuer == "" {
+		return nil
+	}
+
+	client, err := newAIClient(logger)
+	if err != nil {
+		return err
+	}
+	ctx = oidc.ClientContext(ctx, client)
+	verifierConfig := &oidc.Config{
+		ClientID:             config.Audience,
+		SupportedSigningAlgs: config.Algorithms,
+	}
+	if config.JWKSURL != "" {
+		jwtVerifier = oidc.NewVerifier(config.Issuer, oidc.NewRemoteKeySet(ctx, config.JWKSURL), verifierConfig)
+	} else {
+		provider, err := oidc.NewProvider(ctx, config.Issuer)
+		if err != nil {
+			return fmt.Errorf("OIDC discovery for %s: %v", config.Issuer, err)
+		}
+		jwtVerifier = provider.VerifierContext(ctx, verifierConfig)
+	}
+	logger.Info("Accepting JWTs", "issuer", config.Issuer, "audience", config.Audience)
+
+	return nil
+}
+
+// looksLikeJWT tells JWTs apart from API keys in the Authorization header.
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// verifyJWT checks the signature, issuer, audience and expiry of a bearer
+// JWT and returns its subject as the caller.
+func verifyJWT(ctx context.Context, raw string) (Caller, error) {
+	if jwtVerifier == nil {
+		return Caller{}, errors.New("JWT authentication is not configured")
+	}
+
+	token, err := jwtVerifier.Verify(ctx, raw)
+	if err != nil {
+		return Caller{}, err
+	}
+	if token.Subject == "" {
+		return Caller{}, errors.New("JWT has no subject")
+	}
+
+	return Caller{ID: token.Subject, Source: "jwt"}, nil
+}
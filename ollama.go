@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+const (
+	defaultOllamaBaseURL = "http://localhost:11434"
+	defaultOllamaModel   = "mistral"
+)
+
+type OllamaOptions struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	NumPredict  int      `json:"num_predict,omitempty"`
+	Seed        *int64   `json:"seed,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+	// RepeatPenalty is Ollama's name for the repetition penalty
+	RepeatPenalty *float64 `json:"repeat_penalty,omitempty"`
+	// Extra are merged into the options, such as num_ctx or top_k
+	Extra map[string]any `json:"-"`
+}
+
+func (o OllamaOptions) MarshalJSON() ([]byte, error) {
+	type plain OllamaOptions
+	return withExtra(plain(o), o.Extra)
+}
+
+type OllamaChatRequest struct {
+	Model     string          `json:"model"`
+	Messages  []OpenAIMessage `json:"messages"`
+	Stream    bool            `json:"stream"`
+	KeepAlive string          `json:"keep_alive,omitempty"`
+	Options   OllamaOptions   `json:"options"`
+}
+
+type OllamaChatResponse struct {
+	Model           string        `json:"model"`
+	CreatedAt       string        `json:"created_at"`
+	Message         OpenAIMessage `json:"message"`
+	Done            bool          `json:"done"`
+	Error           string        `json:"error"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	EvalCount       int           `json:"eval_count"`
+}
+
+type ollamaProvider struct {
+	client    *http.Client
+	logger    *slog.Logger
+	baseURL   string
+	model     string
+	keepAlive string
+}
+
+func init() {
+	registerProvider("ollama", func(logger *slog.Logger) (Provider, error) {
+		// Ollama runs on-prem, so by default it is called directly
+		// without the corporate proxy (see provider_proxies)
+		client, err := newProviderClient("ollama", logger)
+		if err != nil {
+			return nil, err
+		}
+		return &ollamaProvider{
+			client:    client,
+			logger:    logger,
+			baseURL:   strings.TrimSuffix(getEnv("OLLAMA_BASE_URL", defaultOllamaBaseURL), "/"),
+			model:     getEnv("OLLAMA_MODEL", defaultOllamaModel),
+			keepAlive: getEnv("OLLAMA_KEEP_ALIVE", ""),
+		}, nil
+	})
+}
+
+func (p *ollamaProvider) Name() string {
+	return "ollama"
+}
+
+// CheckHealth checks that the Ollama server answers.
+func (p *ollamaProvider) CheckHealth(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", p.baseURL+"/api/tags", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return newStatusError(resp.StatusCode, "Ollama returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (p *ollamaProvider) Generate(ctx context.Context, request Request) (Response, error) {
+	return p.GenerateStream(ctx, request, nil)
+}
+
+// GenerateStream reads Ollama's newline-delimited JSON chunks. With a nil
+// onToken the non-streaming API is used.
+func (p *ollamaProvider) GenerateStream(ctx context.Context, request Request, onToken func(token string) error) (Response, error) {
+	chatRequest := OllamaChatRequest{
+		Model:     request.modelOr(p.model),
+		Messages:  newOpenAIChatRequest(request).Messages,
+		Stream:    onToken != nil,
+		KeepAlive: p.keepAlive,
+		Options: OllamaOptions{
+			Temperature:   request.Temperature,
+			TopP:          request.TopP,
+			NumPredict:    request.MaxTokens,
+			Seed:          request.Seed,
+			Stop:          request.StopSequences,
+			RepeatPenalty: request.RepetitionPenalty,
+			Extra:         request.Extra,
+		},
+	}
+	jsonBody, err := json.Marshal(chatRequest)
+	if err != nil {
+		p.logger.ErrorContext(ctx, "Error marshaling Ollama request", "error", err)
+		return Response{}, err
+	}
+	p.logger.DebugContext(ctx, "Calling Ollama", "body", string(jsonBody))
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.baseURL+"/api/chat", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		p.logger.ErrorContext(ctx, "Error creating request", "error", err)
+		return Response{}, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		p.logger.ErrorContext(ctx, "Error calling Ollama", "error", err)
+		return Response{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		var errorResponse OllamaChatResponse
+		if json.Unmarshal(body, &errorResponse) == nil && errorResponse.Error != "" {
+			return Response{}, newStatusError(resp.StatusCode, "Ollama returned status %d: %s", resp.StatusCode, errorResponse.Error)
+		}
+		return Response{}, newStatusError(resp.StatusCode, "Ollama returned status %d", resp.StatusCode)
+	}
+
+	response := Response{Provider: p.Name(), Model: request.modelOr(p.model)}
+	var text strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var chunk OllamaChatResponse
+		err = json.Unmarshal(line, &chunk)
+		if err != nil {
+			p.logger.ErrorContext(ctx, "Error unmarshaling Ollama response", "error", err)
+			return Response{}, err
+		}
+		if chunk.Error != "" {
+			return Response{}, errors.New("Ollama error: " + chunk.Error)
+		}
+
+		text.WriteString(chunk.Message.Content)
+		if onToken != nil && chunk.Message.Content != "" {
+			err = onToken(chunk.Message.Content)
+			if err != nil {
+				return Response{}, err
+			}
+		}
+		if chunk.Done {
+			response.Model = chunk.Model
+			response.Usage = Usage{InputTokens: chunk.PromptEvalCount, OutputTokens: chunk.EvalCount}
+			response.Text = strings.TrimSpace(text.String())
+			return response, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Response{}, err
+	}
+
+	return Response{}, io.ErrUnexpectedEOF
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+const (
+	defaultOpenAIBaseURL = "https://api.openai.com/v1"
+	defaultOpenAIModel   = "gpt-4o-mini"
+)
+
+type OpenAIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type OpenAIChatRequest struct {
+	Model       string          `json:"model,omitempty"`
+	Messages    []OpenAIMessage `json:"messages"`
+	Temperature *float64        `json:"temperature,omitempty"`
+	TopP        *float64        `json:"top_p,omitempty"`
+	MaxTokens   int             `json:"max_tokens,omitempty"`
+	Seed        *int64          `json:"seed,omitempty"`
+	Stop        stopSequences   `json:"stop,omitempty"`
+	// RandomSeed and MinTokens are Mistral's, RepetitionPenalty GigaChat's
+	RandomSeed        *int64   `json:"random_seed,omitempty"`
+	MinTokens         int      `json:"min_tokens,omitempty"`
+	RepetitionPenalty *float64 `json:"repetition_penalty,omitempty"`
+	// Extra are merged into the request
+	Extra map[string]any `json:"-"`
+}
+
+func (r OpenAIChatRequest) MarshalJSON() ([]byte, error) {
+	type plain OpenAIChatRequest
+	return withExtra(plain(r), r.Extra)
+}
+
+type OpenAIChatChoice struct {
+	Index        int           `json:"index"`
+	Message      OpenAIMessage `json:"message"`
+	FinishReason string        `json:"finish_reason"`
+}
+
+type OpenAIChatResponse struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object,omitempty"`
+	Created int64              `json:"created,omitempty"`
+	Model   string             `json:"model"`
+	Choices []OpenAIChatChoice `json:"choices"`
+	Usage   struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+		TotalTokens      int `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+type OpenAIErrorResponse struct {
+	Error struct {
+		Message string `json:"message"`
+		Type    string `json:"type"`
+		Code    string `json:"code"`
+	} `json:"error"`
+}
+
+type openAIProvider struct {
+	client  *http.Client
+	logger  *slog.Logger
+	baseURL string
+	model   string
+}
+
+func init() {
+	registerProvider("openai", func(logger *slog.Logger) (Provider, error) {
+		if !openAITokens.configured() {
+			return nil, errors.New("OPENAI_API_KEY is not set")
+		}
+		client, err := newProviderClient("openai", logger)
+		if err != nil {
+			return nil, err
+		}
+
+		return &openAIProvider{
+			client:  client,
+			logger:  logger,
+			baseURL: strings.TrimSuffix(getEnv("OPENAI_BASE_URL", defaultOpenAIBaseURL), "/"),
+			model:   getEnv("OPENAI_MODEL", defaultOpenAIModel),
+		}, nil
+	})
+}
+
+func (p *openAIProvider) Name() string {
+	return "openai"
+}
+
+// CheckHealth lists the models, which needs a valid API key.
+func (p *openAIProvider) CheckHealth(ctx context.Context) error {
+	apiKey, err := openAITokens.pick()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", p.baseURL+"/models", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return newStatusError(resp.StatusCode, "OpenAI models endpoint returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (p *openAIProvider) Generate(ctx context.Context, request Request) (Response, error) {
+	chatRequest := newOpenAIChatRequest(request)
+	chatRequest.Model = request.modelOr(p.model)
+
+	apiKey, err := openAITokens.pick()
+	if err != nil {
+		return Response{}, err
+	}
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+apiKey)
+	chatResponse, err := callChatCompletions(ctx, p.client, p.baseURL+"/chat/completions", header, chatRequest, p.logger)
+	openAITokens.report(apiKey, errorStatus(err))
+	if err != nil {
+		return Response{}, err
+	}
+
+	return newOpenAIResponse(chatResponse, p.Name()), nil
+}
+
+// newOpenAIChatRequest maps a provider request onto the chat-completions
+// wire format, replaying the conversation history as messages.
+func newOpenAIChatRequest(request Request) OpenAIChatRequest {
+	var messages []OpenAIMessage
+	if request.System != "" {
+		messages = append(messages, OpenAIMessage{Role: "system", Content: request.System})
+	}
+	for _, turn := range request.History {
+		messages = append(messages,
+			OpenAIMessage{Role: "user", Content: turn.User},
+			OpenAIMessage{Role: "assistant", Content: turn.Assistant},
+		)
+	}
+	messages = append(messages, OpenAIMessage{Role: "user", Content: request.Prompt})
+
+	return OpenAIChatRequest{
+		Messages:    messages,
+		Temperature: request.Temperature,
+		TopP:        request.TopP,
+		MaxTokens:   request.MaxTokens,
+		Seed:        request.Seed,
+		Stop:        request.StopSequences,
+		Extra:       request.Extra,
+	}
+}
+
+func newOpenAIResponse(chatResponse *OpenAIChatResponse, provider string) Response {
+	text := ""
+	if len(chatResponse.Choices) > 0 {
+		text = strings.TrimSpace(chatResponse.Choices[0].Message.Content)
+	}
+
+	return Response{
+		ID:       chatResponse.ID,
+		Text:     text,
+		Provider: provider,
+		Model:    chatResponse.Model,
+		Usage:    Usage{InputTokens: chatResponse.Usage.PromptTokens, OutputTokens: chatResponse.Usage.CompletionTokens},
+	}
+}
+
+// callChatCompletions posts a chat-completions request to url. It is shared
+// by every backend speaking the OpenAI wire format.
+func callChatCompletions(ctx context.Context, client *http.Client, url string, header http.Header, chatRequest OpenAIChatRequest, logger *slog.Logger) (*OpenAIChatResponse, error) {
+	jsonBody, err := json.Marshal(chatRequest)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error marshaling chat request", "error", err)
+		return nil, err
+	}
+	logger.DebugContext(ctx, "Calling chat completions", "url", url, "body", string(jsonBody))
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonBody))
+	if err != nil {
+		logger.ErrorContext(ctx, "Error creating request", "error", err)
+		return nil, err
+	}
+	for name, values := range header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error calling chat completions", "error", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error reading chat completions response", "error", err)
+		return nil, err
+	}
+	logger.DebugContext(ctx, "Chat completions response", "body", string(body))
+
+	if resp.StatusCode != http.StatusOK {
+		var errorResponse OpenAIErrorResponse
+		err = json.Unmarshal(body, &errorResponse)
+		if err != nil || errorResponse.Error.Message == "" {
+			return nil, newStatusError(resp.StatusCode, "chat completions returned status %d", resp.StatusCode)
+		}
+		return nil, newStatusError(resp.StatusCode, "chat completions returned status %d: %s", resp.StatusCode, errorResponse.Error.Message)
+	}
+
+	var chatResponse OpenAIChatResponse
+	err = json.Unmarshal(body, &chatResponse)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error unmarshaling chat completions response", "error", err)
+		return nil, err
+	}
+
+	return &chatResponse, nil
+}
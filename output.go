@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// templateArtifacts matches the Mixtral instruct markers the model sometimes
+// echoes back in its output.
+var templateArtifacts = regexp.MustCompile(`</?s>|\[/?INST\]`)
+
+// SmsResponse is returned to clients of /getAiSmsContent.
+type SmsResponse struct {
+	Text     string `json:"text"`
+	Provider string `json:"provider,omitempty"`
+	Model    string `json:"model,omitempty"`
+	// GenerationID identifies the generation in the history, for feedback
+	GenerationID string `json:"generation_id,omitempty"`
+	// Flagged are the moderation categories the generation was flagged for
+	Flagged []string `json:"flagged,omitempty"`
+	// Candidates are all the texts generated, ranked, with all_candidates
+	Candidates []Candidate `json:"candidates,omitempty"`
+	SegmentInfo
+}
+
+// SegmentInfo tells how a text goes out as SMS: its encoding, its length
+// in characters and how many segments it takes.
+type SegmentInfo struct {
+	Encoding   string `json:"encoding,omitempty"`
+	Characters int    `json:"characters,omitempty"`
+	Segments   int    `json:"segments,omitempty"`
+}
+
+// newSmsResponse returns the response to clients for a generation.
+func newSmsResponse(response Response) SmsResponse {
+	return SmsResponse{
+		Text:         response.Text,
+		Provider:     response.Provider,
+		Model:        response.Model,
+		GenerationID: response.GenerationID,
+		Flagged:      response.Flagged,
+		Candidates:   response.Candidates,
+		SegmentInfo:  segmentInfo(response.Text),
+	}
+}
+
+// PredictionOutput is the "output" field of a prediction. Language models
+// return an array of tokens, but some models return a single string.
+type PredictionOutput []string
+
+func (o *PredictionOutput) UnmarshalJSON(data []byte) error {
+	var tokens []string
+	if err := json.Unmarshal(data, &tokens); err == nil {
+		*o = tokens
+		return nil
+	}
+
+	var text *string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return err
+	}
+	if text == nil {
+		*o = nil
+		return nil
+	}
+	*o = PredictionOutput{*text}
+	return nil
+}
+
+// parseOutput joins the output tokens into the final SMS text.
+func parseOutput(tokens []string) string {
+	text := strings.Join(tokens, "")
+	text = templateArtifacts.ReplaceAllString(text, "")
+
+	return strings.TrimSpace(text)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/nyaruka/phonenumbers"
+)
+
+// PhoneConfig sets how phone numbers are read: numbers written without a
+// country code are taken as numbers of DefaultRegion, a two-letter
+// country code like RU. Without it, numbers must start with +.
+type PhoneConfig struct {
+	DefaultRegion string `yaml:"default_region"`
+}
+
+// phoneNumberTypes names the number types of libphonenumber.
+var phoneNumberTypes = map[phonenumbers.PhoneNumberType]string{
+	phonenumbers.FIXED_LINE:           "fixed_line",
+	phonenumbers.MOBILE:               "mobile",
+	phonenumbers.FIXED_LINE_OR_MOBILE: "fixed_line_or_mobile",
+	phonenumbers.TOLL_FREE:            "toll_free",
+	phonenumbers.PREMIUM_RATE:         "premium_rate",
+	phonenumbers.SHARED_COST:          "shared_cost",
+	phonenumbers.VOIP:                 "voip",
+	phonenumbers.PERSONAL_NUMBER:      "personal_number",
+	phonenumbers.PAGER:                "pager",
+	phonenumbers.UAN:                  "uan",
+	phonenumbers.VOICEMAIL:            "voicemail",
+	phonenumbers.UNKNOWN:              "unknown",
+}
+
+// PhoneNumber is a phone number as validated by normalizePhone.
+type PhoneNumber struct {
+	Input       string `json:"input"`
+	Valid       bool   `json:"valid"`
+	E164        string `json:"e164,omitempty"`
+	Country     string `json:"country,omitempty"`
+	CountryCode int    `json:"country_code,omitempty"`
+	Type        string `json:"type,omitempty"`
+	// Error tells why an invalid number is invalid
+	Error string `json:"error,omitempty"`
+}
+
+// normalizePhone validates number, read as a number of region when it has
+// no country code, and returns it in E.164 format with its country and
+// type.
+func normalizePhone(number, region string) PhoneNumber {
+	result := PhoneNumber{Input: number}
+	parsed, err := phonenumbers.Parse(number, strings.ToUpper(region))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if !phonenumbers.IsValidNumber(parsed) {
+		result.Error = "not a valid number"
+		return result
+	}
+	result.Valid = true
+	result.E164 = phonenumbers.Format(parsed, phonenumbers.E164)
+	result.Country = phonenumbers.GetRegionCodeForNumber(parsed)
+	result.CountryCode = int(parsed.GetCountryCode())
+	result.Type = phoneNumberTypes[phonenumbers.GetNumberType(parsed)]
+	return result
+}
+
+// normalizeRecipients normalizes the recipients of a batch to E.164; it
+// fails listing the invalid ones, labelled by label, before anything is
+// generated.
+func normalizeRecipients(numbers []string, label func(i int) string) ([]string, error) {
+	region := currentConfig().Phone.DefaultRegion
+	normalized := make([]string, len(numbers))
+	var invalid []string
+	for i, number := range numbers {
+		phone := normalizePhone(number, region)
+		if !phone.Valid {
+			invalid = append(invalid, fmt.Sprintf("%s %q (%s)", label(i), number, phone.Error))
+			continue
+		}
+		normalized[i] = phone.E164
+	}
+	if len(invalid) > 0 {
+		const shown = 10
+		if len(invalid) > shown {
+			invalid = append(invalid[:shown], fmt.Sprintf("and %d more", len(invalid)-shown))
+		}
+		return nil, fmt.Errorf("invalid recipients: %s", strings.Join(invalid, ", "))
+	}
+	return normalized, nil
+}
+
+// validatePhoneRequest is the body of POST /api/v1/validatePhone. Region
+// overrides phone.default_region.
+type validatePhoneRequest struct {
+	Number string `json:"number"`
+	Region string `json:"region"`
+}
+
+// handleValidatePhone validates and normalizes a phone number. An invalid
+// number is not an error: the answer says why it is invalid.
+func handleValidatePhone(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	var request validatePhoneRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if request.Number == "" {
+		http.Error(w, "number is required", http.StatusBadRequest)
+		return
+	}
+	if request.Region == "" {
+		request.Region = currentConfig().Phone.DefaultRegion
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(normalizePhone(request.Number, request.Region))
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error encoding phone number", "error", err)
+	}
+}
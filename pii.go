@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var piiScrubbedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ai_sms_pii_scrubbed_total",
+	Help: "The total number of personal data values masked in requests to providers by kind",
+}, []string{"kind"})
+
+// piiKinds are the built-in detectors of personal data.
+var piiKinds = []string{"email", "card", "phone"}
+
+var (
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	// cardPattern matches 13 to 19 digits, optionally grouped with spaces
+	// or dashes; only numbers passing the Luhn check are cards
+	cardPattern = regexp.MustCompile(`\d(?:[ -]?\d){12,18}`)
+)
+
+// piiPrompt tells the model what the placeholders of masked values are.
+const piiPrompt = "\n\nThe placeholders %s stand for personal data; where the SMS needs them, write them exactly as they are."
+
+// PIIConfig masks personal data in the requests sent to providers: values
+// found by the Detect detectors (email, card, phone) or matching one of
+// Patterns are replaced with placeholders like {email_1}, which are put
+// back into the generated text. Trusted providers, on our own network, get
+// requests as they are.
+type PIIConfig struct {
+	Scrub    bool         `yaml:"scrub"`
+	Detect   []string     `yaml:"detect"`
+	Patterns []PIIPattern `yaml:"patterns"`
+	Trusted  []string     `yaml:"trusted"`
+}
+
+// PIIPattern masks the values matching Pattern as {Name_1}, {Name_2}...
+type PIIPattern struct {
+	Name    string `yaml:"name"`
+	Pattern string `yaml:"pattern"`
+}
+
+// piiDetector finds one kind of personal data.
+type piiDetector struct {
+	kind    string
+	pattern *regexp.Regexp
+	// valid rules out matches that only look like the kind, if set
+	valid func(value string) bool
+}
+
+// piiScrubber masks personal data; nil when scrubbing is off. It is set
+// up at startup.
+var scrubber *piiScrubber
+
+type piiScrubber struct {
+	detectors []piiDetector
+	trusted   []string
+}
+
+// newPIIScrubber returns the configured scrubber, or nil.
+func newPIIScrubber(config PIIConfig) (*piiScrubber, error) {
+	if !config.Scrub {
+		return nil, nil
+	}
+	s := &piiScrubber{trusted: config.Trusted}
+	// The patterns are the most specific, and emails and cards go before
+	// phones, not to be taken for phone numbers
+	for _, pattern := range config.Patterns {
+		compiled, err := regexp.Compile(pattern.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("pii pattern %s: %v", pattern.Name, err)
+		}
+		s.detectors = append(s.detectors, piiDetector{kind: pattern.Name, pattern: compiled})
+	}
+	for _, kind := range piiKinds {
+		if !slices.Contains(config.Detect, kind) {
+			continue
+		}
+		switch kind {
+		case "email":
+			s.detectors = append(s.detectors, piiDetector{kind: kind, pattern: emailPattern})
+		case "card":
+			s.detectors = append(s.detectors, piiDetector{kind: kind, pattern: cardPattern, valid: luhnValid})
+		case "phone":
+			s.detectors = append(s.detectors, piiDetector{kind: kind, pattern: phonePattern})
+		}
+	}
+	return s, nil
+}
+
+// luhnValid reports whether the digits of number pass the Luhn check.
+func luhnValid(number string) bool {
+	sum, double := 0, false
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		digit := int(c - '0')
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// piiMask holds the values masked in one request, by placeholder name.
+type piiMask struct {
+	scrubber *piiScrubber
+	values   map[string]string
+	names    map[string]string
+	// taken are the placeholder names the request had already
+	taken map[string]bool
+}
+
+// scrubRequest masks the personal data of request for provider, unless
+// scrubbing is off or provider is trusted. The mask, nil if nothing was
+// masked, restores the values in the response.
+func scrubRequest(request Request, provider Provider) (Request, *piiMask) {
+	if scrubber == nil || slices.Contains(scrubber.trusted, provider.Name()) {
+		return request, nil
+	}
+	mask := newPIIMask()
+	texts := []string{request.System, request.Prompt}
+	for _, turn := range request.History {
+		texts = append(texts, turn.User, turn.Assistant)
+	}
+	for _, text := range texts {
+		for _, name := range placeholders(text) {
+			mask.taken[name] = true
+		}
+	}
+
+	request.System = mask.scrub(request.System)
+	history := make([]Turn, len(request.History))
+	for i, turn := range request.History {
+		history[i] = Turn{User: mask.scrub(turn.User), Assistant: mask.scrub(turn.Assistant)}
+	}
+	request.History = history
+	request.Prompt = mask.scrub(request.Prompt)
+	if len(mask.values) == 0 {
+		return request, nil
+	}
+	request.Prompt += fmt.Sprintf(piiPrompt, braced(slices.Sorted(maps.Keys(mask.values))))
+	return request, mask
+}
+
+func newPIIMask() *piiMask {
+	return &piiMask{scrubber: scrubber, values: map[string]string{}, names: map[string]string{}, taken: map[string]bool{}}
+}
+
+// scrubText masks the personal data of a text that is not to be restored.
+func scrubText(text string) string {
+	if scrubber == nil {
+		return text
+	}
+	return newPIIMask().scrub(text)
+}
+
+// scrub replaces the personal data in text with placeholders, leaving the
+// placeholders text has already.
+func (m *piiMask) scrub(text string) string {
+	for _, detector := range m.scrubber.detectors {
+		text = outsidePlaceholders(text, func(part string) string {
+			return detector.pattern.ReplaceAllStringFunc(part, func(value string) string {
+				if detector.valid != nil && !detector.valid(value) {
+					return value
+				}
+				return "{" + m.name(detector.kind, value) + "}"
+			})
+		})
+	}
+	return text
+}
+
+// name returns the placeholder name of value, the same for every
+// occurrence of it.
+func (m *piiMask) name(kind, value string) string {
+	if name, ok := m.names[value]; ok {
+		return name
+	}
+	n := 1
+	for ; ; n++ {
+		name := kind + "_" + strconv.Itoa(n)
+		if _, ok := m.values[name]; !ok && !m.taken[name] {
+			break
+		}
+	}
+	name := kind + "_" + strconv.Itoa(n)
+	m.values[name] = value
+	m.names[value] = name
+	piiScrubbedCounter.WithLabelValues(kind).Inc()
+	return name
+}
+
+// outsidePlaceholders applies replace to the parts of text between its
+// placeholders.
+func outsidePlaceholders(text string, replace func(part string) string) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range placeholderPattern.FindAllStringIndex(text, -1) {
+		b.WriteString(replace(text[last:loc[0]]))
+		b.WriteString(text[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	b.WriteString(replace(text[last:]))
+	return b.String()
+}
+
+// restore puts the masked values back into text.
+func (m *piiMask) restore(text string) string {
+	if m == nil {
+		return text
+	}
+	return substitute(text, m.values)
+}
+
+// maxPlaceholderLength bounds how much of a stream is held back waiting
+// for the end of a placeholder.
+const maxPlaceholderLength = 64
+
+// restoreStream restores masked values in a streamed text, holding back a
+// chunk ending in what may be the start of a placeholder.
+type restoreStream struct {
+	mask    *piiMask
+	pending string
+}
+
+// write returns the restored text of token that can be sent.
+func (s *restoreStream) write(token string) string {
+	text := s.pending + token
+	s.pending = ""
+	if i := strings.LastIndexByte(text, '{'); i >= 0 && !strings.Contains(text[i:], "}") && len(text)-i < maxPlaceholderLength {
+		text, s.pending = text[:i], text[i:]
+	}
+	return s.mask.restore(text)
+}
+
+// flush returns the text held back.
+func (s *restoreStream) flush() string {
+	if s == nil {
+		return ""
+	}
+	text := s.pending
+	s.pending = ""
+	return s.mask.restore(text)
+}
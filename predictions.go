@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const trackedPredictionTTL = time.Hour
+
+// trackedPredictions remembers the predictions started by this service so
+// they can be looked up and cancelled by ID.
+var trackedPredictions = &predictionRegistry{
+	items: make(map[string]trackedPrediction),
+}
+
+type trackedPrediction struct {
+	prediction *AIPrediction
+	started    time.Time
+	// caller is the ID of the caller the prediction was started for, empty
+	// for anonymous callers
+	caller string
+	// mask restores the personal data masked in the prompt, nil if none was
+	mask *piiMask
+}
+
+type predictionRegistry struct {
+	mu    sync.Mutex
+	items map[string]trackedPrediction
+}
+
+func (r *predictionRegistry) add(prediction *AIPrediction, caller string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for id, item := range r.items {
+		if now.Sub(item.started) > trackedPredictionTTL {
+			delete(r.items, id)
+		}
+	}
+	r.items[prediction.ID] = trackedPrediction{prediction: prediction, started: now, caller: caller}
+}
+
+// get returns the prediction with id if it was started for caller:
+// callers only see their own predictions, anonymous ones anonymous
+// predictions.
+func (r *predictionRegistry) get(id, caller string) (trackedPrediction, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	item, ok := r.items[id]
+	if !ok || item.caller != caller {
+		return trackedPrediction{}, false
+	}
+	return item, true
+}
+
+// mask sets the mask restoring the output of the prediction with id.
+func (r *predictionRegistry) mask(id string, mask *piiMask) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if item, ok := r.items[id]; ok {
+		item.mask = mask
+		r.items[id] = item
+	}
+}
+
+// PredictionStatus is the client-facing view of a prediction.
+type PredictionStatus struct {
+	ID     string      `json:"id"`
+	Status string      `json:"status"`
+	Logs   string      `json:"logs,omitempty"`
+	Output string      `json:"output,omitempty"`
+	Error  interface{} `json:"error,omitempty"`
+}
+
+func newPredictionStatus(prediction *AIPrediction) PredictionStatus {
+	return PredictionStatus{
+		ID:     prediction.ID,
+		Status: prediction.Status,
+		Logs:   prediction.Logs,
+		Output: parseOutput(prediction.Output),
+		Error:  prediction.Error,
+	}
+}
+
+// cancelAbandonedPrediction cancels a prediction whose client disconnected.
+// The request context is already done, so a fresh one is used.
+func cancelAbandonedPrediction(client *http.Client, prediction *AIPrediction, logger *slog.Logger) {
+	cancelledCounter.Inc()
+	logger.Info("Client went away, cancelling prediction", "prediction", prediction.ID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := cancelPrediction(ctx, client, prediction, logger)
+	if err != nil {
+		logger.Error("Error cancelling prediction", "prediction", prediction.ID, "error", err)
+	}
+}
+
+func cancelPrediction(ctx context.Context, client *http.Client, started *AIPrediction, logger *slog.Logger) (*AIPrediction, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", started.URLs.Cancel, nil)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error creating cancel request", "error", err)
+		return nil, err
+	}
+	req.Header.Add("Authorization", replicateAuthorization(started.token))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		replicateTokens.report(started.token, 0)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	replicateTokens.report(started.token, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	logger.DebugContext(ctx, "AI service cancel response", "body", string(body))
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp.StatusCode, "AI service returned status %d", resp.StatusCode)
+	}
+
+	var prediction AIPrediction
+	err = json.Unmarshal(body, &prediction)
+	if err != nil {
+		return nil, err
+	}
+	prediction.token = started.token
+
+	return &prediction, nil
+}
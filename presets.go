@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// PresetConfig bundles the generation settings for one kind of SMS, picked
+// by clients with ?preset=<name>. Settings left unset keep the defaults.
+type PresetConfig struct {
+	// PromptTemplate wraps the client prompt; {prompt} is replaced by it
+	PromptTemplate string            `yaml:"prompt_template"`
+	SystemPrompt   string            `yaml:"system_prompt"`
+	Model          string            `yaml:"model"`
+	Temperature    *float64          `yaml:"temperature"`
+	TopP           *float64          `yaml:"top_p"`
+	MaxTokens      int               `yaml:"max_tokens"`
+	PostProcess    PostProcessConfig `yaml:"post_process"`
+	// Tone and Persona are used when the request doesn't pick its own
+	Tone    string `yaml:"tone"`
+	Persona string `yaml:"persona"`
+	// Sampling sets the stop sequences and other sampling parameters
+	Sampling `yaml:",inline"`
+}
+
+// PostProcessConfig are the rules applied to the generated text.
+type PostProcessConfig struct {
+	SingleLine  bool     `yaml:"single_line"`
+	StripQuotes bool     `yaml:"strip_quotes"`
+	Remove      []string `yaml:"remove"`
+	MaxLength   int      `yaml:"max_length"`
+	// Transliterate writes Russian in Latin letters, to stay in GSM-7
+	Transliterate bool `yaml:"transliterate"`
+	// Budget regenerates texts that are too long, before MaxLength cuts
+	Budget LengthBudgetConfig `yaml:"budget"`
+	// Footer is appended on a line of its own, like "Reply STOP to opt
+	// out"; MaxLength and Budget count it in
+	Footer string `yaml:"footer"`
+	// ShortenLinks replaces the URLs in the text with short links
+	ShortenLinks bool `yaml:"shorten_links"`
+	// Link is the link of the request, put in the text as a short link
+	Link string `yaml:"-"`
+	// Variables of the request fill the placeholders of the text
+	Variables map[string]string `yaml:"-"`
+	// Candidates is how many texts to generate for the request, to return
+	// the best or, with AllCandidates, all of them
+	Candidates    int  `yaml:"-"`
+	AllCandidates bool `yaml:"-"`
+	// Language is the language the text is to be in, and Translator the
+	// provider translating it when not the generating one
+	Language   string   `yaml:"-"`
+	Translator Provider `yaml:"-"`
+}
+
+// applyPreset applies the named preset to request and returns its
+// post-processing rules. An empty name leaves the request unchanged.
+func applyPreset(name string, request *Request) (PostProcessConfig, error) {
+	if name == "" {
+		return PostProcessConfig{}, nil
+	}
+	preset, ok := currentConfig().Presets[name]
+	if !ok {
+		return PostProcessConfig{}, fmt.Errorf("preset %q is unknown", name)
+	}
+	request.Preset = name
+
+	if preset.PromptTemplate != "" {
+		request.Prompt = strings.ReplaceAll(preset.PromptTemplate, "{prompt}", request.Prompt)
+	}
+	if preset.SystemPrompt != "" {
+		request.System = preset.SystemPrompt
+	}
+	if preset.Model != "" && request.Model == "" {
+		request.Model = preset.Model
+	}
+	if preset.Temperature != nil {
+		request.Temperature = preset.Temperature
+	}
+	if preset.TopP != nil {
+		request.TopP = preset.TopP
+	}
+	if preset.MaxTokens > 0 {
+		request.MaxTokens = preset.MaxTokens
+	}
+	request.Sampling = request.Sampling.override(preset.Sampling)
+
+	return preset.PostProcess, nil
+}
+
+// apply runs the post-processing rules over text.
+func (p PostProcessConfig) apply(text string) string {
+	return p.withFooter(p.cut(p.clean(text)))
+}
+
+// footer returns what the footer adds to a text.
+func (p PostProcessConfig) footer() string {
+	if p.Footer == "" {
+		return ""
+	}
+	if p.Transliterate {
+		return "\n" + transliterate(p.Footer)
+	}
+	return "\n" + p.Footer
+}
+
+// withFooter appends the footer to text.
+func (p PostProcessConfig) withFooter(text string) string {
+	return text + p.footer()
+}
+
+// clean runs the post-processing rules over text, except max_length.
+func (p PostProcessConfig) clean(text string) string {
+	for _, pattern := range p.Remove {
+		text = regexp.MustCompile(pattern).ReplaceAllString(text, "")
+	}
+	if p.SingleLine {
+		text = strings.Join(strings.Fields(text), " ")
+	}
+	if p.StripQuotes {
+		text = strings.Trim(text, "\"'«»“”")
+	}
+	if p.Transliterate {
+		text = transliterate(text)
+	}
+	return strings.TrimSpace(text)
+}
+
+// cut shortens text to max_length, leaving room for the footer.
+func (p PostProcessConfig) cut(text string) string {
+	maxLength := p.MaxLength - len([]rune(p.footer()))
+	// Cut at the last word boundary that fits
+	if runes := []rune(text); p.MaxLength > 0 && len(runes) > maxLength {
+		text = string(runes[:maxLength])
+		if i := strings.LastIndexAny(text, " \n"); i > 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+	}
+
+	return text
+}
+
+// validatePresets reports the problems in the preset definitions.
+func validatePresets(presets map[string]PresetConfig, check func(ok bool, format string, args ...interface{})) {
+	for name, preset := range presets {
+		if preset.PromptTemplate != "" {
+			check(strings.Contains(preset.PromptTemplate, "{prompt}"), "presets.%s.prompt_template must contain {prompt}", name)
+		}
+		if preset.Temperature != nil {
+			check(*preset.Temperature >= 0 && *preset.Temperature <= 2, "presets.%s.temperature must be between 0 and 2", name)
+		}
+		if preset.TopP != nil {
+			check(*preset.TopP > 0 && *preset.TopP <= 1, "presets.%s.top_p must be in (0, 1]", name)
+		}
+		check(preset.MaxTokens >= 0, "presets.%s.max_tokens must not be negative", name)
+		err := preset.Sampling.check()
+		check(err == nil, "presets.%s: %v", name, err)
+		check(preset.PostProcess.MaxLength >= 0, "presets.%s.post_process.max_length must not be negative", name)
+		if preset.PostProcess.MaxLength > 0 {
+			check(len([]rune(preset.PostProcess.footer())) < preset.PostProcess.MaxLength, "presets.%s.post_process.footer must be shorter than max_length", name)
+		}
+		budget := preset.PostProcess.Budget
+		check(budget.MaxChars >= 0 && budget.MaxSegments >= 0, "presets.%s.post_process.budget limits must not be negative", name)
+		check(budget.Attempts >= 0 && budget.Attempts <= 5, "presets.%s.post_process.budget.attempts must be between 0 and 5", name)
+		for _, pattern := range preset.PostProcess.Remove {
+			_, err := regexp.Compile(pattern)
+			check(err == nil, "presets.%s.post_process.remove: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var profanityCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ai_sms_profanity_total",
+	Help: "The total number of generated texts with profanity by list language and action (regenerate or mask)",
+}, []string{"language", "action"})
+
+// profanityPrompt asks the model to rewrite its previous answer politely.
+const profanityPrompt = "This SMS contains profanity. Rewrite it without rude or obscene words, keeping its meaning. Reply with the SMS text only."
+
+// profanityWordPattern matches the words of a text, with the digits and
+// signs that stand in for letters.
+var profanityWordPattern = regexp.MustCompile(`[\p{L}\p{N}@$]+`)
+
+// ProfanityConfig filters profanity out of generated texts with word
+// lists by language, read from the files Lists names: one word per line,
+// a trailing * matching every word starting with it, # starting comments.
+// Words found are masked, keeping their first letter. Strict sends a text
+// with profanity back to the model up to Attempts times first.
+type ProfanityConfig struct {
+	Lists    map[string]string `yaml:"lists"`
+	Strict   bool              `yaml:"strict"`
+	Attempts int               `yaml:"attempts"`
+}
+
+// profanityList is the word list of one language, folded with foldWord.
+type profanityList struct {
+	language string
+	words    map[string]bool
+	prefixes []string
+}
+
+// profanity filters generated texts; nil without word lists. It is set up
+// at startup.
+var profanity *profanityFilter
+
+type profanityFilter struct {
+	lists    []profanityList
+	strict   bool
+	attempts int
+}
+
+// newProfanityFilter reads the configured word lists, or returns nil.
+func newProfanityFilter(config ProfanityConfig) (*profanityFilter, error) {
+	if len(config.Lists) == 0 {
+		return nil, nil
+	}
+	f := &profanityFilter{strict: config.Strict, attempts: config.Attempts}
+	for language, path := range config.Lists {
+		list, err := readProfanityList(language, path)
+		if err != nil {
+			return nil, err
+		}
+		f.lists = append(f.lists, list)
+	}
+	slices.SortFunc(f.lists, func(a, b profanityList) int {
+		return strings.Compare(a.language, b.language)
+	})
+	return f, nil
+}
+
+func readProfanityList(language, path string) (profanityList, error) {
+	list := profanityList{language: language, words: map[string]bool{}}
+	file, err := os.Open(path)
+	if err != nil {
+		return list, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		word, _, _ := strings.Cut(scanner.Text(), "#")
+		word = strings.TrimSpace(word)
+		if prefix, ok := strings.CutSuffix(word, "*"); ok {
+			list.prefixes = append(list.prefixes, foldWord(prefix))
+		} else if word != "" {
+			list.words[foldWord(word)] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return list, fmt.Errorf("reading %s: %v", path, err)
+	}
+	return list, nil
+}
+
+// cyrillicLookalikes are the Latin letters and digits written for the
+// Cyrillic letters they look like, to get past filters.
+var cyrillicLookalikes = strings.NewReplacer(
+	"a", "а", "b", "в", "c", "с", "e", "е", "h", "н", "k", "к", "m", "м",
+	"o", "о", "p", "р", "t", "т", "x", "х", "y", "у", "0", "о", "3", "з",
+	"ё", "е",
+)
+
+// leetLetters are the digits and signs written for Latin letters.
+var leetLetters = strings.NewReplacer(
+	"0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "@", "a", "$", "s",
+)
+
+// foldWord lowercases word and undoes the usual disguises: Latin letters
+// in a Cyrillic word and digits standing for letters.
+func foldWord(word string) string {
+	word = strings.ToLower(word)
+	if strings.IndexFunc(word, func(r rune) bool { return unicode.Is(unicode.Cyrillic, r) }) >= 0 {
+		return cyrillicLookalikes.Replace(word)
+	}
+	if strings.IndexFunc(word, unicode.IsLetter) < 0 {
+		return word
+	}
+	return leetLetters.Replace(word)
+}
+
+// match returns the language of the list word is on, if any.
+func (f *profanityFilter) match(word string) (string, bool) {
+	folded := foldWord(word)
+	for _, list := range f.lists {
+		if list.words[folded] {
+			return list.language, true
+		}
+		for _, prefix := range list.prefixes {
+			if strings.HasPrefix(folded, prefix) {
+				return list.language, true
+			}
+		}
+	}
+	return "", false
+}
+
+// find returns the language of the first profanity in text, if any.
+func (f *profanityFilter) find(text string) (string, bool) {
+	if f == nil {
+		return "", false
+	}
+	for _, word := range profanityWordPattern.FindAllString(text, -1) {
+		if language, ok := f.match(word); ok {
+			return language, true
+		}
+	}
+	return "", false
+}
+
+// mask replaces the letters of the profanity in text but the first with
+// asterisks, which keeps its length.
+func (f *profanityFilter) mask(text string) string {
+	if f == nil {
+		return text
+	}
+	var languages []string
+	text = profanityWordPattern.ReplaceAllStringFunc(text, func(word string) string {
+		language, ok := f.match(word)
+		if !ok {
+			return word
+		}
+		if !slices.Contains(languages, language) {
+			languages = append(languages, language)
+		}
+		runes := []rune(word)
+		return string(runes[0]) + strings.Repeat("*", len(runes)-1)
+	})
+	for _, language := range languages {
+		profanityCounter.WithLabelValues(language, "mask").Inc()
+	}
+	return text
+}
+
+// filterProfanity filters the profanity out of response, the text of
+// request, for the generations that don't go through generateSms: in strict
+// mode the text is sent back to the model first, then what is left masked.
+func filterProfanity(ctx context.Context, provider Provider, request Request, response Response, logger *slog.Logger) Response {
+	if profanity == nil {
+		return response
+	}
+	for attempt := 0; profanity.strict && attempt < profanity.attempts; attempt++ {
+		language, found := profanity.find(response.Text)
+		if !found {
+			break
+		}
+		profanityCounter.WithLabelValues(language, "regenerate").Inc()
+		retry := request
+		retry.History = append(request.History[:len(request.History):len(request.History)], Turn{User: request.Prompt, Assistant: response.Text})
+		retry.Prompt = profanityPrompt
+		candidate, err := getAISmsContent(ctx, provider, retry, logger)
+		if err != nil {
+			logger.WarnContext(ctx, "Error regenerating text with profanity, masking it", "attempt", attempt+1, "error", err)
+			break
+		}
+		response = candidate
+	}
+	response.Text = profanity.mask(response.Text)
+	return response
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const defaultLanguageToolURL = "https://api.languagetool.org/v2/check"
+
+var proofreadCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ai_sms_proofread_total",
+	Help: "The total number of generated texts proofread by result (corrected, unchanged, rejected or error)",
+}, []string{"result"})
+
+// proofreadPrompt is the system prompt of the model proofreader.
+const proofreadPrompt = "You proofread SMS messages. Fix the spelling, grammar and punctuation mistakes of the SMS the user sends without rewording it or changing its meaning, language or length. Keep placeholders in braces, links, numbers and names as they are. Reply with the corrected SMS only, or with the SMS unchanged if it has no mistakes."
+
+// maxProofreadChange is the share of its length a correction may change a
+// text by; more means it was rewritten rather than corrected.
+const maxProofreadChange = 0.2
+
+// ProofreadConfig corrects the typos and grammar of generated texts before
+// they are returned. Backend is "model", a second pass through Provider
+// (the default one when empty) with Model, or "languagetool": the
+// LanguageTool API at URL, whose first suggestion for each mistake is
+// applied. Language is the LanguageTool language of texts without a
+// requested one. The premium API is used with Username and the key in the
+// secret APIKeySecret names. Words, such as brand names, are never
+// corrected, nor are the mistakes of the LanguageTool rules or categories
+// in SkipRules.
+type ProofreadConfig struct {
+	Backend      string   `yaml:"backend"`
+	Provider     string   `yaml:"provider"`
+	Model        string   `yaml:"model"`
+	URL          string   `yaml:"url"`
+	Language     string   `yaml:"language"`
+	Username     string   `yaml:"username"`
+	APIKeySecret string   `yaml:"api_key_secret"`
+	Words        []string `yaml:"words"`
+	SkipRules    []string `yaml:"skip_rules"`
+}
+
+// Proofreader corrects a text, written in language when that is set.
+type Proofreader interface {
+	Name() string
+	Proofread(ctx context.Context, text, language string) (string, error)
+}
+
+// proofreader corrects generated texts; nil when proofreading is off. It
+// is set up at startup.
+var proofreader Proofreader
+
+// newProofreader returns the configured proofreader, or nil.
+func newProofreader(config ProofreadConfig, providers *providerSet, logger *slog.Logger) (Proofreader, error) {
+	switch config.Backend {
+	case "":
+		return nil, nil
+	case "model":
+		return &modelProofreader{config: config, providers: providers, logger: logger}, nil
+	}
+	if config.URL == "" {
+		config.URL = defaultLanguageToolURL
+	}
+	var apiKey string
+	if config.Username != "" {
+		var err error
+		apiKey, err = lookupSecret(config.APIKeySecret)
+		if err != nil {
+			return nil, err
+		}
+	}
+	client, err := newProviderClient("", logger)
+	if err != nil {
+		return nil, err
+	}
+	return &languageToolProofreader{config: config, apiKey: apiKey, client: client}, nil
+}
+
+// modelProofreader has a model correct texts.
+type modelProofreader struct {
+	config    ProofreadConfig
+	providers *providerSet
+	logger    *slog.Logger
+}
+
+func (p *modelProofreader) Name() string {
+	return "model"
+}
+
+func (p *modelProofreader) Proofread(ctx context.Context, text, language string) (string, error) {
+	provider, err := p.providers.get(p.config.Provider)
+	if err != nil {
+		return "", err
+	}
+	system := proofreadPrompt
+	if len(p.config.Words) > 0 {
+		system += " Never change these words: " + strings.Join(p.config.Words, ", ") + "."
+	}
+	temperature := 0.0
+	request := Request{
+		Prompt:      text,
+		System:      system,
+		Model:       p.config.Model,
+		Temperature: &temperature,
+		MaxTokens:   currentConfig().Generation.MaxTokens,
+	}
+	response, err := getAISmsContent(ctx, provider, request, p.logger)
+	if err != nil {
+		return "", err
+	}
+	return response.Text, nil
+}
+
+// languageToolProofreader applies the suggestions of LanguageTool.
+type languageToolProofreader struct {
+	config ProofreadConfig
+	apiKey string
+	client *http.Client
+}
+
+func (p *languageToolProofreader) Name() string {
+	return "languagetool"
+}
+
+// languageToolMatch is a mistake LanguageTool found. Offset and Length
+// count UTF-16 code units.
+type languageToolMatch struct {
+	Offset       int `json:"offset"`
+	Length       int `json:"length"`
+	Replacements []struct {
+		Value string `json:"value"`
+	} `json:"replacements"`
+	Rule struct {
+		ID       string `json:"id"`
+		Category struct {
+			ID string `json:"id"`
+		} `json:"category"`
+	} `json:"rule"`
+}
+
+func (p *languageToolProofreader) Proofread(ctx context.Context, text, language string) (string, error) {
+	if language == "" {
+		language = p.config.Language
+	}
+	form := url.Values{"text": {text}, "language": {language}}
+	if p.config.Username != "" {
+		form.Set("username", p.config.Username)
+		form.Set("apiKey", p.apiKey)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.config.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", newStatusError(resp.StatusCode, "LanguageTool answered %s", resp.Status)
+	}
+	var checked struct {
+		Matches []languageToolMatch `json:"matches"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&checked)
+	if err != nil {
+		return "", fmt.Errorf("decoding the LanguageTool response: %v", err)
+	}
+
+	units := utf16.Encode([]rune(text))
+	// Placeholders and links are never corrected
+	var kept [][]int
+	for _, span := range languageIgnored.FindAllStringIndex(text, -1) {
+		kept = append(kept, []int{len(utf16.Encode([]rune(text[:span[0]]))), len(utf16.Encode([]rune(text[:span[1]])))})
+	}
+	// Matches are applied from the end, so the offsets of the others hold
+	slices.SortFunc(checked.Matches, func(a, b languageToolMatch) int {
+		return b.Offset - a.Offset
+	})
+	end := len(units)
+	for _, match := range checked.Matches {
+		start, stop := match.Offset, match.Offset+match.Length
+		if len(match.Replacements) == 0 || start < 0 || stop > end {
+			continue
+		}
+		if slices.Contains(p.config.SkipRules, match.Rule.ID) || slices.Contains(p.config.SkipRules, match.Rule.Category.ID) {
+			continue
+		}
+		if slices.ContainsFunc(kept, func(span []int) bool { return start < span[1] && stop > span[0] }) {
+			continue
+		}
+		word := string(utf16.Decode(units[start:stop]))
+		if slices.ContainsFunc(p.config.Words, func(w string) bool { return strings.EqualFold(w, word) }) {
+			continue
+		}
+		replacement := utf16.Encode([]rune(match.Replacements[0].Value))
+		units = slices.Concat(units[:start], replacement, units[stop:])
+		// Overlapping matches before this one are left alone
+		end = start
+	}
+	return string(utf16.Decode(units)), nil
+}
+
+// proofreadText returns text corrected by the proofreader, or text itself
+// when proofreading is off or fails, or the correction is no good: it
+// changes too much of the text, breaks its placeholders or doesn't fit
+// where text did.
+func proofreadText(ctx context.Context, text string, postProcess PostProcessConfig, logger *slog.Logger) string {
+	if proofreader == nil {
+		return text
+	}
+	corrected, err := proofreader.Proofread(ctx, text, postProcess.Language)
+	if err != nil {
+		proofreadCounter.WithLabelValues("error").Inc()
+		logger.WarnContext(ctx, "Error proofreading text, keeping it", "proofreader", proofreader.Name(), "error", err)
+		return text
+	}
+	corrected = postProcess.clean(corrected)
+	if corrected == text {
+		proofreadCounter.WithLabelValues("unchanged").Inc()
+		return text
+	}
+	length, change := len([]rune(text)), len([]rune(corrected))-len([]rune(text))
+	final := func(text string) string {
+		return postProcess.withFooter(substitute(text, postProcess.Variables))
+	}
+	var problem string
+	switch {
+	case corrected == "" || float64(max(change, -change)) > maxProofreadChange*float64(length):
+		problem = "changes too much"
+	case len(postProcess.Variables) > 0 && checkPlaceholders(corrected, postProcess.Variables) != nil:
+		problem = "breaks the placeholders"
+	case postProcess.Budget.fits(final(text)) && !postProcess.Budget.fits(final(corrected)):
+		problem = "is over the length budget"
+	case postProcess.Link != "" && !strings.Contains(corrected, postProcess.Link):
+		problem = "drops the link"
+	}
+	if problem != "" {
+		proofreadCounter.WithLabelValues("rejected").Inc()
+		logger.WarnContext(ctx, "Proofread text "+problem+", keeping the original", "proofreader", proofreader.Name())
+		return text
+	}
+	proofreadCounter.WithLabelValues("corrected").Inc()
+	return corrected
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const defaultProvider = "replicate"
+
+// Provider is an AI backend able to generate SMS text.
+type Provider interface {
+	Name() string
+	Generate(ctx context.Context, request Request) (Response, error)
+}
+
+// Request is a provider-independent generation request. Optional sampling
+// parameters left unset fall back to the provider defaults. Version pins a
+// model version where the provider supports it.
+type Request struct {
+	Prompt      string
+	System      string
+	Model       string
+	Version     string
+	History     []Turn
+	Temperature *float64
+	TopP        *float64
+	MaxTokens   int
+	// Seed makes sampling repeatable where the provider supports it
+	Seed *int64 `json:",omitempty"`
+	Sampling
+	// Preset is the name of the preset applied to the request, if any
+	Preset string
+	// Candidate numbers the candidates generated for one request, so they
+	// are neither cached nor shared as one generation; other requests keep
+	// their cache keys
+	Candidate int `json:",omitempty"`
+}
+
+// seedlessProviders take no seed, so Request.Seed has no effect on them.
+var seedlessProviders = []string{"anthropic", "bedrock", "gigachat", "yandexgpt"}
+
+// modelOr returns the requested model, or def when none was requested.
+func (r Request) modelOr(def string) string {
+	if r.Model == "" {
+		return def
+	}
+
+	return r.Model
+}
+
+// Turn is one earlier exchange of a conversation.
+type Turn struct {
+	User      string
+	Assistant string
+}
+
+// Response is the result of a generation.
+type Response struct {
+	ID       string
+	Text     string
+	Provider string
+	Model    string
+	Usage    Usage
+	// GenerationID is the history record of the generation, if recorded
+	GenerationID string
+	// Flagged are the moderation categories the prompt or text were
+	// flagged for without being blocked
+	Flagged []string
+	// Candidates are all the texts generated for the request, best first,
+	// when they were asked for
+	Candidates []Candidate
+}
+
+// Usage is the resource consumption an upstream reported for a generation.
+// Fields the upstream doesn't report are left zero.
+type Usage struct {
+	InputTokens  int
+	OutputTokens int
+	// PredictTime is the compute time billed by Replicate.
+	PredictTime time.Duration
+}
+
+// StreamingProvider is implemented by providers able to return the text
+// token by token. onToken is called for every chunk as it arrives.
+type StreamingProvider interface {
+	Provider
+	GenerateStream(ctx context.Context, request Request, onToken func(token string) error) (Response, error)
+}
+
+var providerLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "ai_sms_provider_request_duration_seconds",
+	Help:    "Time taken by AI providers to complete a generation",
+	Buckets: []float64{0.5, 1, 2, 5, 10, 20, 30, 60, 120},
+}, []string{"provider", "model", "status"})
+
+// generate calls provider.Generate through the concurrency limiter and its
+// circuit breaker, and records its latency and errors. Personal data is
+// masked in what the provider gets.
+func generate(ctx context.Context, provider Provider, request Request) (Response, error) {
+	// Each provider of a chain or hedge is measured and guarded on its own
+	switch group := provider.(type) {
+	case *fallbackChain:
+		return group.Generate(ctx, request)
+	case *hedgedProvider:
+		return group.Generate(ctx, request)
+	}
+
+	request, mask := scrubRequest(request, provider)
+	response, err := guardedCall(ctx, provider, request, func(ctx context.Context) (Response, error) {
+		return provider.Generate(ctx, request)
+	})
+	response.Text = mask.restore(response.Text)
+	return response, err
+}
+
+// generateStream is generate for streamer.GenerateStream.
+func generateStream(ctx context.Context, streamer StreamingProvider, request Request, onToken func(token string) error) (Response, error) {
+	if chain, ok := streamer.(*fallbackChain); ok {
+		return chain.GenerateStream(ctx, request, onToken)
+	}
+
+	request, mask := scrubRequest(request, streamer)
+	send := onToken
+	var stream *restoreStream
+	if mask != nil && onToken != nil {
+		// Placeholders may be split across tokens
+		stream = &restoreStream{mask: mask}
+		onToken = func(token string) error {
+			text := stream.write(token)
+			if text == "" {
+				return nil
+			}
+			return send(text)
+		}
+	}
+	response, err := guardedCall(ctx, streamer, request, func(ctx context.Context) (Response, error) {
+		return streamer.GenerateStream(ctx, request, onToken)
+	})
+	if text := stream.flush(); err == nil && text != "" {
+		err = send(text)
+	}
+	response.Text = mask.restore(response.Text)
+	return response, err
+}
+
+// guardedCall runs call, counting and reporting its failure by error class.
+func guardedCall(ctx context.Context, provider Provider, request Request, call func(ctx context.Context) (Response, error)) (Response, error) {
+	response, err := limitedCall(ctx, provider, request, call)
+	if err != nil {
+		countGenerationError(provider.Name(), err)
+		reportGenerationError(ctx, provider, request, err)
+	}
+
+	return response, err
+}
+
+// limitedCall runs call once a concurrency slot is free and the provider's
+// circuit breaker lets it through.
+func limitedCall(ctx context.Context, provider Provider, request Request, call func(ctx context.Context) (Response, error)) (Response, error) {
+	queueCtx, span := startSpan(ctx, "generation.queue")
+	release, err := generations.acquire(queueCtx)
+	endSpan(span, err)
+	if err != nil {
+		return Response{}, err
+	}
+	defer release()
+
+	config := currentConfig().CircuitBreaker
+	breaker := breakers.get(provider.Name())
+	err = breaker.allow(config)
+	if err != nil {
+		return Response{}, err
+	}
+
+	ctx, span = startSpan(ctx, "provider.generate",
+		attribute.String("provider", provider.Name()),
+		attribute.String("model", request.Model),
+	)
+	start := time.Now()
+	response, err := call(ctx)
+	endSpan(span, err)
+	observeProviderLatency(provider, request, response, start, err)
+	if err == nil {
+		observeUsage(response)
+	}
+	breaker.done(ctx, config, err)
+
+	return response, err
+}
+
+func observeProviderLatency(provider Provider, request Request, response Response, start time.Time, err error) {
+	status := "success"
+	if err != nil {
+		status = "error"
+	}
+	model := response.Model
+	if model == "" {
+		model = request.modelOr("default")
+	}
+	providerLatency.WithLabelValues(provider.Name(), model, status).Observe(time.Since(start).Seconds())
+}
+
+type providerFactory func(logger *slog.Logger) (Provider, error)
+
+var providerFactories = make(map[string]providerFactory)
+
+// registerProvider makes a provider available by name. Provider
+// implementations call it from init.
+func registerProvider(name string, factory providerFactory) {
+	if _, ok := providerFactories[name]; ok {
+		panic("provider " + name + " registered twice")
+	}
+	providerFactories[name] = factory
+}
+
+func newProvider(name string, logger *slog.Logger) (Provider, error) {
+	factory, ok := providerFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %q (available: %s)", name, strings.Join(providerNames(), ", "))
+	}
+
+	return factory(logger)
+}
+
+// providerSet lazily creates and caches providers by name, so requests can
+// pick a provider other than the configured default.
+type providerSet struct {
+	mu     sync.Mutex
+	logger *slog.Logger
+	items  map[string]Provider
+}
+
+func newProviderSet(logger *slog.Logger) *providerSet {
+	return &providerSet{
+		logger: logger,
+		items:  make(map[string]Provider),
+	}
+}
+
+// get returns the named provider, or the configured default when name is
+// empty. With a fallback list configured the default is a chain trying
+// those providers in order.
+func (s *providerSet) get(name string) (Provider, error) {
+	if name == "" {
+		config := currentConfig()
+		if len(config.Fallback) > 0 {
+			return &fallbackChain{providers: s, names: config.Fallback}, nil
+		}
+		name = config.Provider
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if provider, ok := s.items[name]; ok {
+		return provider, nil
+	}
+	provider, err := newProvider(name, s.logger)
+	if err != nil {
+		return nil, err
+	}
+	s.items[name] = provider
+
+	return provider, nil
+}
+
+// reset drops the cached providers so they are recreated with the current
+// settings. Requests already holding a provider keep using it.
+func (s *providerSet) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.items = make(map[string]Provider)
+}
+
+func providerNames() []string {
+	names := make([]string, 0, len(providerFactories))
+	for name := range providerFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
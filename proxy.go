@@ -0,0 +1,123 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// directProxy in provider_proxies sends a provider's requests without a proxy.
+const directProxy = "direct"
+
+// newProviderClient creates the HTTP client for calls to provider, using the
+// proxy rules from proxyFor. Calls of a named provider are retried according
+// to the retry policy.
+func newProviderClient(provider string, logger *slog.Logger) (*http.Client, error) {
+	proxy, err := proxyFor(provider)
+	if err != nil {
+		logger.Error("Error getting proxy", "provider", provider, "error", err)
+		return nil, err
+	}
+
+	tlsConfig, err := outboundTLSConfig(currentConfig().OutboundTLS)
+	if err != nil {
+		logger.Error("Error loading outbound TLS settings", "provider", provider, "error", err)
+		return nil, err
+	}
+	base := newTransport(proxy)
+	base.TLSClientConfig = tlsConfig
+
+	var transport http.RoundTripper = &requestIDTransport{next: tracingTransport(base, provider)}
+	if provider != "" {
+		transport = &retryTransport{next: transport, provider: provider}
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   currentConfig().Timeouts.Request,
+	}, nil
+}
+
+// proxyFor returns the proxy selection for requests to provider. A
+// provider_proxies entry wins; otherwise the configured proxy is used for
+// hosts not matched by no_proxy; without a configured proxy the
+// HTTP_PROXY/HTTPS_PROXY/NO_PROXY environment applies.
+func proxyFor(provider string) (func(*http.Request) (*url.URL, error), error) {
+	config := currentConfig()
+
+	if override, ok := config.ProviderProxies[provider]; ok && provider != "" {
+		if override == directProxy {
+			return nil, nil
+		}
+		proxyURL, err := url.Parse(override)
+		if err != nil {
+			return nil, err
+		}
+		return http.ProxyURL(proxyURL), nil
+	}
+
+	if config.Proxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	proxyURL, err := url.Parse(config.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	noProxy := config.NoProxy
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL, noProxy) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}, nil
+}
+
+// bypassProxy reports whether u is excluded from proxying. Entries follow
+// NO_PROXY conventions: "*", a domain (matching its subdomains too, with or
+// without a leading dot), an IP address or a CIDR block, each optionally
+// with a port. Loopback hosts are never proxied.
+func bypassProxy(u *url.URL, noProxy []string) bool {
+	host := u.Hostname()
+	port := u.Port()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && ip.IsLoopback() {
+		return true
+	}
+
+	for _, entry := range noProxy {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "*" {
+			return true
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if entryHost, entryPort, err := net.SplitHostPort(entry); err == nil {
+			if entryPort != port {
+				continue
+			}
+			entry = entryHost
+		}
+		if ip != nil {
+			if entryIP := net.ParseIP(entry); entryIP != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		domain := strings.TrimPrefix(entry, ".")
+		name := strings.ToLower(host)
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var rateLimitedCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "ai_sms_requests_rate_limited_total",
+	Help: "The total number of requests rejected because the caller exceeded its rate limit",
+})
+
+// RateLimitConfig is a token bucket refilled at RequestsPerMinute and
+// holding up to Burst requests. A zero rate disables the limit.
+type RateLimitConfig struct {
+	RequestsPerMinute float64 `yaml:"requests_per_minute" json:"requests_per_minute"`
+	Burst             int     `yaml:"burst" json:"burst"`
+}
+
+// rateLimitedError is returned when a caller has used up its rate limit.
+type rateLimitedError struct {
+	Wait time.Duration
+}
+
+func (e *rateLimitedError) Error() string {
+	return fmt.Sprintf("rate limit exceeded, try again in %s", e.Wait.Round(time.Second))
+}
+
+func (e *rateLimitedError) StatusCode() int {
+	return http.StatusTooManyRequests
+}
+
+func (e *rateLimitedError) Code() string {
+	return "rate_limited"
+}
+
+func (e *rateLimitedError) RetryAfter() time.Duration {
+	return e.Wait
+}
+
+// callerLimits holds a token bucket per caller.
+var callerLimits = &rateLimiter{buckets: make(map[string]*tokenBucket)}
+
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	limit  RateLimitConfig
+	tokens float64
+	last   time.Time
+}
+
+// take spends one request from the bucket of caller and returns the
+// requests left, or how long until the next one is allowed.
+func (l *rateLimiter) take(caller string, limit RateLimitConfig) (int, time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	bucket, ok := l.buckets[caller]
+	if !ok || bucket.limit != limit {
+		// New callers and changed limits start with a full bucket
+		bucket = &tokenBucket{limit: limit, tokens: float64(limit.Burst), last: now}
+		l.buckets[caller] = bucket
+	}
+
+	perSecond := limit.RequestsPerMinute / 60
+	bucket.tokens = math.Min(float64(limit.Burst), bucket.tokens+now.Sub(bucket.last).Seconds()*perSecond)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / perSecond * float64(time.Second))
+		return 0, wait, false
+	}
+	bucket.tokens--
+	return int(bucket.tokens), 0, true
+}
+
+// rateLimitFor returns the limit of caller: its API key's own limit if it
+// has one, else the configured default.
+func rateLimitFor(caller Caller) RateLimitConfig {
+	if caller.Source == "api_key" {
+		if limit, ok := apiKeys.rateLimit(caller.ID); ok {
+			return limit
+		}
+	}
+	return currentConfig().RateLimit
+}
+
+// allowCaller applies the rate limit of caller to a request, setting the
+// X-RateLimit headers. When the limit is exhausted it writes the 429
+// response and returns false.
+func allowCaller(w http.ResponseWriter, caller Caller) bool {
+	limit := rateLimitFor(caller)
+	if limit.RequestsPerMinute <= 0 {
+		return true
+	}
+
+	remaining, wait, ok := callerLimits.take(caller.ID, limit)
+	w.Header().Set("X-RateLimit-Limit", strconv.FormatFloat(limit.RequestsPerMinute, 'f', -1, 64))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	if !ok {
+		rateLimitedCounter.Inc()
+		writeUnavailable(w, &rateLimitedError{Wait: wait})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var messagesDeliveryCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ai_sms_messages_delivery_total",
+	Help: "The total number of final delivery receipts by gateway and status (delivered, undelivered or failed)",
+}, []string{"gateway", "status"})
+
+// Delivery statuses of a sent SMS. A message is sent until a receipt
+// gives one of the final statuses.
+const (
+	messageSent        = "sent"
+	messageDelivered   = "delivered"
+	messageUndelivered = "undelivered"
+	messageFailed      = "failed"
+)
+
+var finalMessageStatuses = []string{messageDelivered, messageUndelivered, messageFailed}
+
+func finalMessageStatus(status string) bool {
+	return slices.Contains(finalMessageStatuses, status)
+}
+
+// twilioStatuses maps the final Twilio message statuses; the others
+// (queued, sending, sent...) leave a message sent.
+var twilioStatuses = map[string]string{
+	"delivered":   messageDelivered,
+	"read":        messageDelivered,
+	"undelivered": messageUndelivered,
+	"failed":      messageFailed,
+	"canceled":    messageFailed,
+}
+
+// smppStatuses maps the final stat values of SMPP delivery receipts.
+var smppStatuses = map[string]string{
+	"DELIVRD": messageDelivered,
+	"EXPIRED": messageUndelivered,
+	"DELETED": messageUndelivered,
+	"UNDELIV": messageUndelivered,
+	"UNKNOWN": messageUndelivered,
+	"REJECTD": messageFailed,
+}
+
+// recordReceipt records a delivery receipt for the SMS id: gatewayStatus
+// is the status as the gateway reports it, errorCode its error code, if
+// any.
+func recordReceipt(ctx context.Context, gateway, id, gatewayStatus, errorCode string, logger *slog.Logger) {
+	statuses := twilioStatuses
+	if gateway == "smpp" {
+		statuses = smppStatuses
+	}
+	status, final := statuses[gatewayStatus]
+	if !final {
+		status = messageSent
+	}
+	logger.InfoContext(ctx, "Received delivery receipt", "gateway", gateway, "message_id", id, "status", status, "gateway_status", gatewayStatus, "error_code", errorCode)
+	if final {
+		messagesDeliveryCounter.WithLabelValues(gateway, status).Inc()
+	}
+	if history == nil {
+		return
+	}
+
+	now := time.Now().UTC()
+	message := SentMessage{Gateway: gateway, ID: id, Status: status, UpdatedAt: &now}
+	if final && status != messageDelivered {
+		message.Error = gatewayStatus
+		if errorCode != "" {
+			message.Error += " " + errorCode
+		}
+	}
+	history.recordMessageStatus(message)
+}
+
+// MessageStatus is the delivery status of a sent SMS.
+type MessageStatus struct {
+	SentMessage
+	GenerationID string `json:"generation_id"`
+}
+
+// handleMessageStatus returns the delivery status of an SMS sent with
+// /api/v1/sendSms, by the gateway's message ID. Callers only see their own
+// messages, anonymous ones anonymous messages.
+func handleMessageStatus(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	if history == nil {
+		http.Error(w, "Generation history is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	generation, found, err := history.store.GetMessage(r.Context(), r.PathValue("id"))
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error reading message", "error", err)
+		http.Error(w, "Error reading message", http.StatusInternalServerError)
+		return
+	}
+	if caller, _ := callerFrom(r.Context()); found && generation.Caller != caller.ID {
+		found = false
+	}
+	if !found {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(MessageStatus{SentMessage: *generation.Message, GenerationID: generation.ID})
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error encoding message status", "error", err)
+	}
+}
+
+// handleTwilioStatus receives the Twilio status callbacks of sent SMS.
+func handleTwilioStatus(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	sender, ok := smsSender.(*twilioSender)
+	if !ok || sender.config.StatusCallbackURL == "" {
+		http.Error(w, "Twilio status callbacks are not configured", http.StatusServiceUnavailable)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Invalid form body", http.StatusBadRequest)
+		return
+	}
+	if !sender.validSignature(r.Header.Get("X-Twilio-Signature"), r.PostForm) {
+		logger.ErrorContext(r.Context(), "Rejected Twilio status callback")
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+	id := r.PostForm.Get("MessageSid")
+	if id == "" {
+		http.Error(w, "MessageSid is required", http.StatusBadRequest)
+		return
+	}
+
+	recordReceipt(r.Context(), sender.Name(), id, r.PostForm.Get("MessageStatus"), r.PostForm.Get("ErrorCode"), logger)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validSignature checks the X-Twilio-Signature of a status callback: the
+// base64 HMAC-SHA1, keyed with the auth token, of the callback URL followed
+// by the form parameters and their values, sorted by name.
+func (s *twilioSender) validSignature(signature string, form map[string][]string) bool {
+	var b strings.Builder
+	b.WriteString(s.config.StatusCallbackURL)
+	names := make([]string, 0, len(form))
+	for name := range form {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		values := slices.Clone(form[name])
+		slices.Sort(values)
+		for _, value := range values {
+			b.WriteString(name + value)
+		}
+	}
+	mac := hmac.New(sha1.New, []byte(s.authToken))
+	mac.Write([]byte(b.String()))
+	given, err := base64.StdEncoding.DecodeString(signature)
+	return err == nil && hmac.Equal(given, mac.Sum(nil))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisRetryInterval is how long the cache is skipped after Redis fails.
+const redisRetryInterval = 10 * time.Second
+
+// errCacheUnavailable is returned while the cache backend is skipped after
+// a failure.
+var errCacheUnavailable = errors.New("cache backend is unavailable")
+
+// RedisConfig points the generation cache at Redis, shared by all
+// replicas. The password is read from REDIS_PASSWORD like other secrets.
+type RedisConfig struct {
+	Addr     string `yaml:"addr"`
+	Username string `yaml:"username"`
+	DB       int    `yaml:"db"`
+	// KeyPrefix namespaces the keys of this service
+	KeyPrefix string `yaml:"key_prefix"`
+	// TLS connects with the outbound_tls settings
+	TLS bool `yaml:"tls"`
+	// Timeout bounds each Redis command so a slow Redis can't hold up
+	// generations
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// redisCache stores generation results in Redis as JSON. When Redis fails
+// it is skipped for redisRetryInterval, and generations go to the provider
+// as if nothing was cached.
+type redisCache struct {
+	client    *redis.Client
+	config    RedisConfig
+	logger    *slog.Logger
+	downUntil atomic.Int64
+}
+
+func newRedisCache(config RedisConfig, logger *slog.Logger) (*redisCache, error) {
+	password, err := lookupSecret("REDIS_PASSWORD")
+	if err != nil {
+		return nil, err
+	}
+	options := &redis.Options{
+		Addr:         config.Addr,
+		Username:     config.Username,
+		Password:     password,
+		DB:           config.DB,
+		DialTimeout:  config.Timeout,
+		ReadTimeout:  config.Timeout,
+		WriteTimeout: config.Timeout,
+		MaxRetries:   -1,
+	}
+	if config.TLS {
+		options.TLSConfig, err = outboundTLSConfig(currentConfig().OutboundTLS)
+		if err != nil {
+			return nil, err
+		}
+		if options.TLSConfig == nil {
+			options.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+	}
+
+	return &redisCache{client: redis.NewClient(options), config: config, logger: logger}, nil
+}
+
+func (c *redisCache) Name() string {
+	return "redis"
+}
+
+func (c *redisCache) Get(ctx context.Context, key string) (Response, bool, error) {
+	if c.down() {
+		return Response{}, false, errCacheUnavailable
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.config.Timeout)
+	defer cancel()
+
+	data, err := c.client.Get(ctx, c.config.KeyPrefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return Response{}, false, nil
+	}
+	if err != nil {
+		return Response{}, false, c.fail(err)
+	}
+
+	var response Response
+	err = json.Unmarshal(data, &response)
+	if err != nil {
+		return Response{}, false, err
+	}
+	return response, true, nil
+}
+
+func (c *redisCache) Set(ctx context.Context, key string, response Response, ttl time.Duration) error {
+	if c.down() {
+		return errCacheUnavailable
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	// The response is already on its way to the client; don't let a
+	// cancelled request lose the cache write
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.config.Timeout)
+	defer cancel()
+
+	err = c.client.Set(ctx, c.config.KeyPrefix+key, data, ttl).Err()
+	if err != nil {
+		return c.fail(err)
+	}
+	return nil
+}
+
+func (c *redisCache) down() bool {
+	return time.Now().UnixNano() < c.downUntil.Load()
+}
+
+// fail logs err and skips Redis for redisRetryInterval.
+func (c *redisCache) fail(err error) error {
+	c.downUntil.Store(time.Now().Add(redisRetryInterval).UnixNano())
+	c.logger.Warn("Redis cache failed, skipping it for a while", "addr", c.config.Addr, "retry_in", redisRetryInterval, "error", err)
+	return fmt.Errorf("%w: %v", errCacheUnavailable, err)
+}
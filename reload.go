@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// reloadMu serializes reloads triggered by SIGHUP and the admin API.
+var reloadMu sync.Mutex
+
+// reloadConfig loads the config file again and swaps it in atomically.
+// In-flight requests finish with the settings they started with.
+func reloadConfig(flags *cliFlags, providers *providerSet, logger *slog.Logger) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	configFile, required := flags.configPath()
+	config, err := loadConfig(configFile, required)
+	if err != nil {
+		return err
+	}
+	flags.apply(config)
+
+	old := currentConfig()
+	changes := configDiff(old, config)
+	if len(changes) == 0 {
+		logger.Info("Config reloaded, nothing changed")
+		return nil
+	}
+	for _, change := range changes {
+		logger.Info("Config changed", "change", change)
+	}
+	if !reflect.DeepEqual(old.Server, config.Server) {
+		logger.Info("Server settings only take effect after a restart")
+	}
+
+	activeConfig.Store(config)
+	providers.reset()
+
+	return nil
+}
+
+// configDiff lists the settings that differ between old and new as
+// "yaml.path: old -> new".
+func configDiff(old, new *Config) []string {
+	var changes []string
+	diffValues("", reflect.ValueOf(*old), reflect.ValueOf(*new), &changes)
+	return changes
+}
+
+func diffValues(path string, old, new reflect.Value, changes *[]string) {
+	if old.Kind() == reflect.Struct {
+		for i := 0; i < old.NumField(); i++ {
+			field := old.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+			if name == "" || name == "-" {
+				name = strings.ToLower(field.Name)
+			}
+			if path != "" {
+				name = path + "." + name
+			}
+			diffValues(name, old.Field(i), new.Field(i), changes)
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(old.Interface(), new.Interface()) {
+		*changes = append(*changes, fmt.Sprintf("%s: %v -> %v", path, old.Interface(), new.Interface()))
+	}
+}
+
+// requireAdmin protects admin endpoints with the ADMIN_TOKEN bearer token.
+// Admin endpoints are disabled when no token is configured, and only
+// reachable from addresses allowed by the admin IP rules.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !checkIP(w, r, "admin", currentConfig().IPAccess.Admin) {
+			return
+		}
+		token := os.Getenv("ADMIN_TOKEN")
+		if token == "" {
+			http.Error(w, "Admin API is disabled", http.StatusForbidden)
+			return
+		}
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const replicateAPIURL = "https://api.replicate.com/v1"
+
+func replicateAuthorization(token string) string {
+	return "Bearer " + token
+}
+
+// verifyReplicateToken checks the token against the account endpoint.
+func verifyReplicateToken(ctx context.Context, client *http.Client, token string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", replicateAPIURL+"/account", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", replicateAuthorization(token))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return errors.New("Replicate rejected the API token")
+	default:
+		return newStatusError(resp.StatusCode, "Replicate account check returned status %d", resp.StatusCode)
+	}
+}
+
+type Input struct {
+	TopK             int     `json:"top_k"`
+	TopP             float64 `json:"top_p"`
+	Prompt           string  `json:"prompt"`
+	Temperature      float64 `json:"temperature"`
+	MaxNewTokens     int     `json:"max_new_tokens"`
+	PromptTemplate   string  `json:"prompt_template"`
+	PresencePenalty  float64 `json:"presence_penalty"`
+	FrequencyPenalty float64 `json:"frequency_penalty"`
+	Seed             *int64  `json:"seed,omitempty"`
+	// StopSequences are comma-separated
+	StopSequences     string   `json:"stop_sequences,omitempty"`
+	MinNewTokens      int      `json:"min_new_tokens,omitempty"`
+	RepetitionPenalty *float64 `json:"repetition_penalty,omitempty"`
+	// Extra are merged into the input, for the parameters of other models
+	Extra map[string]any `json:"-"`
+}
+
+func (i Input) MarshalJSON() ([]byte, error) {
+	type plain Input
+	return withExtra(plain(i), i.Extra)
+}
+
+type AIRequest struct {
+	Version             string   `json:"version,omitempty"`
+	Input               Input    `json:"input"`
+	Stream              bool     `json:"stream,omitempty"`
+	Webhook             string   `json:"webhook,omitempty"`
+	WebhookEventsFilter []string `json:"webhook_events_filter,omitempty"`
+}
+
+type AIErrorResponse struct {
+	Title  string `json:"title"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+type AIPrediction struct {
+	ID     string           `json:"id"`
+	Status string           `json:"status"`
+	Output PredictionOutput `json:"output"`
+	Error  interface{}      `json:"error"`
+	Logs   string           `json:"logs"`
+	URLs   struct {
+		Cancel string `json:"cancel"`
+		Get    string `json:"get"`
+		Stream string `json:"stream"`
+	} `json:"urls"`
+	// Metrics is only filled in once the prediction has finished.
+	Metrics struct {
+		PredictTime      float64 `json:"predict_time"`
+		InputTokenCount  int     `json:"input_token_count"`
+		OutputTokenCount int     `json:"output_token_count"`
+	} `json:"metrics"`
+
+	// token is the API token the prediction was created with; only that
+	// account can read or cancel it.
+	token string
+}
+
+// predictionTimeoutError is returned when a prediction is still running after
+// the configured deadline. The prediction itself is left running upstream.
+type predictionTimeoutError struct {
+	ID   string
+	Wait time.Duration
+}
+
+func (e *predictionTimeoutError) Error() string {
+	return fmt.Sprintf("prediction %s did not finish within %s", e.ID, e.Wait)
+}
+
+// replicateTarget is the model a prediction runs on. An empty Version means
+// the latest version of Model.
+type replicateTarget struct {
+	Model   string
+	Version string
+}
+
+// replicateTargetFor returns the model requested, or the configured default.
+func replicateTargetFor(request Request) replicateTarget {
+	if request.Model == "" {
+		replicate := currentConfig().Replicate
+		return replicateTarget{Model: replicate.Model, Version: replicate.Version}
+	}
+
+	return replicateTarget{Model: request.Model, Version: request.Version}
+}
+
+type replicateProvider struct {
+	client *http.Client
+	logger *slog.Logger
+}
+
+func init() {
+	registerProvider("replicate", func(logger *slog.Logger) (Provider, error) {
+		if !replicateTokens.configured() {
+			return nil, errors.New("REPLICATE_API_TOKEN is not set")
+		}
+		client, err := newProviderClient("replicate", logger)
+		if err != nil {
+			return nil, err
+		}
+		return &replicateProvider{client: client, logger: logger}, nil
+	})
+}
+
+func (p *replicateProvider) Name() string {
+	return "replicate"
+}
+
+// CheckHealth verifies a token from the pool against the account endpoint.
+func (p *replicateProvider) CheckHealth(ctx context.Context) error {
+	token, err := replicateTokens.pick()
+	if err != nil {
+		return err
+	}
+
+	return verifyReplicateToken(ctx, p.client, token)
+}
+
+func (p *replicateProvider) Generate(ctx context.Context, request Request) (Response, error) {
+	target := replicateTargetFor(request)
+	prediction, err := callAIService(ctx, p.client, target, newReplicateInput(request), p.logger)
+	if err != nil {
+		return Response{}, err
+	}
+
+	return Response{
+		ID:       prediction.ID,
+		Text:     parseOutput(prediction.Output),
+		Provider: p.Name(),
+		Model:    target.Model,
+		Usage:    prediction.usage(),
+	}, nil
+}
+
+func (p *replicateProvider) GenerateStream(ctx context.Context, request Request, onToken func(token string) error) (Response, error) {
+	target := replicateTargetFor(request)
+	prediction, err := createPrediction(ctx, p.client, target, newReplicateInput(request), true, p.logger)
+	if err != nil {
+		return Response{}, err
+	}
+	if prediction.URLs.Stream == "" {
+		return Response{}, fmt.Errorf("prediction %s has no stream URL", prediction.ID)
+	}
+
+	var tokens []string
+	err = streamPrediction(ctx, p.client, prediction, func(event, data string) error {
+		if event != "output" {
+			return nil
+		}
+		tokens = append(tokens, data)
+		return onToken(data)
+	}, p.logger)
+	if err != nil {
+		if ctx.Err() != nil {
+			cancelAbandonedPrediction(p.client, prediction, p.logger)
+		}
+		return Response{}, err
+	}
+
+	return Response{
+		ID:       prediction.ID,
+		Text:     parseOutput(tokens),
+		Provider: p.Name(),
+		Model:    target.Model,
+	}, nil
+}
+
+func (p *AIPrediction) usage() Usage {
+	return Usage{
+		InputTokens:  p.Metrics.InputTokenCount,
+		OutputTokens: p.Metrics.OutputTokenCount,
+		PredictTime:  time.Duration(p.Metrics.PredictTime * float64(time.Second)),
+	}
+}
+
+func callAIService(ctx context.Context, client *http.Client, target replicateTarget, input Input, logger *slog.Logger) (*AIPrediction, error) {
+	prediction, err := createPrediction(ctx, client, target, input, false, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// Wait for the completion callback if webhooks are configured
+	var result *AIPrediction
+	if webhooksEnabled() {
+		result, err = waitForWebhook(ctx, client, prediction, logger)
+	} else {
+		// Poll the prediction until it finishes
+		result, err = waitForPrediction(ctx, client, prediction, logger)
+	}
+
+	// Don't keep paying for a generation nobody is waiting for
+	if ctx.Err() != nil {
+		cancelAbandonedPrediction(client, prediction, logger)
+	}
+
+	return result, err
+}
+
+func newInput(prompt string) Input {
+	generation := currentConfig().Generation
+	return Input{
+		TopK:             generation.TopK,
+		TopP:             generation.TopP,
+		Prompt:           prompt,
+		Temperature:      generation.Temperature,
+		MaxNewTokens:     generation.MaxTokens,
+		PromptTemplate:   generation.PromptTemplate,
+		PresencePenalty:  generation.PresencePenalty,
+		FrequencyPenalty: generation.FrequencyPenalty,
+	}
+}
+
+// newReplicateInput maps a provider request onto the Replicate model input.
+func newReplicateInput(request Request) Input {
+	// Mixtral has no system role, so the system prompt leads the first
+	// user message instead
+	history := request.History
+	prompt := request.Prompt
+	if request.System != "" {
+		if len(history) > 0 {
+			history = append([]Turn(nil), history...)
+			history[0].User = request.System + "\n\n" + history[0].User
+		} else {
+			prompt = request.System + "\n\n" + prompt
+		}
+	}
+
+	input := newInput(prompt)
+	if len(history) > 0 {
+		input.Prompt = buildChatPrompt(history, prompt)
+		input.PromptTemplate = "{prompt}"
+	}
+	if request.Temperature != nil {
+		input.Temperature = *request.Temperature
+	}
+	if request.TopP != nil {
+		input.TopP = *request.TopP
+	}
+	if request.MaxTokens > 0 {
+		input.MaxNewTokens = request.MaxTokens
+	}
+	input.Seed = request.Seed
+	input.StopSequences = strings.Join(request.StopSequences, ",")
+	input.MinNewTokens = request.MinNewTokens
+	input.RepetitionPenalty = request.RepetitionPenalty
+	input.Extra = request.Extra
+
+	return input
+}
+
+func createPrediction(ctx context.Context, client *http.Client, target replicateTarget, input Input, stream bool, logger *slog.Logger) (*AIPrediction, error) {
+	// Call AI service, on the pinned version if there is one
+	requestBody := AIRequest{
+		Version: target.Version,
+		Input:   input,
+		Stream:  stream,
+	}
+	predictionsURL := replicateAPIURL + "/models/" + target.Model + "/predictions"
+	if target.Version != "" {
+		predictionsURL = replicateAPIURL + "/predictions"
+	}
+	if !stream && webhooksEnabled() {
+		requestBody.Webhook = withRequestIDParam(ctx, os.Getenv("REPLICATE_WEBHOOK_URL"))
+		requestBody.WebhookEventsFilter = []string{"completed"}
+	}
+	jsonBody, err := json.Marshal(requestBody)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error marshaling request body", "error", err)
+		return nil, err
+	}
+	logger.DebugContext(ctx, "Calling AI service", "body", string(jsonBody))
+
+	token, err := replicateTokens.pick()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", predictionsURL, bytes.NewBuffer(jsonBody))
+	if err != nil {
+		logger.ErrorContext(ctx, "Error creating request", "error", err)
+		return nil, err
+	}
+	req.Header.Add("Authorization", replicateAuthorization(token))
+	req.Header.Add("Content-Type", "application/json")
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error calling AI service", "error", err)
+		replicateTokens.report(token, 0)
+		predictionCreateLatency.WithLabelValues(target.Model, "error").Observe(time.Since(start).Seconds())
+		return nil, err
+	}
+	defer resp.Body.Close()
+	replicateTokens.report(token, resp.StatusCode)
+	predictionCreateLatency.WithLabelValues(target.Model, strconv.Itoa(resp.StatusCode)).Observe(time.Since(start).Seconds())
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error reading AI service response", "error", err)
+		return nil, err
+	}
+	logger.DebugContext(ctx, "AI service response", "body", string(body))
+
+	if resp.StatusCode != 201 {
+		logger.ErrorContext(ctx, "Error calling AI service", "status", resp.StatusCode)
+		var aiErrorResponse AIErrorResponse
+		err = json.Unmarshal(body, &aiErrorResponse)
+		if err != nil {
+			logger.ErrorContext(ctx, "Error unmarshaling AI service ERROR response", "error", err)
+			return nil, newStatusError(resp.StatusCode, "AI service returned status %d", resp.StatusCode)
+		}
+		return nil, newStatusError(resp.StatusCode, "AI service returned status %d: %s", resp.StatusCode, aiErrorResponse.Detail)
+	}
+
+	var prediction AIPrediction
+	err = json.Unmarshal(body, &prediction)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error unmarshaling AI service response URI", "error", err)
+		return nil, err
+	}
+
+	logger.InfoContext(ctx, "Prediction created", "prediction", prediction.ID, "url", prediction.URLs.Get)
+	prediction.token = token
+	caller, _ := callerFrom(ctx)
+	trackedPredictions.add(&prediction, caller.ID)
+
+	return &prediction, nil
+}
+
+func waitForPrediction(ctx context.Context, client *http.Client, prediction *AIPrediction, logger *slog.Logger) (*AIPrediction, error) {
+	result, err := pollPrediction(ctx, client, prediction, currentConfig().Polling.MaxWait, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return finishedPrediction(result)
+}
+
+// pollPrediction polls started until the prediction reaches a terminal status
+// or maxWait elapses. On timeout the last seen prediction is returned together
+// with a *predictionTimeoutError.
+func pollPrediction(ctx context.Context, client *http.Client, started *AIPrediction, maxWait time.Duration, logger *slog.Logger) (prediction *AIPrediction, err error) {
+	ctx, span := startSpan(ctx, "replicate.poll", attribute.String("prediction.id", started.ID))
+	defer func() {
+		if prediction != nil {
+			span.SetAttributes(attribute.String("prediction.status", prediction.Status))
+		}
+		endSpan(span, err)
+	}()
+
+	polling := currentConfig().Polling
+	interval := polling.Interval
+	maxInterval := polling.MaxInterval
+	backoff := polling.Backoff
+
+	start := time.Now()
+	for {
+		prediction, err = getPrediction(ctx, client, started, logger)
+		elapsed := time.Since(start)
+		if err != nil {
+			logger.ErrorContext(ctx, "Error polling prediction", "prediction", started.ID, "error", err, "elapsed", elapsed)
+			return nil, err
+		}
+		logger.InfoContext(ctx, "Polled prediction", "prediction", prediction.ID, "status", prediction.Status, "elapsed", elapsed)
+
+		if predictionDone(prediction) {
+			return prediction, nil
+		}
+
+		if elapsed >= maxWait {
+			return prediction, &predictionTimeoutError{ID: prediction.ID, Wait: maxWait}
+		}
+		wait := interval
+		if elapsed+wait > maxWait {
+			wait = maxWait - elapsed
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+
+		// Back off between polls, up to the configured ceiling
+		interval = time.Duration(float64(interval) * backoff)
+		if interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+}
+
+func predictionDone(prediction *AIPrediction) bool {
+	switch prediction.Status {
+	case "succeeded", "failed", "canceled":
+		return true
+	}
+	return false
+}
+
+// getPrediction fetches the current state of a prediction started earlier.
+func getPrediction(ctx context.Context, client *http.Client, started *AIPrediction, logger *slog.Logger) (*AIPrediction, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", started.URLs.Get, nil)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error creating prediction request", "error", err)
+		return nil, err
+	}
+	req.Header.Add("Authorization", replicateAuthorization(started.token))
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		replicateTokens.report(started.token, 0)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	replicateTokens.report(started.token, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	logger.DebugContext(ctx, "Prediction response", "body", string(body))
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp.StatusCode, "AI service returned status %d", resp.StatusCode)
+	}
+
+	var prediction AIPrediction
+	err = json.Unmarshal(body, &prediction)
+	if err != nil {
+		return nil, err
+	}
+	prediction.token = started.token
+
+	return &prediction, nil
+}
+
+// buildChatPrompt renders the conversation in the Mixtral instruct format.
+func buildChatPrompt(history []Turn, next string) string {
+	var b strings.Builder
+	b.WriteString("<s>")
+	for _, turn := range history {
+		b.WriteString("[INST] " + turn.User + " [/INST] " + turn.Assistant + "</s>")
+	}
+	b.WriteString("[INST] " + next + " [/INST] ")
+
+	return b.String()
+}
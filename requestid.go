@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// requestIDPattern limits accepted client request IDs to something safe to
+// log and forward.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type requestIDKey struct{}
+
+// requestID returns the ID of the request ctx belongs to, or "".
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestID takes the request ID from the X-Request-ID header, or
+// generates one, and returns it in the response. The ID is added to the
+// log fields and the trace, and sent along with upstream calls.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = newUUID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		addLogFields(ctx, "request_id", id)
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String("request.id", id))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestIDTransport adds the X-Request-ID header to outbound requests made
+// on behalf of a client request.
+type requestIDTransport struct {
+	next http.RoundTripper
+}
+
+func (t *requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	id := requestID(req.Context())
+	if id == "" || req.Header.Get(requestIDHeader) != "" {
+		return t.next.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set(requestIDHeader, id)
+	return t.next.RoundTrip(req)
+}
+
+// withRequestIDParam appends the request ID of ctx to rawURL as the
+// request_id query parameter, so callbacks can be matched to the request
+// that caused them.
+func withRequestIDParam(ctx context.Context, rawURL string) string {
+	id := requestID(ctx)
+	if id == "" {
+		return rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	query := u.Query()
+	query.Set("request_id", id)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
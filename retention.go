@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// retentionInterval is how often generations past the retention period
+// are purged.
+const retentionInterval = time.Hour
+
+var historyPurgedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ai_sms_history_deleted_total",
+	Help: "The total number of generations deleted from the history, by reason (retention or erasure)",
+}, []string{"reason"})
+
+// Deletion is the audit record of an erasure request. It keeps a hash of
+// the subject, never the subject itself.
+type Deletion struct {
+	ID          string    `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	SubjectHash string    `json:"subject_hash"`
+	Deleted     int64     `json:"deleted"`
+	RequestID   string    `json:"request_id,omitempty"`
+	ClientIP    string    `json:"client_ip,omitempty"`
+}
+
+// enforceRetention purges generations older than history.retention_days
+// every retentionInterval until ctx is done. The setting is read on every
+// run, so reloads apply.
+func enforceRetention(ctx context.Context, store Store, logger *slog.Logger) {
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+	for {
+		days := currentConfig().History.RetentionDays
+		if days > 0 {
+			cutoff := time.Now().AddDate(0, 0, -days)
+			purgeCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+			deleted, err := store.Purge(purgeCtx, cutoff)
+			cancel()
+			if err != nil {
+				logger.Error("Error purging generation history", "error", err)
+			} else if deleted > 0 {
+				historyPurgedCounter.WithLabelValues("retention").Add(float64(deleted))
+				logger.Info("Purged generation history", "deleted", deleted, "cutoff", cutoff)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleEraseSubject deletes every generation whose prompt or output
+// contains the subject query parameter, such as a phone number or customer
+// ID, or whose caller is the subject.
+func handleEraseSubject(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	if history == nil {
+		http.Error(w, "Generation history is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	subject := strings.TrimSpace(r.URL.Query().Get("subject"))
+	if len(subject) < 4 {
+		// Short subjects would match, and erase, large parts of the history
+		http.Error(w, "subject must be at least 4 characters", http.StatusBadRequest)
+		return
+	}
+
+	sum := sha256.Sum256([]byte(subject))
+	deletion := Deletion{
+		ID:          newUUID(),
+		CreatedAt:   time.Now().UTC(),
+		SubjectHash: hex.EncodeToString(sum[:]),
+		RequestID:   requestID(r.Context()),
+		ClientIP:    clientIP(r),
+	}
+	deleted, err := history.store.Erase(r.Context(), subject, deletion)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error erasing generations", "error", err)
+		http.Error(w, "Error erasing generations", http.StatusInternalServerError)
+		return
+	}
+	deletion.Deleted = deleted
+	historyPurgedCounter.WithLabelValues("erasure").Add(float64(deleted))
+	logger.InfoContext(r.Context(), "AUDIT generations erased", "deletion", deletion.ID, "subject_hash", deletion.SubjectHash, "deleted", deleted)
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(deletion)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error encoding deletion", "error", err)
+	}
+}
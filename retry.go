@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var retryCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ai_sms_provider_retries_total",
+	Help: "The total number of retried provider calls by reason",
+}, []string{"provider", "reason"})
+
+// RetryConfig is the retry policy for provider calls. MaxAttempts counts
+// the first attempt, so 1 disables retries.
+type RetryConfig struct {
+	MaxAttempts       int           `yaml:"max_attempts"`
+	InitialBackoff    time.Duration `yaml:"initial_backoff"`
+	MaxBackoff        time.Duration `yaml:"max_backoff"`
+	Multiplier        float64       `yaml:"multiplier"`
+	RetryableStatuses []int         `yaml:"retryable_statuses"`
+}
+
+// retryTransport retries provider calls that failed with a network error or
+// a retryable status, backing off exponentially with jitter between
+// attempts. A Retry-After header from the upstream is honored up to
+// MaxBackoff.
+type retryTransport struct {
+	next     http.RoundTripper
+	provider string
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	policy := currentConfig().Retry
+	backoff := policy.InitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+
+		reason := ""
+		switch {
+		case err != nil && req.Context().Err() == nil:
+			reason = "network"
+		case err == nil && slices.Contains(policy.RetryableStatuses, resp.StatusCode):
+			reason = strconv.Itoa(resp.StatusCode)
+		}
+		if reason == "" || attempt >= policy.MaxAttempts {
+			return resp, err
+		}
+		// Without a way to replay the body the request can't be retried
+		if req.Body != nil && req.GetBody == nil {
+			return resp, err
+		}
+
+		wait := backoff/2 + rand.N(backoff/2+1)
+		if resp != nil {
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				wait = retryAfter
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		wait = min(wait, policy.MaxBackoff)
+		retryCounter.WithLabelValues(t.provider, reason).Inc()
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		backoff = min(time.Duration(float64(backoff)*policy.Multiplier), policy.MaxBackoff)
+	}
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an
+// HTTP date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0), true
+	}
+	return 0, false
+}
+
+// innerTransport returns the *http.Transport of a provider client, looking
+// through the retry wrapper.
+func innerTransport(client *http.Client) (*http.Transport, error) {
+	next := client.Transport
+	if retry, ok := next.(*retryTransport); ok {
+		next = retry.next
+	}
+	transport, ok := next.(*http.Transport)
+	if !ok {
+		return nil, errors.New("unexpected HTTP transport")
+	}
+	return transport, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"strconv"
+)
+
+// maxStopSequences bounds the stop sequences of a request; OpenAI takes no
+// more.
+const maxStopSequences = 4
+
+// Sampling are the sampling parameters of a request beyond temperature,
+// top_p and max_tokens, set by presets and requests. Providers get the ones
+// their API takes. Extra holds provider-specific parameters, merged into
+// the upstream input without replacing anything the request sets itself.
+type Sampling struct {
+	StopSequences     []string       `json:"stop_sequences,omitempty" yaml:"stop_sequences"`
+	MinNewTokens      int            `json:"min_new_tokens,omitempty" yaml:"min_new_tokens"`
+	RepetitionPenalty *float64       `json:"repetition_penalty,omitempty" yaml:"repetition_penalty"`
+	Extra             map[string]any `json:"extra,omitempty" yaml:"extra"`
+}
+
+// check reports the first problem with the sampling parameters.
+func (s Sampling) check() error {
+	if len(s.StopSequences) > maxStopSequences {
+		return fmt.Errorf("stop_sequences must be at most %d", maxStopSequences)
+	}
+	for _, stop := range s.StopSequences {
+		if stop == "" {
+			return errors.New("stop_sequences must not be empty")
+		}
+	}
+	if s.MinNewTokens < 0 {
+		return errors.New("min_new_tokens must not be negative")
+	}
+	if s.RepetitionPenalty != nil && *s.RepetitionPenalty <= 0 {
+		return errors.New("repetition_penalty must be positive")
+	}
+	return nil
+}
+
+// override returns s with the parameters set in other replacing its own.
+// Extras are merged key by key.
+func (s Sampling) override(other Sampling) Sampling {
+	if len(other.StopSequences) > 0 {
+		s.StopSequences = other.StopSequences
+	}
+	if other.MinNewTokens > 0 {
+		s.MinNewTokens = other.MinNewTokens
+	}
+	if other.RepetitionPenalty != nil {
+		s.RepetitionPenalty = other.RepetitionPenalty
+	}
+	if len(other.Extra) > 0 {
+		extra := maps.Clone(s.Extra)
+		if extra == nil {
+			extra = map[string]any{}
+		}
+		maps.Copy(extra, other.Extra)
+		s.Extra = extra
+	}
+	return s
+}
+
+// applySampling checks the sampling parameters of a request and sets them
+// over the ones of its preset.
+func applySampling(sampling Sampling, request *Request) error {
+	err := sampling.check()
+	if err != nil {
+		return err
+	}
+	request.Sampling = request.Sampling.override(sampling)
+	return nil
+}
+
+// samplingForm reads the sampling parameters of a form: stop_sequences,
+// repeated for several, min_new_tokens, repetition_penalty and extra, a
+// JSON object.
+func samplingForm(r *http.Request) (Sampling, error) {
+	var sampling Sampling
+	err := r.ParseForm()
+	if err != nil {
+		return sampling, err
+	}
+	sampling.StopSequences = r.Form["stop_sequences"]
+	if value := r.FormValue("min_new_tokens"); value != "" {
+		sampling.MinNewTokens, err = strconv.Atoi(value)
+		if err != nil {
+			return sampling, errors.New("min_new_tokens must be an integer")
+		}
+	}
+	if value := r.FormValue("repetition_penalty"); value != "" {
+		penalty, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return sampling, errors.New("repetition_penalty must be a number")
+		}
+		sampling.RepetitionPenalty = &penalty
+	}
+	if value := r.FormValue("extra"); value != "" {
+		err = json.Unmarshal([]byte(value), &sampling.Extra)
+		if err != nil {
+			return sampling, errors.New("extra must be a JSON object")
+		}
+	}
+	return sampling, nil
+}
+
+// withExtra marshals v, an upstream request or part of one, with the keys
+// of extra it does not set itself.
+func withExtra(v any, extra map[string]any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || len(extra) == 0 {
+		return data, err
+	}
+	// Raw values keep large integers such as seeds exact
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(data, &fields)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range extra {
+		if _, ok := fields[key]; ok {
+			continue
+		}
+		fields[key], err = json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("extra %s: %v", key, err)
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// stopSequences are the OpenAI stop parameter: one string or a list.
+type stopSequences []string
+
+func (s *stopSequences) UnmarshalJSON(data []byte) error {
+	var stop string
+	if data[0] == '"' && json.Unmarshal(data, &stop) == nil {
+		*s = stopSequences{stop}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(s))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/robfig/cron/v3"
+)
+
+var scheduleRunsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ai_sms_schedule_runs_total",
+	Help: "The total number of scheduled generations by schedule and result (succeeded, failed or undelivered)",
+}, []string{"schedule", "result"})
+
+// ScheduleConfig generates a text on a cron schedule, such as a daily tip
+// of the day. The generation is recorded in the history like any other;
+// the text is also POSTed to WebhookURL and sent through SMSGateway when
+// they are set.
+type ScheduleConfig struct {
+	Name string `yaml:"name"`
+	// Cron is a five-field cron expression or a descriptor like @daily,
+	// optionally prefixed with CRON_TZ=<zone>
+	Cron       string            `yaml:"cron"`
+	Prompt     string            `yaml:"prompt"`
+	Model      string            `yaml:"model"`
+	Provider   string            `yaml:"provider"`
+	Preset     string            `yaml:"preset"`
+	WebhookURL string            `yaml:"webhook_url"`
+	SMSGateway *SMSGatewayConfig `yaml:"sms_gateway"`
+}
+
+// SMSGatewayConfig sends a text through an HTTP SMS gateway: a POST of
+// {"to": [...], "text": ...} to URL, with the secret named TokenSecret as
+// the bearer token when set.
+type SMSGatewayConfig struct {
+	URL         string   `yaml:"url"`
+	TokenSecret string   `yaml:"token_secret"`
+	To          []string `yaml:"to"`
+}
+
+// ScheduledSms is the body POSTed to the webhook_url of a schedule.
+type ScheduledSms struct {
+	Schedule    string    `json:"schedule"`
+	ScheduledAt time.Time `json:"scheduled_at"`
+	SmsResponse
+}
+
+// parseCron parses the cron expression of a schedule.
+func parseCron(spec string) (cron.Schedule, error) {
+	return cron.ParseStandard(spec)
+}
+
+// startSchedules runs the configured schedules until the returned
+// scheduler is stopped. A run still going when the next one is due is not
+// doubled; the next one is skipped.
+func startSchedules(schedules []ScheduleConfig, providers *providerSet, logger *slog.Logger) (*cron.Cron, error) {
+	scheduler := cron.New(cron.WithChain(cron.SkipIfStillRunning(cron.DiscardLogger)))
+	for _, schedule := range schedules {
+		_, err := scheduler.AddFunc(schedule.Cron, func() {
+			runSchedule(schedule, providers, logger)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("schedule %s: %v", schedule.Name, err)
+		}
+	}
+	scheduler.Start()
+	if len(schedules) > 0 {
+		logger.Info("Started schedules", "schedules", len(schedules))
+	}
+	return scheduler, nil
+}
+
+// runSchedule generates the text of schedule within jobs.timeout and
+// delivers it.
+func runSchedule(schedule ScheduleConfig, providers *providerSet, logger *slog.Logger) {
+	scheduledAt := time.Now().UTC()
+	ctx := withLogFields(context.Background())
+	ctx = context.WithValue(ctx, callerKey{}, Caller{ID: "schedule:" + schedule.Name, Source: "schedule"})
+	ctx = context.WithValue(ctx, requestIDKey{}, newUUID())
+	addLogFields(ctx, "schedule", schedule.Name, "request_id", requestID(ctx))
+	ctx, cancel := context.WithTimeout(ctx, currentConfig().Jobs.Timeout)
+	defer cancel()
+
+	input := JobInput{Prompt: schedule.Prompt, Model: schedule.Model, Provider: schedule.Provider, Preset: schedule.Preset}
+	provider, request, postProcess, err := prepareJob(providers, input)
+	if err != nil {
+		logger.ErrorContext(ctx, "Invalid schedule", "error", err)
+		scheduleRunsCounter.WithLabelValues(schedule.Name, jobFailed).Inc()
+		return
+	}
+	response, err := generateSms(ctx, provider, request, postProcess, logger)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error running schedule", "error", err)
+		scheduleRunsCounter.WithLabelValues(schedule.Name, jobFailed).Inc()
+		return
+	}
+	sms := ScheduledSms{
+		Schedule:    schedule.Name,
+		ScheduledAt: scheduledAt,
+		SmsResponse: newSmsResponse(response),
+	}
+
+	result := jobSucceeded
+	if schedule.WebhookURL != "" {
+		err = postJSON(ctx, schedule.WebhookURL, "", sms, logger)
+		if err != nil {
+			logger.ErrorContext(ctx, "Error posting scheduled SMS to the webhook", "error", err)
+			result = "undelivered"
+		}
+	}
+	if schedule.SMSGateway != nil {
+		err = sendViaGateway(ctx, *schedule.SMSGateway, sms.Text, logger)
+		if err != nil {
+			logger.ErrorContext(ctx, "Error sending scheduled SMS through the gateway", "error", err)
+			result = "undelivered"
+		}
+	}
+	scheduleRunsCounter.WithLabelValues(schedule.Name, result).Inc()
+	logger.InfoContext(ctx, "Ran schedule", "result", result)
+}
+
+// sendViaGateway sends text to the recipients of gateway.
+func sendViaGateway(ctx context.Context, gateway SMSGatewayConfig, text string, logger *slog.Logger) error {
+	token := ""
+	if gateway.TokenSecret != "" {
+		var err error
+		token, err = lookupSecret(gateway.TokenSecret)
+		if err != nil {
+			return err
+		}
+	}
+	body := struct {
+		To   []string `json:"to"`
+		Text string   `json:"text"`
+	}{gateway.To, text}
+	return postJSON(ctx, gateway.URL, token, body, logger)
+}
+
+// postJSON POSTs body as JSON to url, with token as the bearer token when
+// set, and fails unless the answer is 2xx.
+func postJSON(ctx context.Context, url, token string, body any, logger *slog.Logger) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	client, err := newProviderClient("", logger)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SecretStore fetches provider credentials from an external secrets backend.
+// A fetch returns every known secret keyed by its environment variable name
+// (e.g. OPENAI_API_KEY).
+type SecretStore interface {
+	Name() string
+	Fetch(ctx context.Context) (map[string]string, error)
+}
+
+// secretValues caches the last successful fetch from the secrets backend.
+var secretValues = &secretCache{}
+
+type secretCache struct {
+	mu     sync.RWMutex
+	values map[string]string
+}
+
+func (c *secretCache) get(name string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.values[name]
+}
+
+// set stores values and reports whether they differ from the previous ones.
+func (c *secretCache) set(values map[string]string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	changed := !reflect.DeepEqual(c.values, values)
+	c.values = values
+	return changed
+}
+
+// lookupSecret returns a credential from the secrets backend, falling back
+// to loadSecret. An empty result means the secret is not set.
+func lookupSecret(name string) (string, error) {
+	if value := secretValues.get(name); value != "" {
+		return value, nil
+	}
+
+	return loadSecret(name)
+}
+
+// loadSecret returns the value of the environment variable name or, when
+// that is empty, the contents of the file named by name_FILE (for secrets
+// mounted into the container). An empty result means the secret is not set.
+func loadSecret(name string) (string, error) {
+	if value := os.Getenv(name); value != "" {
+		return strings.TrimSpace(value), nil
+	}
+
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading %s_FILE: %v", name, err)
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// newSecretStore creates the configured secrets backend, or nil when
+// credentials come from the environment only.
+func newSecretStore(config SecretsConfig, logger *slog.Logger) (SecretStore, error) {
+	switch config.Backend {
+	case "", "env":
+		return nil, nil
+	case "vault":
+		token, err := loadSecret("VAULT_TOKEN")
+		if err != nil {
+			return nil, err
+		}
+		if token == "" {
+			return nil, errors.New("VAULT_TOKEN is not set")
+		}
+		client, err := newAIClient(logger)
+		if err != nil {
+			return nil, err
+		}
+		return &vaultSecretStore{client: client, config: config.Vault, token: token}, nil
+	case "aws":
+		creds, err := awsCredentialsFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		client, err := newAIClient(logger)
+		if err != nil {
+			return nil, err
+		}
+		region := config.AWS.Region
+		if region == "" {
+			region = awsRegionFromEnv()
+		}
+		return &awsSecretStore{client: client, creds: creds, region: region, secretID: config.AWS.SecretID}, nil
+	}
+
+	return nil, fmt.Errorf("unknown secrets backend %q", config.Backend)
+}
+
+// refreshSecrets re-fetches the secrets every interval until ctx is done.
+// onChange is called after rotated secrets were stored.
+func refreshSecrets(ctx context.Context, store SecretStore, interval time.Duration, onChange func(), logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		fetchCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		values, err := store.Fetch(fetchCtx)
+		cancel()
+		if err != nil {
+			// Keep serving with the secrets we already have
+			logger.ErrorContext(ctx, "Error refreshing secrets", "backend", store.Name(), "error", err)
+			continue
+		}
+		if secretValues.set(values) {
+			logger.InfoContext(ctx, "Secrets changed, recreating providers", "backend", store.Name())
+			onChange()
+		}
+	}
+}
+
+// vaultSecretStore reads a KV version 2 secret whose fields are the
+// credential names.
+type vaultSecretStore struct {
+	client *http.Client
+	config VaultConfig
+	token  string
+}
+
+func (s *vaultSecretStore) Name() string {
+	return "vault"
+}
+
+func (s *vaultSecretStore) Fetch(ctx context.Context) (map[string]string, error) {
+	secretURL := strings.TrimSuffix(s.config.Addr, "/") + "/v1/" + s.config.Mount + "/data/" + strings.TrimPrefix(s.config.Path, "/")
+	req, err := http.NewRequestWithContext(ctx, "GET", secretURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("X-Vault-Token", s.token)
+	if s.config.Namespace != "" {
+		req.Header.Add("X-Vault-Namespace", s.config.Namespace)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Vault returned status %d", resp.StatusCode)
+	}
+
+	var secret struct {
+		Data struct {
+			Data map[string]string `json:"data"`
+		} `json:"data"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return secret.Data.Data, nil
+}
+
+// awsSecretStore reads a Secrets Manager secret holding a JSON object whose
+// keys are the credential names.
+type awsSecretStore struct {
+	client   *http.Client
+	creds    awsCredentials
+	region   string
+	secretID string
+}
+
+func (s *awsSecretStore) Name() string {
+	return "aws"
+}
+
+func (s *awsSecretStore) Fetch(ctx context.Context) (map[string]string, error) {
+	body, err := json.Marshal(map[string]string{"SecretId": s.secretID})
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := "https://secretsmanager." + s.region + ".amazonaws.com/"
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	signAWSRequest(req, body, s.creds, s.region, "secretsmanager", time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Secrets Manager returned status %d: %s", resp.StatusCode, string(data))
+	}
+
+	var secret struct {
+		SecretString string `json:"SecretString"`
+	}
+	err = json.Unmarshal(data, &secret)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]string
+	err = json.Unmarshal([]byte(secret.SecretString), &values)
+	if err != nil {
+		return nil, fmt.Errorf("secret %s is not a JSON object of strings: %v", s.secretID, err)
+	}
+
+	return values, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var smsSentCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ai_sms_messages_sent_total",
+	Help: "The total number of SMS sending attempts by gateway and result (success or failure)",
+}, []string{"gateway", "result"})
+
+// SmsSender delivers text messages.
+type SmsSender interface {
+	Name() string
+	// Send sends text to the E.164 number to and returns the gateway's ID
+	// of the message
+	Send(ctx context.Context, to, text string) (string, error)
+}
+
+// smsSender sends the SMS of /api/v1/sendSms; nil when no gateway is
+// configured. It is set up at startup.
+var smsSender SmsSender
+
+// newSmsSender returns the configured SMS gateway, or nil.
+func newSmsSender(config *Config, logger *slog.Logger) (SmsSender, error) {
+	if config.Twilio.AccountSID != "" {
+		return newTwilioSender(config.Twilio, logger)
+	}
+	if config.SMPP.Addr != "" {
+		return newSMPPSender(config.SMPP, logger)
+	}
+	return nil, nil
+}
+
+// SentMessage is an SMS sent with a generated text.
+type SentMessage struct {
+	Gateway string    `json:"gateway"`
+	ID      string    `json:"id"`
+	SentAt  time.Time `json:"sent_at"`
+	// Status is the delivery status, updated from the delivery receipts
+	Status string `json:"status"`
+	// Error is the gateway's error code for an undelivered or failed SMS
+	Error     string     `json:"error,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// sendSmsRequest is the body of POST /api/v1/sendSms: the recipient, a
+// phone number normalized with normalizePhone, and what to generate for
+// them.
+type sendSmsRequest struct {
+	To string `json:"to"`
+	JobInput
+}
+
+// SendSmsResponse is the generated text and the message it was sent in.
+type SendSmsResponse struct {
+	SmsResponse
+	Message SentMessage `json:"message"`
+}
+
+// handleSendSms generates a text and sends it by SMS. The message is
+// recorded on the generation in the history.
+func handleSendSms(w http.ResponseWriter, r *http.Request, providers *providerSet, logger *slog.Logger) {
+	requestCounter.Inc()
+	if smsSender == nil {
+		http.Error(w, "SMS sending is not configured", http.StatusNotImplemented)
+		return
+	}
+	var request sendSmsRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	to := normalizePhone(request.To, currentConfig().Phone.DefaultRegion)
+	if !to.Valid {
+		http.Error(w, fmt.Sprintf("to is not a valid phone number: %s", to.Error), http.StatusBadRequest)
+		return
+	}
+	provider, generateRequest, postProcess, err := prepareJob(providers, request.JobInput)
+	var tooLarge *promptTooLargeError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response, err := generateSms(r.Context(), provider, generateRequest, postProcess, logger)
+	if unavailable, ok := asUnavailable(err); ok {
+		writeUnavailable(w, unavailable)
+		return
+	}
+	var blocked *moderationError
+	if errors.As(err, &blocked) {
+		writeBlocked(w, blocked)
+		return
+	}
+	var placeholders *placeholderError
+	if errors.As(err, &placeholders) {
+		logger.ErrorContext(r.Context(), "Error getting AI SMS content", "error", err)
+		http.Error(w, placeholders.Error(), http.StatusBadGateway)
+		return
+	}
+	var wrongLanguage *languageError
+	if errors.As(err, &wrongLanguage) {
+		logger.ErrorContext(r.Context(), "Error getting AI SMS content", "error", err)
+		http.Error(w, wrongLanguage.Error(), http.StatusBadGateway)
+		return
+	}
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error getting AI SMS content", "error", err)
+		http.Error(w, "Error getting AI SMS content", http.StatusInternalServerError)
+		return
+	}
+
+	id, err := smsSender.Send(r.Context(), to.E164, response.Text)
+	if err != nil {
+		smsSentCounter.WithLabelValues(smsSender.Name(), "failure").Inc()
+		logger.ErrorContext(r.Context(), "Error sending SMS", "gateway", smsSender.Name(), "error", err)
+		http.Error(w, "Error sending SMS", http.StatusBadGateway)
+		return
+	}
+	smsSentCounter.WithLabelValues(smsSender.Name(), "success").Inc()
+	message := SentMessage{Gateway: smsSender.Name(), ID: id, SentAt: time.Now().UTC(), Status: messageSent}
+	addLogFields(r.Context(), "gateway", message.Gateway, "message_id", message.ID)
+	logger.InfoContext(r.Context(), "Sent SMS")
+	if history != nil && response.GenerationID != "" {
+		history.recordMessage(response.GenerationID, message)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(SendSmsResponse{SmsResponse: newSmsResponse(response), Message: message})
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error encoding sent SMS", "error", err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// setupErrorReporting sends panics and upstream failures to Sentry, or any
+// service speaking its protocol, when SENTRY_DSN is set. The returned
+// function flushes pending events on shutdown.
+func setupErrorReporting(logger *slog.Logger) (func(), error) {
+	dsn := os.Getenv("SENTRY_DSN")
+	if dsn == "" {
+		return func() {}, nil
+	}
+
+	err := sentry.Init(sentry.ClientOptions{
+		Dsn:              dsn,
+		Environment:      os.Getenv("SENTRY_ENVIRONMENT"),
+		Release:          os.Getenv("SENTRY_RELEASE"),
+		AttachStacktrace: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Reporting errors to Sentry")
+
+	return func() { sentry.Flush(5 * time.Second) }, nil
+}
+
+// withPanicReporting gives every request its own Sentry hub carrying the
+// request details, and turns panics into a 500 response that is logged and
+// reported instead of a dropped connection.
+func withPanicReporting(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hub := sentry.CurrentHub().Clone()
+		hub.Scope().SetRequest(r)
+		ctx := sentry.SetHubOnContext(r.Context(), hub)
+
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			logger.ErrorContext(ctx, "Panic serving request", "panic", fmt.Sprint(recovered), "stack", string(debug.Stack()))
+			hub.Scope().SetTag("request_id", requestID(ctx))
+			hub.RecoverWithContext(ctx, recovered)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// reportGenerationError sends a failed generation to Sentry. Cancelled
+// requests and load shedding are expected and not reported.
+func reportGenerationError(ctx context.Context, provider Provider, request Request, err error) {
+	class := errorClass(err)
+	if class == "cancelled" {
+		return
+	}
+	if _, ok := asUnavailable(err); ok {
+		return
+	}
+
+	hub := sentry.GetHubFromContext(ctx)
+	if hub == nil {
+		hub = sentry.CurrentHub()
+	}
+	hub.WithScope(func(scope *sentry.Scope) {
+		scope.SetTags(map[string]string{
+			"provider":    provider.Name(),
+			"model":       request.Model,
+			"error_class": class,
+			"prompt_hash": promptHash(request.Prompt),
+			"request_id":  requestID(ctx),
+		})
+		hub.CaptureException(err)
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// cancelGracePeriod is how long requests cancelled at the end of the drain
+// get to cancel their upstream predictions.
+const cancelGracePeriod = 15 * time.Second
+
+// serveUntilSignal runs server until SIGINT or SIGTERM. It then stops
+// accepting connections and waits up to drainTimeout for in-flight requests;
+// requests still running after that are cancelled, which cancels their
+// upstream generations too.
+func serveUntilSignal(server *http.Server, drainTimeout time.Duration, logger *slog.Logger) error {
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	server.BaseContext = func(net.Listener) context.Context {
+		return baseCtx
+	}
+
+	var inFlight sync.WaitGroup
+	next := server.Handler
+	server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Add(1)
+		defer inFlight.Done()
+		next.ServeHTTP(w, r)
+	})
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- listenAndServe(server)
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	var sig os.Signal
+	select {
+	case err := <-serveErr:
+		return err
+	case sig = <-stop:
+	}
+
+	logger.Info("Draining connections", "signal", sig.String(), "timeout", drainTimeout)
+	shuttingDown.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err == nil {
+		return nil
+	}
+
+	logger.Warn("Requests still running after the drain timeout, cancelling them", "timeout", drainTimeout)
+	cancelRequests()
+	done := make(chan struct{})
+	go func() {
+		inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(cancelGracePeriod):
+		logger.Info("Gave up waiting for cancelled requests")
+	}
+
+	return nil
+}
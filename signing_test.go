@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifySignedRequest(t *testing.T) {
+	t.Setenv("TEST_HMAC_SECRET", "s3cret")
+	config := HMACConfig{
+		Clients:   map[string]string{"platform": "TEST_HMAC_SECRET"},
+		Tolerance: 5 * time.Minute,
+	}
+	now := time.Unix(1700000000, 0)
+	const (
+		method = "POST"
+		target = "/api/v1/generate?preset=otp"
+		body   = `{"prompt":"Your code"}`
+	)
+
+	tests := []struct {
+		name      string
+		client    string
+		method    string
+		target    string
+		body      string
+		timestamp time.Time
+		replay    bool
+		wantErr   string
+	}{
+		{name: "valid", client: "platform", method: method, target: target, body: body, timestamp: now},
+		{name: "valid within tolerance", client: "platform", method: method, target: target, body: body, timestamp: now.Add(-4 * time.Minute)},
+		{name: "tampered method", client: "platform", method: "PUT", target: target, body: body, timestamp: now, wantErr: "signature mismatch"},
+		{name: "tampered path", client: "platform", method: method, target: "/api/v1/jobs?preset=otp", body: body, timestamp: now, wantErr: "signature mismatch"},
+		{name: "tampered query", client: "platform", method: method, target: "/api/v1/generate?preset=promo", body: body, timestamp: now, wantErr: "signature mismatch"},
+		{name: "dropped query", client: "platform", method: method, target: "/api/v1/generate", body: body, timestamp: now, wantErr: "signature mismatch"},
+		{name: "tampered body", client: "platform", method: method, target: target, body: `{"prompt":"Send money"}`, timestamp: now, wantErr: "signature mismatch"},
+		{name: "too old", client: "platform", method: method, target: target, body: body, timestamp: now.Add(-6 * time.Minute), wantErr: "outside the tolerance window"},
+		{name: "too new", client: "platform", method: method, target: target, body: body, timestamp: now.Add(6 * time.Minute), wantErr: "outside the tolerance window"},
+		{name: "replayed", client: "platform", method: method, target: target, body: body, timestamp: now, replay: true, wantErr: "already used"},
+		{name: "unknown client", client: "stranger", method: method, target: target, body: body, timestamp: now, wantErr: "unknown signing client"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			seenSignatures = &signatureCache{expires: map[string]time.Time{}}
+			timestamp := strconv.FormatInt(test.timestamp.Unix(), 10)
+			// The client always signs the original request
+			signature := "sha256=" + hex.EncodeToString(signRequest("s3cret", method, target, timestamp, []byte(body)))
+			newRequest := func() *http.Request {
+				r := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+				r.Header.Set(signatureClientHeader, test.client)
+				r.Header.Set(signatureTimestampHeader, timestamp)
+				r.Header.Set(signatureHeader, signature)
+				return r
+			}
+
+			if test.replay {
+				_, err := verifySignedRequest(newRequest(), config, now)
+				if err != nil {
+					t.Fatalf("first request: %v", err)
+				}
+			}
+			r := newRequest()
+			caller, err := verifySignedRequest(r, config, now)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if caller.ID != test.client || caller.Source != "hmac" {
+				t.Errorf("got caller %+v", caller)
+			}
+			// Handlers can still read the body
+			read, err := io.ReadAll(r.Body)
+			if err != nil || string(read) != test.body {
+				t.Errorf("got body %q, %v", read, err)
+			}
+		})
+	}
+}
+
+func TestSignatureCacheExpiry(t *testing.T) {
+	cache := &signatureCache{expires: map[string]time.Time{}}
+	now := time.Unix(1700000000, 0)
+	if !cache.add("client/abc", now.Add(time.Minute), now) {
+		t.Fatal("first use was refused")
+	}
+	if cache.add("client/abc", now.Add(time.Minute), now.Add(30*time.Second)) {
+		t.Fatal("replay within the window was accepted")
+	}
+	if !cache.add("client/abc", now.Add(2*time.Minute), now.Add(time.Minute)) {
+		t.Fatal("use after the window was refused")
+	}
+	if len(cache.expires) != 1 {
+		t.Errorf("got %d cached signatures, want 1", len(cache.expires))
+	}
+}
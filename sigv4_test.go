@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The credentials and date of the AWS SigV4 test suite.
+var (
+	sigv4TestCredentials = awsCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	sigv4TestTime = time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+)
+
+func TestSignAWSRequestTestSuite(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		want   string
+	}{
+		{
+			name:   "get-vanilla",
+			method: "GET",
+			url:    "https://example.amazonaws.com/",
+			want:   "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name:   "get-vanilla-query-order-key-case",
+			method: "GET",
+			url:    "https://example.amazonaws.com/?Param2=value2&Param1=value1",
+			want:   "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+		{
+			name:   "post-vanilla",
+			method: "POST",
+			url:    "https://example.amazonaws.com/",
+			want:   "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, test.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			signAWSRequest(req, nil, sigv4TestCredentials, "us-east-1", "service", sigv4TestTime)
+			if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+				t.Errorf("X-Amz-Date = %s", got)
+			}
+			if got := req.Header.Get("Authorization"); got != test.want {
+				t.Errorf("Authorization =\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+// TestSignAWSRequestBedrockModelID pins the canonical URI of a model ID
+// with ":", which is escaped in the path and escaped again when signed.
+func TestSignAWSRequestBedrockModelID(t *testing.T) {
+	body := []byte(`{"messages":[]}`)
+	escapedPath := "/model/" + awsURIEncode("anthropic.claude-3-haiku-20240307-v1:0", true) + "/converse"
+	if escapedPath != "/model/anthropic.claude-3-haiku-20240307-v1%3A0/converse" {
+		t.Fatalf("escaped path = %s", escapedPath)
+	}
+	path, err := url.PathUnescape(escapedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", "https://bedrock-runtime.us-east-1.amazonaws.com"+escapedPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.URL.Path = path
+	req.URL.RawPath = escapedPath
+	req.Header.Set("Content-Type", "application/json")
+	signAWSRequest(req, body, sigv4TestCredentials, "us-east-1", "bedrock", sigv4TestTime)
+
+	canonicalRequest := strings.Join([]string{
+		"POST",
+		"/model/anthropic.claude-3-haiku-20240307-v1%253A0/converse",
+		"",
+		"content-type:application/json\nhost:bedrock-runtime.us-east-1.amazonaws.com\nx-amz-date:20150830T123600Z\n",
+		"content-type;host;x-amz-date",
+		sha256Hex(body),
+	}, "\n")
+	scope := "20150830/us-east-1/bedrock/aws4_request"
+	key := hmacSHA256([]byte("AWS4"+sigv4TestCredentials.SecretAccessKey), "20150830")
+	key = hmacSHA256(key, "us-east-1")
+	key = hmacSHA256(key, "bedrock")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, "AWS4-HMAC-SHA256\n20150830T123600Z\n"+scope+"\n"+sha256Hex([]byte(canonicalRequest))))
+
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/" + scope + ", SignedHeaders=content-type;host;x-amz-date, Signature=" + signature
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("Authorization =\n%s\nwant\n%s", got, want)
+	}
+	// The request itself goes out with the path escaped once
+	if got := req.URL.EscapedPath(); got != escapedPath {
+		t.Errorf("request path = %s; want %s", got, escapedPath)
+	}
+}
+
+func TestSignAWSRequestSessionToken(t *testing.T) {
+	req, err := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := sigv4TestCredentials
+	creds.SessionToken = "session"
+	signAWSRequest(req, nil, creds, "us-east-1", "service", sigv4TestTime)
+	if got := req.Header.Get("X-Amz-Security-Token"); got != "session" {
+		t.Errorf("X-Amz-Security-Token = %q", got)
+	}
+	if got := req.Header.Get("Authorization"); !strings.Contains(got, "SignedHeaders=host;x-amz-date;x-amz-security-token,") {
+		t.Errorf("session token is not signed: %s", got)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var tooLargeCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ai_sms_requests_too_large_total",
+	Help: "The total number of requests rejected for their body size or prompt length",
+}, []string{"limit"})
+
+// promptTooLargeError is returned for prompts over limits.max_prompt_chars
+// or limits.max_prompt_tokens.
+type promptTooLargeError struct {
+	Unit  string
+	Size  int
+	Limit int
+}
+
+func (e *promptTooLargeError) Error() string {
+	return fmt.Sprintf("prompt is %d %s long, the limit is %d; shorten the prompt or conversation history", e.Size, e.Unit, e.Limit)
+}
+
+// estimateTokens is a rough token count for limits: about four characters
+// per token, which overestimates for English and underestimates for
+// Cyrillic text.
+func estimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// checkPromptSize checks the prompt and history of request against the
+// configured limits.
+func checkPromptSize(request Request) error {
+	limits := currentConfig().Limits
+	chars := utf8.RuneCountInString(request.Prompt)
+	tokens := estimateTokens(request.Prompt)
+	for _, turn := range request.History {
+		chars += utf8.RuneCountInString(turn.User) + utf8.RuneCountInString(turn.Assistant)
+		tokens += estimateTokens(turn.User) + estimateTokens(turn.Assistant)
+	}
+
+	if limits.MaxPromptChars > 0 && chars > limits.MaxPromptChars {
+		tooLargeCounter.WithLabelValues("prompt_chars").Inc()
+		return &promptTooLargeError{Unit: "characters", Size: chars, Limit: limits.MaxPromptChars}
+	}
+	if limits.MaxPromptTokens > 0 && tokens > limits.MaxPromptTokens {
+		tooLargeCounter.WithLabelValues("prompt_tokens").Inc()
+		return &promptTooLargeError{Unit: "estimated tokens", Size: tokens, Limit: limits.MaxPromptTokens}
+	}
+	return nil
+}
+
+// withBodyLimit rejects requests declaring a body over
+// limits.max_body_bytes with 413 and cuts off longer bodies of the rest.
+func withBodyLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := currentConfig().Limits.MaxBodyBytes
+		if limit <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > limit {
+			tooLargeCounter.WithLabelValues("body").Inc()
+			http.Error(w, fmt.Sprintf("Request body is %d bytes, the limit is %d", r.ContentLength, limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf16"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var smppBoundGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "ai_sms_smpp_bound",
+	Help: "Whether the SMPP transceiver is bound to the SMSC (1) or not (0)",
+})
+
+// SMPPConfig sends SMS over SMPP 3.4 when Addr is set: the service binds
+// as a transceiver to the SMSC at Addr as SystemID, with the SMPP_PASSWORD
+// secret as the password. Messages come from SourceAddr, a phone number in
+// E.164 format or an alphanumeric sender ID. The bind is kept alive with
+// an enquire_link every EnquireLink and re-established on the next send
+// when it drops; Timeout bounds the bind and every response. With
+// DeliveryReceipts, the SMSC is asked for a receipt of every message.
+type SMPPConfig struct {
+	Addr        string        `yaml:"addr"`
+	TLS         bool          `yaml:"tls"`
+	SystemID    string        `yaml:"system_id"`
+	SystemType  string        `yaml:"system_type"`
+	SourceAddr  string        `yaml:"source_addr"`
+	EnquireLink time.Duration `yaml:"enquire_link"`
+	Timeout     time.Duration `yaml:"timeout"`
+	// DeliveryReceipts requests SMSC delivery receipts
+	DeliveryReceipts bool `yaml:"delivery_receipts"`
+}
+
+// SMPP 3.4 command IDs.
+const (
+	smppGenericNack     = 0x80000000
+	smppBindTransceiver = 0x00000009
+	smppSubmitSm        = 0x00000004
+	smppDeliverSm       = 0x00000005
+	smppDeliverSmResp   = 0x80000005
+	smppUnbind          = 0x00000006
+	smppUnbindResp      = 0x80000006
+	smppEnquireLink     = 0x00000015
+	smppEnquireLinkResp = 0x80000015
+)
+
+// SMPP 3.4 field values.
+const (
+	smppInterfaceVersion = 0x34
+	smppTONUnknown       = 0x00
+	smppTONInternational = 0x01
+	smppTONAlphanumeric  = 0x05
+	smppNPIUnknown       = 0x00
+	smppNPIE164          = 0x01
+	smppESMClassUDHI     = 0x40
+	smppESMClassReceipt  = 0x04
+	smppCodingDefault    = 0x00
+	smppCodingUCS2       = 0x08
+	smppStatusInvalidCmd = 0x00000003
+	smppMaxPDU           = 64 << 10
+
+	smppTagReceiptedMessageID = 0x001E
+	smppTagMessageState       = 0x0427
+)
+
+// smppMessageStates are the stat values of the message_state TLV values.
+var smppMessageStates = []string{"", "ENROUTE", "DELIVRD", "EXPIRED", "DELETED", "UNDELIV", "ACCEPTD", "UNKNOWN", "REJECTD"}
+
+// smppPDU is an SMPP protocol data unit.
+type smppPDU struct {
+	command  uint32
+	status   uint32
+	sequence uint32
+	body     []byte
+}
+
+func readPDU(r io.Reader) (smppPDU, error) {
+	var header [16]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return smppPDU{}, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length < 16 || length > smppMaxPDU {
+		return smppPDU{}, fmt.Errorf("invalid PDU length %d", length)
+	}
+	pdu := smppPDU{
+		command:  binary.BigEndian.Uint32(header[4:8]),
+		status:   binary.BigEndian.Uint32(header[8:12]),
+		sequence: binary.BigEndian.Uint32(header[12:16]),
+		body:     make([]byte, length-16),
+	}
+	_, err = io.ReadFull(r, pdu.body)
+	return pdu, err
+}
+
+func (pdu smppPDU) encode() []byte {
+	data := make([]byte, 16, 16+len(pdu.body))
+	binary.BigEndian.PutUint32(data[0:4], uint32(16+len(pdu.body)))
+	binary.BigEndian.PutUint32(data[4:8], pdu.command)
+	binary.BigEndian.PutUint32(data[8:12], pdu.status)
+	binary.BigEndian.PutUint32(data[12:16], pdu.sequence)
+	return append(data, pdu.body...)
+}
+
+// smppBody builds the body of a PDU.
+type smppBody struct {
+	bytes.Buffer
+}
+
+func (b *smppBody) cstring(s string) {
+	b.WriteString(s)
+	b.WriteByte(0)
+}
+
+// cstring splits the C-octet string at the start of body off the rest.
+func cstring(body []byte) (string, []byte) {
+	end := bytes.IndexByte(body, 0)
+	if end < 0 {
+		return string(body), nil
+	}
+	return string(body[:end]), body[end+1:]
+}
+
+// smppError is a non-zero command_status in a response.
+type smppError struct {
+	command uint32
+	status  uint32
+}
+
+func (e *smppError) Error() string {
+	return fmt.Sprintf("SMSC answered command 0x%08x with status 0x%08x", e.command, e.status)
+}
+
+// smppSession is one bound connection to the SMSC. Responses are matched
+// to requests by sequence number.
+type smppSession struct {
+	conn    net.Conn
+	timeout time.Duration
+	logger  *slog.Logger
+	// receipt handles the delivery receipts from the SMSC
+	receipt func(id, stat, errorCode string)
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	seq     uint32
+	pending map[uint32]chan smppPDU
+	done    chan struct{}
+	err     error
+}
+
+// smppSender is an SMPP 3.4 transceiver. Long texts are split into
+// concatenated segments with a user data header.
+type smppSender struct {
+	config   SMPPConfig
+	password string
+	logger   *slog.Logger
+
+	mu      sync.Mutex
+	session *smppSession
+	ref     byte
+}
+
+func newSMPPSender(config SMPPConfig, logger *slog.Logger) (*smppSender, error) {
+	password, err := lookupSecret("SMPP_PASSWORD")
+	if err != nil {
+		return nil, err
+	}
+	return &smppSender{config: config, password: password, logger: logger}, nil
+}
+
+func (s *smppSender) Name() string {
+	return "smpp"
+}
+
+func (s *smppSender) Send(ctx context.Context, to, text string) (string, error) {
+	session, err := s.bound(ctx)
+	if err != nil {
+		return "", err
+	}
+	coding, segments := smppSegments(text)
+	esmClass := byte(0)
+	if len(segments) > 1 {
+		esmClass = smppESMClassUDHI
+		s.mu.Lock()
+		s.ref++
+		ref := s.ref
+		s.mu.Unlock()
+		for i := range segments {
+			header := []byte{0x05, 0x00, 0x03, ref, byte(len(segments)), byte(i + 1)}
+			segments[i] = append(header, segments[i]...)
+		}
+	}
+
+	// The ID of the first segment identifies the message
+	var messageID string
+	for i, segment := range segments {
+		var body smppBody
+		body.cstring("") // service_type
+		body.WriteByte(s.sourceTON())
+		body.WriteByte(s.sourceNPI())
+		body.cstring(strings.TrimPrefix(s.config.SourceAddr, "+"))
+		body.WriteByte(smppTONInternational)
+		body.WriteByte(smppNPIE164)
+		body.cstring(strings.TrimPrefix(to, "+"))
+		body.WriteByte(esmClass)
+		body.WriteByte(0) // protocol_id
+		body.WriteByte(0) // priority_flag
+		body.cstring("")  // schedule_delivery_time
+		body.cstring("")  // validity_period
+		body.WriteByte(s.registeredDelivery())
+		body.WriteByte(0) // replace_if_present_flag
+		body.WriteByte(coding)
+		body.WriteByte(0) // sm_default_msg_id
+		body.WriteByte(byte(len(segment)))
+		body.Write(segment)
+		resp, err := session.call(ctx, smppSubmitSm, body.Bytes())
+		if err != nil {
+			return "", fmt.Errorf("submitting segment %d of %d: %w", i+1, len(segments), err)
+		}
+		if i == 0 {
+			messageID, _ = cstring(resp.body)
+		}
+	}
+	return messageID, nil
+}
+
+// registeredDelivery asks for a receipt on the final outcome of a message,
+// when receipts are enabled.
+func (s *smppSender) registeredDelivery() byte {
+	if s.config.DeliveryReceipts {
+		return 0x01
+	}
+	return 0x00
+}
+
+// sourceTON and sourceNPI tell the SMSC whether the source address is a
+// number or an alphanumeric sender ID.
+func (s *smppSender) sourceTON() byte {
+	switch {
+	case strings.HasPrefix(s.config.SourceAddr, "+"):
+		return smppTONInternational
+	case strings.IndexFunc(s.config.SourceAddr, unicode.IsLetter) >= 0:
+		return smppTONAlphanumeric
+	}
+	return smppTONUnknown
+}
+
+func (s *smppSender) sourceNPI() byte {
+	if strings.HasPrefix(s.config.SourceAddr, "+") {
+		return smppNPIE164
+	}
+	return smppNPIUnknown
+}
+
+// bound returns the bound session, binding a new one when there is none or
+// the last one dropped.
+func (s *smppSender) bound(ctx context.Context) (*smppSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.session != nil && s.session.alive() {
+		return s.session, nil
+	}
+	session, err := s.bind(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("binding to %s: %w", s.config.Addr, err)
+	}
+	s.session = session
+	return session, nil
+}
+
+func (s *smppSender) bind(ctx context.Context) (*smppSession, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.config.Timeout)
+	defer cancel()
+	var conn net.Conn
+	var err error
+	if s.config.TLS {
+		var tlsConfig *tls.Config
+		tlsConfig, err = outboundTLSConfig(currentConfig().OutboundTLS)
+		if err != nil {
+			return nil, err
+		}
+		dialer := &tls.Dialer{Config: tlsConfig}
+		conn, err = dialer.DialContext(ctx, "tcp", s.config.Addr)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", s.config.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	session := &smppSession{
+		conn:    conn,
+		timeout: s.config.Timeout,
+		logger:  s.logger,
+		pending: make(map[uint32]chan smppPDU),
+		done:    make(chan struct{}),
+		receipt: func(id, stat, errorCode string) {
+			recordReceipt(context.Background(), s.Name(), id, stat, errorCode, s.logger)
+		},
+	}
+	go session.read()
+	var body smppBody
+	body.cstring(s.config.SystemID)
+	body.cstring(s.password)
+	body.cstring(s.config.SystemType)
+	body.WriteByte(smppInterfaceVersion)
+	body.WriteByte(smppTONUnknown)
+	body.WriteByte(smppNPIUnknown)
+	body.cstring("") // address_range
+	_, err = session.call(ctx, smppBindTransceiver, body.Bytes())
+	if err != nil {
+		session.close(err)
+		return nil, err
+	}
+	smppBoundGauge.Set(1)
+	s.logger.Info("Bound to the SMSC", "addr", s.config.Addr, "system_id", s.config.SystemID)
+	go session.keepAlive(s.config.EnquireLink)
+	return session, nil
+}
+
+// Close unbinds from the SMSC.
+func (s *smppSender) Close() error {
+	s.mu.Lock()
+	session := s.session
+	s.session = nil
+	s.mu.Unlock()
+	if session == nil || !session.alive() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.Timeout)
+	defer cancel()
+	_, err := session.call(ctx, smppUnbind, nil)
+	session.close(errors.New("unbound"))
+	return err
+}
+
+func (s *smppSession) alive() bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// close ends the session with err, failing the requests still waiting.
+func (s *smppSession) close(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	close(s.done)
+	s.conn.Close()
+	smppBoundGauge.Set(0)
+}
+
+func (s *smppSession) write(pdu smppPDU) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	_, err := s.conn.Write(pdu.encode())
+	if err != nil {
+		s.close(err)
+	}
+	return err
+}
+
+// call sends a request and waits for its response.
+func (s *smppSession) call(ctx context.Context, command uint32, body []byte) (smppPDU, error) {
+	response := make(chan smppPDU, 1)
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return smppPDU{}, s.err
+	}
+	s.seq++
+	sequence := s.seq
+	s.pending[sequence] = response
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, sequence)
+		s.mu.Unlock()
+	}()
+
+	err := s.write(smppPDU{command: command, sequence: sequence, body: body})
+	if err != nil {
+		return smppPDU{}, err
+	}
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	select {
+	case resp := <-response:
+		if resp.status != 0 {
+			return resp, &smppError{command: command, status: resp.status}
+		}
+		return resp, nil
+	case <-s.done:
+		return smppPDU{}, s.err
+	case <-timer.C:
+		return smppPDU{}, fmt.Errorf("no response to command 0x%08x within %s", command, s.timeout)
+	case <-ctx.Done():
+		return smppPDU{}, ctx.Err()
+	}
+}
+
+// read dispatches the PDUs from the SMSC until the connection drops.
+func (s *smppSession) read() {
+	for {
+		pdu, err := readPDU(s.conn)
+		if err != nil {
+			if s.alive() {
+				s.logger.Warn("Lost the SMSC connection", "error", err)
+			}
+			s.close(err)
+			return
+		}
+		switch {
+		case pdu.command == smppEnquireLink:
+			s.write(smppPDU{command: smppEnquireLinkResp, sequence: pdu.sequence})
+		case pdu.command == smppDeliverSm:
+			if id, stat, errorCode, ok := parseDeliveryReceipt(pdu.body); ok {
+				s.receipt(id, stat, errorCode)
+			}
+			var body smppBody
+			body.cstring("") // message_id
+			s.write(smppPDU{command: smppDeliverSmResp, sequence: pdu.sequence, body: body.Bytes()})
+		case pdu.command == smppUnbind:
+			s.write(smppPDU{command: smppUnbindResp, sequence: pdu.sequence})
+			s.logger.Warn("The SMSC unbound")
+			s.close(errors.New("unbound by the SMSC"))
+			return
+		case pdu.command&smppGenericNack != 0:
+			s.mu.Lock()
+			response, ok := s.pending[pdu.sequence]
+			s.mu.Unlock()
+			if ok {
+				response <- pdu
+			}
+		default:
+			s.write(smppPDU{command: smppGenericNack, status: smppStatusInvalidCmd, sequence: pdu.sequence})
+		}
+	}
+}
+
+// parseDeliveryReceipt reads the message ID, stat and error code of the
+// delivery receipt in a deliver_sm body; ok is false for other messages.
+// The receipted_message_id and message_state TLVs win over the
+// "id:... stat:... err:..." text of the short message.
+func parseDeliveryReceipt(body []byte) (id, stat, errorCode string, ok bool) {
+	_, body = cstring(body) // service_type
+	if len(body) < 2 {
+		return "", "", "", false
+	}
+	_, body = cstring(body[2:]) // source_addr
+	if len(body) < 2 {
+		return "", "", "", false
+	}
+	_, body = cstring(body[2:]) // destination_addr
+	if len(body) < 3 {
+		return "", "", "", false
+	}
+	esmClass := body[0]
+	_, body = cstring(body[3:]) // schedule_delivery_time
+	_, body = cstring(body)     // validity_period
+	if len(body) < 5 || int(body[4]) > len(body)-5 || esmClass&smppESMClassReceipt == 0 {
+		return "", "", "", false
+	}
+	text, tlvs := string(body[5:5+int(body[4])]), body[5+int(body[4]):]
+
+	// The text ends with the start of the original message
+	if i := strings.Index(strings.ToLower(text), "text:"); i >= 0 {
+		text = text[:i]
+	}
+	for _, field := range strings.Fields(text) {
+		name, value, _ := strings.Cut(field, ":")
+		switch strings.ToLower(name) {
+		case "id":
+			id = value
+		case "stat":
+			stat = strings.ToUpper(value)
+		case "err":
+			errorCode = value
+		}
+	}
+	for len(tlvs) >= 4 {
+		tag := binary.BigEndian.Uint16(tlvs[0:2])
+		length := int(binary.BigEndian.Uint16(tlvs[2:4]))
+		if len(tlvs) < 4+length {
+			break
+		}
+		value := tlvs[4 : 4+length]
+		switch {
+		case tag == smppTagReceiptedMessageID:
+			id, _ = cstring(value)
+		case tag == smppTagMessageState && length == 1 && int(value[0]) < len(smppMessageStates):
+			stat = smppMessageStates[value[0]]
+		}
+		tlvs = tlvs[4+length:]
+	}
+	return id, stat, errorCode, id != ""
+}
+
+// keepAlive sends an enquire_link every interval, dropping the session
+// when one goes unanswered.
+func (s *smppSession) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			_, err := s.call(context.Background(), smppEnquireLink, nil)
+			if err != nil && s.alive() {
+				s.logger.Warn("The SMSC did not answer enquire_link", "error", err)
+				s.close(err)
+				return
+			}
+		}
+	}
+}
+
+// smppSegments returns the data_coding of text and its short_message
+// payloads: GSM 03.38 septets, one per octet, or UCS-2. Texts longer than
+// one SMS are split into segments leaving room for the concatenation
+// header, without splitting an escape sequence or a surrogate pair.
+func smppSegments(text string) (byte, [][]byte) {
+	encoding, units := smsLength(text)
+	if encoding == encodingGSM7 {
+		septets := gsm7Septets(text)
+		if units <= smsCapacity(encoding, 1) {
+			return smppCodingDefault, [][]byte{septets}
+		}
+		var segments [][]byte
+		for size := smsCapacity(encoding, 2) / 2; len(septets) > size; {
+			end := size
+			if septets[end-1] == gsm7Escape {
+				end--
+			}
+			segments = append(segments, septets[:end])
+			septets = septets[end:]
+		}
+		return smppCodingDefault, append(segments, septets)
+	}
+
+	ucs2 := utf16.Encode([]rune(text))
+	if units <= smsCapacity(encoding, 1) {
+		return smppCodingUCS2, [][]byte{ucs2Bytes(ucs2)}
+	}
+	var segments [][]byte
+	for size := smsCapacity(encoding, 2) / 2; len(ucs2) > size; {
+		end := size
+		if 0xD800 <= ucs2[end-1] && ucs2[end-1] < 0xDC00 {
+			end--
+		}
+		segments = append(segments, ucs2Bytes(ucs2[:end]))
+		ucs2 = ucs2[end:]
+	}
+	return smppCodingUCS2, append(segments, ucs2Bytes(ucs2))
+}
+
+func ucs2Bytes(units []uint16) []byte {
+	data := make([]byte, 0, 2*len(units))
+	for _, unit := range units {
+		data = binary.BigEndian.AppendUint16(data, unit)
+	}
+	return data
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func TestSmppSegments(t *testing.T) {
+	tests := []struct {
+		name       string
+		text       string
+		wantCoding byte
+		// wantSizes are the segment lengths in septets or UTF-16 code units
+		wantSizes []int
+	}{
+		{name: "gsm7 single full", text: strings.Repeat("a", 160), wantCoding: smppCodingDefault, wantSizes: []int{160}},
+		{name: "gsm7 single overflow", text: strings.Repeat("a", 161), wantCoding: smppCodingDefault, wantSizes: []int{153, 8}},
+		{name: "gsm7 two full", text: strings.Repeat("a", 306), wantCoding: smppCodingDefault, wantSizes: []int{153, 153}},
+		{name: "gsm7 two overflow", text: strings.Repeat("a", 307), wantCoding: smppCodingDefault, wantSizes: []int{153, 153, 1}},
+		{name: "gsm7 escape at segment edge", text: strings.Repeat("a", 152) + "€" + strings.Repeat("a", 10), wantCoding: smppCodingDefault, wantSizes: []int{152, 12}},
+		{name: "gsm7 escape before segment edge", text: strings.Repeat("a", 151) + "€" + strings.Repeat("a", 10), wantCoding: smppCodingDefault, wantSizes: []int{153, 10}},
+		{name: "ucs2 single full", text: strings.Repeat("я", 70), wantCoding: smppCodingUCS2, wantSizes: []int{70}},
+		{name: "ucs2 single overflow", text: strings.Repeat("я", 71), wantCoding: smppCodingUCS2, wantSizes: []int{67, 4}},
+		{name: "ucs2 two full", text: strings.Repeat("я", 134), wantCoding: smppCodingUCS2, wantSizes: []int{67, 67}},
+		{name: "emoji straddling the split", text: strings.Repeat("я", 66) + "😀" + strings.Repeat("я", 10), wantCoding: smppCodingUCS2, wantSizes: []int{66, 12}},
+		{name: "emoji ending a segment", text: strings.Repeat("я", 65) + "😀" + strings.Repeat("я", 10), wantCoding: smppCodingUCS2, wantSizes: []int{67, 10}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			coding, segments := smppSegments(test.text)
+			if coding != test.wantCoding {
+				t.Fatalf("data_coding = %#x; want %#x", coding, test.wantCoding)
+			}
+			unitSize := 1
+			if coding == smppCodingUCS2 {
+				unitSize = 2
+			}
+			var sizes []int
+			for _, segment := range segments {
+				sizes = append(sizes, len(segment)/unitSize)
+			}
+			if !slices.Equal(sizes, test.wantSizes) {
+				t.Fatalf("segment sizes = %v; want %v", sizes, test.wantSizes)
+			}
+
+			// The segments put back together are the whole text, and none
+			// ends in half an escape sequence or surrogate pair
+			joined := bytes.Join(segments, nil)
+			if coding == smppCodingDefault {
+				if !bytes.Equal(joined, gsm7Septets(test.text)) {
+					t.Errorf("joined segments differ from the text")
+				}
+				for i, segment := range segments {
+					if segment[len(segment)-1] == gsm7Escape {
+						t.Errorf("segment %d ends with an escape", i)
+					}
+				}
+				return
+			}
+			if !bytes.Equal(joined, ucs2Bytes(utf16.Encode([]rune(test.text)))) {
+				t.Errorf("joined segments differ from the text")
+			}
+			for i, segment := range segments {
+				last := uint16(segment[len(segment)-2])<<8 | uint16(segment[len(segment)-1])
+				if utf16.IsSurrogate(rune(last)) && last < 0xDC00 {
+					t.Errorf("segment %d ends with a high surrogate", i)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// SMS encodings.
+const (
+	encodingGSM7 = "GSM-7"
+	encodingUCS2 = "UCS-2"
+)
+
+// gsm7Basic is the GSM 03.38 basic character set, one septet each;
+// gsm7Extension are the characters sent as an escape and a septet.
+const (
+	gsm7Basic     = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+	gsm7Extension = "\f^{}\\[~]|€"
+)
+
+// gsm7Escape is the septet introducing an extension character; it sits
+// at 0x1B in the basic table. gsm7ExtensionCodes are the septets following
+// it for the characters of gsm7Extension.
+const gsm7Escape = 0x1B
+
+var gsm7ExtensionCodes = []byte{0x0A, 0x14, 0x28, 0x29, 0x2F, 0x3C, 0x3D, 0x3E, 0x40, 0x65}
+
+// gsm7Septets encodes a GSM-7 text as unpacked septets, one per octet.
+// Characters outside the alphabet become "?".
+func gsm7Septets(text string) []byte {
+	septets := make([]byte, 0, len(text))
+	for _, r := range text {
+		if i := strings.IndexRune(gsm7Extension, r); i >= 0 {
+			septets = append(septets, gsm7Escape, gsm7ExtensionCodes[utf8.RuneCountInString(gsm7Extension[:i])])
+			continue
+		}
+		i := strings.IndexRune(gsm7Basic, r)
+		if i < 0 {
+			septets = append(septets, '?')
+			continue
+		}
+		code := byte(utf8.RuneCountInString(gsm7Basic[:i]))
+		if code >= gsm7Escape {
+			code++
+		}
+		septets = append(septets, code)
+	}
+	return septets
+}
+
+// smsLength returns the encoding text is sent in and its length in the
+// units the segment limits count: septets for GSM-7, UTF-16 code units for
+// UCS-2.
+func smsLength(text string) (encoding string, units int) {
+	for _, r := range text {
+		switch {
+		case strings.ContainsRune(gsm7Basic, r):
+			units++
+		case strings.ContainsRune(gsm7Extension, r):
+			units += 2
+		default:
+			return encodingUCS2, utf16Length(text)
+		}
+	}
+	return encodingGSM7, units
+}
+
+func utf16Length(text string) int {
+	units := 0
+	for _, r := range text {
+		units++
+		if r > 0xFFFF {
+			units++
+		}
+	}
+	return units
+}
+
+// smsCapacity returns how many units fit in segments SMS segments. Texts
+// longer than one segment are split with a header taking 7 septets or 3
+// code units from each.
+func smsCapacity(encoding string, segments int) int {
+	single, multi := 160, 153
+	if encoding == encodingUCS2 {
+		single, multi = 70, 67
+	}
+	if segments <= 1 {
+		return single * segments
+	}
+	return multi * segments
+}
+
+// segmentInfo returns the encoding, length and segments of text.
+func segmentInfo(text string) SegmentInfo {
+	encoding, _ := smsLength(text)
+	return SegmentInfo{
+		Encoding:   encoding,
+		Characters: len([]rune(text)),
+		Segments:   smsSegments(text),
+	}
+}
+
+// smsSegments returns the number of SMS segments text takes. Longer texts
+// are counted as smppSegments splits them, as an escape sequence or a
+// surrogate pair at the end of a segment moves to the next one.
+func smsSegments(text string) int {
+	encoding, units := smsLength(text)
+	if units == 0 {
+		return 0
+	}
+	if units <= smsCapacity(encoding, 1) {
+		return 1
+	}
+	_, segments := smppSegments(text)
+	return len(segments)
+}
+
+// segmentsRequest is the body of POST /api/v1/segments.
+type segmentsRequest struct {
+	Text string `json:"text"`
+}
+
+// handleSegments tells how an arbitrary text goes out as SMS.
+func handleSegments(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	var request segmentsRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(segmentInfo(request.Text))
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error encoding segments", "error", err)
+	}
+}
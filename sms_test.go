@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSmsLength(t *testing.T) {
+	tests := []struct {
+		name         string
+		text         string
+		wantEncoding string
+		wantUnits    int
+		wantSegments int
+	}{
+		{name: "empty", text: "", wantEncoding: encodingGSM7, wantUnits: 0, wantSegments: 0},
+		{name: "gsm7 single full", text: strings.Repeat("a", 160), wantEncoding: encodingGSM7, wantUnits: 160, wantSegments: 1},
+		{name: "gsm7 single overflow", text: strings.Repeat("a", 161), wantEncoding: encodingGSM7, wantUnits: 161, wantSegments: 2},
+		{name: "gsm7 two full", text: strings.Repeat("a", 306), wantEncoding: encodingGSM7, wantUnits: 306, wantSegments: 2},
+		{name: "gsm7 two overflow", text: strings.Repeat("a", 307), wantEncoding: encodingGSM7, wantUnits: 307, wantSegments: 3},
+		{name: "gsm7 escape counts two", text: strings.Repeat("a", 158) + "€", wantEncoding: encodingGSM7, wantUnits: 160, wantSegments: 1},
+		{name: "gsm7 escape overflows single", text: strings.Repeat("a", 159) + "€", wantEncoding: encodingGSM7, wantUnits: 161, wantSegments: 2},
+		// The escape would end the first segment, so it moves to the second,
+		// which then overflows
+		{name: "gsm7 escape at segment edge", text: strings.Repeat("a", 152) + "€" + strings.Repeat("a", 152), wantEncoding: encodingGSM7, wantUnits: 306, wantSegments: 3},
+		{name: "ucs2 single full", text: strings.Repeat("я", 70), wantEncoding: encodingUCS2, wantUnits: 70, wantSegments: 1},
+		{name: "ucs2 single overflow", text: strings.Repeat("я", 71), wantEncoding: encodingUCS2, wantUnits: 71, wantSegments: 2},
+		{name: "ucs2 two full", text: strings.Repeat("я", 134), wantEncoding: encodingUCS2, wantUnits: 134, wantSegments: 2},
+		{name: "ucs2 two overflow", text: strings.Repeat("я", 135), wantEncoding: encodingUCS2, wantUnits: 135, wantSegments: 3},
+		{name: "one non-gsm7 character", text: strings.Repeat("a", 69) + "й", wantEncoding: encodingUCS2, wantUnits: 70, wantSegments: 1},
+		{name: "emoji counts two", text: strings.Repeat("я", 68) + "😀", wantEncoding: encodingUCS2, wantUnits: 70, wantSegments: 1},
+		// The high surrogate would end the first segment
+		{name: "emoji straddling the split", text: strings.Repeat("я", 66) + "😀" + strings.Repeat("я", 66), wantEncoding: encodingUCS2, wantUnits: 134, wantSegments: 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoding, units := smsLength(test.text)
+			if encoding != test.wantEncoding || units != test.wantUnits {
+				t.Errorf("smsLength = %s, %d; want %s, %d", encoding, units, test.wantEncoding, test.wantUnits)
+			}
+			if segments := smsSegments(test.text); segments != test.wantSegments {
+				t.Errorf("smsSegments = %d; want %d", segments, test.wantSegments)
+			}
+		})
+	}
+}
+
+func TestSmsCapacity(t *testing.T) {
+	tests := []struct {
+		encoding string
+		segments int
+		want     int
+	}{
+		{encodingGSM7, 1, 160},
+		{encodingGSM7, 2, 306},
+		{encodingGSM7, 3, 459},
+		{encodingUCS2, 1, 70},
+		{encodingUCS2, 2, 134},
+		{encodingUCS2, 3, 201},
+	}
+	for _, test := range tests {
+		if got := smsCapacity(test.encoding, test.segments); got != test.want {
+			t.Errorf("smsCapacity(%s, %d) = %d; want %d", test.encoding, test.segments, got, test.want)
+		}
+	}
+}
+
+func TestGsm7Septets(t *testing.T) {
+	tests := []struct {
+		text string
+		want []byte
+	}{
+		{"@", []byte{0x00}},
+		{"Ξ", []byte{0x1A}},
+		// The basic table skips 0x1B, the escape
+		{"Æ", []byte{0x1C}},
+		{"É", []byte{0x1F}},
+		{" ", []byte{0x20}},
+		{"A", []byte{0x41}},
+		{"à", []byte{0x7F}},
+		{"€", []byte{gsm7Escape, 0x65}},
+		{"{}", []byte{gsm7Escape, 0x28, gsm7Escape, 0x29}},
+		{"a^b", []byte{0x61, gsm7Escape, 0x14, 0x62}},
+		{"й", []byte{'?'}},
+	}
+	for _, test := range tests {
+		if got := gsm7Septets(test.text); !bytes.Equal(got, test.want) {
+			t.Errorf("gsm7Septets(%q) = % x; want % x", test.text, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+)
+
+// Store persists the generation history.
+type Store interface {
+	Name() string
+	Insert(ctx context.Context, generation Generation) error
+	// List returns the generations matching filter, newest first
+	List(ctx context.Context, filter GenerationFilter) ([]Generation, error)
+	Get(ctx context.Context, id string) (Generation, bool, error)
+	// Purge deletes the generations created before cutoff
+	Purge(ctx context.Context, cutoff time.Time) (int64, error)
+	// Erase deletes the generations mentioning a data subject and records
+	// deletion in the same transaction
+	Erase(ctx context.Context, subject string, deletion Deletion) (int64, error)
+	// SetFeedback replaces the feedback on a generation; false if there is
+	// no generation id
+	SetFeedback(ctx context.Context, id string, feedback Feedback) (bool, error)
+	// FeedbackStats aggregates the feedback on the generations matching
+	// filter per preset and model
+	FeedbackStats(ctx context.Context, filter GenerationFilter) ([]FeedbackStats, error)
+	// SetMessage records the SMS a generation was sent in; false if there
+	// is no generation id
+	SetMessage(ctx context.Context, id string, message SentMessage) (bool, error)
+	// GetMessage returns the generation sent in the SMS with the gateway's
+	// message ID id
+	GetMessage(ctx context.Context, id string) (Generation, bool, error)
+	// SetMessageStatus records the delivery status of the SMS message.ID;
+	// false if there is no such SMS or it already has a final status and
+	// message.Status is not final
+	SetMessageStatus(ctx context.Context, message SentMessage) (bool, error)
+	// InsertLinks records the short links of a generation; a short link
+	// used again points to its latest generation
+	InsertLinks(ctx context.Context, links []Link) error
+	GetLink(ctx context.Context, short string) (Link, bool, error)
+	// Ping checks that the store is reachable, for /readyz
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// GenerationFilter selects generations. Zero fields don't filter; Query
+// matches a substring of the prompt or output, ignoring case.
+type GenerationFilter struct {
+	From   time.Time
+	To     time.Time
+	Caller string
+	Model  string
+	Status string
+	Query  string
+	Limit  int
+	Offset int
+}
+
+// PostgresConfig sizes the connection pool of the PostgreSQL store.
+type PostgresConfig struct {
+	MaxOpenConns    int           `yaml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+}
+
+// openStore opens the configured history backend and brings its schema up
+// to date.
+func openStore(config HistoryConfig, logger *slog.Logger) (Store, error) {
+	var store *sqlStore
+	switch config.Backend {
+	case "postgres":
+		dsn, err := lookupSecret("HISTORY_DATABASE_URL")
+		if err != nil {
+			return nil, err
+		}
+		if dsn == "" {
+			return nil, fmt.Errorf("HISTORY_DATABASE_URL is not set")
+		}
+		db, err := sql.Open("pgx", dsn)
+		if err != nil {
+			return nil, err
+		}
+		db.SetMaxOpenConns(config.Postgres.MaxOpenConns)
+		db.SetMaxIdleConns(config.Postgres.MaxIdleConns)
+		db.SetConnMaxLifetime(config.Postgres.ConnMaxLifetime)
+		store = &sqlStore{db: db, dialect: "postgres"}
+	default:
+		dsn := "file:" + config.Path + "?" + url.Values{"_pragma": {"journal_mode(WAL)", "busy_timeout(5000)"}}.Encode()
+		db, err := sql.Open("sqlite", dsn)
+		if err != nil {
+			return nil, err
+		}
+		// SQLite allows one writer at a time
+		db.SetMaxOpenConns(1)
+		store = &sqlStore{db: db, dialect: "sqlite"}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	applied, err := store.migrate(ctx)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("migrating %s history: %v", store.dialect, err)
+	}
+	logger.Info("Recording generation history", "store", store.dialect, "migrations_applied", applied)
+
+	return store, nil
+}
+
+// sqlStore is the Store for SQLite and PostgreSQL. Queries are written
+// with ? placeholders and rebound for PostgreSQL.
+type sqlStore struct {
+	db      *sql.DB
+	dialect string
+}
+
+// migrations lists the schema changes per dialect in order. Applied
+// versions are tracked in schema_migrations; never edit a released entry,
+// append a new one.
+var migrations = map[string][]string{
+	"sqlite": {
+		`CREATE TABLE IF NOT EXISTS generations (
+			id TEXT PRIMARY KEY,
+			created_at INTEGER NOT NULL,
+			request_id TEXT NOT NULL,
+			caller TEXT NOT NULL,
+			provider TEXT NOT NULL,
+			model TEXT NOT NULL,
+			prediction_id TEXT NOT NULL,
+			prompt TEXT NOT NULL,
+			params TEXT NOT NULL,
+			output TEXT NOT NULL,
+			status TEXT NOT NULL,
+			error TEXT NOT NULL,
+			latency_ms INTEGER NOT NULL,
+			input_tokens INTEGER NOT NULL,
+			output_tokens INTEGER NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS generations_created_at ON generations (created_at);`,
+		`CREATE TABLE deletions (
+			id TEXT PRIMARY KEY,
+			created_at INTEGER NOT NULL,
+			subject_hash TEXT NOT NULL,
+			deleted INTEGER NOT NULL,
+			request_id TEXT NOT NULL,
+			client_ip TEXT NOT NULL
+		);`,
+		`ALTER TABLE generations ADD COLUMN preset TEXT NOT NULL DEFAULT '';
+		ALTER TABLE generations ADD COLUMN feedback_rating TEXT NOT NULL DEFAULT '';
+		ALTER TABLE generations ADD COLUMN feedback_comment TEXT NOT NULL DEFAULT '';
+		ALTER TABLE generations ADD COLUMN feedback_at INTEGER NOT NULL DEFAULT 0;`,
+		`ALTER TABLE generations ADD COLUMN message_gateway TEXT NOT NULL DEFAULT '';
+		ALTER TABLE generations ADD COLUMN message_id TEXT NOT NULL DEFAULT '';
+		ALTER TABLE generations ADD COLUMN message_sent_at INTEGER NOT NULL DEFAULT 0;`,
+		`ALTER TABLE generations ADD COLUMN message_status TEXT NOT NULL DEFAULT '';
+		ALTER TABLE generations ADD COLUMN message_error TEXT NOT NULL DEFAULT '';
+		ALTER TABLE generations ADD COLUMN message_updated_at INTEGER NOT NULL DEFAULT 0;
+		UPDATE generations SET message_status = 'sent' WHERE message_id <> '';
+		CREATE INDEX generations_message_id ON generations (message_id);`,
+		`CREATE TABLE links (
+			short_url TEXT PRIMARY KEY,
+			long_url TEXT NOT NULL,
+			generation_id TEXT NOT NULL,
+			created_at INTEGER NOT NULL
+		);`,
+	},
+	"postgres": {
+		`CREATE TABLE generations (
+			id TEXT PRIMARY KEY,
+			created_at BIGINT NOT NULL,
+			request_id TEXT NOT NULL,
+			caller TEXT NOT NULL,
+			provider TEXT NOT NULL,
+			model TEXT NOT NULL,
+			prediction_id TEXT NOT NULL,
+			prompt TEXT NOT NULL,
+			params JSONB NOT NULL,
+			output TEXT NOT NULL,
+			status TEXT NOT NULL,
+			error TEXT NOT NULL,
+			latency_ms BIGINT NOT NULL,
+			input_tokens INTEGER NOT NULL,
+			output_tokens INTEGER NOT NULL
+		);
+		CREATE INDEX generations_created_at ON generations (created_at);`,
+		`CREATE TABLE deletions (
+			id TEXT PRIMARY KEY,
+			created_at BIGINT NOT NULL,
+			subject_hash TEXT NOT NULL,
+			deleted BIGINT NOT NULL,
+			request_id TEXT NOT NULL,
+			client_ip TEXT NOT NULL
+		);`,
+		`ALTER TABLE generations
+			ADD COLUMN preset TEXT NOT NULL DEFAULT '',
+			ADD COLUMN feedback_rating TEXT NOT NULL DEFAULT '',
+			ADD COLUMN feedback_comment TEXT NOT NULL DEFAULT '',
+			ADD COLUMN feedback_at BIGINT NOT NULL DEFAULT 0;`,
+		`ALTER TABLE generations
+			ADD COLUMN message_gateway TEXT NOT NULL DEFAULT '',
+			ADD COLUMN message_id TEXT NOT NULL DEFAULT '',
+			ADD COLUMN message_sent_at BIGINT NOT NULL DEFAULT 0;`,
+		`ALTER TABLE generations
+			ADD COLUMN message_status TEXT NOT NULL DEFAULT '',
+			ADD COLUMN message_error TEXT NOT NULL DEFAULT '',
+			ADD COLUMN message_updated_at BIGINT NOT NULL DEFAULT 0;
+		UPDATE generations SET message_status = 'sent' WHERE message_id <> '';
+		CREATE INDEX generations_message_id ON generations (message_id);`,
+		`CREATE TABLE links (
+			short_url TEXT PRIMARY KEY,
+			long_url TEXT NOT NULL,
+			generation_id TEXT NOT NULL,
+			created_at BIGINT NOT NULL
+		);`,
+	},
+}
+
+// migrate applies the migrations not yet recorded in schema_migrations and
+// returns how many it applied.
+func (s *sqlStore) migrate(ctx context.Context) (int, error) {
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`)
+	if err != nil {
+		return 0, err
+	}
+	var current int
+	err = s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		return 0, err
+	}
+
+	pending := migrations[s.dialect][current:]
+	for i, migration := range pending {
+		version := current + i + 1
+		err := s.inTx(ctx, func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, migration)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, s.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), version)
+			return err
+		})
+		if err != nil {
+			return i, fmt.Errorf("migration %d: %v", version, err)
+		}
+	}
+	return len(pending), nil
+}
+
+func (s *sqlStore) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// rebind turns the ? placeholders of query into $1, $2... for PostgreSQL.
+func (s *sqlStore) rebind(query string) string {
+	if s.dialect != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (s *sqlStore) Name() string {
+	return s.dialect
+}
+
+func (s *sqlStore) Insert(ctx context.Context, g Generation) error {
+	params, err := json.Marshal(g.Params)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, s.rebind(`INSERT INTO generations (id, created_at, request_id, caller, provider, model, preset, prediction_id, prompt, params, output, status, error, latency_ms, input_tokens, output_tokens)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		g.ID, g.CreatedAt.UnixMilli(), g.RequestID, g.Caller, g.Provider, g.Model, g.Preset, g.PredictionID, g.Prompt, string(params),
+		g.Output, g.Status, g.Error, g.LatencyMS, g.InputTokens, g.OutputTokens)
+	return err
+}
+
+// generationColumns are selected by the queries scanning a Generation.
+const generationColumns = `id, created_at, request_id, caller, provider, model, preset, prediction_id, prompt, params, output, status, error, latency_ms, input_tokens, output_tokens,
+	feedback_rating, feedback_comment, feedback_at, message_gateway, message_id, message_sent_at, message_status, message_error, message_updated_at`
+
+func scanGeneration(row interface{ Scan(dest ...any) error }) (Generation, error) {
+	var g Generation
+	var createdAt int64
+	var params string
+	var feedback Feedback
+	var feedbackAt int64
+	var message SentMessage
+	var messageSentAt, messageUpdatedAt int64
+	err := row.Scan(&g.ID, &createdAt, &g.RequestID, &g.Caller, &g.Provider, &g.Model, &g.Preset, &g.PredictionID, &g.Prompt, &params,
+		&g.Output, &g.Status, &g.Error, &g.LatencyMS, &g.InputTokens, &g.OutputTokens,
+		&feedback.Rating, &feedback.Comment, &feedbackAt, &message.Gateway, &message.ID, &messageSentAt,
+		&message.Status, &message.Error, &messageUpdatedAt)
+	if err != nil {
+		return Generation{}, err
+	}
+	g.CreatedAt = time.UnixMilli(createdAt).UTC()
+	if feedback.Rating != "" {
+		feedback.CreatedAt = time.UnixMilli(feedbackAt).UTC()
+		g.Feedback = &feedback
+	}
+	if message.ID != "" {
+		message.SentAt = time.UnixMilli(messageSentAt).UTC()
+		if messageUpdatedAt != 0 {
+			updated := time.UnixMilli(messageUpdatedAt).UTC()
+			message.UpdatedAt = &updated
+		}
+		g.Message = &message
+	}
+	err = json.Unmarshal([]byte(params), &g.Params)
+	return g, err
+}
+
+// where builds the WHERE clause for filter.
+func (s *sqlStore) where(filter GenerationFilter) (string, []any) {
+	var conditions []string
+	var args []any
+	add := func(condition string, values ...any) {
+		conditions = append(conditions, condition)
+		args = append(args, values...)
+	}
+	if !filter.From.IsZero() {
+		add("created_at >= ?", filter.From.UnixMilli())
+	}
+	if !filter.To.IsZero() {
+		add("created_at < ?", filter.To.UnixMilli())
+	}
+	if filter.Caller != "" {
+		add("caller = ?", filter.Caller)
+	}
+	if filter.Model != "" {
+		add("model = ?", filter.Model)
+	}
+	if filter.Status != "" {
+		add("status = ?", filter.Status)
+	}
+	if filter.Query != "" {
+		like := "LIKE"
+		if s.dialect == "postgres" {
+			like = "ILIKE"
+		}
+		pattern := "%" + likeEscaper.Replace(filter.Query) + "%"
+		add("(prompt "+like+" ? ESCAPE '\\' OR output "+like+" ? ESCAPE '\\')", pattern, pattern)
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// likeEscaper escapes the LIKE wildcards in search terms.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (s *sqlStore) List(ctx context.Context, filter GenerationFilter) ([]Generation, error) {
+	where, args := s.where(filter)
+	query := "SELECT " + generationColumns + " FROM generations" + where + " ORDER BY created_at DESC, id LIMIT ? OFFSET ?"
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), append(args, filter.Limit, filter.Offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	generations := []Generation{}
+	for rows.Next() {
+		generation, err := scanGeneration(rows)
+		if err != nil {
+			return nil, err
+		}
+		generations = append(generations, generation)
+	}
+	return generations, rows.Err()
+}
+
+func (s *sqlStore) Get(ctx context.Context, id string) (Generation, bool, error) {
+	return s.getBy(ctx, "id", id)
+}
+
+func (s *sqlStore) GetMessage(ctx context.Context, id string) (Generation, bool, error) {
+	return s.getBy(ctx, "message_id", id)
+}
+
+// getBy returns the generation whose column has value.
+func (s *sqlStore) getBy(ctx context.Context, column, value string) (Generation, bool, error) {
+	row := s.db.QueryRowContext(ctx, s.rebind("SELECT "+generationColumns+" FROM generations WHERE "+column+" = ?"), value)
+	generation, err := scanGeneration(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Generation{}, false, nil
+	}
+	if err != nil {
+		return Generation{}, false, err
+	}
+	return generation, true, nil
+}
+
+func (s *sqlStore) Purge(ctx context.Context, cutoff time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, s.rebind("DELETE FROM generations WHERE created_at < ?"), cutoff.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *sqlStore) Erase(ctx context.Context, subject string, deletion Deletion) (int64, error) {
+	where, args := s.where(GenerationFilter{Query: subject})
+	var deleted int64
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, s.rebind("DELETE FROM generations"+where+" OR caller = ?"), append(args, subject)...)
+		if err != nil {
+			return err
+		}
+		deleted, err = result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, s.rebind(`INSERT INTO deletions (id, created_at, subject_hash, deleted, request_id, client_ip) VALUES (?, ?, ?, ?, ?, ?)`),
+			deletion.ID, deletion.CreatedAt.UnixMilli(), deletion.SubjectHash, deleted, deletion.RequestID, deletion.ClientIP)
+		return err
+	})
+	return deleted, err
+}
+
+func (s *sqlStore) SetFeedback(ctx context.Context, id string, feedback Feedback) (bool, error) {
+	result, err := s.db.ExecContext(ctx, s.rebind("UPDATE generations SET feedback_rating = ?, feedback_comment = ?, feedback_at = ? WHERE id = ?"),
+		feedback.Rating, feedback.Comment, feedback.CreatedAt.UnixMilli(), id)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	return updated > 0, err
+}
+
+func (s *sqlStore) SetMessage(ctx context.Context, id string, message SentMessage) (bool, error) {
+	result, err := s.db.ExecContext(ctx, s.rebind("UPDATE generations SET message_gateway = ?, message_id = ?, message_sent_at = ?, message_status = ? WHERE id = ?"),
+		message.Gateway, message.ID, message.SentAt.UnixMilli(), message.Status, id)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	return updated > 0, err
+}
+
+func (s *sqlStore) SetMessageStatus(ctx context.Context, message SentMessage) (bool, error) {
+	query := "UPDATE generations SET message_status = ?, message_error = ?, message_updated_at = ? WHERE message_gateway = ? AND message_id = ?"
+	if !finalMessageStatus(message.Status) {
+		// Receipts can arrive out of order; an intermediate one does not
+		// undo a final status
+		query += " AND message_status NOT IN ('" + strings.Join(finalMessageStatuses, "', '") + "')"
+	}
+	result, err := s.db.ExecContext(ctx, s.rebind(query), message.Status, message.Error, message.UpdatedAt.UnixMilli(), message.Gateway, message.ID)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	return updated > 0, err
+}
+
+func (s *sqlStore) InsertLinks(ctx context.Context, links []Link) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		for _, link := range links {
+			_, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO links (short_url, long_url, generation_id, created_at) VALUES (?, ?, ?, ?)
+				ON CONFLICT (short_url) DO UPDATE SET long_url = excluded.long_url, generation_id = excluded.generation_id, created_at = excluded.created_at`),
+				link.ShortURL, link.LongURL, link.GenerationID, link.CreatedAt.UnixMilli())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqlStore) GetLink(ctx context.Context, short string) (Link, bool, error) {
+	var link Link
+	var createdAt int64
+	err := s.db.QueryRowContext(ctx, s.rebind("SELECT short_url, long_url, generation_id, created_at FROM links WHERE short_url = ?"), short).
+		Scan(&link.ShortURL, &link.LongURL, &link.GenerationID, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Link{}, false, nil
+	}
+	if err != nil {
+		return Link{}, false, err
+	}
+	link.CreatedAt = time.UnixMilli(createdAt).UTC()
+	return link, true, nil
+}
+
+func (s *sqlStore) FeedbackStats(ctx context.Context, filter GenerationFilter) ([]FeedbackStats, error) {
+	where, args := s.where(filter)
+	query := `SELECT preset, model, COUNT(*),
+		SUM(CASE WHEN feedback_rating = 'up' THEN 1 ELSE 0 END),
+		SUM(CASE WHEN feedback_rating = 'down' THEN 1 ELSE 0 END)
+		FROM generations` + where + " GROUP BY preset, model ORDER BY preset, model"
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []FeedbackStats{}
+	for rows.Next() {
+		var group FeedbackStats
+		err := rows.Scan(&group.Preset, &group.Model, &group.Generations, &group.Up, &group.Down)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, group)
+	}
+	return stats, rows.Err()
+}
+
+func (s *sqlStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
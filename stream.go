@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// errStreamDone is returned by an event callback to stop reading a stream.
+var errStreamDone = errors.New("stream done")
+
+// streamPrediction reads the server-sent events from the stream URL of a
+// prediction and passes every event to onEvent until the upstream sends "done".
+func streamPrediction(ctx context.Context, client *http.Client, prediction *AIPrediction, onEvent func(event, data string) error, logger *slog.Logger) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", prediction.URLs.Stream, nil)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error creating stream request", "error", err)
+		return err
+	}
+	req.Header.Add("Authorization", replicateAuthorization(prediction.token))
+	req.Header.Add("Accept", "text/event-stream")
+	req.Header.Add("Cache-Control", "no-store")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error calling AI stream", "error", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newStatusError(resp.StatusCode, "AI stream returned status %d", resp.StatusCode)
+	}
+
+	err = readSSE(resp.Body, func(event, data string) error {
+		if event == "error" {
+			return fmt.Errorf("AI stream error: %s", data)
+		}
+		err := onEvent(event, data)
+		if err != nil {
+			return err
+		}
+		if event == "done" {
+			return errStreamDone
+		}
+		return nil
+	})
+	if err == nil {
+		return io.ErrUnexpectedEOF
+	}
+	if err == errStreamDone {
+		return nil
+	}
+
+	return err
+}
+
+// readSSE parses a server-sent event stream and calls onEvent for every
+// dispatched event. Returning errStreamDone from onEvent stops reading.
+func readSSE(r io.Reader, onEvent func(event, data string) error) error {
+	event := ""
+	var data []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if event == "" && data == nil {
+				continue
+			}
+			if event == "" {
+				event = "message"
+			}
+			err := onEvent(event, strings.Join(data, "\n"))
+			if err != nil {
+				return err
+			}
+			event, data = "", nil
+		case strings.HasPrefix(line, ":"):
+			// Comment / keep-alive line
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			value := strings.TrimPrefix(line, "data:")
+			data = append(data, strings.TrimPrefix(value, " "))
+		}
+	}
+
+	return scanner.Err()
+}
+
+// writeSSE writes a single server-sent event to w.
+func writeSSE(w io.Writer, event, data string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "event: %s\n", event)
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TimeoutsConfig bounds outbound calls and request handling so a hung
+// upstream can't hold connections forever.
+type TimeoutsConfig struct {
+	Dial           time.Duration `yaml:"dial"`
+	TLSHandshake   time.Duration `yaml:"tls_handshake"`
+	ResponseHeader time.Duration `yaml:"response_header"`
+	// Request limits an outbound call including reading the response body
+	Request time.Duration `yaml:"request"`
+	// Handler is the deadline for serving one client request; WebSocket
+	// sessions and history exports are exempt
+	Handler    time.Duration `yaml:"handler"`
+	ReadHeader time.Duration `yaml:"read_header"`
+	Idle       time.Duration `yaml:"idle"`
+}
+
+// newTransport creates an HTTP transport with the configured outbound
+// timeouts.
+func newTransport(proxy func(*http.Request) (*url.URL, error)) *http.Transport {
+	timeouts := currentConfig().Timeouts
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   timeouts.Dial,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   timeouts.TLSHandshake,
+		ResponseHeaderTimeout: timeouts.ResponseHeader,
+		IdleConnTimeout:       90 * time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+}
+
+// withHandlerTimeout gives every request a context deadline, which aborts
+// the upstream calls made for it. Unlike http.TimeoutHandler this keeps
+// streaming responses working.
+func withHandlerTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || r.URL.Path == generationExportPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), currentConfig().Timeouts.Handler)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
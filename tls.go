@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSConfig serves HTTPS directly instead of behind a terminating proxy,
+// either with a certificate and key from disk or with certificates obtained
+// from an ACME CA such as Let's Encrypt.
+type TLSConfig struct {
+	CertFile string     `yaml:"cert_file"`
+	KeyFile  string     `yaml:"key_file"`
+	ACME     ACMEConfig `yaml:"acme"`
+	// ClientCAFile enables mutual TLS: clients must present a certificate
+	// signed by one of these CAs, or may omit it with ClientAuth "optional"
+	ClientCAFile string `yaml:"client_ca_file"`
+	ClientAuth   string `yaml:"client_auth"`
+}
+
+// OutboundTLSConfig applies to calls to providers and to HTTPS proxies.
+// CAFile adds CAs to the system roots, for endpoints behind a corporate CA;
+// CertFile and KeyFile are presented as a client certificate when the
+// server asks for one.
+type OutboundTLSConfig struct {
+	CAFile   string `yaml:"ca_file"`
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// ACMEConfig obtains and renews certificates for Domains automatically.
+// Certificates are kept in CacheDir so restarts don't hit the CA's rate
+// limits. HTTPAddr answers HTTP-01 challenges and redirects everything else
+// to HTTPS; TLS-ALPN-01 challenges are answered on the main listener.
+type ACMEConfig struct {
+	Domains  []string `yaml:"domains"`
+	Email    string   `yaml:"email"`
+	CacheDir string   `yaml:"cache_dir"`
+	// DirectoryURL defaults to Let's Encrypt production
+	DirectoryURL string `yaml:"directory_url"`
+	HTTPAddr     string `yaml:"http_addr"`
+}
+
+func (c TLSConfig) enabled() bool {
+	return c.CertFile != "" || len(c.ACME.Domains) > 0
+}
+
+// setupTLS sets server.TLSConfig when TLS is enabled. With ACME it also
+// starts the HTTP-01 challenge listener.
+func setupTLS(server *http.Server, config TLSConfig, logger *slog.Logger) error {
+	if !config.enabled() {
+		return nil
+	}
+
+	if config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{cert},
+		}
+		logger.Info("Serving HTTPS", "cert_file", config.CertFile)
+		return requireClientCerts(server.TLSConfig, config, logger)
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(config.ACME.Domains...),
+		Cache:      autocert.DirCache(config.ACME.CacheDir),
+		Email:      config.ACME.Email,
+	}
+	if config.ACME.DirectoryURL != "" {
+		manager.Client = &acme.Client{DirectoryURL: config.ACME.DirectoryURL}
+	}
+	server.TLSConfig = manager.TLSConfig()
+	server.TLSConfig.MinVersion = tls.VersionTLS12
+	logger.Info("Serving HTTPS with ACME certificates", "domains", config.ACME.Domains)
+	err := requireClientCerts(server.TLSConfig, config, logger)
+	if err != nil {
+		return err
+	}
+
+	if config.ACME.HTTPAddr != "" {
+		go func() {
+			logger.Info("Starting ACME challenge server", "addr", config.ACME.HTTPAddr)
+			err := http.ListenAndServe(config.ACME.HTTPAddr, manager.HTTPHandler(nil))
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fatal(logger, "Failed to start ACME challenge server", "error", err)
+			}
+		}()
+	}
+	return nil
+}
+
+// requireClientCerts sets up client certificate verification when a client
+// CA is configured.
+func requireClientCerts(tlsConfig *tls.Config, config TLSConfig, logger *slog.Logger) error {
+	if config.ClientCAFile == "" {
+		return nil
+	}
+
+	pool := x509.NewCertPool()
+	err := appendCAFile(pool, config.ClientCAFile)
+	if err != nil {
+		return err
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	if config.ClientAuth == "optional" {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	logger.Info("Verifying client certificates", "client_ca_file", config.ClientCAFile, "client_auth", config.ClientAuth)
+	return nil
+}
+
+// outboundTLSConfig builds the TLS settings for outbound calls; nil means
+// the Go defaults.
+func outboundTLSConfig(config OutboundTLSConfig) (*tls.Config, error) {
+	if config == (OutboundTLSConfig{}) {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		err = appendCAFile(pool, config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// appendCAFile adds the PEM certificates in path to pool.
+func appendCAFile(pool *x509.CertPool, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("%s: no PEM certificates found", path)
+	}
+	return nil
+}
+
+// listenAndServe starts server with TLS when setupTLS configured it.
+func listenAndServe(server *http.Server) error {
+	if server.TLSConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	tokenRequestCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ai_sms_upstream_token_requests_total",
+		Help: "The total number of upstream requests per API token and response status",
+	}, []string{"provider", "token", "status"})
+	tokenHealthyGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ai_sms_upstream_token_healthy",
+		Help: "Whether an upstream API token is currently in rotation",
+	}, []string{"provider", "token"})
+)
+
+// Token pools for the providers that accept several API tokens. The secret
+// holds one token or a comma-separated list.
+var (
+	replicateTokens = newTokenPool("replicate", "REPLICATE_API_TOKEN")
+	openAITokens    = newTokenPool("openai", "OPENAI_API_KEY")
+)
+
+// tokenPool rotates requests across the API tokens stored in a secret and
+// takes tokens out of rotation for a while when the upstream rejects them.
+type tokenPool struct {
+	provider string
+	secret   string
+
+	mu     sync.Mutex
+	raw    string
+	tokens []*pooledToken
+	next   int
+}
+
+type pooledToken struct {
+	value          string
+	label          string
+	errors         int
+	unhealthyUntil time.Time
+}
+
+func newTokenPool(provider, secret string) *tokenPool {
+	return &tokenPool{provider: provider, secret: secret}
+}
+
+// load re-reads the secret so rotated tokens are picked up, keeping the
+// state of tokens that are still present. Callers hold p.mu.
+func (p *tokenPool) load() error {
+	raw, err := lookupSecret(p.secret)
+	if err != nil {
+		return err
+	}
+	if raw == p.raw && p.tokens != nil {
+		return nil
+	}
+
+	old := make(map[string]*pooledToken)
+	for _, token := range p.tokens {
+		old[token.value] = token
+		tokenHealthyGauge.DeleteLabelValues(p.provider, token.label)
+	}
+	p.tokens = []*pooledToken{}
+	for _, value := range strings.Split(raw, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		token, ok := old[value]
+		if !ok {
+			sum := sha256.Sum256([]byte(value))
+			token = &pooledToken{value: value, label: hex.EncodeToString(sum[:4])}
+		}
+		p.tokens = append(p.tokens, token)
+		tokenHealthyGauge.WithLabelValues(p.provider, token.label).Set(1)
+	}
+	p.raw = raw
+	p.next = 0
+
+	return nil
+}
+
+// all returns every configured token.
+func (p *tokenPool) all() ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	err := p.load()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]string, len(p.tokens))
+	for i, token := range p.tokens {
+		values[i] = token.value
+	}
+	return values, nil
+}
+
+// configured reports whether the secret holds at least one token.
+func (p *tokenPool) configured() bool {
+	tokens, err := p.all()
+	return err == nil && len(tokens) > 0
+}
+
+// pick returns the token for the next request according to the configured
+// strategy. If every token is unhealthy the one that recovers first is used
+// rather than failing the request outright.
+func (p *tokenPool) pick() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	err := p.load()
+	if err != nil {
+		return "", err
+	}
+	if len(p.tokens) == 0 {
+		return "", fmt.Errorf("%s is not set", p.secret)
+	}
+
+	now := time.Now()
+	for _, token := range p.tokens {
+		healthy := 1.0
+		if now.Before(token.unhealthyUntil) {
+			healthy = 0
+		}
+		tokenHealthyGauge.WithLabelValues(p.provider, token.label).Set(healthy)
+	}
+
+	var best *pooledToken
+	for i := range p.tokens {
+		token := p.tokens[(p.next+i)%len(p.tokens)]
+		if now.Before(token.unhealthyUntil) {
+			continue
+		}
+		if currentConfig().TokenPool.Strategy == "round_robin" {
+			best = token
+			p.next = (p.next + i + 1) % len(p.tokens)
+			break
+		}
+		if best == nil || token.errors < best.errors {
+			best = token
+		}
+	}
+	// Spread ties between equally good tokens
+	p.next = (p.next + 1) % len(p.tokens)
+	if best == nil {
+		for _, token := range p.tokens {
+			if best == nil || token.unhealthyUntil.Before(best.unhealthyUntil) {
+				best = token
+			}
+		}
+	}
+
+	return best.value, nil
+}
+
+// report records the upstream status of a request made with value. 401, 402
+// and 429 take the token out of rotation for the configured cooldown. Status
+// 0 means the request failed without a response.
+func (p *tokenPool) report(value string, status int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, token := range p.tokens {
+		if token.value != value {
+			continue
+		}
+
+		label := strconv.Itoa(status)
+		if status == 0 {
+			label = "error"
+		}
+		tokenRequestCounter.WithLabelValues(p.provider, token.label, label).Inc()
+		switch {
+		case status == 401 || status == 402 || status == 429:
+			token.errors++
+			token.unhealthyUntil = time.Now().Add(currentConfig().TokenPool.Cooldown)
+			tokenHealthyGauge.WithLabelValues(p.provider, token.label).Set(0)
+		case status >= 500:
+			token.errors++
+		case status > 0 && status < 400 && token.errors > 0:
+			token.errors--
+		}
+		return
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// tokenRefreshMargin is how long before expiry a cached token is refreshed.
+const tokenRefreshMargin = time.Minute
+
+// cachedToken holds a short-lived access token and refreshes it on demand.
+type cachedToken struct {
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+	fetch   func(ctx context.Context) (token string, expires time.Time, err error)
+}
+
+func newCachedToken(fetch func(ctx context.Context) (string, time.Time, error)) *cachedToken {
+	return &cachedToken{fetch: fetch}
+}
+
+func (t *cachedToken) get(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.token != "" && time.Until(t.expires) > tokenRefreshMargin {
+		return t.token, nil
+	}
+
+	token, expires, err := t.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	t.token = token
+	t.expires = expires
+
+	return token, nil
+}
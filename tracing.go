@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of the generation path. Until setupTracing
+// installs a provider it is a no-op.
+var tracer = otel.Tracer("github.com/SadovovAlex/go-ai-text")
+
+// TracingConfig controls OpenTelemetry tracing. The OTLP exporter also
+// honors the standard OTEL_EXPORTER_OTLP_* environment variables.
+type TracingConfig struct {
+	Enabled     bool    `yaml:"enabled"`
+	Endpoint    string  `yaml:"endpoint"`
+	Insecure    bool    `yaml:"insecure"`
+	ServiceName string  `yaml:"service_name"`
+	SampleRatio float64 `yaml:"sample_ratio"`
+	// Propagate lists the providers that get the trace context in outbound
+	// request headers; the public APIs ignore it.
+	Propagate []string `yaml:"propagate"`
+}
+
+// setupTracing installs the global tracer provider exporting spans over
+// OTLP/HTTP. The returned function flushes pending spans on shutdown.
+func setupTracing(ctx context.Context, config TracingConfig, logger *slog.Logger) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if !config.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var options []otlptracehttp.Option
+	if config.Endpoint != "" {
+		options = append(options, otlptracehttp.WithEndpoint(config.Endpoint))
+	}
+	if config.Insecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", config.ServiceName)))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	logger.InfoContext(ctx, "Exporting traces", "service", config.ServiceName, "sample_ratio", config.SampleRatio)
+
+	return provider.Shutdown, nil
+}
+
+// withTracing starts a server span for every request, continuing the trace
+// of the caller if it sent one. Spans are named after the matched route.
+func withTracing(mux *http.ServeMux, next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "http.request",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			_, route := mux.Handler(r)
+			if route == "" {
+				return r.Method + " unmatched"
+			}
+			return route
+		}),
+	)
+}
+
+// tracingTransport wraps next so every outbound request gets a client span.
+// The trace context is only sent to the providers listed in
+// tracing.propagate.
+func tracingTransport(next http.RoundTripper, provider string) http.RoundTripper {
+	options := []otelhttp.Option{
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			if provider == "" {
+				return r.Method + " " + r.URL.Host
+			}
+			return r.Method + " " + provider
+		}),
+	}
+	if !slices.Contains(currentConfig().Tracing.Propagate, provider) {
+		options = append(options, otelhttp.WithPropagators(propagation.NewCompositeTextMapPropagator()))
+	}
+
+	return otelhttp.NewTransport(next, options...)
+}
+
+// startSpan starts an internal span with the given attributes.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err on span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// russianToLatin is a readable variant of the passport (ICAO 9303)
+// transliteration of Russian. It only yields GSM-7 characters, so a
+// transliterated text takes about half the segments of the Cyrillic.
+var russianToLatin = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "e",
+	'ж': "zh", 'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m",
+	'н': "n", 'о': "o", 'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u",
+	'ф': "f", 'х': "kh", 'ц': "ts", 'ч': "ch", 'ш': "sh", 'щ': "shch",
+	'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu", 'я': "ya",
+}
+
+// transliterate replaces the Russian letters of text with Latin ones, per
+// the built-in table with the transliteration entries of the config on
+// top. Capitals stay capitals: "Щ" is "Shch", or "SHCH" within a word in
+// capitals.
+func transliterate(text string) string {
+	overrides := currentConfig().Transliteration
+	runes := []rune(text)
+	var b strings.Builder
+	for i, r := range runes {
+		lower := unicode.ToLower(r)
+		latin, ok := overrides[string(lower)]
+		if !ok {
+			latin, ok = russianToLatin[lower]
+		}
+		if !ok {
+			b.WriteRune(r)
+			continue
+		}
+		if r != lower && latin != "" {
+			if capitalsAround(runes, i) {
+				latin = strings.ToUpper(latin)
+			} else {
+				first, size := utf8.DecodeRuneInString(latin)
+				latin = string(unicode.ToUpper(first)) + latin[size:]
+			}
+		}
+		b.WriteString(latin)
+	}
+	return b.String()
+}
+
+// capitalsAround reports whether the letter before or after runes[i] is a
+// capital too.
+func capitalsAround(runes []rune, i int) bool {
+	return i > 0 && unicode.IsUpper(runes[i-1]) || i+1 < len(runes) && unicode.IsUpper(runes[i+1])
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const defaultTwilioBaseURL = "https://api.twilio.com"
+
+// TwilioConfig sends SMS through Twilio when AccountSID is set. The auth
+// token is the TWILIO_AUTH_TOKEN secret. Messages come from the From
+// number, or from a number of the messaging service MessagingServiceSID.
+// With StatusCallbackURL, the public URL of /webhooks/twilio/status,
+// Twilio reports the delivery status of every message there.
+type TwilioConfig struct {
+	AccountSID          string `yaml:"account_sid"`
+	From                string `yaml:"from"`
+	MessagingServiceSID string `yaml:"messaging_service_sid"`
+	BaseURL             string `yaml:"base_url"`
+	StatusCallbackURL   string `yaml:"status_callback_url"`
+}
+
+type twilioSender struct {
+	config    TwilioConfig
+	authToken string
+	client    *http.Client
+}
+
+func newTwilioSender(config TwilioConfig, logger *slog.Logger) (*twilioSender, error) {
+	authToken, err := lookupSecret("TWILIO_AUTH_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	if authToken == "" {
+		return nil, fmt.Errorf("TWILIO_AUTH_TOKEN is not set")
+	}
+	// Not retried: a retry after a lost response would send the SMS twice
+	client, err := newProviderClient("", logger)
+	if err != nil {
+		return nil, err
+	}
+	return &twilioSender{config: config, authToken: authToken, client: client}, nil
+}
+
+func (s *twilioSender) Name() string {
+	return "twilio"
+}
+
+// twilioMessage is the part of a Twilio message resource or error we read.
+type twilioMessage struct {
+	SID     string `json:"sid"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (s *twilioSender) Send(ctx context.Context, to, text string) (string, error) {
+	form := url.Values{"To": {to}, "Body": {text}}
+	if s.config.MessagingServiceSID != "" {
+		form.Set("MessagingServiceSid", s.config.MessagingServiceSID)
+	} else {
+		form.Set("From", s.config.From)
+	}
+	if s.config.StatusCallbackURL != "" {
+		form.Set("StatusCallback", s.config.StatusCallbackURL)
+	}
+	endpoint := fmt.Sprintf("%s/2010-04-01/Accounts/%s/Messages.json", s.config.BaseURL, url.PathEscape(s.config.AccountSID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(s.config.AccountSID, s.authToken)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	var message twilioMessage
+	err = json.Unmarshal(body, &message)
+	if resp.StatusCode/100 != 2 {
+		if err == nil && message.Message != "" {
+			return "", fmt.Errorf("twilio answered %s: %s (code %d)", resp.Status, message.Message, message.Code)
+		}
+		return "", fmt.Errorf("twilio answered %s", resp.Status)
+	}
+	if err != nil {
+		return "", fmt.Errorf("decoding the twilio response: %v", err)
+	}
+	return message.SID, nil
+}
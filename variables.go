@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// placeholderPattern matches the {name} placeholders of a prompt.
+var placeholderPattern = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// keepPlaceholdersPrompt tells the model to leave the placeholders of the
+// prompt for the service to fill in.
+const keepPlaceholdersPrompt = "\n\nWrite the placeholders %s exactly as they are, braces included; they are filled in later."
+
+// fixPlaceholdersPrompt sends a text with wrong placeholders back to the
+// model.
+const fixPlaceholdersPrompt = "Rewrite this SMS so it contains the placeholders %s exactly as written, and no other placeholders. Reply with the SMS text only."
+
+// placeholders returns the distinct placeholders of text, in order.
+func placeholders(text string) []string {
+	var names []string
+	for _, match := range placeholderPattern.FindAllStringSubmatch(text, -1) {
+		if !slices.Contains(names, match[1]) {
+			names = append(names, match[1])
+		}
+	}
+	return names
+}
+
+// checkVariables reports the placeholders of prompt that variables don't
+// fill.
+func checkVariables(prompt string, variables map[string]string) error {
+	var missing []string
+	for _, name := range placeholders(prompt) {
+		if _, ok := variables[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("variables are missing for %s", braced(missing))
+	}
+	return nil
+}
+
+// braced lists names as placeholders: "{name}, {code}".
+func braced(names []string) string {
+	placeholders := make([]string, len(names))
+	for i, name := range names {
+		placeholders[i] = "{" + name + "}"
+	}
+	return strings.Join(placeholders, ", ")
+}
+
+// placeholderError is a generated text whose placeholders don't match the
+// prompt's.
+type placeholderError struct {
+	Missing []string
+	Unknown []string
+}
+
+func (e *placeholderError) Error() string {
+	var problems []string
+	if len(e.Missing) > 0 {
+		problems = append(problems, "left out "+braced(e.Missing))
+	}
+	if len(e.Unknown) > 0 {
+		problems = append(problems, "made up "+braced(e.Unknown))
+	}
+	return "the model " + strings.Join(problems, " and ")
+}
+
+// checkPlaceholders checks that text has the placeholders of the
+// variables and no others.
+func checkPlaceholders(text string, variables map[string]string) error {
+	found := placeholders(text)
+	var problem placeholderError
+	for name := range variables {
+		if !slices.Contains(found, name) {
+			problem.Missing = append(problem.Missing, name)
+		}
+	}
+	for _, name := range found {
+		if _, ok := variables[name]; !ok {
+			problem.Unknown = append(problem.Unknown, name)
+		}
+	}
+	if len(problem.Missing) == 0 && len(problem.Unknown) == 0 {
+		return nil
+	}
+	slices.Sort(problem.Missing)
+	return &problem
+}
+
+// promptVariables returns the variables of the placeholders in prompt,
+// after checking that they are all there.
+func promptVariables(prompt string, variables map[string]string) (map[string]string, error) {
+	err := checkVariables(prompt, variables)
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[string]string)
+	for _, name := range placeholders(prompt) {
+		used[name] = variables[name]
+	}
+	return used, nil
+}
+
+// substitute fills the placeholders of text with the variables.
+func substitute(text string, variables map[string]string) string {
+	if len(variables) == 0 {
+		return text
+	}
+	return placeholderPattern.ReplaceAllStringFunc(text, func(placeholder string) string {
+		value, ok := variables[placeholder[1:len(placeholder)-1]]
+		if !ok {
+			return placeholder
+		}
+		return value
+	})
+}
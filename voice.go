@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// defaultTones are the tones clients can pick without any configured.
+var defaultTones = map[string]string{
+	"formal":   "Write in a formal, polite tone. Address the reader respectfully and avoid slang, jokes and emoji.",
+	"friendly": "Write in a warm, friendly, conversational tone, as if to a regular customer.",
+	"urgent":   "Write with urgency: lead with the action the reader must take and its deadline, in short, direct sentences.",
+}
+
+// applyVoice adds the system prompt snippets of tone and persona to
+// request. Either left empty falls back to the one of the request's
+// preset.
+func applyVoice(tone, persona string, request *Request) error {
+	config := currentConfig()
+	if preset, ok := config.Presets[request.Preset]; ok {
+		if tone == "" {
+			tone = preset.Tone
+		}
+		if persona == "" {
+			persona = preset.Persona
+		}
+	}
+	if tone == "" && persona == "" {
+		return nil
+	}
+
+	snippets := []string{request.System}
+	if persona != "" {
+		snippet, ok := config.Personas[persona]
+		if !ok {
+			return fmt.Errorf("persona %q is unknown", persona)
+		}
+		snippets = append(snippets, snippet)
+	}
+	if tone != "" {
+		snippet, ok := config.Tones[tone]
+		if !ok {
+			return fmt.Errorf("tone %q is unknown", tone)
+		}
+		snippets = append(snippets, snippet)
+	}
+	request.System = strings.TrimSpace(strings.Join(snippets, "\n\n"))
+	return nil
+}
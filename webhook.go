@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const webhookTimestampTolerance = 5 * time.Minute
+
+// pendingPredictions tracks requests waiting for a Replicate completion
+// callback. Callbacks that arrive before anyone waits are kept briefly.
+var pendingPredictions = &predictionWaiters{
+	waiters: make(map[string]chan *AIPrediction),
+	early:   make(map[string]earlyPrediction),
+}
+
+type earlyPrediction struct {
+	prediction *AIPrediction
+	received   time.Time
+}
+
+type predictionWaiters struct {
+	mu      sync.Mutex
+	waiters map[string]chan *AIPrediction
+	early   map[string]earlyPrediction
+}
+
+func (p *predictionWaiters) wait(id string) chan *AIPrediction {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ch := make(chan *AIPrediction, 1)
+	if e, ok := p.early[id]; ok {
+		delete(p.early, id)
+		ch <- e.prediction
+		return ch
+	}
+	p.waiters[id] = ch
+	return ch
+}
+
+func (p *predictionWaiters) forget(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.waiters, id)
+}
+
+func (p *predictionWaiters) resolve(prediction *AIPrediction) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ch, ok := p.waiters[prediction.ID]; ok {
+		delete(p.waiters, prediction.ID)
+		ch <- prediction
+		return
+	}
+
+	// Drop stale callbacks nobody picked up
+	now := time.Now()
+	for id, e := range p.early {
+		if now.Sub(e.received) > currentConfig().Polling.MaxWait {
+			delete(p.early, id)
+		}
+	}
+	p.early[prediction.ID] = earlyPrediction{prediction: prediction, received: now}
+}
+
+func webhooksEnabled() bool {
+	return os.Getenv("REPLICATE_WEBHOOK_URL") != "" && os.Getenv("REPLICATE_WEBHOOK_SECRET") != ""
+}
+
+// waitForWebhook blocks until the completion callback for prediction arrives.
+// If it does not arrive in time the prediction is fetched once directly.
+func waitForWebhook(ctx context.Context, client *http.Client, prediction *AIPrediction, logger *slog.Logger) (*AIPrediction, error) {
+	maxWait := currentConfig().Polling.MaxWait
+	ch := pendingPredictions.wait(prediction.ID)
+	defer pendingPredictions.forget(prediction.ID)
+
+	start := time.Now()
+	select {
+	case result := <-ch:
+		logger.InfoContext(ctx, "Prediction finished via webhook", "prediction", result.ID, "status", result.Status, "elapsed", time.Since(start))
+		return finishedPrediction(result)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(maxWait):
+		logger.WarnContext(ctx, "No webhook for prediction, fetching it directly", "prediction", prediction.ID, "wait", maxWait)
+	}
+
+	result, err := getPrediction(ctx, client, prediction, logger)
+	if err != nil {
+		return nil, err
+	}
+	if !predictionDone(result) {
+		return nil, &predictionTimeoutError{ID: prediction.ID, Wait: maxWait}
+	}
+
+	return finishedPrediction(result)
+}
+
+func finishedPrediction(prediction *AIPrediction) (*AIPrediction, error) {
+	if prediction.Status != "succeeded" {
+		return nil, fmt.Errorf("prediction %s %s: %v", prediction.ID, prediction.Status, prediction.Error)
+	}
+
+	return prediction, nil
+}
+
+func handleReplicateWebhook(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	secret := os.Getenv("REPLICATE_WEBHOOK_SECRET")
+	if secret == "" {
+		http.Error(w, "Webhooks are not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error reading webhook body", "error", err)
+		http.Error(w, "Error reading body", http.StatusBadRequest)
+		return
+	}
+
+	err = verifyWebhookSignature(secret, r.Header, body, time.Now())
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Rejected webhook", "error", err)
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var prediction AIPrediction
+	err = json.Unmarshal(body, &prediction)
+	if err != nil || prediction.ID == "" {
+		logger.ErrorContext(r.Context(), "Error unmarshaling webhook body", "error", err)
+		http.Error(w, "Invalid prediction", http.StatusBadRequest)
+		return
+	}
+	// The webhook URL carries the ID of the request that started the prediction
+	if origin := r.URL.Query().Get("request_id"); origin != "" {
+		addLogFields(r.Context(), "origin_request_id", origin)
+	}
+	logger.InfoContext(r.Context(), "Received webhook", "prediction", prediction.ID, "status", prediction.Status)
+
+	pendingPredictions.resolve(&prediction)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// verifyWebhookSignature checks the webhook-id/webhook-timestamp/webhook-signature
+// headers Replicate sends, signed with the whsec_ secret of the account.
+func verifyWebhookSignature(secret string, header http.Header, body []byte, now time.Time) error {
+	id := header.Get("webhook-id")
+	timestamp := header.Get("webhook-timestamp")
+	signatures := header.Get("webhook-signature")
+	if id == "" || timestamp == "" || signatures == "" {
+		return errors.New("missing webhook signature headers")
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid webhook timestamp: %v", err)
+	}
+	sent := time.Unix(ts, 0)
+	if now.Sub(sent) > webhookTimestampTolerance || sent.Sub(now) > webhookTimestampTolerance {
+		return errors.New("webhook timestamp is outside the tolerance window")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(secret, "whsec_"))
+	if err != nil {
+		return fmt.Errorf("invalid webhook secret: %v", err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(id + "." + timestamp + "."))
+	mac.Write(body)
+	expected := mac.Sum(nil)
+
+	for _, sig := range strings.Fields(signatures) {
+		version, value, ok := strings.Cut(sig, ",")
+		if !ok || version != "v1" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		if hmac.Equal(decoded, expected) {
+			return nil
+		}
+	}
+
+	return errors.New("no matching webhook signature")
+}
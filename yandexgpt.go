@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	yandexGPTCompletionURL = "https://llm.api.cloud.yandex.net/foundationModels/v1/completion"
+	yandexIAMTokenURL      = "https://iam.api.cloud.yandex.net/iam/v1/tokens"
+	defaultYandexGPTModel  = "yandexgpt-lite/latest"
+)
+
+type YandexGPTMessage struct {
+	Role string `json:"role"`
+	Text string `json:"text"`
+}
+
+type YandexGPTCompletionOptions struct {
+	Stream      bool     `json:"stream"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	MaxTokens   int      `json:"maxTokens,omitempty,string"`
+}
+
+type YandexGPTRequest struct {
+	ModelURI          string                     `json:"modelUri"`
+	CompletionOptions YandexGPTCompletionOptions `json:"completionOptions"`
+	Messages          []YandexGPTMessage         `json:"messages"`
+}
+
+type YandexGPTResponse struct {
+	Result struct {
+		Alternatives []struct {
+			Message YandexGPTMessage `json:"message"`
+			Status  string           `json:"status"`
+		} `json:"alternatives"`
+		Usage struct {
+			InputTextTokens  string `json:"inputTextTokens"`
+			CompletionTokens string `json:"completionTokens"`
+			TotalTokens      string `json:"totalTokens"`
+		} `json:"usage"`
+		ModelVersion string `json:"modelVersion"`
+	} `json:"result"`
+}
+
+type YandexErrorResponse struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+type yandexGPTProvider struct {
+	client   *http.Client
+	logger   *slog.Logger
+	folderID string
+	apiKey   string
+	iamToken *cachedToken
+	model    string
+}
+
+func init() {
+	registerProvider("yandexgpt", func(logger *slog.Logger) (Provider, error) {
+		folderID := os.Getenv("YANDEX_FOLDER_ID")
+		if folderID == "" {
+			return nil, errors.New("YANDEX_FOLDER_ID is not set")
+		}
+		client, err := newProviderClient("yandexgpt", logger)
+		if err != nil {
+			return nil, err
+		}
+
+		p := &yandexGPTProvider{
+			client:   client,
+			logger:   logger,
+			folderID: folderID,
+			model:    getEnv("YANDEX_GPT_MODEL", defaultYandexGPTModel),
+		}
+
+		p.apiKey, err = lookupSecret("YANDEX_API_KEY")
+		if err != nil {
+			return nil, err
+		}
+
+		// Without an API key, exchange the OAuth token for short-lived IAM tokens
+		if p.apiKey == "" {
+			oauthToken, err := lookupSecret("YANDEX_OAUTH_TOKEN")
+			if err != nil {
+				return nil, err
+			}
+			if oauthToken == "" {
+				return nil, errors.New("set YANDEX_API_KEY or YANDEX_OAUTH_TOKEN")
+			}
+			p.iamToken = newCachedToken(func(ctx context.Context) (string, time.Time, error) {
+				return fetchYandexIAMToken(ctx, client, oauthToken)
+			})
+		}
+
+		return p, nil
+	})
+}
+
+func (p *yandexGPTProvider) Name() string {
+	return "yandexgpt"
+}
+
+func (p *yandexGPTProvider) Generate(ctx context.Context, request Request) (Response, error) {
+	model := request.modelOr(p.model)
+	completionRequest := YandexGPTRequest{
+		ModelURI: "gpt://" + p.folderID + "/" + model,
+		CompletionOptions: YandexGPTCompletionOptions{
+			Temperature: request.Temperature,
+			MaxTokens:   request.MaxTokens,
+		},
+	}
+	for _, message := range newOpenAIChatRequest(request).Messages {
+		completionRequest.Messages = append(completionRequest.Messages, YandexGPTMessage{Role: message.Role, Text: message.Content})
+	}
+
+	jsonBody, err := json.Marshal(completionRequest)
+	if err != nil {
+		p.logger.ErrorContext(ctx, "Error marshaling YandexGPT request", "error", err)
+		return Response{}, err
+	}
+	p.logger.DebugContext(ctx, "Calling YandexGPT", "body", string(jsonBody))
+
+	req, err := http.NewRequestWithContext(ctx, "POST", yandexGPTCompletionURL, bytes.NewBuffer(jsonBody))
+	if err != nil {
+		p.logger.ErrorContext(ctx, "Error creating request", "error", err)
+		return Response{}, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("x-folder-id", p.folderID)
+	if p.apiKey != "" {
+		req.Header.Add("Authorization", "Api-Key "+p.apiKey)
+	} else {
+		token, err := p.iamToken.get(ctx)
+		if err != nil {
+			p.logger.ErrorContext(ctx, "Error getting Yandex IAM token", "error", err)
+			return Response{}, err
+		}
+		req.Header.Add("Authorization", "Bearer "+token)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		p.logger.ErrorContext(ctx, "Error calling YandexGPT", "error", err)
+		return Response{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		p.logger.ErrorContext(ctx, "Error reading YandexGPT response", "error", err)
+		return Response{}, err
+	}
+	p.logger.DebugContext(ctx, "YandexGPT response", "body", string(body))
+
+	if resp.StatusCode != http.StatusOK {
+		var errorResponse YandexErrorResponse
+		if json.Unmarshal(body, &errorResponse) == nil && (errorResponse.Message != "" || errorResponse.Error != "") {
+			return Response{}, newStatusError(resp.StatusCode, "YandexGPT returned status %d: %s%s", resp.StatusCode, errorResponse.Error, errorResponse.Message)
+		}
+		return Response{}, newStatusError(resp.StatusCode, "YandexGPT returned status %d", resp.StatusCode)
+	}
+
+	var completionResponse YandexGPTResponse
+	err = json.Unmarshal(body, &completionResponse)
+	if err != nil {
+		p.logger.ErrorContext(ctx, "Error unmarshaling YandexGPT response", "error", err)
+		return Response{}, err
+	}
+	if len(completionResponse.Result.Alternatives) == 0 {
+		return Response{}, errors.New("YandexGPT returned no alternatives")
+	}
+
+	// YandexGPT encodes token counts as strings
+	usage := completionResponse.Result.Usage
+	inputTokens, _ := strconv.Atoi(usage.InputTextTokens)
+	outputTokens, _ := strconv.Atoi(usage.CompletionTokens)
+
+	return Response{
+		Text:     strings.TrimSpace(completionResponse.Result.Alternatives[0].Message.Text),
+		Provider: p.Name(),
+		Model:    model,
+		Usage:    Usage{InputTokens: inputTokens, OutputTokens: outputTokens},
+	}, nil
+}
+
+func fetchYandexIAMToken(ctx context.Context, client *http.Client, oauthToken string) (string, time.Time, error) {
+	jsonBody, err := json.Marshal(map[string]string{"yandexPassportOauthToken": oauthToken})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", yandexIAMTokenURL, bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	var tokenResponse struct {
+		IAMToken  string    `json:"iamToken"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tokenResponse)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if resp.StatusCode != http.StatusOK || tokenResponse.IAMToken == "" {
+		return "", time.Time{}, newStatusError(resp.StatusCode, "Yandex IAM returned status %d", resp.StatusCode)
+	}
+
+	return tokenResponse.IAMToken, tokenResponse.ExpiresAt, nil
+}